@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+	"github.com/seriousconsult/cloud_safe/internal/pipeline"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	copyFrom     string
+	copyTo       string
+	copyFilename string
+)
+
+var copyCmd = &cobra.Command{
+	Use:   "copy",
+	Short: "Copy an archive from one storage provider to another",
+	Long: `Copy streams the archive named by --filename from the --from provider (default:
+the configured provider) to the --to provider, for example to migrate away from a
+provider or to keep a second copy of older backups. The stored bytes are copied as
+they are: encrypted archives stay encrypted and no key is needed. An archive split
+into volumes is copied as one object unless --volume-size splits the copy as well.
+
+Both providers are configured with the usual provider flags and config file
+settings. With --resume (the default), running an interrupted copy again downloads
+the archive again, and S3, MinIO, Google Drive and local destinations skip what they
+already stored; a copy split into volumes starts over.`,
+	Args: cobra.NoArgs,
+	RunE: runCopy,
+}
+
+func init() {
+	copyCmd.Flags().StringVar(&copyFrom, "from", "", "Storage provider the archive is copied from (default: --provider)")
+	copyCmd.Flags().StringVar(&copyTo, "to", "", "Storage provider the archive is copied to (required)")
+	copyCmd.Flags().StringVar(&copyFilename, "to-filename", "", "Name of the copy (default: --filename)")
+	copyCmd.Flags().Int64Var(&volumeSize, "volume-size", 0, "Split the copy into volumes of at most this many bytes (name.000, name.001, ...); 0 stores it as one object")
+	rootCmd.AddCommand(copyCmd)
+}
+
+func runCopy(cmd *cobra.Command, args []string) error {
+	// Initialize logger
+	log := logger.New(verbose)
+
+	cfg, err := loadConfig(cmd, log)
+	if err != nil {
+		return err
+	}
+
+	if cfg.S3Filename == "" {
+		return fmt.Errorf("filename must be specified via config file or command-line flag")
+	}
+	if cmd.Flags().Changed("volume-size") {
+		cfg.VolumeSize = volumeSize
+	}
+	if copyTo == "" {
+		return fmt.Errorf("destination provider must be specified with --to")
+	}
+	from := copyFrom
+	if from == "" {
+		from = cfg.StorageProvider
+	}
+
+	ctx, cancel := signalContext(log)
+	defer cancel()
+
+	copier, err := pipeline.NewCopier(cfg, from, copyTo, copyFilename, log)
+	if err != nil {
+		return fmt.Errorf("failed to create copier: %w", err)
+	}
+
+	target := copyFilename
+	if target == "" {
+		target = cfg.S3Filename
+	}
+	log.Infof("Starting archive copy: %s://%s -> %s://%s", from, cfg.S3Filename, copyTo, target)
+
+	if err := copier.Copy(ctx); err != nil {
+		return fmt.Errorf("copy failed: %w", err)
+	}
+
+	log.Info("Copy completed successfully")
+	return nil
+}
@@ -0,0 +1,204 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/seriousconsult/cloud_safe/internal/crypto"
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	keyOutput  string
+	keyringArg string
+)
+
+var keyCmd = &cobra.Command{
+	Use:   "key",
+	Short: "Manage key pairs for public-key encryption",
+	Long: `Key manages X25519 key pairs. Backup hosts encrypt archives to public keys
+(--recipient or default_settings.recipients) and never need the private key;
+restores read the private key from the file passed with --identity.`,
+}
+
+var keyGenerateCmd = &cobra.Command{
+	Use:   "generate",
+	Short: "Generate a new key pair",
+	Long: `Generate creates a new key pair. The private key is written to --output, which
+must not exist yet, or to stdout when --output is omitted. The public key is
+printed so it can be added to the recipients of backup hosts.`,
+	Args: cobra.NoArgs,
+	RunE: runKeyGenerate,
+}
+
+var keyInspectCmd = &cobra.Command{
+	Use:   "inspect <key-file|public-key>",
+	Short: "Show the public keys of a private key file, or validate a public key",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runKeyInspect,
+}
+
+var keyKeyringCmd = &cobra.Command{
+	Use:   "keyring",
+	Short: "Manage the local keyring used by --key-manager keyring",
+	Long: `The keyring is a local file of key-encryption keys for offline use. Each
+archive's data key is wrapped under the keyring's primary key; older keys stay
+in the file so existing archives can still be restored. Keep the keyring out of
+config.json and back it up separately, since archives cannot be decrypted
+without it.`,
+}
+
+var keyKeyringAddCmd = &cobra.Command{
+	Use:   "add",
+	Short: "Add a new primary key to the keyring, creating it if needed",
+	Long: `Add generates a new key-encryption key and makes it the primary key. New
+archives are wrapped under it; use "rekey --new-key-manager" to move existing
+archives to it before removing an old key.`,
+	Args: cobra.NoArgs,
+	RunE: runKeyringAdd,
+}
+
+var keyKeyringListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the keys in the keyring",
+	Args:  cobra.NoArgs,
+	RunE:  runKeyringList,
+}
+
+func init() {
+	keyKeyringCmd.PersistentFlags().StringVar(&keyringArg, "keyring", "", "Keyring file (default: default_settings.keyring_file)")
+	keyKeyringCmd.AddCommand(keyKeyringAddCmd)
+	keyKeyringCmd.AddCommand(keyKeyringListCmd)
+	keyCmd.AddCommand(keyKeyringCmd)
+
+	keyGenerateCmd.Flags().StringVarP(&keyOutput, "output", "o", "", "File to write the private key to (default stdout)")
+	keyCmd.AddCommand(keyGenerateCmd)
+	keyCmd.AddCommand(keyInspectCmd)
+	rootCmd.AddCommand(keyCmd)
+}
+
+func runKeyGenerate(cmd *cobra.Command, args []string) error {
+	identity, err := crypto.GenerateX25519Identity()
+	if err != nil {
+		return err
+	}
+	public := identity.Recipient().String()
+
+	contents := fmt.Sprintf("# created: %s\n# public key: %s\n%s\n", time.Now().Format(time.RFC3339), public, identity)
+
+	if keyOutput == "" {
+		fmt.Print(contents)
+		return nil
+	}
+
+	// Never overwrite an existing key; losing it would make its archives unreadable
+	file, err := os.OpenFile(keyOutput, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create key file: %w", err)
+	}
+	if _, err := file.WriteString(contents); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write key file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write key file: %w", err)
+	}
+
+	fmt.Printf("Private key written to %s\n", keyOutput)
+	fmt.Printf("Public key: %s\n", public)
+	return nil
+}
+
+func runKeyInspect(cmd *cobra.Command, args []string) error {
+	// A bare public key is validated and echoed back
+	if strings.HasPrefix(args[0], "cloudsafe-pub-") {
+		recipient, err := crypto.ParseX25519Recipient(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Public key: %s (valid)\n", recipient)
+		return nil
+	}
+
+	identities, err := crypto.ReadIdentityFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(args[0]); err == nil && info.Mode().Perm()&0077 != 0 {
+		fmt.Printf("Warning: %s is accessible by other users (mode %04o)\n", args[0], info.Mode().Perm())
+	}
+
+	fmt.Printf("Private keys in %s: %d\n", args[0], len(identities))
+	for _, identity := range identities {
+		fmt.Printf("Public key: %s\n", identity.Recipient())
+	}
+	return nil
+}
+
+// keyringPath returns the keyring file from --keyring or config.json
+func keyringPath(cmd *cobra.Command) (string, error) {
+	if keyringArg != "" {
+		return keyringArg, nil
+	}
+
+	cfg, err := loadConfig(cmd, logger.New(verbose))
+	if err != nil {
+		return "", err
+	}
+	if cfg.KeyringFile == "" {
+		return "", fmt.Errorf("keyring file must be specified with --keyring or default_settings.keyring_file")
+	}
+	return cfg.KeyringFile, nil
+}
+
+func runKeyringAdd(cmd *cobra.Command, args []string) error {
+	path, err := keyringPath(cmd)
+	if err != nil {
+		return err
+	}
+
+	keyring, err := crypto.OpenOrCreateKeyring(path)
+	if err != nil {
+		return err
+	}
+	id, err := keyring.AddKey()
+	if err != nil {
+		return err
+	}
+	if err := keyring.Save(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Added primary key %s to %s (%d keys)\n", id, path, len(keyring.Keys))
+	return nil
+}
+
+func runKeyringList(cmd *cobra.Command, args []string) error {
+	path, err := keyringPath(cmd)
+	if err != nil {
+		return err
+	}
+
+	keyring, err := crypto.LoadKeyring(path)
+	if err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0077 != 0 {
+		fmt.Printf("Warning: %s is accessible by other users (mode %04o)\n", path, info.Mode().Perm())
+	}
+
+	for _, key := range keyring.Keys {
+		marker := " "
+		if key.ID == keyring.Primary {
+			marker = "*"
+		}
+		fmt.Printf("%s %s  created %s\n", marker, key.ID, key.Created.Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+	"github.com/seriousconsult/cloud_safe/internal/pipeline"
+	"github.com/seriousconsult/cloud_safe/internal/storage"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	listPrefix string
+	listOutput string
+	listAll    bool
+	listTags   bool
+)
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List backups stored on a storage provider",
+	Long: `List shows the archives stored on the configured storage provider, with their
+size, upload time and whether they carry the marker cloud_safe sets on upload.
+Mega and local storage keep no tags, so there the start of every file is read to
+tell whether it looks like an encrypted cloud_safe archive or volume manifest.
+By default only cloud_safe archives are shown; use --all to include every object.
+S3 listings do not carry object tags, so on S3 every object is shown unless --tags
+looks up the tag of each object, which takes one request per object.`,
+	Args: cobra.NoArgs,
+	RunE: runList,
+}
+
+func init() {
+	listCmd.Flags().StringVar(&listPrefix, "prefix", "", "Only list objects whose key starts with this prefix")
+	listCmd.Flags().StringVarP(&listOutput, "output", "o", "table", "Output format (table, json)")
+	listCmd.Flags().BoolVar(&listAll, "all", false, "Include objects not uploaded by cloud_safe")
+	listCmd.Flags().BoolVar(&listTags, "tags", false, "Look up the tags of every object on S3 to find cloud_safe archives (one request per object)")
+	rootCmd.AddCommand(listCmd)
+}
+
+func runList(cmd *cobra.Command, args []string) error {
+	// Initialize logger
+	log := logger.New(verbose)
+
+	if listOutput != "table" && listOutput != "json" {
+		return fmt.Errorf("unsupported output format: %s", listOutput)
+	}
+
+	cfg, err := loadConfig(cmd, log)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signalContext(log)
+	defer cancel()
+
+	provider, err := storage.NewStorageProvider(cfg, log)
+	if err != nil {
+		return fmt.Errorf("failed to create storage provider: %w", err)
+	}
+
+	objects, err := provider.List(ctx, listPrefix)
+	if err != nil {
+		return err
+	}
+
+	// Providers without object tags are told apart by the start of each file
+	markers := true
+	if !hasTags(provider) {
+		if err := pipeline.DetectArchives(ctx, provider, objects); err != nil {
+			return err
+		}
+	} else if reader, ok := provider.(storage.MarkerReader); ok {
+		// Some listings leave out the tags, which then take a request per object
+		if listTags {
+			if err := reader.ReadMarkers(ctx, objects); err != nil {
+				return err
+			}
+		} else {
+			markers = false
+			if !listAll {
+				log.Infof("%s listings do not include object tags; listing all objects (use --tags to look them up)", provider.GetProviderType())
+				listAll = true
+			}
+		}
+	}
+
+	// Keep only archives uploaded by cloud_safe unless asked for everything
+	if !listAll {
+		archives := objects[:0]
+		for _, object := range objects {
+			if object.CloudSafe {
+				archives = append(archives, object)
+			}
+		}
+		objects = archives
+	}
+
+	if listOutput == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if objects == nil {
+			objects = []storage.ObjectInfo{}
+		}
+		return encoder.Encode(objects)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "KEY\tSIZE\tUPLOADED\tCLOUD_SAFE")
+	for _, object := range objects {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n",
+			object.Key,
+			formatSize(object.Size),
+			object.LastModified.Local().Format(time.DateTime),
+			marker(object.CloudSafe, markers))
+	}
+	return writer.Flush()
+}
+
+// hasTags reports whether provider stores the marker cloud_safe sets on upload
+func hasTags(provider storage.StorageProvider) bool {
+	switch provider.GetProviderType() {
+	case storage.ProviderMega, storage.ProviderLocal:
+		return false
+	default:
+		return true
+	}
+}
+
+// formatSize renders a byte count in the units the progress output uses
+func formatSize(size int64) string {
+	switch {
+	case size >= 1024*1024*1024:
+		return fmt.Sprintf("%.2f GB", float64(size)/(1024*1024*1024))
+	case size >= 1024*1024:
+		return fmt.Sprintf("%.2f MB", float64(size)/(1024*1024))
+	case size >= 1024:
+		return fmt.Sprintf("%.2f KB", float64(size)/1024)
+	default:
+		return fmt.Sprintf("%d B", size)
+	}
+}
+
+// marker renders whether an object carries the cloud_safe marker as a table
+// cell, or "-" when its tags were not read
+func marker(value, known bool) string {
+	switch {
+	case !known:
+		return "-"
+	case value:
+		return "yes"
+	default:
+		return "no"
+	}
+}
@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/seriousconsult/cloud_safe/internal/crypto"
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+	"github.com/seriousconsult/cloud_safe/internal/pipeline"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	rekeyIdentity   string
+	rekeyRecipients []string
+	rekeyKDF        string
+	rekeyKeyManager bool
+)
+
+var rekeyCmd = &cobra.Command{
+	Use:   "rekey",
+	Short: "Rewrap an archive's data key under new keys without re-uploading it",
+	Long: `Rekey rotates the keys that protect an existing archive. Every archive is
+encrypted with its own random data key, which the header stores wrapped under one
+or more key-encryption keys. Rekey unwraps the data key with the current key
+(--identity, the configured key manager, or the ENCRYPTION_KEY passphrase) and
+replaces only the header with one wrapped for the new keys: public keys given
+with --new-recipient, the key manager's current key with --new-key-manager,
+and/or a passphrase read from the NEW_ENCRYPTION_KEY environment variable.
+
+S3 and MinIO copy the payload server-side, so only the header and about 5 MB are
+transferred. Google Drive and Mega stream the payload back into the provider.
+
+Rekeying does not change the data key itself; anyone who already unwrapped it
+can still decrypt the archive.`,
+	Args: cobra.NoArgs,
+	RunE: runRekey,
+}
+
+func init() {
+	rekeyCmd.Flags().StringVarP(&rekeyIdentity, "identity", "i", "", "Private key file that can currently decrypt the archive (default: use the ENCRYPTION_KEY passphrase)")
+	rekeyCmd.Flags().StringSliceVar(&rekeyRecipients, "new-recipient", []string{}, "Public key to wrap the data key for (can specify multiple)")
+	rekeyCmd.Flags().BoolVar(&rekeyKeyManager, "new-key-manager", false, "Wrap the data key under the current key of the configured key manager (--key-manager)")
+	rekeyCmd.Flags().StringVar(&rekeyKDF, "kdf", "", "Key derivation function for NEW_ENCRYPTION_KEY (argon2id, scrypt). Defaults to argon2id")
+	rootCmd.AddCommand(rekeyCmd)
+}
+
+func runRekey(cmd *cobra.Command, args []string) error {
+	// Initialize logger
+	log := logger.New(verbose)
+
+	cfg, err := loadConfig(cmd, log)
+	if err != nil {
+		return err
+	}
+
+	if cmd.Flags().Changed("identity") {
+		cfg.IdentityFile = rekeyIdentity
+	}
+
+	if cfg.S3Filename == "" {
+		return fmt.Errorf("filename must be specified via config file or command-line flag")
+	}
+
+	// Collect the new key-encryption keys
+	var recipients []crypto.Recipient
+	for _, key := range rekeyRecipients {
+		recipient, err := crypto.ParseX25519Recipient(key)
+		if err != nil {
+			return err
+		}
+		recipients = append(recipients, recipient)
+	}
+	if passphrase := os.Getenv("NEW_ENCRYPTION_KEY"); passphrase != "" {
+		kdf, err := crypto.ParseKDF(rekeyKDF)
+		if err != nil {
+			return err
+		}
+		recipient, err := crypto.NewPassphraseRecipient([]byte(passphrase), kdf)
+		if err != nil {
+			return err
+		}
+		recipients = append(recipients, recipient)
+	}
+	if rekeyKeyManager {
+		manager, err := pipeline.NewKeyManager(cfg)
+		if err != nil {
+			return err
+		}
+		if manager == nil {
+			return fmt.Errorf("--new-key-manager requires --key-manager or default_settings.key_manager")
+		}
+		recipients = append(recipients, crypto.NewKeyManagerRecipient(manager))
+	}
+	if len(recipients) == 0 {
+		return fmt.Errorf("no new key provided: pass --new-recipient or --new-key-manager, or set NEW_ENCRYPTION_KEY")
+	}
+
+	ctx, cancel := signalContext(log)
+	defer cancel()
+
+	rekeyer, err := pipeline.NewRekeyer(cfg, recipients, log)
+	if err != nil {
+		return fmt.Errorf("failed to create rekeyer: %w", err)
+	}
+
+	log.Infof("Starting rekey: %s://%s", cfg.StorageProvider, cfg.S3Filename)
+
+	if err := rekeyer.Rekey(ctx); err != nil {
+		return fmt.Errorf("rekey failed: %w", err)
+	}
+
+	log.Info("Rekey completed successfully")
+	return nil
+}
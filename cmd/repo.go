@@ -0,0 +1,215 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+	"github.com/seriousconsult/cloud_safe/internal/pipeline"
+	"github.com/seriousconsult/cloud_safe/internal/setup"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	repoSnapshot string
+	repoTarget   string
+	repoIdentity string
+)
+
+var repoCmd = &cobra.Command{
+	Use:   "repo",
+	Short: "Back up into a deduplicated repository",
+	Long: `A repository stores backups as deduplicated chunks instead of one archive per
+backup. Files are split at content-defined boundaries and every chunk is stored once,
+however many files, snapshots or machines contain it, so a backup only uploads the
+chunks that are new. The repository lives under --filename on the configured storage
+provider; its chunks and metadata are encrypted when encryption is enabled.`,
+}
+
+var repoInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Create a repository",
+	Args:  cobra.NoArgs,
+	RunE:  runRepoInit,
+}
+
+var repoBackupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Store source files and directories as a new snapshot",
+	Args:  cobra.NoArgs,
+	RunE:  runRepoBackup,
+}
+
+var repoSnapshotsCmd = &cobra.Command{
+	Use:   "snapshots",
+	Short: "List the snapshots of a repository",
+	Args:  cobra.NoArgs,
+	RunE:  runRepoSnapshots,
+}
+
+var repoRestoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restore a snapshot from a repository",
+	Args:  cobra.NoArgs,
+	RunE:  runRepoRestore,
+}
+
+func init() {
+	repoInitCmd.Flags().StringVar(&compression, "compression", "", "Compression codec of the repository (none, gzip, zstd). Defaults to zstd")
+	repoInitCmd.Flags().IntVar(&compressionLevel, "compression-level", 0, "Compression level (gzip 1-9, zstd 1-22; 0 uses the codec default)")
+	repoBackupCmd.Flags().StringSliceVarP(&sourcePaths, "source", "s", []string{}, "Source files or directories to back up (can specify multiple)")
+	repoBackupCmd.Flags().StringSliceVar(&excludes, "exclude", []string{}, "Leave out paths in source directories matching this gitignore-style pattern (can specify multiple)")
+	repoBackupCmd.Flags().StringSliceVar(&includes, "include", []string{}, "Back up paths matching this pattern even if they are excluded (can specify multiple)")
+	repoRestoreCmd.Flags().StringVar(&repoSnapshot, "snapshot", "latest", "ID, or start of the ID, of the snapshot to restore")
+	repoRestoreCmd.Flags().StringVarP(&repoTarget, "target", "t", ".", "Directory to restore the snapshot into")
+	repoRestoreCmd.Flags().StringVarP(&repoIdentity, "identity", "i", "", "Private key file for repositories encrypted to public keys")
+
+	repoCmd.AddCommand(repoInitCmd)
+	repoCmd.AddCommand(repoBackupCmd)
+	repoCmd.AddCommand(repoSnapshotsCmd)
+	repoCmd.AddCommand(repoRestoreCmd)
+	rootCmd.AddCommand(repoCmd)
+}
+
+// loadRepoConfig loads the configuration and checks that it names a repository
+func loadRepoConfig(cmd *cobra.Command, log *logger.Logger) (*setup.Config, error) {
+	cfg, err := loadConfig(cmd, log)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.S3Filename == "" {
+		return nil, fmt.Errorf("repository name must be specified via config file or --filename")
+	}
+	return cfg, nil
+}
+
+func runRepoInit(cmd *cobra.Command, args []string) error {
+	// Initialize logger
+	log := logger.New(verbose)
+
+	cfg, err := loadRepoConfig(cmd, log)
+	if err != nil {
+		return err
+	}
+	if cmd.Flags().Changed("compression") {
+		cfg.Compression = compression
+	}
+	if cmd.Flags().Changed("compression-level") {
+		cfg.CompressionLevel = compressionLevel
+	}
+
+	ctx, cancel := signalContext(log)
+	defer cancel()
+
+	repo, err := pipeline.InitRepository(ctx, cfg, log)
+	if err != nil {
+		return fmt.Errorf("failed to create repository: %w", err)
+	}
+
+	log.Infof("Created repository %s at %s://%s", repo.Config().ID[:8], cfg.StorageProvider, cfg.S3Filename)
+	return nil
+}
+
+func runRepoBackup(cmd *cobra.Command, args []string) error {
+	// Initialize logger
+	log := logger.New(verbose)
+
+	cfg, err := loadRepoConfig(cmd, log)
+	if err != nil {
+		return err
+	}
+	if len(sourcePaths) > 0 {
+		cfg.SourcePaths = sourcePaths
+	}
+	if cmd.Flags().Changed("exclude") {
+		cfg.Excludes = excludes
+	}
+	if cmd.Flags().Changed("include") {
+		cfg.Includes = includes
+	}
+
+	if len(cfg.SourcePaths) == 0 {
+		return fmt.Errorf("at least one source path must be specified via config file or command-line flag")
+	}
+	for _, path := range cfg.SourcePaths {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return fmt.Errorf("source path does not exist: %s", path)
+		}
+	}
+
+	ctx, cancel := signalContext(log)
+	defer cancel()
+
+	log.Infof("Starting repository backup: %v -> %s://%s", cfg.SourcePaths, cfg.StorageProvider, cfg.S3Filename)
+
+	if _, err := pipeline.BackupToRepository(ctx, cfg, log); err != nil {
+		return fmt.Errorf("backup failed: %w", err)
+	}
+
+	log.Info("Backup completed successfully")
+	return nil
+}
+
+func runRepoSnapshots(cmd *cobra.Command, args []string) error {
+	// Initialize logger
+	log := logger.New(verbose)
+
+	cfg, err := loadRepoConfig(cmd, log)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signalContext(log)
+	defer cancel()
+
+	repo, err := pipeline.OpenRepository(ctx, cfg, log)
+	if err != nil {
+		return err
+	}
+	snapshots, err := repo.Snapshots(ctx)
+	if err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tTIME\tHOST\tFILES\tSIZE\tPATHS")
+	for _, snapshot := range snapshots {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%d\t%s\t%s\n",
+			snapshot.ID.String()[:8],
+			snapshot.Time.Local().Format(time.DateTime),
+			snapshot.Hostname,
+			snapshot.Files,
+			formatSize(snapshot.Size),
+			strings.Join(snapshot.Paths, ", "))
+	}
+	return writer.Flush()
+}
+
+func runRepoRestore(cmd *cobra.Command, args []string) error {
+	// Initialize logger
+	log := logger.New(verbose)
+
+	cfg, err := loadRepoConfig(cmd, log)
+	if err != nil {
+		return err
+	}
+	if cmd.Flags().Changed("identity") {
+		cfg.IdentityFile = repoIdentity
+	}
+
+	ctx, cancel := signalContext(log)
+	defer cancel()
+
+	log.Infof("Starting repository restore: %s://%s -> %s", cfg.StorageProvider, cfg.S3Filename, repoTarget)
+
+	if err := pipeline.RestoreFromRepository(ctx, cfg, repoSnapshot, repoTarget, log); err != nil {
+		return err
+	}
+
+	log.Info("Restore completed successfully")
+	return nil
+}
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+	"github.com/seriousconsult/cloud_safe/internal/pipeline"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	restoreTarget   string
+	restoreIdentity string
+	restoreList     bool
+	restorePaths    []string
+)
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Download, decrypt and extract an archive from cloud storage",
+	Long: `Restore reverses the upload pipeline: it streams the archive named by --filename
+from the configured storage provider, decrypts it if encryption is enabled, and
+extracts the tar stream into the target directory. Archives encrypted to public
+keys need the matching private key file, passed with --identity.
+
+Archives uploaded with --index can be listed with --list, and single files or
+directories restored with --path, downloading only the parts of the archive that
+hold them.`,
+	Args: cobra.NoArgs,
+	RunE: runRestore,
+}
+
+func init() {
+	restoreCmd.Flags().StringVarP(&restoreTarget, "target", "t", ".", "Directory to extract the archive into")
+	restoreCmd.Flags().StringVarP(&restoreIdentity, "identity", "i", "", "Private key file for archives encrypted to public keys")
+	restoreCmd.Flags().BoolVar(&restoreList, "list", false, "List the entries of the archive from its index instead of restoring it")
+	restoreCmd.Flags().StringSliceVar(&restorePaths, "path", []string{}, "Only restore this entry of the archive and the entries below it, using its index (can specify multiple)")
+	rootCmd.AddCommand(restoreCmd)
+}
+
+func runRestore(cmd *cobra.Command, args []string) error {
+	// Initialize logger
+	log := logger.New(verbose)
+
+	cfg, err := loadConfig(cmd, log)
+	if err != nil {
+		return err
+	}
+
+	if cmd.Flags().Changed("identity") {
+		cfg.IdentityFile = restoreIdentity
+	}
+
+	if cfg.S3Filename == "" {
+		return fmt.Errorf("filename must be specified via config file or command-line flag")
+	}
+
+	ctx, cancel := signalContext(log)
+	defer cancel()
+
+	// Create and run restorer
+	restorer, err := pipeline.NewRestorer(cfg, log)
+	if err != nil {
+		return fmt.Errorf("failed to create restorer: %w", err)
+	}
+
+	if restoreList {
+		return listArchive(ctx, restorer)
+	}
+
+	log.Infof("Starting archive restore: %s://%s -> %s", cfg.StorageProvider, cfg.S3Filename, restoreTarget)
+
+	if len(restorePaths) > 0 {
+		err = restorer.RestorePaths(ctx, restoreTarget, restorePaths)
+	} else {
+		err = restorer.Restore(ctx, restoreTarget)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Info("Restore completed successfully")
+	return nil
+}
+
+// listArchive prints the entries of the archive index
+func listArchive(ctx context.Context, restorer *pipeline.Restorer) error {
+	index, err := restorer.LoadIndex(ctx)
+	if err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "MODE\tSIZE\tMODIFIED\tNAME")
+	for _, entry := range index.Entries {
+		name := entry.Name
+		switch {
+		case entry.HardLink:
+			name += " link to " + entry.Linkname
+		case entry.Linkname != "":
+			name += " -> " + entry.Linkname
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n",
+			entry.Mode,
+			formatSize(entry.Size),
+			entry.ModTime.Local().Format(time.DateTime),
+			name)
+	}
+	return writer.Flush()
+}
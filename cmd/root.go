@@ -6,8 +6,8 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
-	"time"
 
 	"github.com/seriousconsult/cloud_safe/internal/logger"
 	"github.com/seriousconsult/cloud_safe/internal/pipeline"
@@ -22,6 +22,11 @@ var (
 	storageProvider       string
 	s3Bucket              string
 	s3Filename            string
+	s3Endpoint            string
+	s3PathStyle           bool
+	s3CABundle            string
+	s3Signature           string
+	s3Tagging             bool
 	googleDriveCredPath   string
 	googleDriveTokenPath  string
 	googleDriveFolderID   string
@@ -32,12 +37,35 @@ var (
 	minioSecretAccessKey  string
 	minioBucket           string
 	minioUseSSL           bool
+	localPath             string
 	workers               int
 	chunkSize             int64
 	bufferSize            int
 	encrypt               bool
 	resume                bool
 	verbose               bool
+	compression           string
+	compressionLevel      int
+	kdfName               string
+	insecureDefaultKey    bool
+	recipients            []string
+	keyManager            string
+	kmsKeyID              string
+	keyringFile           string
+	destinations          []string
+	failurePolicy         string
+	volumeSize            int64
+	excludes              []string
+	includes              []string
+	minFileSize           int64
+	maxFileSize           int64
+	newerThan             string
+	olderThan             string
+	specialFiles          string
+	incremental           bool
+	fullBackup            bool
+	manifestDir           string
+	index                 bool
 )
 
 var rootCmd = &cobra.Command{
@@ -46,6 +74,8 @@ var rootCmd = &cobra.Command{
 	Long: `CloudSafe is a tool for efficiently compressing, encrypting, and uploading
 large directories to cloud storage services like AWS S3. It uses streaming processing
 to minimize memory usage regardless of directory size.`,
+	// Accept arbitrary args so run() can report unknown commands itself
+	Args: cobra.ArbitraryArgs,
 	RunE: run,
 }
 
@@ -61,28 +91,59 @@ func init() {
 		defaultConfigPath = ""
 	}
 
-	rootCmd.Flags().StringVarP(&cfgFile, "config", "c", defaultConfigPath, "Config file (default is config/config.json)")
-	rootCmd.Flags().StringSliceVarP(&sourcePaths, "source", "s", []string{}, "Source files or directories to archive (can specify multiple)")
+	// Provider and processing flags are persistent so subcommands share them
+	flags := rootCmd.PersistentFlags()
+	flags.StringVarP(&cfgFile, "config", "c", defaultConfigPath, "Config file (default is config/config.json)")
 	// Leave provider empty by default so config.json can supply the default
-	rootCmd.Flags().StringVarP(&storageProvider, "provider", "p", "", "Storage provider (s3, googledrive, mega, minio). If omitted, config.json default_settings.storage_provider is used; otherwise falls back to s3")
-	rootCmd.Flags().StringVarP(&s3Bucket, "bucket", "b", "safe-storage-24", "S3 bucket name")
-	rootCmd.Flags().StringVarP(&s3Filename, "filename", "f", "", "Target filename (required)")
-	rootCmd.Flags().StringVar(&googleDriveCredPath, "gd-credentials", "", "Google Drive credentials JSON file path")
-	rootCmd.Flags().StringVar(&googleDriveTokenPath, "gd-token", "", "Google Drive token file path")
-	rootCmd.Flags().StringVar(&googleDriveFolderID, "gd-folder", "", "Google Drive folder ID (optional)")
-	rootCmd.Flags().StringVar(&megaUsername, "mega-username", "", "Mega username")
-	rootCmd.Flags().StringVar(&megaPassword, "mega-password", "", "Mega password")
-	rootCmd.Flags().StringVar(&minioEndpoint, "minio-endpoint", "", "MinIO endpoint (e.g., localhost:9000)")
-	rootCmd.Flags().StringVar(&minioAccessKeyID, "minio-access-key", "", "MinIO access key ID")
-	rootCmd.Flags().StringVar(&minioSecretAccessKey, "minio-secret-key", "", "MinIO secret access key")
-	rootCmd.Flags().StringVar(&minioBucket, "minio-bucket", "", "MinIO bucket name")
-	rootCmd.Flags().BoolVar(&minioUseSSL, "minio-ssl", false, "Use SSL for MinIO connection")
-	rootCmd.Flags().IntVarP(&workers, "workers", "w", 4, "Number of concurrent workers")
-	rootCmd.Flags().Int64Var(&chunkSize, "chunk-size", 100*1024*1024, "Chunk size for multipart upload (bytes)")
-	rootCmd.Flags().IntVar(&bufferSize, "buffer-size", 64*1024, "Buffer size for streaming operations (bytes)")
-	rootCmd.Flags().BoolVarP(&encrypt, "encrypt", "e", true, "Enable encryption")
-	rootCmd.Flags().BoolVarP(&resume, "resume", "r", true, "Enable resumable uploads")
-	rootCmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "Enable verbose logging")
+	flags.StringVarP(&storageProvider, "provider", "p", "", "Storage provider (s3, googledrive, mega, minio, local). If omitted, config.json default_settings.storage_provider is used; otherwise falls back to s3")
+	flags.StringVarP(&s3Bucket, "bucket", "b", "safe-storage-24", "S3 bucket name")
+	flags.StringVarP(&s3Filename, "filename", "f", "", "Target filename (required)")
+	flags.StringVar(&s3Endpoint, "s3-endpoint", "", "Endpoint URL of an S3-compatible service (e.g., R2, Wasabi, B2, Ceph RGW); empty uses AWS")
+	flags.BoolVar(&s3PathStyle, "s3-path-style", false, "Use path-style bucket addressing (endpoint/bucket)")
+	flags.StringVar(&s3CABundle, "s3-ca-bundle", "", "PEM file of extra certificate authorities to trust for the S3 endpoint")
+	flags.StringVar(&s3Signature, "s3-signature", "", "S3 request signing (v4, v4-unsigned-payload, anonymous). Defaults to v4")
+	flags.BoolVar(&s3Tagging, "s3-tagging", false, "Tag uploaded objects with Source=cloud_safe. Defaults to on for AWS and off with --s3-endpoint, since R2 and B2 reject tags")
+	flags.StringVar(&googleDriveCredPath, "gd-credentials", "", "Google Drive credentials JSON file path")
+	flags.StringVar(&googleDriveTokenPath, "gd-token", "", "Google Drive token file path")
+	flags.StringVar(&googleDriveFolderID, "gd-folder", "", "Google Drive folder ID (optional)")
+	flags.StringVar(&megaUsername, "mega-username", "", "Mega username")
+	flags.StringVar(&megaPassword, "mega-password", "", "Mega password")
+	flags.StringVar(&minioEndpoint, "minio-endpoint", "", "MinIO endpoint (e.g., localhost:9000)")
+	flags.StringVar(&minioAccessKeyID, "minio-access-key", "", "MinIO access key ID")
+	flags.StringVar(&minioSecretAccessKey, "minio-secret-key", "", "MinIO secret access key")
+	flags.StringVar(&minioBucket, "minio-bucket", "", "MinIO bucket name")
+	flags.BoolVar(&minioUseSSL, "minio-ssl", false, "Use SSL for MinIO connection")
+	flags.StringVar(&localPath, "local-path", "", "Directory archives are written to by the local provider (e.g., a NAS mount)")
+	flags.IntVarP(&workers, "workers", "w", 4, "Number of concurrent workers")
+	flags.Int64Var(&chunkSize, "chunk-size", 100*1024*1024, "Chunk size for multipart upload (bytes)")
+	flags.IntVar(&bufferSize, "buffer-size", 64*1024, "Buffer size for streaming operations (bytes)")
+	flags.BoolVarP(&encrypt, "encrypt", "e", true, "Enable encryption")
+	flags.BoolVarP(&resume, "resume", "r", true, "Enable resumable uploads")
+	flags.BoolVarP(&verbose, "verbose", "v", false, "Enable verbose logging")
+	flags.StringVar(&keyManager, "key-manager", "", "Key manager for archive data keys (none, aws-kms, keyring). If omitted, config.json default_settings.key_manager is used")
+	flags.StringVar(&kmsKeyID, "kms-key-id", "", "AWS KMS key ID, ARN or alias data keys are wrapped under")
+	flags.StringVar(&keyringFile, "keyring", "", "Local keyring file for the keyring key manager")
+	flags.BoolVar(&insecureDefaultKey, "insecure-default-key", false, "Allow encryption with the publicly known default key when no ENCRYPTION_KEY is set (INSECURE)")
+
+	rootCmd.Flags().StringSliceVarP(&sourcePaths, "source", "s", []string{}, "Source files or directories to archive (can specify multiple)")
+	rootCmd.Flags().StringVar(&compression, "compression", "", "Compression codec (none, gzip, zstd). If omitted, config.json default_settings.compression is used; otherwise falls back to zstd")
+	rootCmd.Flags().IntVar(&compressionLevel, "compression-level", 0, "Compression level (gzip 1-9, zstd 1-22; 0 uses the codec default)")
+	rootCmd.Flags().StringSliceVar(&recipients, "recipient", []string{}, "Encrypt to this public key instead of a passphrase (can specify multiple)")
+	rootCmd.Flags().StringVar(&kdfName, "kdf", "", "Key derivation function for the encryption passphrase (argon2id, scrypt). Defaults to argon2id")
+	rootCmd.Flags().StringSliceVar(&destinations, "destination", []string{}, "Also upload the archive to this storage provider (can specify multiple)")
+	rootCmd.Flags().StringSliceVar(&excludes, "exclude", []string{}, "Leave out paths in source directories matching this gitignore-style pattern (can specify multiple)")
+	rootCmd.Flags().StringSliceVar(&includes, "include", []string{}, "Archive paths matching this pattern even if they are excluded, unless a directory above them is (can specify multiple)")
+	rootCmd.Flags().Int64Var(&minFileSize, "min-file-size", 0, "Leave out files smaller than this (bytes)")
+	rootCmd.Flags().Int64Var(&maxFileSize, "max-file-size", 0, "Leave out files larger than this (bytes)")
+	rootCmd.Flags().StringVar(&newerThan, "newer-than", "", "Only archive files modified within this age (e.g., 72h, 30d, 2w)")
+	rootCmd.Flags().StringVar(&olderThan, "older-than", "", "Only archive files last modified longer ago than this age (e.g., 10m, 1d)")
+	rootCmd.Flags().StringVar(&specialFiles, "special-files", "", "Handling of device files, FIFOs and sockets (archive, skip, fail). Defaults to archive; sockets are always skipped")
+	rootCmd.Flags().StringVar(&failurePolicy, "failure-policy", "", "What a failed destination does to the others (abort, continue). Defaults to abort")
+	rootCmd.Flags().Int64Var(&volumeSize, "volume-size", 0, "Split the stored archive into volumes of at most this many bytes (name.000, name.001, ...); 0 stores it as one object")
+	rootCmd.Flags().BoolVar(&incremental, "incremental", false, "Only archive files that changed since the previous backup of the same sources")
+	rootCmd.Flags().BoolVar(&fullBackup, "full", false, "With --incremental, make a full backup that starts a new chain")
+	rootCmd.Flags().StringVar(&manifestDir, "manifest-dir", "", "Directory for the manifests of incremental backups")
+	rootCmd.Flags().BoolVar(&index, "index", false, "Upload an index of the archive, so it can be listed and single files restored without downloading all of it")
 }
 
 // getAWSProfile returns the AWS profile to use, defaulting to "sean"
@@ -101,20 +162,8 @@ func getAWSRegion() string {
 	return "us-east-1"
 }
 
-func run(cmd *cobra.Command, args []string) error {
-	// Initialize logger
-	log := logger.New(verbose)
-
-	// Only show debug info in verbose mode
-	if verbose {
-		wd, _ := os.Getwd()
-		log.Debugf("Working directory: %s, Config: %s", wd, cfgFile)
-	}
-	
-	if len(args) > 0 {
-        return fmt.Errorf("unknown command or argument: %s\n\nRun 'cloud_safe --help' for usage.", args[0])
-    }
-
+// loadConfig loads config.json and applies any explicitly set CLI flags on top of it
+func loadConfig(cmd *cobra.Command, log *logger.Logger) (*setup.Config, error) {
 	// Start with a minimal config.
 	cfg := &setup.Config{}
 	err := cfg.LoadFromFile(cfgFile)
@@ -122,7 +171,7 @@ func run(cmd *cobra.Command, args []string) error {
 		log.Debugf("Error loading config file: %v", err)
 		// Continue with default config if file doesn't exist
 		if !os.IsNotExist(err) {
-			return fmt.Errorf("failed to load config: %v", err)
+			return nil, fmt.Errorf("failed to load config: %v", err)
 		}
 	}
 
@@ -136,6 +185,21 @@ func run(cmd *cobra.Command, args []string) error {
 	if cmd.Flags().Changed("filename") {
 		cfg.S3Filename = s3Filename
 	}
+	if cmd.Flags().Changed("s3-endpoint") {
+		cfg.S3Endpoint = s3Endpoint
+	}
+	if cmd.Flags().Changed("s3-path-style") {
+		cfg.S3UsePathStyle = s3PathStyle
+	}
+	if cmd.Flags().Changed("s3-ca-bundle") {
+		cfg.S3CABundle = s3CABundle
+	}
+	if cmd.Flags().Changed("s3-signature") {
+		cfg.S3SignatureVersion = s3Signature
+	}
+	if cmd.Flags().Changed("s3-tagging") {
+		cfg.S3Tagging = &s3Tagging
+	}
 	if cmd.Flags().Changed("gd-credentials") {
 		cfg.GoogleDriveCredentialsPath = googleDriveCredPath
 	}
@@ -166,6 +230,9 @@ func run(cmd *cobra.Command, args []string) error {
 	if cmd.Flags().Changed("minio-ssl") {
 		cfg.MinIOUseSSL = minioUseSSL
 	}
+	if cmd.Flags().Changed("local-path") {
+		cfg.LocalPath = localPath
+	}
 	if cmd.Flags().Changed("workers") {
 		cfg.Workers = workers
 	}
@@ -181,7 +248,19 @@ func run(cmd *cobra.Command, args []string) error {
 	if cmd.Flags().Changed("resume") {
 		cfg.Resume = resume
 	}
-	
+	if cmd.Flags().Changed("insecure-default-key") {
+		cfg.AllowInsecureKey = insecureDefaultKey
+	}
+	if cmd.Flags().Changed("key-manager") {
+		cfg.KeyManager = keyManager
+	}
+	if cmd.Flags().Changed("kms-key-id") {
+		cfg.KMSKeyID = kmsKeyID
+	}
+	if cmd.Flags().Changed("keyring") {
+		cfg.KeyringFile = keyringFile
+	}
+
 	// Always set AWS env-derived values unless config.json provided overrides
 	if cfg.AWSRegion == "" {
 		cfg.AWSRegion = getAWSRegion()
@@ -201,6 +280,100 @@ func run(cmd *cobra.Command, args []string) error {
 		log.Debugf("Config after loading:\n%s", string(configJSON))
 	}
 
+	return cfg, nil
+}
+
+// signalContext returns a context that is cancelled on SIGINT or SIGTERM
+func signalContext(log *logger.Logger) (context.Context, context.CancelFunc) {
+	// Create context with cancellation
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Handle interrupts
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		log.Info("Received interrupt signal, cancelling...")
+		cancel()
+	}()
+
+	return ctx, cancel
+}
+
+func run(cmd *cobra.Command, args []string) error {
+	// Initialize logger
+	log := logger.New(verbose)
+
+	// Only show debug info in verbose mode
+	if verbose {
+		wd, _ := os.Getwd()
+		log.Debugf("Working directory: %s, Config: %s", wd, cfgFile)
+	}
+
+	if len(args) > 0 {
+        return fmt.Errorf("unknown command or argument: %s\n\nRun 'cloud_safe --help' for usage.", args[0])
+    }
+
+	cfg, err := loadConfig(cmd, log)
+	if err != nil {
+		return err
+	}
+
+	if cmd.Flags().Changed("compression") {
+		cfg.Compression = compression
+	}
+	if cmd.Flags().Changed("compression-level") {
+		cfg.CompressionLevel = compressionLevel
+	}
+	if cmd.Flags().Changed("kdf") {
+		cfg.KDF = kdfName
+	}
+	if cmd.Flags().Changed("recipient") {
+		cfg.Recipients = recipients
+	}
+	if cmd.Flags().Changed("destination") {
+		cfg.Destinations = destinations
+	}
+	if cmd.Flags().Changed("failure-policy") {
+		cfg.FailurePolicy = failurePolicy
+	}
+	if cmd.Flags().Changed("volume-size") {
+		cfg.VolumeSize = volumeSize
+	}
+	if cmd.Flags().Changed("exclude") {
+		cfg.Excludes = excludes
+	}
+	if cmd.Flags().Changed("include") {
+		cfg.Includes = includes
+	}
+	if cmd.Flags().Changed("min-file-size") {
+		cfg.MinFileSize = minFileSize
+	}
+	if cmd.Flags().Changed("max-file-size") {
+		cfg.MaxFileSize = maxFileSize
+	}
+	if cmd.Flags().Changed("newer-than") {
+		cfg.NewerThan = newerThan
+	}
+	if cmd.Flags().Changed("older-than") {
+		cfg.OlderThan = olderThan
+	}
+	if cmd.Flags().Changed("special-files") {
+		cfg.SpecialFiles = specialFiles
+	}
+	if cmd.Flags().Changed("incremental") {
+		cfg.Incremental = incremental
+	}
+	if cmd.Flags().Changed("full") {
+		cfg.FullBackup = fullBackup
+	}
+	if cmd.Flags().Changed("manifest-dir") {
+		cfg.ManifestDir = manifestDir
+	}
+	if cmd.Flags().Changed("index") {
+		cfg.Index = index
+	}
+
 	// Validate source paths and filename after config is loaded
 	if len(sourcePaths) > 0 {
 		cfg.SourcePaths = sourcePaths
@@ -208,15 +381,15 @@ func run(cmd *cobra.Command, args []string) error {
 	if s3Filename != "" {
 		cfg.S3Filename = s3Filename
 	}
-	
+
 	if verbose {
 		log.Debugf("Source paths: %v, S3 Filename: %s", cfg.SourcePaths, cfg.S3Filename)
 	}
-	
+
 	if len(cfg.SourcePaths) == 0 {
 		return fmt.Errorf("at least one source path must be specified via config file or command-line flag")
 	}
-	
+
 	if cfg.S3Filename == "" {
 		return fmt.Errorf("filename must be specified via config file or command-line flag")
 	}
@@ -227,26 +400,16 @@ func run(cmd *cobra.Command, args []string) error {
 		}
 	}
 
-	// Create context with cancellation
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := signalContext(log)
 	defer cancel()
 
-	// Handle interrupts
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sigChan
-		log.Info("Received interrupt signal, cancelling...")
-		cancel()
-	}()
-
 	// Create and run processor
 	processor, err := pipeline.NewProcessor(cfg, log)
 	if err != nil {
 		return fmt.Errorf("failed to create processor: %w", err)
 	}
 
-	log.Infof("Starting archive upload: %v -> %s://%s", cfg.SourcePaths, cfg.StorageProvider, cfg.S3Filename)
+	log.Infof("Starting archive upload: %v -> %s://%s", cfg.SourcePaths, strings.Join(cfg.GetDestinations(), "+"), cfg.S3Filename)
 
 	log.Debug("About to call processor.Process()")
 	if err := processor.Process(ctx); err != nil {
@@ -256,16 +419,6 @@ func run(cmd *cobra.Command, args []string) error {
 	log.Debug("processor.Process() completed successfully")
 	log.Info("Upload completed successfully")
 
-	// Special handling for Mega provider to prevent hanging
-	if cfg.StorageProvider == "mega" {
-		log.Info("Mega upload detected - forcing cleanup and exit")
-		// Give a brief moment for any final cleanup
-		time.Sleep(50 * time.Millisecond)
-		log.Debug("About to call os.Exit(0)")
-		// Force exit for Mega uploads due to library limitations
-		os.Exit(0)
-	}
-
 	log.Debug("Returning from run() function")
 	return nil
 }
@@ -0,0 +1,319 @@
+package compressor
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec identifies the compression applied to the tar stream
+type Codec string
+
+const (
+	CodecNone Codec = "none"
+	CodecGzip Codec = "gzip"
+	CodecZstd Codec = "zstd"
+)
+
+// DefaultCodec is used when no compression is configured
+const DefaultCodec = CodecZstd
+
+// Magic bytes at the start of each compressed stream; restore uses them to
+// pick the codec of archives written without an archive header
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Archive header, written before the compressed tar stream (inside the
+// encryption of an encrypted archive):
+//
+//	magic    14 bytes  "CLOUDSAFE-TAR\x00"
+//	version   1 byte   ArchiveHeaderVersion
+//	codec     1 byte   codec of the stream that follows (see codecIDs)
+//
+// The magic of a plain tar stream is the name of its first entry, which is
+// followed by NUL bytes, so it never carries a version after the magic.
+const archiveMagic = "CLOUDSAFE-TAR\x00"
+
+// ArchiveHeaderVersion is the version of the archive header format
+const ArchiveHeaderVersion = 1
+
+// archiveHeaderSize is the size of the archive header
+const archiveHeaderSize = len(archiveMagic) + 2
+
+// codecIDs are the codec bytes of the archive header
+var codecIDs = map[Codec]byte{
+	CodecNone: 0,
+	CodecGzip: 1,
+	CodecZstd: 2,
+}
+
+// ParseCodec parses a codec name, falling back to DefaultCodec when empty
+func ParseCodec(name string) (Codec, error) {
+	switch Codec(name) {
+	case "":
+		return DefaultCodec, nil
+	case CodecNone, CodecGzip, CodecZstd:
+		return Codec(name), nil
+	default:
+		return "", fmt.Errorf("unsupported compression codec: %s (expected none, gzip or zstd)", name)
+	}
+}
+
+// ValidateLevel checks that level is valid for codec; 0 selects the codec default
+func ValidateLevel(codec Codec, level int) error {
+	if level == 0 {
+		return nil
+	}
+	switch codec {
+	case CodecGzip:
+		if level < gzip.BestSpeed || level > gzip.BestCompression {
+			return fmt.Errorf("gzip compression level must be between %d and %d, got %d", gzip.BestSpeed, gzip.BestCompression, level)
+		}
+	case CodecZstd:
+		if level < 1 || level > 22 {
+			return fmt.Errorf("zstd compression level must be between 1 and 22, got %d", level)
+		}
+	}
+	return nil
+}
+
+// NewCompressWriter wraps writer with an encoder for codec. Closing the returned
+// writer flushes the encoder but does not close writer.
+func NewCompressWriter(writer io.Writer, codec Codec, level int) (io.WriteCloser, error) {
+	if err := ValidateLevel(codec, level); err != nil {
+		return nil, err
+	}
+
+	switch codec {
+	case CodecNone:
+		return nopWriteCloser{writer}, nil
+
+	case CodecGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		gzipWriter, err := gzip.NewWriterLevel(writer, level)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create gzip writer: %w", err)
+		}
+		return gzipWriter, nil
+
+	case CodecZstd:
+		opts := []zstd.EOption{}
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		zstdWriter, err := zstd.NewWriter(writer, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd writer: %w", err)
+		}
+		return zstdWriter, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported compression codec: %s", codec)
+	}
+}
+
+// NewArchiveWriter writes the archive header recording codec to writer and
+// returns a writer that compresses the tar stream after it. With framed set
+// the stream is compressed in frames, and the returned writer is a
+// FrameWriter whose offsets count the header. Closing the returned writer
+// does not close writer.
+func NewArchiveWriter(writer io.Writer, codec Codec, level int, framed bool) (io.WriteCloser, error) {
+	id, ok := codecIDs[codec]
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression codec: %s", codec)
+	}
+	if err := ValidateLevel(codec, level); err != nil {
+		return nil, err
+	}
+
+	header := append([]byte(archiveMagic), ArchiveHeaderVersion, id)
+	if _, err := writer.Write(header); err != nil {
+		return nil, fmt.Errorf("failed to write archive header: %w", err)
+	}
+
+	if !framed {
+		return NewCompressWriter(writer, codec, level)
+	}
+	frames, err := NewFrameWriter(writer, codec, level)
+	if err != nil {
+		return nil, err
+	}
+	frames.output.written = int64(len(header))
+	return frames, nil
+}
+
+// NewArchiveReader reads the archive header at the start of reader and
+// returns a reader that yields the decompressed tar stream. The codec of an
+// archive written without a header is detected from its magic bytes.
+func NewArchiveReader(reader io.Reader) (io.ReadCloser, Codec, error) {
+	buffered := bufio.NewReader(reader)
+
+	header, err := buffered.Peek(archiveHeaderSize)
+	if err != nil && err != io.EOF {
+		return nil, "", fmt.Errorf("failed to read archive header: %w", err)
+	}
+	if len(header) < len(archiveMagic)+1 || !bytes.HasPrefix(header, []byte(archiveMagic)) || header[len(archiveMagic)] == 0 {
+		return NewDecompressReader(buffered)
+	}
+
+	if version := header[len(archiveMagic)]; version > ArchiveHeaderVersion {
+		return nil, "", fmt.Errorf("unsupported archive header version %d", version)
+	}
+	if len(header) < archiveHeaderSize {
+		return nil, "", fmt.Errorf("archive header is truncated")
+	}
+	codec, err := codecOf(header[archiveHeaderSize-1])
+	if err != nil {
+		return nil, "", err
+	}
+	buffered.Discard(len(header))
+
+	decompressor, err := NewCodecReader(buffered, codec)
+	if err != nil {
+		return nil, "", err
+	}
+	return decompressor, codec, nil
+}
+
+// codecOf returns the codec with the archive header codec byte id
+func codecOf(id byte) (Codec, error) {
+	for codec, codecID := range codecIDs {
+		if codecID == id {
+			return codec, nil
+		}
+	}
+	return "", fmt.Errorf("archive header names unknown codec %d", id)
+}
+
+// NewCodecReader returns a reader that yields the stream read from reader,
+// decompressed with codec
+func NewCodecReader(reader io.Reader, codec Codec) (io.ReadCloser, error) {
+	switch codec {
+	case CodecNone:
+		return io.NopCloser(reader), nil
+
+	case CodecGzip:
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+		}
+		return gzipReader, nil
+
+	case CodecZstd:
+		zstdReader, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd reader: %w", err)
+		}
+		return zstdReader.IOReadCloser(), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported compression codec: %s", codec)
+	}
+}
+
+// NewDecompressReader detects the codec from the magic bytes at the start of
+// reader and returns a reader that yields the decompressed tar stream
+func NewDecompressReader(reader io.Reader) (io.ReadCloser, Codec, error) {
+	buffered := bufio.NewReader(reader)
+
+	// A short stream cannot carry a magic number; treat it as uncompressed
+	magic, err := buffered.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, "", fmt.Errorf("failed to read stream header: %w", err)
+	}
+
+	codec := CodecNone
+	switch {
+	case bytes.HasPrefix(magic, zstdMagic):
+		codec = CodecZstd
+	case bytes.HasPrefix(magic, gzipMagic):
+		codec = CodecGzip
+	}
+
+	decompressor, err := NewCodecReader(buffered, codec)
+	if err != nil {
+		return nil, "", err
+	}
+	return decompressor, codec, nil
+}
+
+// FrameWriter compresses a stream as a series of independent frames: gzip
+// members or zstd frames. Decoders read the frames as one stream, and each
+// frame can also be decompressed on its own, starting at its offset.
+type FrameWriter struct {
+	output  *countingWriter
+	encoder io.WriteCloser
+	// written counts the uncompressed bytes
+	written int64
+}
+
+// NewFrameWriter wraps writer with an encoder for codec that can start new
+// frames. Closing it ends the last frame but does not close writer.
+func NewFrameWriter(writer io.Writer, codec Codec, level int) (*FrameWriter, error) {
+	output := &countingWriter{writer: writer}
+	encoder, err := NewCompressWriter(output, codec, level)
+	if err != nil {
+		return nil, err
+	}
+	return &FrameWriter{output: output, encoder: encoder}, nil
+}
+
+// Write compresses p into the current frame
+func (f *FrameWriter) Write(p []byte) (int, error) {
+	n, err := f.encoder.Write(p)
+	f.written += int64(n)
+	return n, err
+}
+
+// NewFrame ends the current frame, so the next byte written starts a frame
+func (f *FrameWriter) NewFrame() error {
+	if err := f.encoder.Close(); err != nil {
+		return err
+	}
+	// Both encoders can start over on the same writer
+	if encoder, ok := f.encoder.(interface{ Reset(io.Writer) }); ok {
+		encoder.Reset(f.output)
+	}
+	return nil
+}
+
+// Offsets returns the number of bytes written and the number of compressed
+// bytes they have produced so far. Right after NewFrame these are the
+// offsets of the new frame.
+func (f *FrameWriter) Offsets() (int64, int64) {
+	return f.written, f.output.written
+}
+
+// Close ends the last frame
+func (f *FrameWriter) Close() error {
+	return f.encoder.Close()
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	writer  io.Writer
+	written int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	c.written += int64(n)
+	return n, err
+}
+
+// nopWriteCloser adds a no-op Close to a writer
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
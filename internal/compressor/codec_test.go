@@ -0,0 +1,86 @@
+package compressor
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestArchiveHeaderRecordsCodec(t *testing.T) {
+	// A tar stream whose first entry name starts with the gzip magic
+	// bytes looks like gzip to a reader that only sniffs
+	var tarStream bytes.Buffer
+	tarWriter := tar.NewWriter(&tarStream)
+	if err := tarWriter.WriteHeader(&tar.Header{Name: "\x1f\x8bname", Typeflag: tar.TypeReg, Mode: 0644}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, codec := range []Codec{CodecNone, CodecGzip, CodecZstd} {
+		for _, framed := range []bool{false, true} {
+			var archive bytes.Buffer
+			writer, err := NewArchiveWriter(&archive, codec, 0, framed)
+			if err != nil {
+				t.Fatalf("NewArchiveWriter(%s) error = %v", codec, err)
+			}
+			if _, err := writer.Write(tarStream.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			reader, got, err := NewArchiveReader(&archive)
+			if err != nil {
+				t.Fatalf("NewArchiveReader(%s) error = %v", codec, err)
+			}
+			if got != codec {
+				t.Errorf("NewArchiveReader() codec = %s, want %s", got, codec)
+			}
+			data, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("reading %s archive: %v", codec, err)
+			}
+			if !bytes.Equal(data, tarStream.Bytes()) {
+				t.Errorf("%s archive read back %d bytes that differ from the %d written", codec, len(data), tarStream.Len())
+			}
+		}
+	}
+}
+
+func TestArchiveReaderWithoutHeader(t *testing.T) {
+	for _, codec := range []Codec{CodecNone, CodecGzip, CodecZstd} {
+		var archive bytes.Buffer
+		writer, err := NewCompressWriter(&archive, codec, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Write([]byte("an archive written before the header existed")); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		reader, got, err := NewArchiveReader(&archive)
+		if err != nil {
+			t.Fatalf("NewArchiveReader(%s) error = %v", codec, err)
+		}
+		if got != codec {
+			t.Errorf("NewArchiveReader() codec = %s, want %s", got, codec)
+		}
+		if data, err := io.ReadAll(reader); err != nil || string(data) != "an archive written before the header existed" {
+			t.Errorf("NewArchiveReader(%s) read %q, %v", codec, data, err)
+		}
+	}
+}
+
+func TestArchiveReaderRejectsUnknownCodec(t *testing.T) {
+	header := append([]byte(archiveMagic), ArchiveHeaderVersion, 9)
+	if _, _, err := NewArchiveReader(bytes.NewReader(header)); err == nil {
+		t.Error("NewArchiveReader() accepted an unknown codec")
+	}
+}
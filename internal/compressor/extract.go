@@ -0,0 +1,281 @@
+package compressor
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+)
+
+// TarExtractor handles streaming extraction of tar archives
+type TarExtractor struct {
+	logger *logger.Logger
+}
+
+// NewTarExtractor creates a new tar extractor
+func NewTarExtractor(log *logger.Logger) *TarExtractor {
+	return &TarExtractor{
+		logger: log,
+	}
+}
+
+// Extract reads a tar stream and recreates its entries under targetDir
+func (te *TarExtractor) Extract(ctx context.Context, reader io.Reader, targetDir string) error {
+	te.logger.Debug("Starting extraction")
+
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		return fmt.Errorf("failed to create target directory %s: %w", targetDir, err)
+	}
+
+	tarReader := tar.NewReader(reader)
+	for {
+		select {
+		case <-ctx.Done():
+			te.logger.Debug("Context cancelled during extraction")
+			return ctx.Err()
+		default:
+		}
+
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar header: %w", err)
+		}
+
+		// Entries of incremental archives describe the archive itself
+		switch header.Name {
+		case SnapshotEntryName:
+			continue
+		case DeletionsEntryName:
+			if err := te.applyDeletions(tarReader, targetDir); err != nil {
+				return err
+			}
+			continue
+		}
+
+		path, err := safeJoin(targetDir, header.Name)
+		if err != nil {
+			return err
+		}
+		// Extracted symlinks must not redirect later entries outside targetDir
+		if err := checkNoSymlinks(targetDir, path); err != nil {
+			return err
+		}
+
+		if err := te.extractEntry(header, tarReader, targetDir, path); err != nil {
+			return err
+		}
+	}
+
+	te.logger.Debug("Extraction completed successfully")
+	return nil
+}
+
+// applyDeletions removes the entries listed in the deletions entry of an
+// incremental archive, which were deleted after its parent was made
+func (te *TarExtractor) applyDeletions(reader io.Reader, targetDir string) error {
+	var deleted []string
+	if err := json.NewDecoder(reader).Decode(&deleted); err != nil {
+		return fmt.Errorf("failed to read %s: %w", DeletionsEntryName, err)
+	}
+
+	for _, name := range deleted {
+		path, err := safeJoin(targetDir, name)
+		if err != nil {
+			return err
+		}
+		if path == filepath.Clean(targetDir) {
+			return fmt.Errorf("%s lists the target directory itself", DeletionsEntryName)
+		}
+		if err := checkNoSymlinks(targetDir, path); err != nil {
+			return err
+		}
+		te.logger.Debugf("Removing deleted entry: %s", name)
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("failed to remove deleted entry %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// extractEntry writes a single tar entry to path
+func (te *TarExtractor) extractEntry(header *tar.Header, tarReader *tar.Reader, targetDir, path string) error {
+	mode := os.FileMode(header.Mode).Perm()
+
+	// Replace whatever is there instead of writing through it, which matters
+	// for symlinks, including one a directory entry would otherwise follow,
+	// and for files hard linked elsewhere
+	if info, err := os.Lstat(path); err == nil && !info.IsDir() {
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to replace %s: %w", path, err)
+		}
+	}
+
+	if header.Typeflag != tar.TypeDir {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("failed to create parent directory for %s: %w", path, err)
+		}
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		te.logger.Debugf("Creating directory: %s", header.Name)
+		if err := os.MkdirAll(path, mode|0700); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", path, err)
+		}
+
+	case tar.TypeReg, tar.TypeGNUSparse:
+		te.logger.Debugf("Extracting file: %s", header.Name)
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+		if err != nil {
+			return fmt.Errorf("failed to create file %s: %w", path, err)
+		}
+
+		// The reader fills the holes of sparse entries with zeros, which are
+		// skipped again so the file gets its holes back
+		var content io.Writer = file
+		if isSparse(header) {
+			content = &sparseWriter{file: file}
+		}
+
+		// Stream file content with buffered copy
+		if _, err := io.Copy(content, tarReader); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to write file content for %s: %w", path, err)
+		}
+		if err := file.Truncate(header.Size); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to write file content for %s: %w", path, err)
+		}
+		if err := file.Close(); err != nil {
+			return fmt.Errorf("failed to close file %s: %w", path, err)
+		}
+
+	case tar.TypeSymlink:
+		te.logger.Debugf("Creating symlink: %s -> %s", header.Name, header.Linkname)
+		if err := os.Symlink(header.Linkname, path); err != nil {
+			return fmt.Errorf("failed to create symlink %s: %w", path, err)
+		}
+		te.restoreOwner(header, path)
+		te.restoreXattrs(header, path)
+		return nil
+
+	case tar.TypeLink:
+		// The link target is an earlier entry of the same archive
+		target, err := safeJoin(targetDir, header.Linkname)
+		if err != nil {
+			return err
+		}
+		// A link through an extracted symlink would reach files outside targetDir
+		if err := checkNoSymlinks(targetDir, target); err != nil {
+			return err
+		}
+		te.logger.Debugf("Creating hard link: %s -> %s", header.Name, header.Linkname)
+		if err := os.Link(target, path); err != nil {
+			return fmt.Errorf("failed to create hard link %s: %w", path, err)
+		}
+		return nil
+
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		te.logger.Debugf("Creating special file: %s", header.Name)
+		if err := makeSpecial(path, header); err != nil {
+			// Device files can only be created by root; the rest of the
+			// archive is still worth restoring
+			if errors.Is(err, os.ErrPermission) || errors.Is(err, errUnsupported) {
+				te.logger.Errorf("WARNING: skipping special file %s: %v", header.Name, err)
+				return nil
+			}
+			return fmt.Errorf("failed to create special file %s: %w", path, err)
+		}
+
+	default:
+		te.logger.Infof("Skipping unsupported tar entry %s (type %c)", header.Name, header.Typeflag)
+		return nil
+	}
+
+	te.restoreOwner(header, path)
+	te.restoreXattrs(header, path)
+
+	// Set the exact permissions, including setuid, setgid and sticky bits,
+	// after the owner since changing it clears setuid. Directories keep
+	// owner write access so their entries can still be extracted.
+	if header.Typeflag != tar.TypeDir {
+		if err := os.Chmod(path, header.FileInfo().Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			te.logger.Debugf("Failed to set permissions for %s: %v", path, err)
+		}
+	}
+
+	// Restore the modification time recorded in the archive
+	if err := os.Chtimes(path, header.ModTime, header.ModTime); err != nil {
+		te.logger.Debugf("Failed to set modification time for %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// restoreOwner sets the owner recorded in the archive when running as root,
+// the only user allowed to give files away
+func (te *TarExtractor) restoreOwner(header *tar.Header, path string) {
+	if os.Geteuid() != 0 {
+		return
+	}
+	if err := os.Lchown(path, header.Uid, header.Gid); err != nil {
+		te.logger.Debugf("Failed to set owner of %s: %v", path, err)
+	}
+}
+
+// restoreXattrs sets the extended attributes recorded in the archive. Some
+// namespaces need privileges or filesystem support, so failures are logged.
+func (te *TarExtractor) restoreXattrs(header *tar.Header, path string) {
+	for key, value := range header.PAXRecords {
+		name, ok := strings.CutPrefix(key, paxXattrPrefix)
+		if !ok {
+			continue
+		}
+		if err := writeXattr(path, name, value); err != nil {
+			te.logger.Debugf("Failed to set attribute %s of %s: %v", name, path, err)
+		}
+	}
+}
+
+// checkNoSymlinks returns an error if a directory between targetDir and path
+// is a symlink
+func checkNoSymlinks(targetDir, path string) error {
+	rel, err := filepath.Rel(targetDir, filepath.Dir(path))
+	if err != nil || rel == "." {
+		return nil
+	}
+
+	dir := targetDir
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if err != nil {
+			// Missing directories are created by the extraction
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("tar entry %s is below the symlink %s", path, dir)
+		}
+	}
+	return nil
+}
+
+// safeJoin joins name onto targetDir, rejecting entries that would escape it
+func safeJoin(targetDir, name string) (string, error) {
+	path := filepath.Join(targetDir, filepath.FromSlash(name))
+	rel, err := filepath.Rel(targetDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("tar entry %s escapes target directory", name)
+	}
+	return path, nil
+}
@@ -0,0 +1,145 @@
+package compressor
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+)
+
+// tarOf returns a tar stream holding headers, with content for regular files
+func tarOf(t *testing.T, headers ...*tar.Header) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := tar.NewWriter(&buf)
+	for _, header := range headers {
+		if header.Mode == 0 {
+			header.Mode = 0644
+		}
+		var content []byte
+		if header.Typeflag == tar.TypeReg {
+			content = []byte("content of " + header.Name)
+			header.Size = int64(len(content))
+		}
+		if err := writer.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractStaysInTargetDir(t *testing.T) {
+	outside := t.TempDir()
+	past := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	if err := os.Chtimes(outside, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file outside the target directory that must not be linked into it
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	secretInfo, err := os.Stat(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		headers []*tar.Header
+		wantErr bool
+	}{
+		{
+			name:    "parent directory",
+			headers: []*tar.Header{{Name: "../escaped", Typeflag: tar.TypeReg}},
+			wantErr: true,
+		},
+		{
+			name:    "nested parent directory",
+			headers: []*tar.Header{{Name: "a/../../escaped", Typeflag: tar.TypeReg}},
+			wantErr: true,
+		},
+		{
+			name: "file below symlink",
+			headers: []*tar.Header{
+				{Name: "d", Typeflag: tar.TypeSymlink, Linkname: outside},
+				{Name: "d/escaped", Typeflag: tar.TypeReg},
+			},
+			wantErr: true,
+		},
+		{
+			name: "directory below symlink",
+			headers: []*tar.Header{
+				{Name: "d", Typeflag: tar.TypeSymlink, Linkname: outside},
+				{Name: "d/escaped/", Typeflag: tar.TypeDir, Mode: 0755},
+			},
+			wantErr: true,
+		},
+		{
+			name: "hard link below symlink",
+			headers: []*tar.Header{
+				{Name: "d", Typeflag: tar.TypeSymlink, Linkname: filepath.Dir(secret)},
+				{Name: "linked", Typeflag: tar.TypeLink, Linkname: "d/" + filepath.Base(secret)},
+			},
+			wantErr: true,
+		},
+		{
+			name: "directory replacing symlink",
+			headers: []*tar.Header{
+				{Name: "d", Typeflag: tar.TypeSymlink, Linkname: outside},
+				{Name: "d/", Typeflag: tar.TypeDir, Mode: 0700, ModTime: time.Now()},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := t.TempDir()
+			extractor := NewTarExtractor(logger.New(false).Quiet())
+			err := extractor.Extract(context.Background(), bytes.NewReader(tarOf(t, tt.headers...)), target)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Extract() error = %v, wantErr %t", err, tt.wantErr)
+			}
+
+			entries, err := os.ReadDir(outside)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("Extract() wrote %s outside the target directory", entries[0].Name())
+			}
+			info, err := os.Stat(outside)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !info.ModTime().Equal(past) {
+				t.Errorf("Extract() changed the directory a symlink pointed to")
+			}
+
+			err = filepath.WalkDir(target, func(path string, entry os.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if info, err := os.Lstat(path); err == nil && os.SameFile(info, secretInfo) {
+					t.Errorf("Extract() linked %s to a file outside the target directory", path)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,340 @@
+package compressor
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IgnoreFileName is the per-directory file of exclude patterns. Its patterns
+// apply to the directory it is in and everything below it.
+const IgnoreFileName = ".cloudsafeignore"
+
+// FilterOptions selects the files archived from source directories. Zero
+// values disable a filter.
+type FilterOptions struct {
+	// Excludes are gitignore-style patterns of paths to leave out
+	Excludes []string
+	// Includes are patterns of paths to archive even if they are excluded,
+	// as long as no directory above them is
+	Includes []string
+	// MinSize and MaxSize bound the size of archived files in bytes
+	MinSize int64
+	MaxSize int64
+	// NewerThan and OlderThan bound the age of archived files by
+	// modification time
+	NewerThan time.Duration
+	OlderThan time.Duration
+}
+
+// Filter decides which entries of a source directory are archived. Patterns
+// follow gitignore: the last matching pattern wins, "!" re-includes a path,
+// a trailing "/" matches only directories, a pattern containing "/" is
+// relative to the directory it was defined for and "**" matches any number
+// of directories. An excluded directory is skipped with everything in it.
+//
+// Rules from .cloudsafeignore files come first, from the source directory
+// down, followed by Excludes and then Includes, so Includes win over any
+// exclude of the same path. Like "!" patterns, they cannot re-include a path
+// below an excluded directory, because that directory is not walked.
+type Filter struct {
+	rules   []*ignoreRule
+	minSize int64
+	maxSize int64
+	// Files modified before newerThan or after olderThan are skipped; the
+	// cutoffs are fixed when the filter is created so size estimation and
+	// compression select the same files
+	newerThan time.Time
+	olderThan time.Time
+}
+
+// NewFilter creates a filter from options
+func NewFilter(options FilterOptions) (*Filter, error) {
+	f := &Filter{
+		minSize: options.MinSize,
+		maxSize: options.MaxSize,
+	}
+
+	if options.MinSize < 0 || options.MaxSize < 0 {
+		return nil, fmt.Errorf("file size limits must not be negative")
+	}
+	if options.MaxSize > 0 && options.MinSize > options.MaxSize {
+		return nil, fmt.Errorf("minimum file size %d is larger than maximum file size %d", options.MinSize, options.MaxSize)
+	}
+
+	now := time.Now()
+	if options.NewerThan > 0 {
+		f.newerThan = now.Add(-options.NewerThan)
+	}
+	if options.OlderThan > 0 {
+		f.olderThan = now.Add(-options.OlderThan)
+	}
+
+	for _, pattern := range options.Excludes {
+		rule, err := parseIgnoreRule(pattern, "")
+		if err != nil {
+			return nil, err
+		}
+		if rule != nil {
+			f.rules = append(f.rules, rule)
+		}
+	}
+	for _, pattern := range options.Includes {
+		rule, err := parseIgnoreRule(pattern, "")
+		if err != nil {
+			return nil, err
+		}
+		if rule != nil {
+			rule.negate = !rule.negate
+			f.rules = append(f.rules, rule)
+		}
+	}
+	return f, nil
+}
+
+// ParseAge parses an age such as "36h", "30d" or "2w"; besides the units of
+// time.ParseDuration it accepts days and weeks
+func ParseAge(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	unit := time.Duration(0)
+	switch value[len(value)-1] {
+	case 'd':
+		unit = 24 * time.Hour
+	case 'w':
+		unit = 7 * 24 * time.Hour
+	}
+	if unit != 0 {
+		n, err := strconv.ParseFloat(value[:len(value)-1], 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age %q", value)
+		}
+		return time.Duration(n * float64(unit)), nil
+	}
+
+	age, err := time.ParseDuration(value)
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("invalid age %q", value)
+	}
+	return age, nil
+}
+
+// ignoreRule is a single gitignore-style pattern
+type ignoreRule struct {
+	// base is the slash-separated directory, relative to the source
+	// directory, that the pattern was defined for
+	base    string
+	regexp  *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// parseIgnoreRule parses one pattern line. Blank lines and comments return a
+// nil rule.
+func parseIgnoreRule(line, base string) (*ignoreRule, error) {
+	pattern := strings.TrimRight(line, " \t\r")
+	// A trailing space escaped with a backslash is part of the pattern
+	if strings.HasSuffix(pattern, "\\") && len(pattern) < len(line) {
+		pattern += " "
+	}
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return nil, nil
+	}
+
+	rule := &ignoreRule{base: base}
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if pattern == "" {
+		return nil, nil
+	}
+
+	// A pattern with a slash anywhere but the end only matches relative to
+	// its base directory; otherwise it matches a name at any depth
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	expr := globToRegexp(pattern)
+	if anchored {
+		expr = "^" + expr + "$"
+	} else {
+		expr = "^(?:.*/)?" + expr + "$"
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", line, err)
+	}
+	rule.regexp = re
+	return rule, nil
+}
+
+// globToRegexp translates a gitignore glob into a regular expression
+func globToRegexp(pattern string) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/") && (i == 0 || pattern[i-1] == '/'):
+			// Any number of leading directories, including none
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**") && i+2 == len(pattern) && (i == 0 || pattern[i-1] == '/'):
+			// Everything below a directory
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				b.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// match reports whether the rule matches relPath, the slash-separated path
+// of an entry relative to the source directory
+func (r *ignoreRule) match(relPath string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base != "" {
+		rest, ok := strings.CutPrefix(relPath, r.base+"/")
+		if !ok {
+			return false
+		}
+		relPath = rest
+	}
+	return r.regexp.MatchString(relPath)
+}
+
+// filterWalk applies a filter while walking one source directory, collecting
+// the rules of .cloudsafeignore files on the way down
+type filterWalk struct {
+	filter   *Filter
+	dirRules map[string][]*ignoreRule
+}
+
+// newFilterWalk starts walking a source directory with filter, which may be nil
+func newFilterWalk(filter *Filter) *filterWalk {
+	return &filterWalk{
+		filter:   filter,
+		dirRules: make(map[string][]*ignoreRule),
+	}
+}
+
+// selected reports whether the entry at relPath is archived. For a directory
+// that is selected, its .cloudsafeignore file is loaded for the entries below.
+func (w *filterWalk) selected(path, relPath string, info os.FileInfo) (bool, error) {
+	if relPath == "." {
+		return true, w.loadIgnoreFile(path, "")
+	}
+
+	if w.ignored(relPath, info.IsDir()) {
+		return false, nil
+	}
+
+	if info.IsDir() {
+		return true, w.loadIgnoreFile(path, relPath)
+	}
+	if w.filter == nil || !info.Mode().IsRegular() {
+		return true, nil
+	}
+
+	f := w.filter
+	switch {
+	case f.minSize > 0 && info.Size() < f.minSize:
+		return false, nil
+	case f.maxSize > 0 && info.Size() > f.maxSize:
+		return false, nil
+	case !f.newerThan.IsZero() && info.ModTime().Before(f.newerThan):
+		return false, nil
+	case !f.olderThan.IsZero() && info.ModTime().After(f.olderThan):
+		return false, nil
+	}
+	return true, nil
+}
+
+// ignored applies the patterns of the .cloudsafeignore files above relPath
+// and then those of the filter; the last match decides
+func (w *filterWalk) ignored(relPath string, isDir bool) bool {
+	dir := path.Dir(relPath)
+	var ancestors []string
+	for dir != "." {
+		ancestors = append(ancestors, dir)
+		dir = path.Dir(dir)
+	}
+	rules := append([]*ignoreRule{}, w.dirRules[""]...)
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		rules = append(rules, w.dirRules[ancestors[i]]...)
+	}
+	if w.filter != nil {
+		rules = append(rules, w.filter.rules...)
+	}
+
+	ignored := false
+	for _, rule := range rules {
+		if rule.match(relPath, isDir) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// loadIgnoreFile reads the .cloudsafeignore file of a directory, if any
+func (w *filterWalk) loadIgnoreFile(dirPath, relPath string) error {
+	file, err := os.Open(filepath.Join(dirPath, IgnoreFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", IgnoreFileName, err)
+	}
+	defer file.Close()
+
+	base := relPath
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		rule, err := parseIgnoreRule(scanner.Text(), base)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filepath.Join(dirPath, IgnoreFileName), err)
+		}
+		if rule != nil {
+			w.dirRules[base] = append(w.dirRules[base], rule)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", filepath.Join(dirPath, IgnoreFileName), err)
+	}
+	return nil
+}
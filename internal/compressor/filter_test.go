@@ -0,0 +1,206 @@
+package compressor
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+)
+
+func TestFilterPatterns(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  FilterOptions
+		path     string
+		isDir    bool
+		excluded bool
+	}{
+		{name: "unanchored name at top", options: FilterOptions{Excludes: []string{"*.log"}}, path: "app.log", excluded: true},
+		{name: "unanchored name at depth", options: FilterOptions{Excludes: []string{"*.log"}}, path: "a/b/app.log", excluded: true},
+		{name: "star stays in one directory", options: FilterOptions{Excludes: []string{"*.log"}}, path: "a.log/b", excluded: false},
+		{name: "anchored with leading slash", options: FilterOptions{Excludes: []string{"/build"}}, path: "build", isDir: true, excluded: true},
+		{name: "anchored with leading slash below top", options: FilterOptions{Excludes: []string{"/build"}}, path: "src/build", isDir: true, excluded: false},
+		{name: "anchored with inner slash", options: FilterOptions{Excludes: []string{"docs/*.md"}}, path: "docs/a.md", excluded: true},
+		{name: "anchored with inner slash below top", options: FilterOptions{Excludes: []string{"docs/*.md"}}, path: "x/docs/a.md", excluded: false},
+		{name: "anchored star is one level", options: FilterOptions{Excludes: []string{"docs/*.md"}}, path: "docs/sub/a.md", excluded: false},
+		{name: "question mark", options: FilterOptions{Excludes: []string{"file?.txt"}}, path: "file1.txt", excluded: true},
+		{name: "negated class", options: FilterOptions{Excludes: []string{"file[!0-9].txt"}}, path: "file1.txt", excluded: false},
+		{name: "escaped star", options: FilterOptions{Excludes: []string{`\*.txt`}}, path: "a.txt", excluded: false},
+		{name: "escaped star literal", options: FilterOptions{Excludes: []string{`\*.txt`}}, path: "*.txt", excluded: true},
+		{name: "leading double star at top", options: FilterOptions{Excludes: []string{"**/cache"}}, path: "cache", isDir: true, excluded: true},
+		{name: "leading double star at depth", options: FilterOptions{Excludes: []string{"**/cache"}}, path: "a/b/cache", isDir: true, excluded: true},
+		{name: "trailing double star", options: FilterOptions{Excludes: []string{"tmp/**"}}, path: "tmp/a/b.txt", excluded: true},
+		{name: "trailing double star not the directory", options: FilterOptions{Excludes: []string{"tmp/**"}}, path: "tmp", isDir: true, excluded: false},
+		{name: "inner double star without directories", options: FilterOptions{Excludes: []string{"a/**/z.txt"}}, path: "a/z.txt", excluded: true},
+		{name: "inner double star with directories", options: FilterOptions{Excludes: []string{"a/**/z.txt"}}, path: "a/b/c/z.txt", excluded: true},
+		{name: "directory only matches directory", options: FilterOptions{Excludes: []string{"out/"}}, path: "src/out", isDir: true, excluded: true},
+		{name: "directory only skips file", options: FilterOptions{Excludes: []string{"out/"}}, path: "src/out", excluded: false},
+		{name: "negation re-includes", options: FilterOptions{Excludes: []string{"*.log", "!keep.log"}}, path: "keep.log", excluded: false},
+		{name: "negation leaves others", options: FilterOptions{Excludes: []string{"*.log", "!keep.log"}}, path: "drop.log", excluded: true},
+		{name: "last match wins", options: FilterOptions{Excludes: []string{"!keep.log", "*.log"}}, path: "keep.log", excluded: true},
+		{name: "include wins over exclude", options: FilterOptions{Excludes: []string{"*.log"}, Includes: []string{"keep.log"}}, path: "a/keep.log", excluded: false},
+		{name: "comment", options: FilterOptions{Excludes: []string{"#a.txt"}}, path: "#a.txt", excluded: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := NewFilter(tt.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := newFilterWalk(filter).ignored(tt.path, tt.isDir); got != tt.excluded {
+				t.Errorf("ignored(%q) = %v, want %v", tt.path, got, tt.excluded)
+			}
+		})
+	}
+}
+
+func TestWalkSourceFilters(t *testing.T) {
+	old := time.Now().Add(-30 * 24 * time.Hour)
+
+	tests := []struct {
+		name    string
+		options FilterOptions
+		// ignoreFiles maps a directory to the contents of its .cloudsafeignore
+		ignoreFiles map[string]string
+		want        []string
+	}{
+		{
+			name: "no filter",
+			want: []string{"a.log", "big.bin", "old.txt", "src", "src/gen", "src/gen/keep.go", "src/gen/x.go", "src/main.go", "src/sub", "src/sub/b.log"},
+		},
+		{
+			name:    "excluded directory is not walked",
+			options: FilterOptions{Excludes: []string{"gen/"}, Includes: []string{"keep.go"}},
+			want:    []string{"a.log", "big.bin", "old.txt", "src", "src/main.go", "src/sub", "src/sub/b.log"},
+		},
+		{
+			name:        "ignore file at top",
+			ignoreFiles: map[string]string{".": "*.log\n# comment\n\n"},
+			want:        []string{".cloudsafeignore", "big.bin", "old.txt", "src", "src/gen", "src/gen/keep.go", "src/gen/x.go", "src/main.go", "src/sub"},
+		},
+		{
+			name:        "nested ignore file is relative to its directory",
+			ignoreFiles: map[string]string{"src": "/gen/x.go\n/b.log\n"},
+			want:        []string{"a.log", "big.bin", "old.txt", "src", "src/.cloudsafeignore", "src/gen", "src/gen/keep.go", "src/main.go", "src/sub", "src/sub/b.log"},
+		},
+		{
+			name:        "nested ignore file re-includes",
+			ignoreFiles: map[string]string{".": "*.log\n", "src/sub": "!b.log\n"},
+			want:        []string{".cloudsafeignore", "big.bin", "old.txt", "src", "src/gen", "src/gen/keep.go", "src/gen/x.go", "src/main.go", "src/sub", "src/sub/.cloudsafeignore", "src/sub/b.log"},
+		},
+		{
+			name:        "excludes apply after ignore files",
+			options:     FilterOptions{Excludes: []string{"b.log"}},
+			ignoreFiles: map[string]string{"src/sub": "!b.log\n"},
+			want:        []string{"a.log", "big.bin", "old.txt", "src", "src/gen", "src/gen/keep.go", "src/gen/x.go", "src/main.go", "src/sub", "src/sub/.cloudsafeignore"},
+		},
+		{
+			name:    "size limits",
+			options: FilterOptions{MinSize: 2, MaxSize: 1000},
+			want:    []string{"a.log", "old.txt", "src", "src/gen", "src/gen/keep.go", "src/main.go", "src/sub", "src/sub/b.log"},
+		},
+		{
+			name:    "newer than",
+			options: FilterOptions{NewerThan: 7 * 24 * time.Hour},
+			want:    []string{"a.log", "big.bin", "src", "src/gen", "src/gen/keep.go", "src/gen/x.go", "src/main.go", "src/sub", "src/sub/b.log"},
+		},
+		{
+			name:    "older than",
+			options: FilterOptions{OlderThan: 7 * 24 * time.Hour},
+			want:    []string{"old.txt", "src", "src/gen", "src/sub"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := t.TempDir()
+			files := map[string]int{
+				"a.log":           10,
+				"big.bin":         4096,
+				"old.txt":         10,
+				"src/main.go":     10,
+				"src/gen/x.go":    1,
+				"src/gen/keep.go": 10,
+				"src/sub/b.log":   10,
+			}
+			for name, size := range files {
+				path := filepath.Join(source, filepath.FromSlash(name))
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.Chtimes(filepath.Join(source, "old.txt"), old, old); err != nil {
+				t.Fatal(err)
+			}
+			for dir, content := range tt.ignoreFiles {
+				if err := os.WriteFile(filepath.Join(source, filepath.FromSlash(dir), IgnoreFileName), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			filter, err := NewFilter(tt.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			err = WalkSource(source, filter, logger.New(false), func(path, relPath string, info os.FileInfo) error {
+				if relPath != "." {
+					got = append(got, relPath)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("walked %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewFilterRejectsSizeLimits(t *testing.T) {
+	for _, options := range []FilterOptions{
+		{MinSize: -1},
+		{MaxSize: -1},
+		{MinSize: 10, MaxSize: 5},
+	} {
+		if _, err := NewFilter(options); err == nil {
+			t.Errorf("NewFilter(%+v) succeeded", options)
+		}
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		err   bool
+	}{
+		{value: "", want: 0},
+		{value: "36h", want: 36 * time.Hour},
+		{value: "30d", want: 30 * 24 * time.Hour},
+		{value: "2w", want: 14 * 24 * time.Hour},
+		{value: "1.5d", want: 36 * time.Hour},
+		{value: "-1d", err: true},
+		{value: "-5m", err: true},
+		{value: "xd", err: true},
+		{value: "soon", err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseAge(tt.value)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("ParseAge(%q) = %v, %v; want %v, error %v", tt.value, got, err, tt.want, tt.err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package compressor
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"time"
+)
+
+// IndexVersion is the version of the archive index format
+const IndexVersion = 1
+
+// IndexFrameSize is the amount of tar stream after which an indexed archive
+// starts a new compression frame, at the next entry. Extracting one entry
+// decompresses its frame from the start, so smaller frames mean less to
+// download and larger ones compress better.
+const IndexFrameSize = 1024 * 1024
+
+// Index lists the entries of an archive and where they are stored, so the
+// archive can be listed without downloading it and single entries can be
+// extracted by fetching only the frame that holds them
+type Index struct {
+	Version int `json:"version"`
+	// Codec is the compression of the frames; indexes written before it was
+	// recorded leave it empty
+	Codec Codec `json:"codec,omitempty"`
+	// Encryption is the layout of the encrypted archive, or nil when the
+	// archive is not encrypted
+	Encryption *IndexEncryption `json:"encryption,omitempty"`
+	Frames     []IndexFrame     `json:"frames"`
+	Entries    []IndexEntry     `json:"entries"`
+}
+
+// IndexEncryption describes the sealed chunks of an encrypted archive as it
+// was uploaded. Rekeying the archive replaces its header with one of another
+// size, so readers take the header size from the archive itself rather than
+// from HeaderSize or the EncryptedOffset of a frame.
+type IndexEncryption struct {
+	HeaderSize      int64 `json:"header_size"`
+	ChunkSize       int64 `json:"chunk_size"`
+	SealedChunkSize int64 `json:"sealed_chunk_size"`
+}
+
+// IndexFrame is an independently compressed frame of the archive. A frame
+// starts at the start of an entry.
+type IndexFrame struct {
+	// Offset is where the frame starts in the tar stream
+	Offset int64 `json:"offset"`
+	// CompressedOffset is where the frame starts in the archive header and
+	// compressed stream that follows it, which are the plaintext of an
+	// encrypted archive
+	CompressedOffset int64 `json:"compressed_offset"`
+	// EncryptedOffset is where the sealed chunk holding the start of the
+	// frame starts in the stored archive; it equals CompressedOffset when
+	// the archive is not encrypted
+	EncryptedOffset int64 `json:"encrypted_offset"`
+}
+
+// IndexEntry is an entry of the archive
+type IndexEntry struct {
+	Name     string      `json:"name"`
+	Mode     os.FileMode `json:"mode"`
+	Size     int64       `json:"size"`
+	ModTime  time.Time   `json:"mtime"`
+	Linkname string      `json:"linkname,omitempty"`
+	HardLink bool        `json:"hard_link,omitempty"`
+	// Offset and Length locate the entry in the tar stream, from its first
+	// header block to the end of its padded content
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+	// Frame is the frame that holds the entry
+	Frame int `json:"frame"`
+}
+
+// SetEncryption records the layout of the encrypted archive and the offset
+// of the sealed chunk each frame starts in
+func (idx *Index) SetEncryption(encryption *IndexEncryption) {
+	idx.Encryption = encryption
+	for i := range idx.Frames {
+		frame := &idx.Frames[i]
+		chunk := frame.CompressedOffset / encryption.ChunkSize
+		frame.EncryptedOffset = encryption.HeaderSize + chunk*encryption.SealedChunkSize
+	}
+}
+
+// archiveIndex builds the index of the archive being written
+type archiveIndex struct {
+	index *Index
+	// stream counts the tar stream
+	stream *countingWriter
+	// frames splits the compressed stream into frames; without it the
+	// archive is a single frame
+	frames *FrameWriter
+}
+
+// newArchiveIndex starts the index of an archive written to writer
+func newArchiveIndex(writer io.Writer) *archiveIndex {
+	ai := &archiveIndex{
+		index: &Index{
+			Version: IndexVersion,
+			Frames:  []IndexFrame{{}},
+		},
+		stream: &countingWriter{writer: writer},
+	}
+	// The first frame starts after the archive header
+	if ai.frames, _ = writer.(*FrameWriter); ai.frames != nil {
+		_, compressed := ai.frames.Offsets()
+		ai.index.Frames[0].CompressedOffset = compressed
+		ai.index.Frames[0].EncryptedOffset = compressed
+	}
+	return ai
+}
+
+// add records the entry whose header is about to be written. A new frame is
+// started before it once the current frame is large enough, and before any
+// large entry, so small entries are not stuck in the frame of a large one.
+func (ai *archiveIndex) add(tarWriter *tar.Writer, header *tar.Header) error {
+	// Write out the padding of the previous entry
+	if err := tarWriter.Flush(); err != nil {
+		return err
+	}
+	offset := ai.stream.written
+	ai.closeLast(offset)
+
+	current := &ai.index.Frames[len(ai.index.Frames)-1]
+	if ai.frames != nil && offset > current.Offset && (offset-current.Offset >= IndexFrameSize || header.Size >= IndexFrameSize) {
+		if err := ai.frames.NewFrame(); err != nil {
+			return err
+		}
+		_, compressed := ai.frames.Offsets()
+		ai.index.Frames = append(ai.index.Frames, IndexFrame{
+			Offset:           offset,
+			CompressedOffset: compressed,
+			EncryptedOffset:  compressed,
+		})
+	}
+
+	ai.index.Entries = append(ai.index.Entries, IndexEntry{
+		Name:     header.Name,
+		Mode:     header.FileInfo().Mode(),
+		Size:     header.Size,
+		ModTime:  header.ModTime,
+		Linkname: header.Linkname,
+		HardLink: header.Typeflag == tar.TypeLink,
+		Offset:   offset,
+		Frame:    len(ai.index.Frames) - 1,
+	})
+	return nil
+}
+
+// finish ends the last entry; nothing written after it belongs to an entry
+func (ai *archiveIndex) finish(tarWriter *tar.Writer) error {
+	if err := tarWriter.Flush(); err != nil {
+		return err
+	}
+	ai.closeLast(ai.stream.written)
+	return nil
+}
+
+// closeLast sets the length of the last entry, which ends at offset
+func (ai *archiveIndex) closeLast(offset int64) {
+	if n := len(ai.index.Entries); n > 0 {
+		last := &ai.index.Entries[n-1]
+		last.Length = offset - last.Offset
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package compressor
+
+import (
+	"os"
+)
+
+// fileIdentity is not available on this platform, so hard links are archived
+// as separate files
+func fileIdentity(info os.FileInfo) (fileID, uint64, bool) {
+	return fileID{}, 0, false
+}
+
+// allocatedSize returns the size of a file; sparse files are not detected on
+// this platform
+func allocatedSize(info os.FileInfo) int64 {
+	return info.Size()
+}
@@ -0,0 +1,27 @@
+//go:build unix
+
+package compressor
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileIdentity returns the device and inode of a file and its number of links
+func fileIdentity(info os.FileInfo) (fileID, uint64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, 0, false
+	}
+	return fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, uint64(stat.Nlink), true
+}
+
+// allocatedSize returns the size a file takes on disk, which is less than
+// its size when the file is sparse
+func allocatedSize(info os.FileInfo) int64 {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Blocks*512 >= info.Size() {
+		return info.Size()
+	}
+	return stat.Blocks * 512
+}
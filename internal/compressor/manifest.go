@@ -0,0 +1,143 @@
+package compressor
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// ManifestVersion is the version of the manifest and snapshot formats
+const ManifestVersion = 1
+
+// Entries of archives made in incremental mode. They are read by the
+// extractor and never written to the target directory.
+const (
+	// SnapshotEntryName is the first entry; it names the parent archive
+	SnapshotEntryName = ".cloudsafe/snapshot.json"
+	// DeletionsEntryName is the last entry of an incremental archive; it
+	// lists the entries of the parent's tree that no longer exist
+	DeletionsEntryName = ".cloudsafe/deleted.json"
+)
+
+// Manifest records the tree archived by a backup, so the next backup can
+// archive only what changed
+type Manifest struct {
+	Version int `json:"version"`
+	// Archive is the name the backup was stored under
+	Archive string `json:"archive"`
+	// Parent is the archive this one is incremental to; empty for a full backup
+	Parent string `json:"parent,omitempty"`
+	// Files holds the archived entries by their name in the archive
+	Files map[string]*ManifestEntry `json:"files"`
+}
+
+// ManifestEntry describes one archived entry
+type ManifestEntry struct {
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"mtime"`
+	Mode    os.FileMode `json:"mode"`
+	Inode   uint64      `json:"inode,omitempty"`
+	// SHA256 is the hash of the content of regular files; the holes of
+	// sparse files count as the zeros they read as.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// Snapshot is the content of the snapshot entry
+type Snapshot struct {
+	Version int    `json:"version"`
+	Parent  string `json:"parent,omitempty"`
+}
+
+// newManifestEntry describes the entry with info
+func newManifestEntry(info os.FileInfo) *ManifestEntry {
+	entry := &ManifestEntry{
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Mode:    info.Mode(),
+	}
+	if id, _, ok := fileIdentity(info); ok {
+		entry.Inode = id.ino
+	}
+	return entry
+}
+
+// unchanged reports whether the entry named name was archived by the backup
+// of m and has not changed since. Directories are always archived again.
+func (m *Manifest) unchanged(name string, info os.FileInfo) bool {
+	previous := m.Files[name]
+	if previous == nil || info.IsDir() {
+		return false
+	}
+	current := newManifestEntry(info)
+	return previous.Size == current.Size &&
+		previous.ModTime.Equal(current.ModTime) &&
+		previous.Mode == current.Mode &&
+		previous.Inode == current.Inode
+}
+
+// deleted returns the sorted names of the entries of m that current does
+// not have
+func (m *Manifest) deleted(current *Manifest) []string {
+	names := []string{}
+	for name := range m.Files {
+		if _, ok := current.Files[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// writeMetadataEntry writes v as a JSON entry of the archive. The entry has a
+// fixed time so the archive stream can be regenerated exactly.
+func writeMetadataEntry(tarWriter *tar.Writer, name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", name, err)
+	}
+
+	header := &tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0600,
+		Size:     int64(len(data)),
+		ModTime:  time.Unix(0, 0),
+	}
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write tar header for %s: %w", name, err)
+	}
+	if _, err := tarWriter.Write(data); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
+}
+
+// ReadSnapshot reads the snapshot entry at the start of a tar stream. It
+// returns nil without an error when the archive was not made in incremental
+// mode.
+func ReadSnapshot(reader io.Reader) (*Snapshot, error) {
+	tarReader := tar.NewReader(reader)
+	header, err := tarReader.Next()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tar header: %w", err)
+	}
+	if header.Name != SnapshotEntryName {
+		return nil, nil
+	}
+
+	var snapshot Snapshot
+	if err := json.NewDecoder(tarReader).Decode(&snapshot); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", SnapshotEntryName, err)
+	}
+	if snapshot.Version > ManifestVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", snapshot.Version)
+	}
+	return &snapshot, nil
+}
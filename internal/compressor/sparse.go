@@ -0,0 +1,270 @@
+package compressor
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// blockSize is the size of a tar block
+const blockSize = 512
+
+// holeSize is the granularity at which restored sparse files skip zeros
+const holeSize = 4096
+
+// paxSparsePrefix prefixes the PAX records of GNU sparse entries
+const paxSparsePrefix = "GNU.sparse."
+
+// sparseEntry is a region of a file that holds data
+type sparseEntry struct {
+	offset int64
+	length int64
+}
+
+// writeSparse writes a regular file whose data is only in regions as a GNU
+// PAX 1.0 sparse entry, the format GNU tar writes with --sparse and
+// archive/tar reads. The holes between the regions take no space in the
+// archive. tar.Writer drops the GNU.sparse records this format needs, so the
+// entry is encoded here and written to raw once the previous entry has been
+// flushed. When hash is not nil the whole content of the file is written to
+// it, holes included as the zeros they read as.
+func writeSparse(tarWriter *tar.Writer, raw io.Writer, header *tar.Header, file *os.File, regions []sparseEntry, hash io.Writer) error {
+	if err := tarWriter.Flush(); err != nil {
+		return err
+	}
+
+	// The data starts with the sparse map: the number of regions and the
+	// offset and length of each, padded to a whole block. A file that ends
+	// in a hole ends with an empty region at its size.
+	if len(regions) == 0 || regions[len(regions)-1].offset+regions[len(regions)-1].length < header.Size {
+		regions = append(regions, sparseEntry{offset: header.Size})
+	}
+	var sparseMap bytes.Buffer
+	fmt.Fprintf(&sparseMap, "%d\n", len(regions))
+	var dataSize int64
+	for _, region := range regions {
+		fmt.Fprintf(&sparseMap, "%d\n%d\n", region.offset, region.length)
+		dataSize += region.length
+	}
+	sparseMap.Write(make([]byte, padding(int64(sparseMap.Len()))))
+	size := int64(sparseMap.Len()) + dataSize
+
+	records := map[string]string{
+		paxSparsePrefix + "major":    "1",
+		paxSparsePrefix + "minor":    "0",
+		paxSparsePrefix + "name":     header.Name,
+		paxSparsePrefix + "realsize": strconv.FormatInt(header.Size, 10),
+	}
+	for key, value := range header.PAXRecords {
+		records[key] = value
+	}
+
+	// Values that do not fit the ustar header go into the PAX records
+	fields := map[string]int64{"size": size, "uid": int64(header.Uid), "gid": int64(header.Gid), "mtime": header.ModTime.Unix()}
+	widths := map[string]int{"size": 12, "uid": 8, "gid": 8, "mtime": 12}
+	for key, value := range fields {
+		if !fitsOctal(value, widths[key]) {
+			records[key] = strconv.FormatInt(value, 10)
+			fields[key] = 0
+		}
+	}
+	if len(header.Uname) > 32 {
+		records["uname"] = header.Uname
+	}
+	if len(header.Gname) > 32 {
+		records["gname"] = header.Gname
+	}
+
+	paxData := formatPAXRecords(records)
+	base := path.Base(header.Name)
+
+	var blocks bytes.Buffer
+	blocks.Write(ustarBlock(ustarHeader{
+		name:     "PaxHeaders.0/" + base,
+		mode:     0644,
+		size:     int64(len(paxData)),
+		mtime:    fields["mtime"],
+		typeflag: tar.TypeXHeader,
+	}))
+	blocks.WriteString(paxData)
+	blocks.Write(make([]byte, padding(int64(len(paxData)))))
+	blocks.Write(ustarBlock(ustarHeader{
+		name:     "GNUSparseFile.0/" + base,
+		mode:     header.Mode & 07777,
+		uid:      fields["uid"],
+		gid:      fields["gid"],
+		size:     fields["size"],
+		mtime:    fields["mtime"],
+		typeflag: tar.TypeReg,
+		uname:    header.Uname,
+		gname:    header.Gname,
+	}))
+	blocks.Write(sparseMap.Bytes())
+	if _, err := raw.Write(blocks.Bytes()); err != nil {
+		return err
+	}
+
+	var content io.Reader = file
+	if hash != nil {
+		content = io.TeeReader(file, hash)
+	}
+	var offset int64
+	for _, region := range regions {
+		if hash != nil {
+			writeZeros(hash, region.offset-offset)
+		}
+		if _, err := file.Seek(region.offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(raw, content, region.length); err != nil {
+			return err
+		}
+		offset = region.offset + region.length
+	}
+	_, err := raw.Write(make([]byte, padding(dataSize)))
+	return err
+}
+
+// writeZeros writes length zero bytes to writer
+func writeZeros(writer io.Writer, length int64) {
+	zeros := make([]byte, min(length, 64*1024))
+	for length > 0 {
+		n := min(length, int64(len(zeros)))
+		writer.Write(zeros[:n])
+		length -= n
+	}
+}
+
+// ustarHeader holds the fields of a ustar header block
+type ustarHeader struct {
+	name     string
+	mode     int64
+	uid      int64
+	gid      int64
+	size     int64
+	mtime    int64
+	typeflag byte
+	uname    string
+	gname    string
+}
+
+// ustarBlock encodes h as a ustar header block. Names are truncated; the
+// full values are carried in PAX records.
+func ustarBlock(h ustarHeader) []byte {
+	block := make([]byte, blockSize)
+	copy(block[0:100], h.name)
+	putOctal(block[100:108], h.mode)
+	putOctal(block[108:116], h.uid)
+	putOctal(block[116:124], h.gid)
+	putOctal(block[124:136], h.size)
+	putOctal(block[136:148], h.mtime)
+	block[156] = h.typeflag
+	copy(block[257:263], "ustar\x00")
+	copy(block[263:265], "00")
+	copy(block[265:297], h.uname)
+	copy(block[297:329], h.gname)
+
+	// The checksum is computed with its own field filled with spaces
+	copy(block[148:156], "        ")
+	var sum int64
+	for _, b := range block {
+		sum += int64(b)
+	}
+	putOctal(block[148:155], sum)
+	return block
+}
+
+// putOctal writes value as a NUL-terminated octal number filling field
+func putOctal(field []byte, value int64) {
+	copy(field, fmt.Sprintf("%0*o", len(field)-1, value))
+	field[len(field)-1] = 0
+}
+
+// fitsOctal reports whether value fits a ustar octal field of width bytes
+func fitsOctal(value int64, width int) bool {
+	return value >= 0 && value < 1<<(3*(width-1))
+}
+
+// formatPAXRecords encodes PAX records, sorted so the archive stream is the
+// same every time it is generated
+func formatPAXRecords(records map[string]string) string {
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		// Each record starts with its own length, including the length digits
+		record := fmt.Sprintf(" %s=%s\n", key, records[key])
+		size := len(record) + len(strconv.Itoa(len(record)))
+		if len(strconv.Itoa(size)) != len(strconv.Itoa(len(record))) {
+			size++
+		}
+		b.WriteString(strconv.Itoa(size) + record)
+	}
+	return b.String()
+}
+
+// padding returns the number of bytes that fill size up to a whole block
+func padding(size int64) int64 {
+	return -size & (blockSize - 1)
+}
+
+// isSparse reports whether an archive entry was stored as a sparse file
+func isSparse(header *tar.Header) bool {
+	if header.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range header.PAXRecords {
+		if strings.HasPrefix(key, paxSparsePrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// sparseWriter writes a file, leaving holes where whole blocks are zero
+type sparseWriter struct {
+	file   *os.File
+	offset int64
+}
+
+// Write writes p at the current offset, skipping over zero blocks
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// Work in blocks aligned to the file so skipped blocks become holes
+		n := holeSize - int(w.offset%holeSize)
+		if n > len(p) {
+			n = len(p)
+		}
+		chunk := p[:n]
+		if !isZero(chunk) {
+			if _, err := w.file.WriteAt(chunk, w.offset); err != nil {
+				return written, err
+			}
+		}
+		w.offset += int64(n)
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// isZero reports whether data only holds zero bytes
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,55 @@
+package compressor
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// dataRegions returns the regions of a sparse file that hold data, found with
+// SEEK_DATA and SEEK_HOLE. It returns nil for a file without holes.
+func dataRegions(file *os.File, size int64) ([]sparseEntry, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// Only a file with fewer blocks than its size can have holes
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || stat.Blocks*512 >= size {
+		return nil, nil
+	}
+
+	regions := []sparseEntry{}
+	for offset := int64(0); offset < size; {
+		data, err := file.Seek(offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// The rest of the file is a hole
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if data >= size {
+			break
+		}
+		hole, err := file.Seek(data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		if hole > size {
+			hole = size
+		}
+		regions = append(regions, sparseEntry{offset: data, length: hole - data})
+		offset = hole
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if len(regions) == 1 && regions[0].offset == 0 && regions[0].length == size {
+		return nil, nil
+	}
+	return regions, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package compressor
+
+import (
+	"os"
+)
+
+// dataRegions is not available on this platform, so sparse files are
+// archived with their holes
+func dataRegions(file *os.File, size int64) ([]sparseEntry, error) {
+	return nil, nil
+}
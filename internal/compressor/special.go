@@ -0,0 +1,46 @@
+package compressor
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errUnsupported is returned for file metadata this platform cannot restore
+var errUnsupported = errors.New("not supported on this platform")
+
+// SpecialFilePolicy decides how device files, FIFOs and sockets found in
+// source directories are handled
+type SpecialFilePolicy string
+
+const (
+	// SpecialArchive stores device files and FIFOs as tar entries. Sockets
+	// cannot be stored in a tar archive and are skipped with a message.
+	SpecialArchive SpecialFilePolicy = "archive"
+	// SpecialSkip leaves device files, FIFOs and sockets out of the archive
+	SpecialSkip SpecialFilePolicy = "skip"
+	// SpecialFail stops the backup at the first device file, FIFO or socket
+	SpecialFail SpecialFilePolicy = "fail"
+)
+
+// ParseSpecialFilePolicy returns the special file policy for name. An empty
+// name selects SpecialArchive.
+func ParseSpecialFilePolicy(name string) (SpecialFilePolicy, error) {
+	switch SpecialFilePolicy(name) {
+	case "", SpecialArchive:
+		return SpecialArchive, nil
+	case SpecialSkip, SpecialFail:
+		return SpecialFilePolicy(name), nil
+	default:
+		return "", fmt.Errorf("unsupported special file policy: %s (use archive, skip or fail)", name)
+	}
+}
+
+// paxXattrPrefix prefixes the PAX records that hold extended attributes, as
+// written by GNU tar and bsdtar
+const paxXattrPrefix = "SCHILY.xattr."
+
+// fileID identifies a file on disk so hard links to it can be recognised
+type fileID struct {
+	dev uint64
+	ino uint64
+}
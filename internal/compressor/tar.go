@@ -3,7 +3,10 @@ package compressor
 import (
 	"archive/tar"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
@@ -14,19 +17,78 @@ import (
 
 // TarCompressor handles streaming compression of directories
 type TarCompressor struct {
-	logger *logger.Logger
+	logger  *logger.Logger
+	filter  *Filter
+	special SpecialFilePolicy
+
+	// In incremental mode Compress records a manifest of the archived tree
+	// and leaves out what is unchanged since base
+	incremental bool
+	base        *Manifest
+	manifest    *Manifest
+
+	// With indexing Compress records where every entry is in the archive
+	indexed bool
+	index   *Index
 }
 
 // NewTarCompressor creates a new tar compressor
 func NewTarCompressor(log *logger.Logger) *TarCompressor {
 	return &TarCompressor{
-		logger: log,
+		logger:  log,
+		special: SpecialArchive,
 	}
 }
 
+// SetFilter selects the files archived from source directories; a nil filter
+// archives everything. Files given directly as sources are always archived.
+func (tc *TarCompressor) SetFilter(filter *Filter) {
+	tc.filter = filter
+}
+
+// SetSpecialFilePolicy sets how device files, FIFOs and sockets are handled
+func (tc *TarCompressor) SetSpecialFilePolicy(policy SpecialFilePolicy) {
+	tc.special = policy
+}
+
+// SetIncremental makes Compress record a manifest of the archived tree and
+// add the entries that restore uses to apply an archive on top of its
+// parent. With a base manifest only entries that are new or changed since
+// base are archived; with a nil base everything is, starting a new chain.
+func (tc *TarCompressor) SetIncremental(base *Manifest) {
+	tc.incremental = true
+	tc.base = base
+}
+
+// Manifest returns the manifest recorded by the last call to Compress in
+// incremental mode. Its Archive is left for the caller to fill in.
+func (tc *TarCompressor) Manifest() *Manifest {
+	return tc.manifest
+}
+
+// SetIndexed makes Compress record an index of the archive. When the writer
+// passed to Compress is a FrameWriter, the compressed stream is split into
+// frames at entry boundaries so entries can be extracted on their own.
+func (tc *TarCompressor) SetIndexed(indexed bool) {
+	tc.indexed = indexed
+}
+
+// Index returns the index recorded by the last call to Compress with
+// indexing enabled. The caller adds the encryption layout, if any.
+func (tc *TarCompressor) Index() *Index {
+	return tc.index
+}
+
 // Compress compresses multiple sources (files or directories) to a tar stream
 func (tc *TarCompressor) Compress(ctx context.Context, sourcePaths []string, writer io.Writer) error {
 	tc.logger.Debug("Starting compression")
+	var index *archiveIndex
+	if tc.indexed {
+		index = newArchiveIndex(writer)
+		tc.index = index.index
+		writer = index.stream
+	}
+
 	tarWriter := tar.NewWriter(writer)
 	defer func() {
 		tc.logger.Debug("Closing tar writer")
@@ -34,6 +96,29 @@ func (tc *TarCompressor) Compress(ctx context.Context, sourcePaths []string, wri
 		tc.logger.Debug("Tar writer closed")
 	}()
 
+	aw := &archiveWriter{
+		tar:   tarWriter,
+		raw:   writer,
+		links: make(map[fileID]string),
+		index: index,
+	}
+
+	if tc.incremental {
+		snapshot := Snapshot{Version: ManifestVersion}
+		if tc.base != nil {
+			snapshot.Parent = tc.base.Archive
+		}
+		tc.manifest = &Manifest{
+			Version: ManifestVersion,
+			Parent:  snapshot.Parent,
+			Files:   make(map[string]*ManifestEntry),
+		}
+		aw.manifest = tc.manifest
+		if err := writeMetadataEntry(tarWriter, SnapshotEntryName, &snapshot); err != nil {
+			return err
+		}
+	}
+
 	// Process each source path
 	for _, sourcePath := range sourcePaths {
 		select {
@@ -52,11 +137,11 @@ func (tc *TarCompressor) Compress(ctx context.Context, sourcePaths []string, wri
 		if info.IsDir() {
 			// Handle directory
 			tc.logger.Debugf("Compressing directory: %s", sourcePath)
-			err = tc.compressDirectory(ctx, sourcePath, tarWriter)
+			err = tc.compressDirectory(ctx, sourcePath, aw)
 		} else {
 			// Handle single file
 			tc.logger.Debugf("Compressing file: %s", sourcePath)
-			err = tc.compressFile(ctx, sourcePath, info, tarWriter)
+			err = tc.compressFile(ctx, sourcePath, info, aw)
 		}
 
 		if err != nil {
@@ -64,13 +149,40 @@ func (tc *TarCompressor) Compress(ctx context.Context, sourcePaths []string, wri
 		}
 	}
 
+	if aw.index != nil {
+		if err := aw.index.finish(tarWriter); err != nil {
+			return err
+		}
+	}
+
+	// Restore deletes what was deleted since the parent
+	if tc.base != nil {
+		if err := writeMetadataEntry(tarWriter, DeletionsEntryName, tc.base.deleted(tc.manifest)); err != nil {
+			return err
+		}
+	}
+
 	tc.logger.Debug("Compression completed successfully")
 	return nil
 }
 
+// archiveWriter is the tar stream being written
+type archiveWriter struct {
+	tar *tar.Writer
+	// raw is the writer under tar, for entries tar.Writer cannot encode
+	raw io.Writer
+	// links holds the names of archived files by inode, so hard links are
+	// stored once
+	links map[fileID]string
+	// manifest records the archived tree in incremental mode
+	manifest *Manifest
+	// index records where entries are when indexing
+	index *archiveIndex
+}
+
 // compressDirectory compresses a directory recursively
-func (tc *TarCompressor) compressDirectory(ctx context.Context, sourcePath string, tarWriter *tar.Writer) error {
-	return filepath.Walk(sourcePath, func(path string, info os.FileInfo, err error) error {
+func (tc *TarCompressor) compressDirectory(ctx context.Context, sourcePath string, aw *archiveWriter) error {
+	return tc.walkSource(sourcePath, func(path, relPath string, info os.FileInfo) error {
 		// Check for context cancellation
 		select {
 		case <-ctx.Done():
@@ -78,58 +190,233 @@ func (tc *TarCompressor) compressDirectory(ctx context.Context, sourcePath strin
 		default:
 		}
 
-		if err != nil {
-			tc.logger.Errorf("Error walking path %s: %v", path, err)
-			return err
+		name := archiveName(sourcePath, relPath)
+		if !tc.record(aw, name, info) {
+			return nil
 		}
 
 		// Create tar header
-		header, err := tar.FileInfoHeader(info, "")
-		if err != nil {
-			return fmt.Errorf("failed to create tar header for %s: %w", path, err)
+		header, err := tc.header(path, name, info, aw.links)
+		if err != nil || header == nil {
+			return err
 		}
 
-		// Set the name to be relative to source path
-		relPath, err := filepath.Rel(sourcePath, path)
-		if err != nil {
-			return fmt.Errorf("failed to get relative path for %s: %w", path, err)
-		}
-		
-		// Use the directory name as prefix for better organization
-		dirName := filepath.Base(sourcePath)
-		if relPath == "." {
-			header.Name = dirName + "/"
-		} else {
-			header.Name = dirName + "/" + strings.ReplaceAll(relPath, string(filepath.Separator), "/")
+		return tc.writeEntry(aw, path, header)
+	})
+}
+
+// archiveName returns the name in the archive of the entry at relPath in the
+// source directory sourcePath
+func archiveName(sourcePath, relPath string) string {
+	// Use the directory name as prefix for better organization
+	name := filepath.Base(sourcePath) + "/"
+	if relPath != "." {
+		name += relPath
+	}
+	return name
+}
+
+// record adds the entry named name to the manifest in incremental mode and
+// reports whether it has to be archived, which it does unless it is
+// unchanged since the base manifest
+func (tc *TarCompressor) record(aw *archiveWriter, name string, info os.FileInfo) bool {
+	if aw.manifest == nil {
+		return true
+	}
+
+	entry := newManifestEntry(info)
+	aw.manifest.Files[name] = entry
+	if tc.base != nil && tc.base.unchanged(name, info) {
+		entry.SHA256 = tc.base.Files[name].SHA256
+		tc.logger.Debugf("Unchanged since %s: %s", tc.base.Archive, name)
+		return false
+	}
+	return true
+}
+
+// writeEntry writes header and, for a regular file, the content of the file
+// at path. Sparse files are written as sparse entries, without their holes.
+func (tc *TarCompressor) writeEntry(aw *archiveWriter, path string, header *tar.Header) error {
+	if aw.index != nil {
+		if err := aw.index.add(aw.tar, header); err != nil {
+			return fmt.Errorf("failed to write tar header for %s: %w", path, err)
 		}
+	}
 
-		// Write header
-		if err := tarWriter.WriteHeader(header); err != nil {
+	// Only regular files have content
+	if header.Typeflag != tar.TypeReg {
+		if err := aw.tar.WriteHeader(header); err != nil {
 			return fmt.Errorf("failed to write tar header for %s: %w", path, err)
 		}
+		// A hard link has the content of the file it links to
+		if header.Typeflag == tar.TypeLink && aw.manifest != nil {
+			if first := aw.manifest.Files[header.Linkname]; first != nil {
+				aw.manifest.Files[header.Name].SHA256 = first.SHA256
+			}
+		}
+		return nil
+	}
 
-		// Write file content if it's a regular file
-		if info.Mode().IsRegular() {
-			file, err := os.Open(path)
-			if err != nil {
-				return fmt.Errorf("failed to open file %s: %w", path, err)
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	regions, err := dataRegions(file, header.Size)
+	if err != nil {
+		tc.logger.Debugf("Failed to find the holes of %s: %v", path, err)
+		regions = nil
+	}
+	if regions != nil {
+		tc.logger.Debugf("Compressing sparse file: %s (%d data regions)", header.Name, len(regions))
+		// Hash the content for the manifest like that of any other file
+		var contentHash hash.Hash
+		if aw.manifest != nil {
+			contentHash = sha256.New()
+		}
+		if err := writeSparse(aw.tar, aw.raw, header, file, regions, contentHash); err != nil {
+			return fmt.Errorf("failed to copy file content for %s: %w", path, err)
+		}
+		if aw.manifest != nil {
+			aw.manifest.Files[header.Name].SHA256 = hex.EncodeToString(contentHash.Sum(nil))
+		}
+		return nil
+	}
+
+	if err := aw.tar.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write tar header for %s: %w", path, err)
+	}
+
+	tc.logger.Debugf("Compressing file: %s", header.Name)
+
+	// Hash the content on its way into the archive for the manifest
+	var content io.Reader = file
+	hash := sha256.New()
+	if aw.manifest != nil {
+		content = io.TeeReader(file, hash)
+	}
+
+	// Stream file content with buffered copy
+	if _, err := io.Copy(aw.tar, content); err != nil {
+		return fmt.Errorf("failed to copy file content for %s: %w", path, err)
+	}
+	if aw.manifest != nil {
+		aw.manifest.Files[header.Name].SHA256 = hex.EncodeToString(hash.Sum(nil))
+	}
+	return nil
+}
+
+// header creates the tar header of the source entry at path, stored in the
+// archive as name. Symlinks keep their target, a file already archived under
+// another hard link becomes a link to that entry, and extended attributes are
+// added as PAX records. A nil header means the entry is skipped.
+func (tc *TarCompressor) header(path, name string, info os.FileInfo, links map[fileID]string) (*tar.Header, error) {
+	mode := info.Mode()
+
+	// Sockets cannot be represented in a tar archive
+	if mode&os.ModeSocket != 0 {
+		if tc.special == SpecialFail {
+			return nil, fmt.Errorf("%s is a socket, which cannot be archived", path)
+		}
+		tc.logger.Infof("Skipping socket %s", path)
+		return nil, nil
+	}
+	if mode&(os.ModeDevice|os.ModeNamedPipe) != 0 {
+		switch tc.special {
+		case SpecialFail:
+			return nil, fmt.Errorf("%s is a device file or FIFO", path)
+		case SpecialSkip:
+			tc.logger.Debugf("Skipping special file %s", path)
+			return nil, nil
+		}
+	}
+
+	var link string
+	if mode&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read symlink %s: %w", path, err)
+		}
+		link = target
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tar header for %s: %w", path, err)
+	}
+	header.Name = name
+
+	if mode.IsRegular() {
+		if id, nlink, ok := fileIdentity(info); ok && nlink > 1 {
+			if first, seen := links[id]; seen {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = first
+				header.Size = 0
+			} else {
+				links[id] = name
+			}
+		}
+	}
+
+	// Extended attributes belong to the inode, which a hard link shares
+	if header.Typeflag != tar.TypeLink {
+		xattrs, err := readXattrs(path)
+		if err != nil {
+			tc.logger.Debugf("Failed to read extended attributes of %s: %v", path, err)
+		}
+		for key, value := range xattrs {
+			if header.PAXRecords == nil {
+				header.PAXRecords = make(map[string]string)
 			}
-			defer file.Close()
+			header.PAXRecords[paxXattrPrefix+key] = value
+		}
+	}
+
+	return header, nil
+}
+
+// walkSource walks a source directory with the filter of the compressor
+func (tc *TarCompressor) walkSource(sourcePath string, fn func(path, relPath string, info os.FileInfo) error) error {
+	return WalkSource(sourcePath, tc.filter, tc.logger, fn)
+}
 
-			tc.logger.Debugf("Compressing file: %s", header.Name)
+// WalkSource walks a source directory and calls fn for every entry filter
+// selects, with its slash-separated path relative to sourcePath. Excluded
+// directories are not walked; a nil filter selects everything.
+func WalkSource(sourcePath string, filter *Filter, log *logger.Logger, fn func(path, relPath string, info os.FileInfo) error) error {
+	walk := newFilterWalk(filter)
+	return filepath.Walk(sourcePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Errorf("Error walking path %s: %v", path, err)
+			return err
+		}
+
+		// Set the name to be relative to source path
+		relPath, err := filepath.Rel(sourcePath, path)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path for %s: %w", path, err)
+		}
+		relPath = filepath.ToSlash(relPath)
 
-			// Stream file content with buffered copy
-			if _, err := io.Copy(tarWriter, file); err != nil {
-				return fmt.Errorf("failed to copy file content for %s: %w", path, err)
+		selected, err := walk.selected(path, relPath, info)
+		if err != nil {
+			return err
+		}
+		if !selected {
+			log.Debugf("Excluding %s", path)
+			if info.IsDir() {
+				return filepath.SkipDir
 			}
+			return nil
 		}
 
-		return nil
+		return fn(path, relPath, info)
 	})
 }
 
 // compressFile compresses a single file
-func (tc *TarCompressor) compressFile(ctx context.Context, filePath string, info os.FileInfo, tarWriter *tar.Writer) error {
+func (tc *TarCompressor) compressFile(ctx context.Context, filePath string, info os.FileInfo, aw *archiveWriter) error {
 	// Check for context cancellation
 	select {
 	case <-ctx.Done():
@@ -137,53 +424,56 @@ func (tc *TarCompressor) compressFile(ctx context.Context, filePath string, info
 	default:
 	}
 
-	// Create tar header
-	header, err := tar.FileInfoHeader(info, "")
-	if err != nil {
-		return fmt.Errorf("failed to create tar header for %s: %w", filePath, err)
-	}
-
-	// Use just the filename for single files
-	header.Name = filepath.Base(filePath)
-
-	// Write header
-	if err := tarWriter.WriteHeader(header); err != nil {
-		// Check if this is a broken pipe error (expected when upload completes early)
-		if strings.Contains(err.Error(), "broken pipe") || strings.Contains(err.Error(), "closed pipe") {
-			tc.logger.Debug("Pipe closed during header write - upload likely completed")
-			return nil
-		}
-		return fmt.Errorf("failed to write tar header for %s: %w", filePath, err)
+	// Create tar header, using just the filename for single files
+	name := filepath.Base(filePath)
+	if !tc.record(aw, name, info) {
+		return nil
 	}
-
-	// Write file content
-	tc.logger.Debugf("Opening file: %s", filePath)
-	file, err := os.Open(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to open file %s: %w", filePath, err)
+	header, err := tc.header(filePath, name, info, aw.links)
+	if err != nil || header == nil {
+		return err
 	}
-	defer file.Close()
 
-	tc.logger.Debugf("About to copy file content: %s", header.Name)
+	tc.logger.Debugf("About to write file: %s", header.Name)
 
-	// Stream file content with buffered copy
-	if _, err := io.Copy(tarWriter, file); err != nil {
+	if err := tc.writeEntry(aw, filePath, header); err != nil {
 		// Check if this is a broken pipe error (expected when upload completes early)
 		if strings.Contains(err.Error(), "broken pipe") || strings.Contains(err.Error(), "closed pipe") {
 			tc.logger.Debug("Pipe closed during compression - upload likely completed")
 			return nil
 		}
-		return fmt.Errorf("failed to copy file content for %s: %w", filePath, err)
+		return err
 	}
 
-	tc.logger.Debugf("Finished copying file content: %s", header.Name)
+	tc.logger.Debugf("Finished writing file: %s", header.Name)
 	return nil
 }
 
-// EstimateSize estimates the total size of files to be compressed
+// EstimateSize estimates the total size of files to be compressed. Sparse
+// files count with the size allocated on disk, and in incremental mode files
+// unchanged since the base manifest are not counted.
 func (tc *TarCompressor) EstimateSize(sourcePaths []string) (int64, error) {
 	var totalSize int64
 
+	// Hard links are archived once
+	seen := make(map[fileID]bool)
+	add := func(name string, info os.FileInfo) {
+		if !info.Mode().IsRegular() {
+			return
+		}
+		if tc.base != nil && tc.base.unchanged(name, info) {
+			return
+		}
+		if id, nlink, ok := fileIdentity(info); ok && nlink > 1 {
+			if seen[id] {
+				return
+			}
+			seen[id] = true
+		}
+		// Holes of sparse files are not archived
+		totalSize += allocatedSize(info)
+	}
+
 	for _, sourcePath := range sourcePaths {
 		info, err := os.Stat(sourcePath)
 		if err != nil {
@@ -191,16 +481,9 @@ func (tc *TarCompressor) EstimateSize(sourcePaths []string) (int64, error) {
 		}
 
 		if info.IsDir() {
-			// Walk directory and sum file sizes
-			err = filepath.Walk(sourcePath, func(path string, info os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
-
-				if info.Mode().IsRegular() {
-					totalSize += info.Size()
-				}
-
+			// Walk directory and sum the sizes of the files that will be archived
+			err = tc.walkSource(sourcePath, func(path, relPath string, info os.FileInfo) error {
+				add(archiveName(sourcePath, relPath), info)
 				return nil
 			})
 			if err != nil {
@@ -208,7 +491,7 @@ func (tc *TarCompressor) EstimateSize(sourcePaths []string) (int64, error) {
 			}
 		} else {
 			// Single file
-			totalSize += info.Size()
+			add(filepath.Base(sourcePath), info)
 		}
 	}
 
@@ -0,0 +1,86 @@
+package compressor
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+)
+
+func TestManifestHashesSparseFiles(t *testing.T) {
+	source := t.TempDir()
+
+	tests := []struct {
+		name  string
+		write func(file *os.File) error
+	}{
+		{name: "data between holes", write: func(file *os.File) error {
+			if _, err := file.WriteAt(bytes.Repeat([]byte("data"), 2000), 1<<20); err != nil {
+				return err
+			}
+			return file.Truncate(4 << 20)
+		}},
+		{name: "hole only", write: func(file *os.File) error {
+			return file.Truncate(1 << 20)
+		}},
+		{name: "data at the end", write: func(file *os.File) error {
+			_, err := file.WriteAt([]byte("tail"), 2<<20)
+			return err
+		}},
+	}
+
+	for _, tt := range tests {
+		file, err := os.Create(filepath.Join(source, tt.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		if err := tt.write(file); err != nil {
+			t.Fatal(err)
+		}
+		if regions, _ := dataRegions(file, mustSize(t, file)); regions == nil {
+			t.Skip("the file system does not report holes")
+		}
+	}
+
+	compressor := NewTarCompressor(logger.New(false).Quiet())
+	compressor.SetIncremental(nil)
+	if err := compressor.Compress(context.Background(), []string{source}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	manifest := compressor.Manifest()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, err := os.ReadFile(filepath.Join(source, tt.name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sum := sha256.Sum256(content)
+
+			entry := manifest.Files[archiveName(source, tt.name)]
+			if entry == nil {
+				t.Fatal("file is missing from the manifest")
+			}
+			if want := hex.EncodeToString(sum[:]); entry.SHA256 != want {
+				t.Errorf("manifest SHA-256 = %q, want %q", entry.SHA256, want)
+			}
+		})
+	}
+}
+
+// mustSize returns the size of file
+func mustSize(t *testing.T, file *os.File) int64 {
+	t.Helper()
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
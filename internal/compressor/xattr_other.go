@@ -0,0 +1,22 @@
+//go:build !linux
+
+package compressor
+
+import (
+	"archive/tar"
+)
+
+// readXattrs is not implemented on this platform; no attributes are archived
+func readXattrs(path string) (map[string]string, error) {
+	return nil, nil
+}
+
+// writeXattr is not implemented on this platform
+func writeXattr(path, name, value string) error {
+	return errUnsupported
+}
+
+// makeSpecial is not implemented on this platform
+func makeSpecial(path string, header *tar.Header) error {
+	return errUnsupported
+}
@@ -0,0 +1,122 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"fmt"
+	"io"
+)
+
+// Layout describes where the sealed chunks of an archive are stored. Chunk i
+// holds the plaintext bytes from i*ChunkSize and starts at
+// HeaderSize + i*SealedChunkSize in the archive.
+type Layout struct {
+	HeaderSize      int64 `json:"header_size"`
+	ChunkSize       int64 `json:"chunk_size"`
+	SealedChunkSize int64 `json:"sealed_chunk_size"`
+}
+
+// Chunk returns the chunk that holds the plaintext byte at offset
+func (l *Layout) Chunk(offset int64) int64 {
+	return offset / l.ChunkSize
+}
+
+// ChunkOffset returns the offset of chunk in the archive
+func (l *Layout) ChunkOffset(chunk int64) int64 {
+	return l.HeaderSize + chunk*l.SealedChunkSize
+}
+
+// LastChunk returns the final chunk of an archive of archiveSize bytes
+func (l *Layout) LastChunk(archiveSize int64) int64 {
+	payload := archiveSize - l.HeaderSize
+	if payload <= l.SealedChunkSize {
+		return 0
+	}
+	return (payload+l.SealedChunkSize-1)/l.SealedChunkSize - 1
+}
+
+// Layout returns the layout of the archives encrypted with archiveKey
+func (k *ArchiveKey) Layout() (*Layout, error) {
+	header, err := ReadHeader(bytes.NewReader(k.Header))
+	if err != nil {
+		return nil, err
+	}
+	return headerLayout(header), nil
+}
+
+// headerLayout returns the layout of the archive that starts with header
+func headerLayout(header *Header) *Layout {
+	return &Layout{
+		HeaderSize:      header.Size(),
+		ChunkSize:       int64(header.ChunkSize),
+		SealedChunkSize: int64(header.ChunkSize) + gcmOverhead,
+	}
+}
+
+// gcmOverhead is the tag every sealed chunk carries
+const gcmOverhead = 16
+
+// ChunkOpener decrypts chunks of an archive on their own, so part of an
+// archive can be read without the chunks before it
+type ChunkOpener struct {
+	aead   cipher.AEAD
+	layout *Layout
+}
+
+// NewChunkOpener reads and verifies the header of an archive and returns an
+// opener for its chunks
+func (sd *StreamDecryptor) NewChunkOpener(reader io.Reader) (*ChunkOpener, error) {
+	header, err := ReadHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	key, err := sd.archiveKey(header)
+	if err != nil {
+		return nil, err
+	}
+	if err := header.Verify(key); err != nil {
+		return nil, err
+	}
+	aead, err := header.payloadAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &ChunkOpener{aead: aead, layout: headerLayout(header)}, nil
+}
+
+// Layout returns the layout of the archive
+func (o *ChunkOpener) Layout() *Layout {
+	return o.layout
+}
+
+// DecryptChunks decrypts the consecutive sealed chunks read from reader,
+// starting with chunk first, and writes their plaintext to writer. last is
+// the final chunk of the archive, which is sealed with the final flag.
+// Reading stops at the end of reader or after chunk last.
+func (o *ChunkOpener) DecryptChunks(reader io.Reader, writer io.Writer, first, last int64) error {
+	buffer := make([]byte, o.layout.SealedChunkSize)
+	nonce := make([]byte, o.aead.NonceSize())
+	plain := make([]byte, 0, o.layout.ChunkSize)
+
+	for counter := first; counter <= last; counter++ {
+		n, eof, err := readChunk(reader, buffer)
+		if err != nil {
+			return fmt.Errorf("failed to read encrypted chunk: %w", err)
+		}
+		if n == 0 && eof {
+			return nil
+		}
+
+		plain, err = o.aead.Open(plain[:0], chunkNonce(nonce, uint64(counter), counter == last), buffer[:n], nil)
+		if err != nil {
+			return fmt.Errorf("chunk %d failed authentication (archive truncated or tampered)", counter)
+		}
+		if _, err := writer.Write(plain); err != nil {
+			return fmt.Errorf("failed to write decrypted chunk: %w", err)
+		}
+		if eof {
+			return nil
+		}
+	}
+	return nil
+}
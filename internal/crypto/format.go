@@ -0,0 +1,377 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Encrypted archive layout (integers are big-endian):
+//
+//	magic       10 bytes  "CLOUDSAFE\x00"
+//	version      1 byte   FormatV1 or FormatV2
+//	cipher       1 byte   Cipher used for the payload
+//	chunk size   4 bytes  plaintext bytes per payload chunk
+//	seed        32 bytes  random per archive, mixed into the payload key
+//	key info    variable  how to obtain the archive key, by version:
+//	                      1: KDF parameters (see KDFParams.MarshalBinary); the
+//	                         archive key is derived from a passphrase
+//	                      2: a stanza count byte, then per stanza a type byte,
+//	                         a 2-byte body length and the body; each stanza
+//	                         wraps the random archive key (the data key) under
+//	                         one key-encryption key
+//	header MAC  32 bytes  HMAC-SHA256 over all preceding header bytes
+//
+// Version 2 is written by StreamEncryptor. Because the payload depends only on
+// the archive key and seed, its stanzas can be replaced without touching the
+// payload (see Rekey). Version 1 archives are still read.
+//
+// The payload follows as a sequence of sealed chunks (STREAM construction).
+// Every chunk except the last holds exactly chunk size plaintext bytes. The
+// nonce of chunk i is an 11-byte big-endian i followed by a final flag byte
+// that is 1 only for the last chunk, so reordered, dropped or truncated
+// chunks fail authentication.
+
+// Magic identifies a cloud_safe encrypted archive
+var Magic = []byte("CLOUDSAFE\x00")
+
+// Archive format versions
+const (
+	FormatV1 = 1
+	FormatV2 = 2
+)
+
+// Cipher identifies the AEAD used for the payload
+type Cipher byte
+
+const (
+	CipherAES256GCM Cipher = 1
+)
+
+// String returns the cipher name
+func (c Cipher) String() string {
+	switch c {
+	case CipherAES256GCM:
+		return "AES-256-GCM"
+	default:
+		return fmt.Sprintf("cipher(%d)", byte(c))
+	}
+}
+
+const (
+	// DefaultChunkSize is the plaintext size of each payload chunk
+	DefaultChunkSize = 64 * 1024
+	maxChunkSize     = 16 * 1024 * 1024
+	seedSize         = 32
+	macSize          = sha256.Size
+	maxStanzas       = 64
+	maxStanzaBody    = 4096
+)
+
+// HKDF info strings separating the keys derived from an archive key
+var (
+	payloadKeyInfo   = []byte("cloud_safe payload key")
+	headerMACKeyInfo = []byte("cloud_safe header mac")
+)
+
+// StanzaType identifies how a stanza wraps the archive key
+type StanzaType byte
+
+const (
+	StanzaX25519     StanzaType = 1
+	StanzaPassphrase StanzaType = 2
+	StanzaKeyManager StanzaType = 3
+)
+
+// String returns the stanza type name
+func (t StanzaType) String() string {
+	switch t {
+	case StanzaX25519:
+		return "X25519"
+	case StanzaPassphrase:
+		return "passphrase"
+	case StanzaKeyManager:
+		return "key manager"
+	default:
+		return fmt.Sprintf("stanza(%d)", byte(t))
+	}
+}
+
+// Stanza holds the archive key wrapped for a single recipient
+type Stanza struct {
+	Type StanzaType
+	Body []byte
+}
+
+// Header describes an encrypted archive
+type Header struct {
+	Version   byte
+	Cipher    Cipher
+	ChunkSize uint32
+	Seed      []byte
+
+	// KDF is set for version 1 archives, Stanzas for version 2
+	KDF     *KDFParams
+	Stanzas []Stanza
+
+	// raw holds the encoded header without the MAC, as read or written
+	raw []byte
+	mac []byte
+}
+
+// NewHeader creates a version 2 header with archiveKey wrapped for each recipient
+func NewHeader(archiveKey []byte, recipients []Recipient) (*Header, error) {
+	h, err := newHeader()
+	if err != nil {
+		return nil, err
+	}
+	if err := h.wrap(archiveKey, recipients); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// wrap replaces the stanzas of h with archiveKey wrapped for each recipient
+func (h *Header) wrap(archiveKey []byte, recipients []Recipient) error {
+	if len(recipients) == 0 {
+		return fmt.Errorf("at least one recipient is required")
+	}
+	if len(recipients) > maxStanzas {
+		return fmt.Errorf("too many recipients: %d (maximum %d)", len(recipients), maxStanzas)
+	}
+
+	stanzas := make([]Stanza, 0, len(recipients))
+	for _, recipient := range recipients {
+		stanza, err := recipient.Wrap(archiveKey)
+		if err != nil {
+			return fmt.Errorf("failed to wrap archive key: %w", err)
+		}
+		stanzas = append(stanzas, stanza)
+	}
+	h.Stanzas = stanzas
+	return nil
+}
+
+// newHeader creates a version 2 header with a fresh random seed
+func newHeader() (*Header, error) {
+	seed := make([]byte, seedSize)
+	if _, err := io.ReadFull(rand.Reader, seed); err != nil {
+		return nil, fmt.Errorf("failed to generate seed: %w", err)
+	}
+
+	return &Header{
+		Version:   FormatV2,
+		Cipher:    CipherAES256GCM,
+		ChunkSize: DefaultChunkSize,
+		Seed:      seed,
+	}, nil
+}
+
+// HasMagic reports whether prefix starts with the encrypted archive magic
+func HasMagic(prefix []byte) bool {
+	return bytes.HasPrefix(prefix, Magic)
+}
+
+// marshal encodes the header fields that precede the MAC
+func (h *Header) marshal() ([]byte, error) {
+	buf := append([]byte{}, Magic...)
+	buf = append(buf, h.Version, byte(h.Cipher))
+	buf = binary.BigEndian.AppendUint32(buf, h.ChunkSize)
+	buf = append(buf, h.Seed...)
+
+	switch h.Version {
+	case FormatV1:
+		kdf, err := h.KDF.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		return append(buf, kdf...), nil
+
+	case FormatV2:
+		if len(h.Stanzas) == 0 || len(h.Stanzas) > maxStanzas {
+			return nil, fmt.Errorf("invalid stanza count %d", len(h.Stanzas))
+		}
+		buf = append(buf, byte(len(h.Stanzas)))
+		for _, stanza := range h.Stanzas {
+			if len(stanza.Body) > maxStanzaBody {
+				return nil, fmt.Errorf("%s stanza too large: %d bytes", stanza.Type, len(stanza.Body))
+			}
+			buf = append(buf, byte(stanza.Type))
+			buf = binary.BigEndian.AppendUint16(buf, uint16(len(stanza.Body)))
+			buf = append(buf, stanza.Body...)
+		}
+		return buf, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported archive format version %d", h.Version)
+	}
+}
+
+// WriteTo writes the header and its MAC, computed with archiveKey, to writer
+func (h *Header) WriteTo(writer io.Writer, archiveKey []byte) (int64, error) {
+	raw, err := h.marshal()
+	if err != nil {
+		return 0, err
+	}
+	macKey, err := deriveKey(archiveKey, h.Seed, headerMACKeyInfo)
+	if err != nil {
+		return 0, err
+	}
+	h.raw = raw
+	h.mac = computeMAC(macKey, raw)
+
+	n, err := writer.Write(append(raw, h.mac...))
+	if err != nil {
+		return int64(n), fmt.Errorf("failed to write archive header: %w", err)
+	}
+	return int64(n), nil
+}
+
+// ReadHeader reads an archive header from reader. The MAC is not checked until
+// Verify is called with the archive key.
+func ReadHeader(reader io.Reader) (*Header, error) {
+	// Record everything read so the MAC can be checked over the exact bytes
+	var raw bytes.Buffer
+	tee := io.TeeReader(reader, &raw)
+
+	fixed := make([]byte, len(Magic)+2+4+seedSize)
+	if _, err := io.ReadFull(tee, fixed); err != nil {
+		return nil, fmt.Errorf("failed to read archive header: %w", err)
+	}
+	if !HasMagic(fixed) {
+		return nil, fmt.Errorf("not a cloud_safe encrypted archive (bad magic)")
+	}
+
+	h := &Header{
+		Version: fixed[len(Magic)],
+		Cipher:  Cipher(fixed[len(Magic)+1]),
+	}
+	if h.Version != FormatV1 && h.Version != FormatV2 {
+		return nil, fmt.Errorf("unsupported archive format version %d", h.Version)
+	}
+	if h.Cipher != CipherAES256GCM {
+		return nil, fmt.Errorf("unsupported archive cipher %s", h.Cipher)
+	}
+
+	offset := len(Magic) + 2
+	h.ChunkSize = binary.BigEndian.Uint32(fixed[offset : offset+4])
+	if h.ChunkSize == 0 || h.ChunkSize > maxChunkSize {
+		return nil, fmt.Errorf("invalid archive chunk size %d", h.ChunkSize)
+	}
+	h.Seed = fixed[offset+4:]
+
+	if h.Version == FormatV1 {
+		kdf, err := ReadKDFParams(tee)
+		if err != nil {
+			return nil, err
+		}
+		h.KDF = kdf
+	} else {
+		stanzas, err := readStanzas(tee)
+		if err != nil {
+			return nil, err
+		}
+		h.Stanzas = stanzas
+	}
+	h.raw = raw.Bytes()
+
+	h.mac = make([]byte, macSize)
+	if _, err := io.ReadFull(reader, h.mac); err != nil {
+		return nil, fmt.Errorf("failed to read archive header MAC: %w", err)
+	}
+
+	return h, nil
+}
+
+// readStanzas decodes the stanza list of a version 2 header
+func readStanzas(reader io.Reader) ([]Stanza, error) {
+	var count [1]byte
+	if _, err := io.ReadFull(reader, count[:]); err != nil {
+		return nil, fmt.Errorf("failed to read stanza count: %w", err)
+	}
+	if count[0] == 0 || count[0] > maxStanzas {
+		return nil, fmt.Errorf("invalid stanza count %d", count[0])
+	}
+
+	stanzas := make([]Stanza, 0, count[0])
+	for i := 0; i < int(count[0]); i++ {
+		var prefix [3]byte
+		if _, err := io.ReadFull(reader, prefix[:]); err != nil {
+			return nil, fmt.Errorf("failed to read stanza: %w", err)
+		}
+		size := binary.BigEndian.Uint16(prefix[1:])
+		if size > maxStanzaBody {
+			return nil, fmt.Errorf("stanza too large: %d bytes", size)
+		}
+
+		stanza := Stanza{Type: StanzaType(prefix[0]), Body: make([]byte, size)}
+		if _, err := io.ReadFull(reader, stanza.Body); err != nil {
+			return nil, fmt.Errorf("failed to read %s stanza: %w", stanza.Type, err)
+		}
+		stanzas = append(stanzas, stanza)
+	}
+
+	return stanzas, nil
+}
+
+// Verify checks the header MAC against archiveKey. A mismatch means the
+// passphrase is wrong or the header was modified.
+func (h *Header) Verify(archiveKey []byte) error {
+	macKey, err := deriveKey(archiveKey, h.Seed, headerMACKeyInfo)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(computeMAC(macKey, h.raw), h.mac) {
+		return fmt.Errorf("archive header authentication failed: wrong key or tampered archive")
+	}
+	return nil
+}
+
+// Size returns the encoded header length including the MAC
+func (h *Header) Size() int64 {
+	return int64(len(h.raw) + len(h.mac))
+}
+
+// payloadAEAD returns the AEAD that seals the payload chunks
+func (h *Header) payloadAEAD(archiveKey []byte) (cipher.AEAD, error) {
+	key, err := deriveKey(archiveKey, h.Seed, payloadKeyInfo)
+	if err != nil {
+		return nil, err
+	}
+	return newGCM(key)
+}
+
+// deriveKey expands archiveKey into a 32-byte subkey bound to seed and info
+func deriveKey(archiveKey, seed, info []byte) ([]byte, error) {
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, archiveKey, seed, info), key); err != nil {
+		return nil, fmt.Errorf("failed to derive subkey: %w", err)
+	}
+	return key, nil
+}
+
+// computeMAC returns HMAC-SHA256 of data
+func computeMAC(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// chunkNonce returns the STREAM nonce for chunk counter
+func chunkNonce(nonce []byte, counter uint64, final bool) []byte {
+	for i := range nonce {
+		nonce[i] = 0
+	}
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
@@ -0,0 +1,212 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// KDF identifies a passphrase-based key derivation function
+type KDF byte
+
+const (
+	KDFArgon2id KDF = 1
+	KDFScrypt   KDF = 2
+)
+
+// Default cost parameters; each derivation takes roughly a second on current hardware
+const (
+	defaultArgon2Time    = 3
+	defaultArgon2Memory  = 64 * 1024 // KiB
+	defaultArgon2Threads = 4
+	defaultScryptLogN    = 17
+	defaultScryptR       = 8
+	defaultScryptP       = 1
+	saltSize             = 16
+	keySize              = 32
+)
+
+// Upper bounds applied when reading parameters, so a crafted archive cannot
+// make decryption consume unbounded memory or time. maxKDFMemory bounds the
+// memory either KDF may use, 16 times the defaults.
+const (
+	maxKDFMemory    = 1024 * 1024 * 1024 // bytes
+	maxArgon2Time   = 64
+	maxArgon2Memory = maxKDFMemory / 1024 // KiB
+	maxScryptLogN   = 24
+	maxScryptRP     = 64
+	maxSaltSize     = 64
+)
+
+// String returns the name used for the KDF in configuration
+func (k KDF) String() string {
+	switch k {
+	case KDFArgon2id:
+		return "argon2id"
+	case KDFScrypt:
+		return "scrypt"
+	default:
+		return fmt.Sprintf("kdf(%d)", byte(k))
+	}
+}
+
+// ParseKDF parses a KDF name, defaulting to Argon2id when empty
+func ParseKDF(name string) (KDF, error) {
+	switch name {
+	case "", "argon2id":
+		return KDFArgon2id, nil
+	case "scrypt":
+		return KDFScrypt, nil
+	default:
+		return 0, fmt.Errorf("unsupported key derivation function: %s (expected argon2id or scrypt)", name)
+	}
+}
+
+// KDFParams records how an archive key was derived from a passphrase. It is
+// stored in the archive so decryption can repeat the derivation.
+type KDFParams struct {
+	Algorithm KDF
+	Salt      []byte
+
+	// Argon2id parameters
+	Time    uint32
+	Memory  uint32 // KiB
+	Threads uint8
+
+	// scrypt parameters
+	LogN uint8
+	R    uint32
+	P    uint32
+}
+
+// NewKDFParams returns default parameters for kdf with a fresh random salt
+func NewKDFParams(kdf KDF) (*KDFParams, error) {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	switch kdf {
+	case KDFArgon2id:
+		return &KDFParams{
+			Algorithm: kdf,
+			Salt:      salt,
+			Time:      defaultArgon2Time,
+			Memory:    defaultArgon2Memory,
+			Threads:   defaultArgon2Threads,
+		}, nil
+	case KDFScrypt:
+		return &KDFParams{
+			Algorithm: kdf,
+			Salt:      salt,
+			LogN:      defaultScryptLogN,
+			R:         defaultScryptR,
+			P:         defaultScryptP,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key derivation function: %s", kdf)
+	}
+}
+
+// DeriveKey derives a 32-byte key from passphrase
+func (p *KDFParams) DeriveKey(passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("passphrase must not be empty")
+	}
+
+	switch p.Algorithm {
+	case KDFArgon2id:
+		return argon2.IDKey(passphrase, p.Salt, p.Time, p.Memory, p.Threads, keySize), nil
+	case KDFScrypt:
+		key, err := scrypt.Key(passphrase, p.Salt, 1<<p.LogN, int(p.R), int(p.P), keySize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive scrypt key: %w", err)
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key derivation function: %s", p.Algorithm)
+	}
+}
+
+// MarshalBinary encodes the parameters as: algorithm, cost parameters, salt length, salt
+func (p *KDFParams) MarshalBinary() ([]byte, error) {
+	if len(p.Salt) == 0 || len(p.Salt) > maxSaltSize {
+		return nil, fmt.Errorf("invalid salt length %d", len(p.Salt))
+	}
+
+	buf := []byte{byte(p.Algorithm)}
+	switch p.Algorithm {
+	case KDFArgon2id:
+		buf = binary.BigEndian.AppendUint32(buf, p.Time)
+		buf = binary.BigEndian.AppendUint32(buf, p.Memory)
+		buf = append(buf, p.Threads)
+	case KDFScrypt:
+		buf = append(buf, p.LogN)
+		buf = binary.BigEndian.AppendUint32(buf, p.R)
+		buf = binary.BigEndian.AppendUint32(buf, p.P)
+	default:
+		return nil, fmt.Errorf("unsupported key derivation function: %s", p.Algorithm)
+	}
+
+	buf = append(buf, byte(len(p.Salt)))
+	return append(buf, p.Salt...), nil
+}
+
+// ReadKDFParams decodes parameters written by MarshalBinary and checks they are within sane bounds
+func ReadKDFParams(reader io.Reader) (*KDFParams, error) {
+	var algorithm [1]byte
+	if _, err := io.ReadFull(reader, algorithm[:]); err != nil {
+		return nil, fmt.Errorf("failed to read KDF algorithm: %w", err)
+	}
+
+	p := &KDFParams{Algorithm: KDF(algorithm[0])}
+	switch p.Algorithm {
+	case KDFArgon2id:
+		var costs [9]byte
+		if _, err := io.ReadFull(reader, costs[:]); err != nil {
+			return nil, fmt.Errorf("failed to read Argon2id parameters: %w", err)
+		}
+		p.Time = binary.BigEndian.Uint32(costs[0:4])
+		p.Memory = binary.BigEndian.Uint32(costs[4:8])
+		p.Threads = costs[8]
+		if p.Time == 0 || p.Time > maxArgon2Time || p.Memory == 0 || p.Memory > maxArgon2Memory || p.Threads == 0 {
+			return nil, fmt.Errorf("Argon2id parameters out of range (t=%d, m=%d KiB, p=%d)", p.Time, p.Memory, p.Threads)
+		}
+	case KDFScrypt:
+		var costs [9]byte
+		if _, err := io.ReadFull(reader, costs[:]); err != nil {
+			return nil, fmt.Errorf("failed to read scrypt parameters: %w", err)
+		}
+		p.LogN = costs[0]
+		p.R = binary.BigEndian.Uint32(costs[1:5])
+		p.P = binary.BigEndian.Uint32(costs[5:9])
+		if p.LogN == 0 || p.LogN > maxScryptLogN || p.R == 0 || p.R > maxScryptRP || p.P == 0 || p.P > maxScryptRP {
+			return nil, fmt.Errorf("scrypt parameters out of range (logN=%d, r=%d, p=%d)", p.LogN, p.R, p.P)
+		}
+		// scrypt uses 128 * r * N bytes
+		if 128*uint64(p.R)<<p.LogN > maxKDFMemory {
+			return nil, fmt.Errorf("scrypt parameters need more than %d MiB (logN=%d, r=%d)", maxKDFMemory/(1024*1024), p.LogN, p.R)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key derivation function: %s", p.Algorithm)
+	}
+
+	var saltLen [1]byte
+	if _, err := io.ReadFull(reader, saltLen[:]); err != nil {
+		return nil, fmt.Errorf("failed to read salt length: %w", err)
+	}
+	if saltLen[0] == 0 || saltLen[0] > maxSaltSize {
+		return nil, fmt.Errorf("invalid salt length %d", saltLen[0])
+	}
+
+	p.Salt = make([]byte, saltLen[0])
+	if _, err := io.ReadFull(reader, p.Salt); err != nil {
+		return nil, fmt.Errorf("failed to read salt: %w", err)
+	}
+
+	return p, nil
+}
@@ -0,0 +1,203 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// cheapKDFParams returns parameters of kdf that derive quickly
+func cheapKDFParams(t *testing.T, kdf KDF) *KDFParams {
+	t.Helper()
+	params, err := NewKDFParams(kdf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kdf == KDFArgon2id {
+		params.Time, params.Memory, params.Threads = 1, 64, 1
+	} else {
+		params.LogN = 4
+	}
+	return params
+}
+
+func TestKDFParamsRoundTrip(t *testing.T) {
+	for _, kdf := range []KDF{KDFArgon2id, KDFScrypt} {
+		params, err := NewKDFParams(kdf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := params.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadKDFParams(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatalf("%s: ReadKDFParams() error = %v", kdf, err)
+		}
+		if !reflect.DeepEqual(got, params) {
+			t.Errorf("%s: ReadKDFParams() = %+v, want %+v", kdf, got, params)
+		}
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	for _, kdf := range []KDF{KDFArgon2id, KDFScrypt} {
+		params := cheapKDFParams(t, kdf)
+		key, err := params.DeriveKey([]byte("correct horse"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(key) != keySize {
+			t.Fatalf("%s: DeriveKey() returned %d bytes", kdf, len(key))
+		}
+
+		again, err := params.DeriveKey([]byte("correct horse"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(key, again) {
+			t.Errorf("%s: DeriveKey() is not deterministic", kdf)
+		}
+		other, err := params.DeriveKey([]byte("battery staple"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(key, other) {
+			t.Errorf("%s: DeriveKey() returned the same key for another passphrase", kdf)
+		}
+		salted := cheapKDFParams(t, kdf)
+		if resalted, _ := salted.DeriveKey([]byte("correct horse")); bytes.Equal(key, resalted) {
+			t.Errorf("%s: DeriveKey() returned the same key for another salt", kdf)
+		}
+		if _, err := params.DeriveKey(nil); err == nil {
+			t.Errorf("%s: DeriveKey() accepted an empty passphrase", kdf)
+		}
+	}
+}
+
+func TestReadKDFParamsBounds(t *testing.T) {
+	argon2 := func(time, memory uint32, threads byte) []byte {
+		buf := []byte{byte(KDFArgon2id)}
+		buf = binary.BigEndian.AppendUint32(buf, time)
+		buf = binary.BigEndian.AppendUint32(buf, memory)
+		return append(append(buf, threads, 16), make([]byte, 16)...)
+	}
+	scrypt := func(logN byte, r, p uint32) []byte {
+		buf := []byte{byte(KDFScrypt), logN}
+		buf = binary.BigEndian.AppendUint32(buf, r)
+		buf = binary.BigEndian.AppendUint32(buf, p)
+		return append(append(buf, 16), make([]byte, 16)...)
+	}
+
+	tests := []struct {
+		name    string
+		encoded []byte
+		wantErr bool
+	}{
+		{name: "argon2id defaults", encoded: argon2(defaultArgon2Time, defaultArgon2Memory, defaultArgon2Threads)},
+		{name: "argon2id at memory cap", encoded: argon2(1, maxArgon2Memory, 1)},
+		{name: "argon2id over memory cap", encoded: argon2(1, maxArgon2Memory+1, 1), wantErr: true},
+		{name: "argon2id 4 GiB", encoded: argon2(1, 4*1024*1024, 1), wantErr: true},
+		{name: "argon2id zero time", encoded: argon2(0, 64, 1), wantErr: true},
+		{name: "argon2id over time cap", encoded: argon2(maxArgon2Time+1, 64, 1), wantErr: true},
+		{name: "argon2id zero threads", encoded: argon2(1, 64, 0), wantErr: true},
+		{name: "scrypt defaults", encoded: scrypt(defaultScryptLogN, defaultScryptR, defaultScryptP)},
+		{name: "scrypt at memory cap", encoded: scrypt(20, 8, 1)},
+		{name: "scrypt over memory cap", encoded: scrypt(21, 8, 1), wantErr: true},
+		{name: "scrypt large r", encoded: scrypt(maxScryptLogN, maxScryptRP, 1), wantErr: true},
+		{name: "scrypt over logN cap", encoded: scrypt(maxScryptLogN+1, 1, 1), wantErr: true},
+		{name: "scrypt zero r", encoded: scrypt(10, 0, 1), wantErr: true},
+		{name: "unknown algorithm", encoded: append([]byte{9}, argon2(1, 64, 1)[1:]...), wantErr: true},
+		{name: "empty salt", encoded: append(argon2(1, 64, 1)[:10], 0), wantErr: true},
+		{name: "short salt", encoded: argon2(1, 64, 1)[:20], wantErr: true},
+		{name: "truncated", encoded: argon2(1, 64, 1)[:5], wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadKDFParams(bytes.NewReader(tt.encoded))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ReadKDFParams() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVersion1Archive(t *testing.T) {
+	plaintext := randomBytes(t, DefaultChunkSize+10)
+
+	for _, kdf := range []KDF{KDFArgon2id, KDFScrypt} {
+		params := cheapKDFParams(t, kdf)
+		key, err := params.DeriveKey([]byte("correct horse"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Version 1 archives derive the archive key from the passphrase directly
+		header, err := newHeader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		header.Version = FormatV1
+		header.KDF = params
+		var archive bytes.Buffer
+		if _, err := header.WriteTo(&archive, key); err != nil {
+			t.Fatal(err)
+		}
+		aead, err := header.payloadAEAD(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sealChunks(aead, int(header.ChunkSize), bytes.NewReader(plaintext), &archive); err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, err := ReadHeader(bytes.NewReader(archive.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: ReadHeader() error = %v", kdf, err)
+		}
+		if parsed.Version != FormatV1 || parsed.KDF == nil || parsed.KDF.Algorithm != kdf || len(parsed.Stanzas) != 0 {
+			t.Fatalf("%s: ReadHeader() = %+v", kdf, parsed)
+		}
+
+		for _, tt := range []struct {
+			passphrase string
+			wantErr    bool
+		}{
+			{passphrase: "correct horse"},
+			{passphrase: "battery staple", wantErr: true},
+		} {
+			decryptor, err := NewStreamDecryptor([]byte(tt.passphrase))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got bytes.Buffer
+			err = decryptor.DecryptStream(bytes.NewReader(archive.Bytes()), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%s with %q: DecryptStream() error = %v, wantErr %t", kdf, tt.passphrase, err, tt.wantErr)
+			}
+			if !tt.wantErr && !bytes.Equal(got.Bytes(), plaintext) {
+				t.Errorf("%s: DecryptStream() returned bytes that differ from the plaintext", kdf)
+			}
+		}
+
+		// Identities other than the passphrase cannot open a version 1 archive
+		if _, err := decrypt(t, newTestIdentity(t), archive.Bytes()); err == nil {
+			t.Errorf("%s: DecryptStream() opened a version 1 archive without the passphrase", kdf)
+		}
+	}
+}
+
+func TestParseKDF(t *testing.T) {
+	for name, want := range map[string]KDF{"": KDFArgon2id, "argon2id": KDFArgon2id, "scrypt": KDFScrypt} {
+		got, err := ParseKDF(name)
+		if err != nil || got != want {
+			t.Errorf("ParseKDF(%q) = %s, %v; want %s", name, got, err, want)
+		}
+	}
+	if _, err := ParseKDF("pbkdf2"); err == nil {
+		t.Error("ParseKDF() accepted an unsupported KDF")
+	}
+}
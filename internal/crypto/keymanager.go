@@ -0,0 +1,113 @@
+package crypto
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+)
+
+// KeyManager generates archive data keys wrapped under a key-encryption key it
+// controls, and unwraps them again. The key-encryption key itself never has to
+// be stored in config.json or passed on the command line.
+type KeyManager interface {
+	// Name identifies the implementation; it is recorded with every wrapped key
+	Name() string
+
+	// KeyID identifies the key-encryption key new data keys are wrapped under
+	KeyID() string
+
+	// GenerateDataKey returns a new random data key and the same key wrapped
+	GenerateDataKey(ctx context.Context) (plaintext, wrapped []byte, err error)
+
+	// WrapDataKey wraps an existing data key, for example when rekeying
+	WrapDataKey(ctx context.Context, plaintext []byte) ([]byte, error)
+
+	// UnwrapDataKey recovers a data key wrapped under the key-encryption key keyID
+	UnwrapDataKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// KeyManagerRecipient wraps archive keys with a KeyManager
+type KeyManagerRecipient struct {
+	manager KeyManager
+}
+
+// NewKeyManagerRecipient creates a recipient for manager's current key
+func NewKeyManagerRecipient(manager KeyManager) *KeyManagerRecipient {
+	return &KeyManagerRecipient{manager: manager}
+}
+
+// Wrap wraps archiveKey under the manager's current key-encryption key
+func (r *KeyManagerRecipient) Wrap(archiveKey []byte) (Stanza, error) {
+	wrapped, err := r.manager.WrapDataKey(context.Background(), archiveKey)
+	if err != nil {
+		return Stanza{}, err
+	}
+	return keyManagerStanza(r.manager.Name(), r.manager.KeyID(), wrapped)
+}
+
+// KeyManagerIdentity unwraps archive keys with a KeyManager
+type KeyManagerIdentity struct {
+	manager KeyManager
+}
+
+// NewKeyManagerIdentity creates an identity that asks manager to unwrap data keys
+func NewKeyManagerIdentity(manager KeyManager) *KeyManagerIdentity {
+	return &KeyManagerIdentity{manager: manager}
+}
+
+// Unwrap recovers the archive key from a stanza written by the same kind of KeyManager
+func (i *KeyManagerIdentity) Unwrap(stanza Stanza) ([]byte, error) {
+	if stanza.Type != StanzaKeyManager {
+		return nil, ErrIncorrectIdentity
+	}
+
+	name, keyID, wrapped, err := parseKeyManagerStanza(stanza.Body)
+	if err != nil {
+		return nil, err
+	}
+	if name != i.manager.Name() {
+		return nil, ErrIncorrectIdentity
+	}
+
+	key, err := i.manager.UnwrapDataKey(context.Background(), keyID, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key with %s key %s: %w", name, keyID, err)
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("%s returned a %d byte data key", name, len(key))
+	}
+	return key, nil
+}
+
+// keyManagerStanza encodes a wrapped key as: name length, name, key ID
+// length (2 bytes), key ID, wrapped key
+func keyManagerStanza(name, keyID string, wrapped []byte) (Stanza, error) {
+	if len(name) > 255 || len(keyID) > maxStanzaBody {
+		return Stanza{}, fmt.Errorf("key manager name or key ID too long")
+	}
+
+	body := []byte{byte(len(name))}
+	body = append(body, name...)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(keyID)))
+	body = append(body, keyID...)
+	body = append(body, wrapped...)
+	return Stanza{Type: StanzaKeyManager, Body: body}, nil
+}
+
+// parseKeyManagerStanza decodes a stanza body written by keyManagerStanza
+func parseKeyManagerStanza(body []byte) (name, keyID string, wrapped []byte, err error) {
+	malformed := fmt.Errorf("malformed key manager stanza")
+
+	if len(body) < 1 || len(body) < 1+int(body[0])+2 {
+		return "", "", nil, malformed
+	}
+	name = string(body[1 : 1+body[0]])
+	body = body[1+body[0]:]
+
+	idLen := int(binary.BigEndian.Uint16(body))
+	body = body[2:]
+	if len(body) < idLen {
+		return "", "", nil, malformed
+	}
+	return name, string(body[:idLen]), body[idLen:], nil
+}
@@ -0,0 +1,234 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestKeyring creates a keyring with one key in a temporary directory
+func newTestKeyring(t *testing.T) *Keyring {
+	t.Helper()
+	keyring, err := OpenOrCreateKeyring(filepath.Join(t.TempDir(), "keyring.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keyring.AddKey(); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.Save(); err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+// encryptWithManager encrypts plaintext with data keys from manager
+func encryptWithManager(t *testing.T, manager KeyManager, recipients []Recipient, plaintext []byte) []byte {
+	t.Helper()
+	encryptor, err := NewKeyManagerEncryptor(manager, recipients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := encryptor.EncryptStream(bytes.NewReader(plaintext), &archive); err != nil {
+		t.Fatal(err)
+	}
+	return archive.Bytes()
+}
+
+func TestKeyringSaveAndLoad(t *testing.T) {
+	keyring := newTestKeyring(t)
+
+	info, err := os.Stat(keyring.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("keyring file mode = %o, want 600", mode)
+	}
+
+	loaded, err := LoadKeyring(keyring.path)
+	if err != nil {
+		t.Fatalf("LoadKeyring() error = %v", err)
+	}
+	if loaded.KeyID() != keyring.KeyID() || len(loaded.Keys) != 1 {
+		t.Errorf("LoadKeyring() = primary %s with %d keys, want primary %s with 1 key", loaded.KeyID(), len(loaded.Keys), keyring.KeyID())
+	}
+
+	for name, content := range map[string]string{
+		"no primary": `{"primary": "missing", "keys": []}`,
+		"short key":  `{"primary": "a", "keys": [{"id": "a", "key": "AAAA"}]}`,
+		"not json":   `primary`,
+	} {
+		path := filepath.Join(t.TempDir(), "keyring.json")
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadKeyring(path); err == nil {
+			t.Errorf("%s: LoadKeyring() succeeded", name)
+		}
+	}
+}
+
+func TestKeyManagerStanza(t *testing.T) {
+	keyring := newTestKeyring(t)
+	plaintext := randomBytes(t, DefaultChunkSize+1)
+	archive := encryptWithManager(t, keyring, nil, plaintext)
+
+	header, err := ReadHeader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatalf("ReadHeader() error = %v", err)
+	}
+	if len(header.Stanzas) != 1 || header.Stanzas[0].Type != StanzaKeyManager {
+		t.Fatalf("ReadHeader() stanzas = %+v", header.Stanzas)
+	}
+	name, keyID, _, err := parseKeyManagerStanza(header.Stanzas[0].Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != KeyringName || keyID != keyring.KeyID() {
+		t.Errorf("stanza names %s key %s, want %s key %s", name, keyID, KeyringName, keyring.KeyID())
+	}
+
+	got, err := decryptWith(t, []Identity{NewKeyManagerIdentity(keyring)}, archive)
+	if err != nil {
+		t.Fatalf("DecryptStream() error = %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Error("DecryptStream() returned bytes that differ from the plaintext")
+	}
+
+	// Another keyring has no key with the stanza's ID
+	if _, err := decryptWith(t, []Identity{NewKeyManagerIdentity(newTestKeyring(t))}, archive); err == nil {
+		t.Error("DecryptStream() accepted another keyring")
+	}
+	// A keyring that has the ID but another key fails authentication
+	impostor := newTestKeyring(t)
+	impostor.Keys[0].ID = keyring.KeyID()
+	impostor.Primary = keyring.KeyID()
+	if _, err := decryptWith(t, []Identity{NewKeyManagerIdentity(impostor)}, archive); err == nil {
+		t.Error("DecryptStream() accepted a keyring with a different key under the same ID")
+	}
+	// A key manager of another kind does not claim the stanza
+	other := &namedKeyManager{KeyManager: keyring, name: AWSKMSName}
+	if _, err := NewKeyManagerIdentity(other).Unwrap(header.Stanzas[0]); !errors.Is(err, ErrIncorrectIdentity) {
+		t.Errorf("Unwrap() by another key manager error = %v, want ErrIncorrectIdentity", err)
+	}
+	if _, err := NewKeyManagerIdentity(keyring).Unwrap(Stanza{Type: StanzaX25519, Body: header.Stanzas[0].Body}); !errors.Is(err, ErrIncorrectIdentity) {
+		t.Errorf("Unwrap() of an X25519 stanza error = %v, want ErrIncorrectIdentity", err)
+	}
+}
+
+func TestKeyManagerWithRecipients(t *testing.T) {
+	keyring := newTestKeyring(t)
+	identity := newTestIdentity(t)
+	plaintext := randomBytes(t, 100)
+	archive := encryptWithManager(t, keyring, []Recipient{identity.Recipient()}, plaintext)
+
+	header, err := ReadHeader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header.Stanzas) != 2 || header.Stanzas[0].Type != StanzaKeyManager || header.Stanzas[1].Type != StanzaX25519 {
+		t.Fatalf("ReadHeader() stanzas = %+v, want a key manager stanza followed by an X25519 stanza", header.Stanzas)
+	}
+
+	// The same data key opens with either
+	for name, identities := range map[string][]Identity{
+		"keyring":    {NewKeyManagerIdentity(keyring)},
+		"public key": {identity},
+	} {
+		got, err := decryptWith(t, identities, archive)
+		if err != nil {
+			t.Fatalf("%s: DecryptStream() error = %v", name, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("%s: DecryptStream() returned bytes that differ from the plaintext", name)
+		}
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	keyring := newTestKeyring(t)
+	oldKeyID := keyring.KeyID()
+	plaintext := randomBytes(t, 100)
+	archive := encryptWithManager(t, keyring, nil, plaintext)
+
+	newKeyID, err := keyring.AddKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyring.KeyID() != newKeyID || newKeyID == oldKeyID {
+		t.Fatalf("AddKey() did not make a new primary key")
+	}
+
+	// Archives wrapped under the old key still open
+	if _, err := decryptWith(t, []Identity{NewKeyManagerIdentity(keyring)}, archive); err != nil {
+		t.Errorf("DecryptStream() under the old key error = %v", err)
+	}
+
+	// Rekeying rewraps the data key under the new primary key
+	header, err := ReadHeader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix, err := Rekey(header, []Identity{NewKeyManagerIdentity(keyring)}, []Recipient{NewKeyManagerRecipient(keyring)})
+	if err != nil {
+		t.Fatalf("Rekey() error = %v", err)
+	}
+	rekeyed := append(prefix, archive[header.Size():]...)
+	rekeyedHeader, err := ReadHeader(bytes.NewReader(rekeyed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, keyID, _, _ := parseKeyManagerStanza(rekeyedHeader.Stanzas[0].Body); keyID != newKeyID {
+		t.Errorf("rekeyed stanza names key %s, want %s", keyID, newKeyID)
+	}
+
+	// Once the old key is dropped only the rekeyed archive opens
+	keyring.Keys = keyring.Keys[1:]
+	got, err := decryptWith(t, []Identity{NewKeyManagerIdentity(keyring)}, rekeyed)
+	if err != nil {
+		t.Fatalf("DecryptStream() of the rekeyed archive error = %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Error("DecryptStream() of the rekeyed archive returned bytes that differ from the plaintext")
+	}
+	if _, err := decryptWith(t, []Identity{NewKeyManagerIdentity(keyring)}, archive); err == nil {
+		t.Error("DecryptStream() opened an archive whose key was dropped from the keyring")
+	}
+}
+
+func TestParseKeyManagerStanza(t *testing.T) {
+	stanza, err := keyManagerStanza("keyring", "20260101-abc", []byte("wrapped"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, keyID, wrapped, err := parseKeyManagerStanza(stanza.Body)
+	if err != nil || name != "keyring" || keyID != "20260101-abc" || string(wrapped) != "wrapped" {
+		t.Errorf("parseKeyManagerStanza() = %q, %q, %q, %v", name, keyID, wrapped, err)
+	}
+
+	for _, body := range [][]byte{
+		nil,
+		{7, 'k', 'e', 'y'},
+		stanza.Body[:1+len("keyring")+1],
+		stanza.Body[:1+len("keyring")+2+3],
+	} {
+		if _, _, _, err := parseKeyManagerStanza(body); err == nil {
+			t.Errorf("parseKeyManagerStanza(%q) succeeded", body)
+		}
+	}
+}
+
+// namedKeyManager is a KeyManager that reports another name
+type namedKeyManager struct {
+	KeyManager
+	name string
+}
+
+func (m *namedKeyManager) Name() string {
+	return m.name
+}
@@ -0,0 +1,191 @@
+package crypto
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// KeyringName identifies the local keyring KeyManager
+const KeyringName = "keyring"
+
+// Keyring is a KeyManager backed by a local JSON file of key-encryption keys.
+// New data keys are wrapped under the primary key; older keys stay in the file
+// so archives wrapped under them can still be unwrapped.
+type Keyring struct {
+	path string
+
+	Primary string       `json:"primary"`
+	Keys    []KeyringKey `json:"keys"`
+}
+
+// KeyringKey is a single key-encryption key in a Keyring
+type KeyringKey struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Key     []byte    `json:"key"`
+}
+
+// LoadKeyring reads the keyring file at path
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring: %w", err)
+	}
+
+	keyring := &Keyring{path: path}
+	if err := json.Unmarshal(data, keyring); err != nil {
+		return nil, fmt.Errorf("failed to parse keyring %s: %w", path, err)
+	}
+	for _, key := range keyring.Keys {
+		if len(key.Key) != chacha20poly1305.KeySize {
+			return nil, fmt.Errorf("keyring key %s has %d bytes, expected %d", key.ID, len(key.Key), chacha20poly1305.KeySize)
+		}
+	}
+	if keyring.key(keyring.Primary) == nil {
+		return nil, fmt.Errorf("keyring %s has no primary key", path)
+	}
+
+	return keyring, nil
+}
+
+// OpenOrCreateKeyring loads the keyring at path, or returns an empty one that
+// Save will create
+func OpenOrCreateKeyring(path string) (*Keyring, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return &Keyring{path: path}, nil
+	}
+	return LoadKeyring(path)
+}
+
+// AddKey generates a new key-encryption key and makes it the primary key
+func (k *Keyring) AddKey() (string, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	idBytes := make([]byte, 6)
+	if _, err := io.ReadFull(rand.Reader, idBytes); err != nil {
+		return "", fmt.Errorf("failed to generate key ID: %w", err)
+	}
+	now := time.Now().UTC()
+	id := now.Format("20060102") + "-" + base64.RawURLEncoding.EncodeToString(idBytes)
+
+	k.Keys = append(k.Keys, KeyringKey{ID: id, Created: now, Key: key})
+	k.Primary = id
+	return id, nil
+}
+
+// Save writes the keyring back to its file, readable only by the owner
+func (k *Keyring) Save() error {
+	data, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode keyring: %w", err)
+	}
+
+	// Write a temporary file and rename it so a crash cannot truncate the keyring
+	temp, err := os.CreateTemp(filepath.Dir(k.path), ".keyring-*")
+	if err != nil {
+		return fmt.Errorf("failed to save keyring: %w", err)
+	}
+	defer os.Remove(temp.Name())
+
+	if err := temp.Chmod(0600); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to save keyring: %w", err)
+	}
+	if _, err := temp.Write(append(data, '\n')); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to save keyring: %w", err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("failed to save keyring: %w", err)
+	}
+	if err := os.Rename(temp.Name(), k.path); err != nil {
+		return fmt.Errorf("failed to save keyring: %w", err)
+	}
+	return nil
+}
+
+// key returns the key with id, or nil
+func (k *Keyring) key(id string) *KeyringKey {
+	for i := range k.Keys {
+		if k.Keys[i].ID == id {
+			return &k.Keys[i]
+		}
+	}
+	return nil
+}
+
+// Name identifies the keyring in wrapped-key stanzas
+func (k *Keyring) Name() string {
+	return KeyringName
+}
+
+// KeyID returns the ID of the primary key
+func (k *Keyring) KeyID() string {
+	return k.Primary
+}
+
+// GenerateDataKey returns a new random data key wrapped under the primary key
+func (k *Keyring) GenerateDataKey(ctx context.Context) ([]byte, []byte, error) {
+	plaintext := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, plaintext); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	wrapped, err := k.WrapDataKey(ctx, plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plaintext, wrapped, nil
+}
+
+// WrapDataKey seals plaintext under the primary key with a random nonce,
+// bound to the key ID
+func (k *Keyring) WrapDataKey(ctx context.Context, plaintext []byte) ([]byte, error) {
+	primary := k.key(k.Primary)
+	if primary == nil {
+		return nil, fmt.Errorf("keyring has no primary key")
+	}
+
+	aead, err := chacha20poly1305.NewX(primary.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key-wrapping cipher: %w", err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, []byte(primary.ID)), nil
+}
+
+// UnwrapDataKey opens a data key wrapped under the key keyID
+func (k *Keyring) UnwrapDataKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	key := k.key(keyID)
+	if key == nil {
+		return nil, fmt.Errorf("key %s is not in keyring %s", keyID, k.path)
+	}
+
+	aead, err := chacha20poly1305.NewX(key.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key-wrapping cipher: %w", err)
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, fmt.Errorf("wrapped data key too short")
+	}
+	plaintext, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(key.ID))
+	if err != nil {
+		return nil, fmt.Errorf("wrapped data key failed authentication")
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,85 @@
+package crypto
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+// AWSKMSName identifies the AWS KMS KeyManager
+const AWSKMSName = "aws-kms"
+
+// kmsEncryptionContext binds wrapped data keys to cloud_safe; KMS requires the
+// same context to decrypt them
+var kmsEncryptionContext = map[string]string{"application": "cloud_safe"}
+
+// AWSKMSManager is a KeyManager that wraps data keys under an AWS KMS key
+type AWSKMSManager struct {
+	client *kms.Client
+	keyID  string
+}
+
+// NewAWSKMSManager creates a KeyManager for the KMS key keyID (a key ID, ARN or alias)
+func NewAWSKMSManager(awsCfg aws.Config, keyID string) (*AWSKMSManager, error) {
+	if keyID == "" {
+		return nil, fmt.Errorf("KMS key ID is required")
+	}
+
+	return &AWSKMSManager{
+		client: kms.NewFromConfig(awsCfg),
+		keyID:  keyID,
+	}, nil
+}
+
+// Name identifies AWS KMS in wrapped-key stanzas
+func (m *AWSKMSManager) Name() string {
+	return AWSKMSName
+}
+
+// KeyID returns the configured KMS key
+func (m *AWSKMSManager) KeyID() string {
+	return m.keyID
+}
+
+// GenerateDataKey asks KMS for a new AES-256 data key
+func (m *AWSKMSManager) GenerateDataKey(ctx context.Context) ([]byte, []byte, error) {
+	output, err := m.client.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+		KeyId:             aws.String(m.keyID),
+		KeySpec:           types.DataKeySpecAes256,
+		EncryptionContext: kmsEncryptionContext,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate KMS data key: %w", err)
+	}
+	return output.Plaintext, output.CiphertextBlob, nil
+}
+
+// WrapDataKey encrypts an existing data key under the configured KMS key
+func (m *AWSKMSManager) WrapDataKey(ctx context.Context, plaintext []byte) ([]byte, error) {
+	output, err := m.client.Encrypt(ctx, &kms.EncryptInput{
+		KeyId:             aws.String(m.keyID),
+		Plaintext:         plaintext,
+		EncryptionContext: kmsEncryptionContext,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key with KMS: %w", err)
+	}
+	return output.CiphertextBlob, nil
+}
+
+// UnwrapDataKey asks KMS to decrypt a data key. keyID is the key recorded when
+// the data key was wrapped; KMS refuses to decrypt with any other key.
+func (m *AWSKMSManager) UnwrapDataKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	output, err := m.client.Decrypt(ctx, &kms.DecryptInput{
+		KeyId:             aws.String(keyID),
+		CiphertextBlob:    wrapped,
+		EncryptionContext: kmsEncryptionContext,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key with KMS: %w", err)
+	}
+	return output.Plaintext, nil
+}
@@ -0,0 +1,67 @@
+package crypto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// DecryptLegacyStream decrypts archives written before the versioned format
+// existed: a raw nonce followed by length-prefixed GCM chunks, keyed directly
+// with the passphrase padded or truncated to 32 bytes. The legacy format does
+// not detect truncation or dropped trailing chunks.
+func (sd *StreamDecryptor) DecryptLegacyStream(reader io.Reader, writer io.Writer) error {
+	if len(sd.passphrase) == 0 {
+		return fmt.Errorf("legacy archives can only be decrypted with a passphrase; set ENCRYPTION_KEY")
+	}
+
+	key := make([]byte, keySize)
+	copy(key, sd.passphrase)
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(reader, nonce); err != nil {
+		return fmt.Errorf("failed to read nonce: %w", err)
+	}
+
+	sizeBytes := make([]byte, 4)
+	for {
+		_, err := io.ReadFull(reader, sizeBytes)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read chunk size: %w", err)
+		}
+
+		size := binary.BigEndian.Uint32(sizeBytes)
+		if size > maxChunkSize+uint32(gcm.Overhead()) {
+			return fmt.Errorf("invalid encrypted chunk size %d", size)
+		}
+
+		encryptedChunk := make([]byte, size)
+		if _, err := io.ReadFull(reader, encryptedChunk); err != nil {
+			return fmt.Errorf("failed to read encrypted chunk: %w", err)
+		}
+
+		decrypted, err := gcm.Open(nil, nonce, encryptedChunk, nil)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt chunk: %w", err)
+		}
+		if _, err := writer.Write(decrypted); err != nil {
+			return fmt.Errorf("failed to write decrypted chunk: %w", err)
+		}
+
+		// Increment nonce for next chunk
+		for i := len(nonce) - 1; i >= 0; i-- {
+			nonce[i]++
+			if nonce[i] != 0 {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package crypto
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// PassphraseRecipient wraps archive keys with a key-encryption key derived
+// from a passphrase
+type PassphraseRecipient struct {
+	passphrase []byte
+	kdf        KDF
+}
+
+// NewPassphraseRecipient creates a recipient that derives a fresh key-encryption
+// key from passphrase with kdf for every archive
+func NewPassphraseRecipient(passphrase []byte, kdf KDF) (*PassphraseRecipient, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("passphrase must not be empty")
+	}
+	if kdf != KDFArgon2id && kdf != KDFScrypt {
+		return nil, fmt.Errorf("unsupported key derivation function: %s", kdf)
+	}
+
+	return &PassphraseRecipient{
+		passphrase: passphrase,
+		kdf:        kdf,
+	}, nil
+}
+
+// Wrap encrypts archiveKey under a key derived from the passphrase and a fresh
+// salt. The stanza body is the KDF parameters followed by the sealed key.
+func (r *PassphraseRecipient) Wrap(archiveKey []byte) (Stanza, error) {
+	params, err := NewKDFParams(r.kdf)
+	if err != nil {
+		return Stanza{}, err
+	}
+	kek, err := params.DeriveKey(r.passphrase)
+	if err != nil {
+		return Stanza{}, fmt.Errorf("failed to derive key: %w", err)
+	}
+
+	body, err := params.MarshalBinary()
+	if err != nil {
+		return Stanza{}, err
+	}
+	body, err = sealArchiveKey(body, kek, archiveKey)
+	if err != nil {
+		return Stanza{}, err
+	}
+
+	return Stanza{Type: StanzaPassphrase, Body: body}, nil
+}
+
+// PassphraseIdentity unwraps archive keys wrapped by a PassphraseRecipient
+type PassphraseIdentity struct {
+	passphrase []byte
+}
+
+// NewPassphraseIdentity creates an identity for passphrase
+func NewPassphraseIdentity(passphrase []byte) *PassphraseIdentity {
+	return &PassphraseIdentity{passphrase: passphrase}
+}
+
+// Unwrap recovers the archive key from a passphrase stanza
+func (i *PassphraseIdentity) Unwrap(stanza Stanza) ([]byte, error) {
+	if stanza.Type != StanzaPassphrase {
+		return nil, ErrIncorrectIdentity
+	}
+
+	reader := bytes.NewReader(stanza.Body)
+	params, err := ReadKDFParams(reader)
+	if err != nil {
+		return nil, fmt.Errorf("malformed passphrase stanza: %w", err)
+	}
+	sealed, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	kek, err := params.DeriveKey(i.passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	return openArchiveKey(kek, sealed)
+}
+
+// sealArchiveKey appends archiveKey sealed under kek to dst. Every key-encryption
+// key wraps a single archive key, so a zero nonce is safe.
+func sealArchiveKey(dst, kek, archiveKey []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(kek)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key-wrapping cipher: %w", err)
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	return aead.Seal(dst, nonce, archiveKey, nil), nil
+}
+
+// openArchiveKey reverses sealArchiveKey, returning ErrIncorrectIdentity when
+// kek does not match
+func openArchiveKey(kek, sealed []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(kek)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key-wrapping cipher: %w", err)
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	archiveKey, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, ErrIncorrectIdentity
+	}
+	return archiveKey, nil
+}
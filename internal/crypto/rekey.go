@@ -0,0 +1,39 @@
+package crypto
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Rekey recovers the data key of header with identities and returns the encoded
+// header with that key wrapped for recipients instead. The seed and chunk size
+// are kept, so the new header is valid for the archive's existing payload.
+func Rekey(header *Header, identities []Identity, recipients []Recipient) ([]byte, error) {
+	if header.Version != FormatV2 {
+		return nil, fmt.Errorf("archive format version %d derives its key from the passphrase and cannot be rekeyed; restore and upload it again", header.Version)
+	}
+
+	key, err := UnwrapArchiveKey(header, identities)
+	if err != nil {
+		return nil, err
+	}
+	if err := header.Verify(key); err != nil {
+		return nil, err
+	}
+
+	rekeyed := &Header{
+		Version:   header.Version,
+		Cipher:    header.Cipher,
+		ChunkSize: header.ChunkSize,
+		Seed:      header.Seed,
+	}
+	if err := rekeyed.wrap(key, recipients); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if _, err := rekeyed.WriteTo(&buf, key); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,181 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// decryptWith decrypts archive with identities
+func decryptWith(t *testing.T, identities []Identity, archive []byte) ([]byte, error) {
+	t.Helper()
+	decryptor, err := NewIdentityDecryptor(identities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plaintext bytes.Buffer
+	err = decryptor.DecryptStream(bytes.NewReader(archive), &plaintext)
+	return plaintext.Bytes(), err
+}
+
+func TestPassphraseStanza(t *testing.T) {
+	archiveKey := randomBytes(t, keySize)
+
+	for _, kdf := range []KDF{KDFArgon2id, KDFScrypt} {
+		recipient, err := NewPassphraseRecipient([]byte("correct horse"), kdf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, err := NewHeader(archiveKey, []Recipient{recipient})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var encoded bytes.Buffer
+		if _, err := header.WriteTo(&encoded, archiveKey); err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, err := ReadHeader(bytes.NewReader(encoded.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: ReadHeader() error = %v", kdf, err)
+		}
+		if len(parsed.Stanzas) != 1 || parsed.Stanzas[0].Type != StanzaPassphrase {
+			t.Fatalf("%s: ReadHeader() stanzas = %+v", kdf, parsed.Stanzas)
+		}
+
+		key, err := NewPassphraseIdentity([]byte("correct horse")).Unwrap(parsed.Stanzas[0])
+		if err != nil {
+			t.Fatalf("%s: Unwrap() error = %v", kdf, err)
+		}
+		if !bytes.Equal(key, archiveKey) {
+			t.Errorf("%s: Unwrap() returned a different archive key", kdf)
+		}
+		if err := parsed.Verify(key); err != nil {
+			t.Errorf("%s: Verify() error = %v", kdf, err)
+		}
+
+		if _, err := NewPassphraseIdentity([]byte("battery staple")).Unwrap(parsed.Stanzas[0]); !errors.Is(err, ErrIncorrectIdentity) {
+			t.Errorf("%s: Unwrap() with a wrong passphrase error = %v, want ErrIncorrectIdentity", kdf, err)
+		}
+		if _, err := newTestIdentity(t).Unwrap(parsed.Stanzas[0]); !errors.Is(err, ErrIncorrectIdentity) {
+			t.Errorf("%s: X25519 Unwrap() of a passphrase stanza error = %v, want ErrIncorrectIdentity", kdf, err)
+		}
+		if err := parsed.Verify(randomBytes(t, keySize)); err == nil {
+			t.Errorf("%s: Verify() accepted a wrong archive key", kdf)
+		}
+	}
+
+	if _, err := NewPassphraseRecipient(nil, KDFArgon2id); err == nil {
+		t.Error("NewPassphraseRecipient() accepted an empty passphrase")
+	}
+}
+
+func TestRekey(t *testing.T) {
+	passphrase := []byte("correct horse")
+	passphraseRecipient, err := NewPassphraseRecipient(passphrase, KDFScrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passphraseIdentity := NewPassphraseIdentity(passphrase)
+	oldIdentity := newTestIdentity(t)
+	newIdentity := newTestIdentity(t)
+	plaintext := randomBytes(t, 2*DefaultChunkSize+3)
+
+	tests := []struct {
+		name          string
+		from          []Recipient
+		identities    []Identity
+		to            []Recipient
+		newIdentities []Identity
+		oldIdentities []Identity
+	}{
+		{
+			name:          "passphrase to public key",
+			from:          []Recipient{passphraseRecipient},
+			identities:    []Identity{passphraseIdentity},
+			to:            []Recipient{newIdentity.Recipient()},
+			newIdentities: []Identity{newIdentity},
+			oldIdentities: []Identity{passphraseIdentity},
+		},
+		{
+			name:          "public key to passphrase",
+			from:          []Recipient{oldIdentity.Recipient()},
+			identities:    []Identity{oldIdentity},
+			to:            []Recipient{passphraseRecipient},
+			newIdentities: []Identity{passphraseIdentity},
+			oldIdentities: []Identity{oldIdentity},
+		},
+		{
+			name:          "one public key to two",
+			from:          []Recipient{oldIdentity.Recipient()},
+			identities:    []Identity{oldIdentity},
+			to:            []Recipient{newIdentity.Recipient(), passphraseRecipient},
+			newIdentities: []Identity{newIdentity},
+			oldIdentities: []Identity{oldIdentity},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encryptor, err := NewRecipientEncryptor(tt.from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var archive bytes.Buffer
+			if err := encryptor.EncryptStream(bytes.NewReader(plaintext), &archive); err != nil {
+				t.Fatal(err)
+			}
+			header, err := ReadHeader(bytes.NewReader(archive.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			prefix, err := Rekey(header, tt.identities, tt.to)
+			if err != nil {
+				t.Fatalf("Rekey() error = %v", err)
+			}
+			rekeyed := append(prefix, archive.Bytes()[header.Size():]...)
+
+			got, err := decryptWith(t, tt.newIdentities, rekeyed)
+			if err != nil {
+				t.Fatalf("DecryptStream() of the rekeyed archive error = %v", err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Error("DecryptStream() of the rekeyed archive returned bytes that differ from the plaintext")
+			}
+			if _, err := decryptWith(t, tt.oldIdentities, rekeyed); err == nil {
+				t.Error("DecryptStream() of the rekeyed archive accepts the old key")
+			}
+
+			if _, err := Rekey(header, []Identity{newTestIdentity(t)}, tt.to); err == nil {
+				t.Error("Rekey() accepted an identity the archive is not encrypted for")
+			}
+		})
+	}
+}
+
+func TestRekeyRefusesVersion1(t *testing.T) {
+	params := cheapKDFParams(t, KDFScrypt)
+	key, err := params.DeriveKey([]byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := newHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header.Version = FormatV1
+	header.KDF = params
+	var encoded bytes.Buffer
+	if _, err := header.WriteTo(&encoded, key); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ReadHeader(bytes.NewReader(encoded.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Rekey(parsed, []Identity{NewPassphraseIdentity([]byte("correct horse"))}, []Recipient{newTestIdentity(t).Recipient()}); err == nil {
+		t.Error("Rekey() rewrapped a version 1 archive, whose key comes from the passphrase")
+	}
+}
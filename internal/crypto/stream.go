@@ -1,21 +1,69 @@
 package crypto
 
 import (
+	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
 )
 
-// StreamEncryptor provides streaming encryption capabilities
+// StreamEncryptor provides streaming encryption capabilities. Every archive is
+// encrypted with a random data key that is stored in the header wrapped under
+// each recipient's key-encryption key.
 type StreamEncryptor struct {
-	gcm cipher.AEAD
-	key []byte
+	recipients []Recipient
+	keyManager KeyManager
 }
 
-// NewStreamEncryptor creates a new stream encryptor with the given key
-func NewStreamEncryptor(key []byte) (*StreamEncryptor, error) {
+// NewStreamEncryptor creates a new stream encryptor whose data keys are wrapped
+// under a key derived from passphrase using kdf
+func NewStreamEncryptor(passphrase []byte, kdf KDF) (*StreamEncryptor, error) {
+	recipient, err := NewPassphraseRecipient(passphrase, kdf)
+	if err != nil {
+		return nil, err
+	}
+	return NewRecipientEncryptor([]Recipient{recipient})
+}
+
+// NewRecipientEncryptor creates a stream encryptor whose data keys are wrapped
+// for each of recipients, so no secret is needed to write backups
+func NewRecipientEncryptor(recipients []Recipient) (*StreamEncryptor, error) {
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("at least one recipient is required")
+	}
+	if len(recipients) > maxStanzas {
+		return nil, fmt.Errorf("too many recipients: %d (maximum %d)", len(recipients), maxStanzas)
+	}
+
+	return &StreamEncryptor{
+		recipients: recipients,
+	}, nil
+}
+
+// NewKeyManagerEncryptor creates a stream encryptor that asks manager for a
+// new data key for every archive. The data key is additionally wrapped for
+// each of recipients, which may be empty.
+func NewKeyManagerEncryptor(manager KeyManager, recipients []Recipient) (*StreamEncryptor, error) {
+	if manager == nil {
+		return nil, fmt.Errorf("key manager is required")
+	}
+	if len(recipients)+1 > maxStanzas {
+		return nil, fmt.Errorf("too many recipients: %d (maximum %d)", len(recipients), maxStanzas-1)
+	}
+
+	return &StreamEncryptor{
+		recipients: recipients,
+		keyManager: manager,
+	}, nil
+}
+
+// newGCM creates an AES-256-GCM cipher for key
+func newGCM(key []byte) (cipher.AEAD, error) {
 	if len(key) != 32 {
 		return nil, fmt.Errorf("key must be 32 bytes for AES-256, got %d bytes", len(key))
 	}
@@ -30,151 +78,353 @@ func NewStreamEncryptor(key []byte) (*StreamEncryptor, error) {
 		return nil, fmt.Errorf("failed to create GCM cipher: %w", err)
 	}
 
-	return &StreamEncryptor{
-		gcm: gcm,
-		key: key,
-	}, nil
+	return gcm, nil
 }
 
-// EncryptStream encrypts data from reader and writes to writer
+// EncryptStream encrypts data from reader and writes to writer. The output
+// starts with an authenticated archive header (see format.go) followed by
+// the payload sealed in fixed-size chunks.
 func (se *StreamEncryptor) EncryptStream(reader io.Reader, writer io.Writer) error {
-	// Generate a random nonce
-	nonce := make([]byte, se.gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return fmt.Errorf("failed to generate nonce: %w", err)
+	archiveKey, err := se.NewArchiveKey()
+	if err != nil {
+		return err
 	}
+	return EncryptStreamWithKey(archiveKey, reader, writer)
+}
 
-	// Write nonce to output first
-	if _, err := writer.Write(nonce); err != nil {
-		return fmt.Errorf("failed to write nonce: %w", err)
+// ArchiveKey is the data key of one archive together with its encoded header.
+// Encrypting the same plaintext with the same ArchiveKey yields the same
+// ciphertext, which lets an interrupted upload be resumed. Only the header is
+// meant to be kept; see RecoverArchiveKey.
+type ArchiveKey struct {
+	Key    []byte
+	Header []byte
+}
+
+// NewArchiveKey creates a random data key and the header that wraps it for
+// the encryptor's recipients
+func (se *StreamEncryptor) NewArchiveKey() (*ArchiveKey, error) {
+	key, header, err := se.newArchiveKey()
+	if err != nil {
+		return nil, err
 	}
 
-	// Create a buffer for reading chunks
-	const chunkSize = 64 * 1024 // 64KB chunks
-	buffer := make([]byte, chunkSize)
+	var encoded bytes.Buffer
+	if _, err := header.WriteTo(&encoded, key); err != nil {
+		return nil, err
+	}
+	return &ArchiveKey{Key: key, Header: encoded.Bytes()}, nil
+}
+
+// CanRecoverArchiveKey reports whether the encryptor holds a secret that
+// unwraps the data keys it creates. An encryptor that only has public keys of
+// X25519 recipients cannot recover them.
+func (se *StreamEncryptor) CanRecoverArchiveKey() bool {
+	return len(se.identities()) > 0
+}
 
-	for {
-		n, err := reader.Read(buffer)
-		if err == io.EOF {
-			break
+// RecoverArchiveKey recovers the ArchiveKey of a header the encryptor created
+// earlier, unwrapping the data key with the encryptor's own passphrase or key
+// manager, so the data key never has to be stored outside the header
+func (se *StreamEncryptor) RecoverArchiveKey(encoded []byte) (*ArchiveKey, error) {
+	identities := se.identities()
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("data keys wrapped only for public-key recipients cannot be recovered")
+	}
+
+	header, err := ReadHeader(bytes.NewReader(encoded))
+	if err != nil {
+		return nil, err
+	}
+	key, err := UnwrapArchiveKey(header, identities)
+	if err != nil {
+		return nil, err
+	}
+	if err := header.Verify(key); err != nil {
+		return nil, err
+	}
+	return &ArchiveKey{Key: key, Header: encoded}, nil
+}
+
+// identities returns the identities that unwrap the stanzas the encryptor
+// writes for its passphrase and key manager recipients
+func (se *StreamEncryptor) identities() []Identity {
+	var identities []Identity
+	if se.keyManager != nil {
+		identities = append(identities, NewKeyManagerIdentity(se.keyManager))
+	}
+	for _, recipient := range se.recipients {
+		switch recipient := recipient.(type) {
+		case *PassphraseRecipient:
+			identities = append(identities, NewPassphraseIdentity(recipient.passphrase))
+		case *KeyManagerRecipient:
+			identities = append(identities, NewKeyManagerIdentity(recipient.manager))
 		}
-		if err != nil {
-			return fmt.Errorf("failed to read data: %w", err)
+	}
+	return identities
+}
+
+// EncryptStreamWithKey encrypts data from reader with a previously created
+// ArchiveKey and writes the archive to writer
+func EncryptStreamWithKey(archiveKey *ArchiveKey, reader io.Reader, writer io.Writer) error {
+	header, err := ReadHeader(bytes.NewReader(archiveKey.Header))
+	if err != nil {
+		return err
+	}
+	if err := header.Verify(archiveKey.Key); err != nil {
+		return err
+	}
+	if _, err := writer.Write(archiveKey.Header); err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+
+	aead, err := header.payloadAEAD(archiveKey.Key)
+	if err != nil {
+		return err
+	}
+
+	return sealChunks(aead, int(header.ChunkSize), reader, writer)
+}
+
+// newArchiveKey creates a random data key for a new archive and the header
+// that lets the reader recover it
+func (se *StreamEncryptor) newArchiveKey() ([]byte, *Header, error) {
+	if se.keyManager != nil {
+		return se.newManagedArchiveKey()
+	}
+
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	header, err := NewHeader(key, se.recipients)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, header, nil
+}
+
+// newManagedArchiveKey obtains the data key from the key manager; the key
+// manager's stanza comes first, followed by one for each other recipient
+func (se *StreamEncryptor) newManagedArchiveKey() ([]byte, *Header, error) {
+	key, wrapped, err := se.keyManager.GenerateDataKey(context.Background())
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(key) != keySize {
+		return nil, nil, fmt.Errorf("%s returned a %d byte data key", se.keyManager.Name(), len(key))
+	}
+	stanza, err := keyManagerStanza(se.keyManager.Name(), se.keyManager.KeyID(), wrapped)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header, err := newHeader()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(se.recipients) > 0 {
+		if err := header.wrap(key, se.recipients); err != nil {
+			return nil, nil, err
 		}
+	}
+	header.Stanzas = append([]Stanza{stanza}, header.Stanzas...)
 
-		// Encrypt the chunk
-		chunk := buffer[:n]
-		encrypted := se.gcm.Seal(nil, nonce, chunk, nil)
+	return key, header, nil
+}
 
-		// Write encrypted chunk size first (for decryption)
-		sizeBytes := make([]byte, 4)
-		sizeBytes[0] = byte(len(encrypted) >> 24)
-		sizeBytes[1] = byte(len(encrypted) >> 16)
-		sizeBytes[2] = byte(len(encrypted) >> 8)
-		sizeBytes[3] = byte(len(encrypted))
+// sealChunks encrypts reader in chunkSize pieces. One chunk is read ahead so
+// the last chunk can be sealed with the final flag, even when the payload is
+// empty or an exact multiple of chunkSize.
+func sealChunks(aead cipher.AEAD, chunkSize int, reader io.Reader, writer io.Writer) error {
+	buffer := make([]byte, chunkSize)
+	next := make([]byte, chunkSize)
+	nonce := make([]byte, aead.NonceSize())
+	sealed := make([]byte, 0, chunkSize+aead.Overhead())
+
+	n, eof, err := readChunk(reader, buffer)
+	if err != nil {
+		return fmt.Errorf("failed to read data: %w", err)
+	}
 
-		if _, err := writer.Write(sizeBytes); err != nil {
-			return fmt.Errorf("failed to write chunk size: %w", err)
+	for counter := uint64(0); ; counter++ {
+		final := eof
+		var nextN int
+		var nextEOF bool
+		if !eof {
+			nextN, nextEOF, err = readChunk(reader, next)
+			if err != nil {
+				return fmt.Errorf("failed to read data: %w", err)
+			}
+			final = nextN == 0 && nextEOF
 		}
 
-		// Write encrypted chunk
-		if _, err := writer.Write(encrypted); err != nil {
+		sealed = aead.Seal(sealed[:0], chunkNonce(nonce, counter, final), buffer[:n], nil)
+		if _, err := writer.Write(sealed); err != nil {
 			return fmt.Errorf("failed to write encrypted chunk: %w", err)
 		}
 
-		// Increment nonce for next chunk (simple counter mode)
-		for i := len(nonce) - 1; i >= 0; i-- {
-			nonce[i]++
-			if nonce[i] != 0 {
-				break
-			}
+		if final {
+			return nil
 		}
+		buffer, next = next, buffer
+		n, eof = nextN, nextEOF
 	}
+}
 
-	return nil
+// readChunk fills buffer from reader, reporting whether the end of the stream was reached
+func readChunk(reader io.Reader, buffer []byte) (int, bool, error) {
+	n, err := io.ReadFull(reader, buffer)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, true, nil
+	}
+	return n, false, err
 }
 
 // StreamDecryptor provides streaming decryption capabilities
 type StreamDecryptor struct {
-	gcm cipher.AEAD
-	key []byte
+	passphrase []byte
+	identities []Identity
 }
 
-// NewStreamDecryptor creates a new stream decryptor with the given key
-func NewStreamDecryptor(key []byte) (*StreamDecryptor, error) {
-	if len(key) != 32 {
-		return nil, fmt.Errorf("key must be 32 bytes for AES-256, got %d bytes", len(key))
+// NewStreamDecryptor creates a new stream decryptor for archives encrypted with passphrase
+func NewStreamDecryptor(passphrase []byte) (*StreamDecryptor, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("passphrase must not be empty")
 	}
 
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
-	}
+	return &StreamDecryptor{
+		passphrase: passphrase,
+		identities: []Identity{NewPassphraseIdentity(passphrase)},
+	}, nil
+}
 
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create GCM cipher: %w", err)
+// NewIdentityDecryptor creates a new stream decryptor for archives encrypted
+// to the recipients of identities
+func NewIdentityDecryptor(identities []Identity) (*StreamDecryptor, error) {
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("at least one identity is required")
 	}
 
 	return &StreamDecryptor{
-		gcm: gcm,
-		key: key,
+		identities: identities,
 	}, nil
 }
 
-// DecryptStream decrypts data from reader and writes to writer
+// DecryptStream decrypts an archive written by EncryptStream from reader and
+// writes the plaintext to writer. It fails if the header or any chunk does
+// not authenticate, or if the archive ends before its final chunk.
 func (sd *StreamDecryptor) DecryptStream(reader io.Reader, writer io.Writer) error {
-	// Read the nonce first
-	nonce := make([]byte, sd.gcm.NonceSize())
-	if _, err := io.ReadFull(reader, nonce); err != nil {
-		return fmt.Errorf("failed to read nonce: %w", err)
+	header, err := ReadHeader(reader)
+	if err != nil {
+		return err
 	}
 
-	originalNonce := make([]byte, len(nonce))
-	copy(originalNonce, nonce)
+	// Recover the archive key and check it against the header before touching the payload
+	key, err := sd.archiveKey(header)
+	if err != nil {
+		return err
+	}
+	if err := header.Verify(key); err != nil {
+		return err
+	}
 
-	sizeBytes := make([]byte, 4)
+	aead, err := header.payloadAEAD(key)
+	if err != nil {
+		return err
+	}
 
-	for {
-		// Read chunk size
-		n, err := io.ReadFull(reader, sizeBytes)
-		if err == io.EOF {
-			break
+	return openChunks(aead, int(header.ChunkSize), reader, writer)
+}
+
+// archiveKey recovers the archive key described by header
+func (sd *StreamDecryptor) archiveKey(header *Header) ([]byte, error) {
+	if header.Version == FormatV1 {
+		if len(sd.passphrase) == 0 {
+			return nil, fmt.Errorf("archive is encrypted with a passphrase; set ENCRYPTION_KEY")
 		}
+		key, err := header.KDF.DeriveKey(sd.passphrase)
 		if err != nil {
-			return fmt.Errorf("failed to read chunk size: %w", err)
+			return nil, fmt.Errorf("failed to derive key: %w", err)
 		}
-		if n != 4 {
-			return fmt.Errorf("incomplete chunk size read")
+		return key, nil
+	}
+
+	return UnwrapArchiveKey(header, sd.identities)
+}
+
+// UnwrapArchiveKey recovers the data key of a version 2 header using the first
+// identity that matches one of its stanzas
+func UnwrapArchiveKey(header *Header, identities []Identity) ([]byte, error) {
+	if header.Version != FormatV2 {
+		return nil, fmt.Errorf("archive format version %d has no wrapped data key", header.Version)
+	}
+
+	for _, stanza := range header.Stanzas {
+		for _, identity := range identities {
+			key, err := identity.Unwrap(stanza)
+			if errors.Is(err, ErrIncorrectIdentity) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			return key, nil
 		}
+	}
+	return nil, fmt.Errorf("no key matches any of the archive's %d wrapped data key(s): %s", len(header.Stanzas), describeStanzas(header.Stanzas))
+}
 
-		chunkSize := int(sizeBytes[0])<<24 | int(sizeBytes[1])<<16 | int(sizeBytes[2])<<8 | int(sizeBytes[3])
+// describeStanzas lists stanza types for error messages
+func describeStanzas(stanzas []Stanza) string {
+	names := make([]string, 0, len(stanzas))
+	for _, stanza := range stanzas {
+		names = append(names, stanza.Type.String())
+	}
+	return strings.Join(names, ", ")
+}
 
-		// Read encrypted chunk
-		encryptedChunk := make([]byte, chunkSize)
-		if _, err := io.ReadFull(reader, encryptedChunk); err != nil {
-			return fmt.Errorf("failed to read encrypted chunk: %w", err)
+// openChunks decrypts chunks sealed by sealChunks. The chunk after the current
+// one is read ahead to tell whether the current chunk must carry the final flag.
+func openChunks(aead cipher.AEAD, chunkSize int, reader io.Reader, writer io.Writer) error {
+	sealedSize := chunkSize + aead.Overhead()
+	buffer := make([]byte, sealedSize)
+	next := make([]byte, sealedSize)
+	nonce := make([]byte, aead.NonceSize())
+	plain := make([]byte, 0, chunkSize)
+
+	n, eof, err := readChunk(reader, buffer)
+	if err != nil {
+		return fmt.Errorf("failed to read encrypted chunk: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("archive is truncated: no encrypted payload")
+	}
+
+	for counter := uint64(0); ; counter++ {
+		final := eof
+		var nextN int
+		var nextEOF bool
+		if !eof {
+			nextN, nextEOF, err = readChunk(reader, next)
+			if err != nil {
+				return fmt.Errorf("failed to read encrypted chunk: %w", err)
+			}
+			final = nextN == 0 && nextEOF
 		}
 
-		// Decrypt the chunk
-		decrypted, err := sd.gcm.Open(nil, nonce, encryptedChunk, nil)
+		plain, err = aead.Open(plain[:0], chunkNonce(nonce, counter, final), buffer[:n], nil)
 		if err != nil {
-			return fmt.Errorf("failed to decrypt chunk: %w", err)
+			return fmt.Errorf("chunk %d failed authentication (archive truncated or tampered)", counter)
 		}
-
-		// Write decrypted chunk
-		if _, err := writer.Write(decrypted); err != nil {
+		if _, err := writer.Write(plain); err != nil {
 			return fmt.Errorf("failed to write decrypted chunk: %w", err)
 		}
 
-		// Increment nonce for next chunk
-		for i := len(nonce) - 1; i >= 0; i-- {
-			nonce[i]++
-			if nonce[i] != 0 {
-				break
-			}
+		if final {
+			return nil
 		}
+		buffer, next = next, buffer
+		n, eof = nextN, nextEOF
 	}
-
-	return nil
 }
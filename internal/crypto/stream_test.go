@@ -0,0 +1,270 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+// randomBytes returns n random bytes
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// newTestIdentity returns a new X25519 identity, which is much cheaper to
+// unwrap with than a passphrase
+func newTestIdentity(t *testing.T) *X25519Identity {
+	t.Helper()
+	identity, err := GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity
+}
+
+// encrypt encrypts plaintext for identity
+func encrypt(t *testing.T, identity *X25519Identity, plaintext []byte) []byte {
+	t.Helper()
+	encryptor, err := NewRecipientEncryptor([]Recipient{identity.Recipient()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := encryptor.EncryptStream(bytes.NewReader(plaintext), &archive); err != nil {
+		t.Fatal(err)
+	}
+	return archive.Bytes()
+}
+
+// decrypt decrypts archive with identity
+func decrypt(t *testing.T, identity *X25519Identity, archive []byte) ([]byte, error) {
+	t.Helper()
+	decryptor, err := NewIdentityDecryptor([]Identity{identity})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plaintext bytes.Buffer
+	err = decryptor.DecryptStream(bytes.NewReader(archive), &plaintext)
+	return plaintext.Bytes(), err
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	identity := newTestIdentity(t)
+	sizes := []int{0, 1, DefaultChunkSize - 1, DefaultChunkSize, DefaultChunkSize + 1, 3*DefaultChunkSize + 5}
+
+	for _, size := range sizes {
+		plaintext := randomBytes(t, size)
+		archive := encrypt(t, identity, plaintext)
+
+		got, err := decrypt(t, identity, archive)
+		if err != nil {
+			t.Fatalf("size %d: DecryptStream() error = %v", size, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("size %d: DecryptStream() returned %d bytes that differ from the plaintext", size, len(got))
+		}
+	}
+}
+
+func TestPassphraseRoundTrip(t *testing.T) {
+	plaintext := randomBytes(t, DefaultChunkSize+1)
+
+	for _, kdf := range []KDF{KDFArgon2id, KDFScrypt} {
+		encryptor, err := NewStreamEncryptor([]byte("correct horse"), kdf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var archive bytes.Buffer
+		if err := encryptor.EncryptStream(bytes.NewReader(plaintext), &archive); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tt := range []struct {
+			passphrase string
+			wantErr    bool
+		}{
+			{passphrase: "correct horse"},
+			{passphrase: "battery staple", wantErr: true},
+		} {
+			decryptor, err := NewStreamDecryptor([]byte(tt.passphrase))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got bytes.Buffer
+			err = decryptor.DecryptStream(bytes.NewReader(archive.Bytes()), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%s with %q: DecryptStream() error = %v, wantErr %t", kdf, tt.passphrase, err, tt.wantErr)
+			}
+			if tt.wantErr && got.Len() > 0 {
+				t.Errorf("%s with %q: DecryptStream() wrote %d bytes", kdf, tt.passphrase, got.Len())
+			}
+			if !tt.wantErr && !bytes.Equal(got.Bytes(), plaintext) {
+				t.Errorf("%s: DecryptStream() returned bytes that differ from the plaintext", kdf)
+			}
+		}
+	}
+}
+
+func TestWrongIdentity(t *testing.T) {
+	archive := encrypt(t, newTestIdentity(t), []byte("secret"))
+
+	got, err := decrypt(t, newTestIdentity(t), archive)
+	if err == nil {
+		t.Fatal("DecryptStream() accepted an identity the archive is not encrypted for")
+	}
+	if len(got) > 0 {
+		t.Errorf("DecryptStream() wrote %d bytes before failing", len(got))
+	}
+}
+
+func TestTamperedArchive(t *testing.T) {
+	identity := newTestIdentity(t)
+	plaintext := randomBytes(t, 3*DefaultChunkSize+100)
+	archive := encrypt(t, identity, plaintext)
+
+	header, err := ReadHeader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout := headerLayout(header)
+	chunk := func(i int64) []byte {
+		end := layout.ChunkOffset(i + 1)
+		if end > int64(len(archive)) {
+			end = int64(len(archive))
+		}
+		return archive[layout.ChunkOffset(i):end]
+	}
+	headerBytes := archive[:layout.HeaderSize]
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	flip := func(offset int64) []byte {
+		tampered := append([]byte{}, archive...)
+		tampered[offset] ^= 1
+		return tampered
+	}
+
+	tests := []struct {
+		name    string
+		archive []byte
+	}{
+		{name: "header only", archive: headerBytes},
+		{name: "truncated header", archive: archive[:layout.HeaderSize-1]},
+		{name: "truncated at chunk boundary", archive: join(headerBytes, chunk(0), chunk(1), chunk(2))},
+		{name: "truncated within chunk", archive: archive[:len(archive)-10]},
+		{name: "reordered chunks", archive: join(headerBytes, chunk(1), chunk(0), chunk(2), chunk(3))},
+		{name: "dropped chunk", archive: join(headerBytes, chunk(0), chunk(2), chunk(3))},
+		{name: "duplicated chunk", archive: join(headerBytes, chunk(0), chunk(0), chunk(1), chunk(2), chunk(3))},
+		{name: "appended chunk", archive: join(archive, chunk(3))},
+		{name: "flipped payload bit", archive: flip(layout.ChunkOffset(1) + 7)},
+		{name: "flipped tag bit", archive: flip(int64(len(archive)) - 1)},
+		{name: "flipped header bit", archive: flip(layout.HeaderSize - macSize - 1)},
+		{name: "flipped header MAC bit", archive: flip(layout.HeaderSize - 1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decrypt(t, identity, tt.archive)
+			if err == nil {
+				t.Fatal("DecryptStream() accepted a tampered archive")
+			}
+			if bytes.Equal(got, plaintext) {
+				t.Error("DecryptStream() returned the whole plaintext of a tampered archive")
+			}
+		})
+	}
+}
+
+func TestDecryptChunks(t *testing.T) {
+	identity := newTestIdentity(t)
+	plaintext := randomBytes(t, 4*DefaultChunkSize+100)
+	archive := encrypt(t, identity, plaintext)
+
+	decryptor, err := NewIdentityDecryptor([]Identity{identity})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opener, err := decryptor.NewChunkOpener(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout := opener.Layout()
+	last := layout.LastChunk(int64(len(archive)))
+	if last != 4 {
+		t.Fatalf("LastChunk() = %d, want 4", last)
+	}
+
+	tests := []struct {
+		name        string
+		first, end  int64
+		wantErr     bool
+		wantOffsets [2]int64
+	}{
+		{name: "middle chunks", first: 1, end: 3, wantOffsets: [2]int64{DefaultChunkSize, 3 * DefaultChunkSize}},
+		{name: "to the end", first: 2, end: last + 1, wantOffsets: [2]int64{2 * DefaultChunkSize, int64(len(plaintext))}},
+		// Chunk 3 read as if it were the last must fail the final flag
+		{name: "truncated before last", first: 2, end: 4, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			end := layout.ChunkOffset(tt.end)
+			if end > int64(len(archive)) {
+				end = int64(len(archive))
+			}
+			sealed := archive[layout.ChunkOffset(tt.first):end]
+			chunksLast := last
+			if tt.wantErr {
+				chunksLast = tt.end - 1
+			}
+			var got bytes.Buffer
+			err := opener.DecryptChunks(bytes.NewReader(sealed), &got, tt.first, chunksLast)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DecryptChunks() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if want := plaintext[tt.wantOffsets[0]:tt.wantOffsets[1]]; !bytes.Equal(got.Bytes(), want) {
+				t.Errorf("DecryptChunks() returned %d bytes, want %d bytes of plaintext", got.Len(), len(want))
+			}
+		})
+	}
+}
+
+func TestRekeyKeepsPayload(t *testing.T) {
+	oldIdentity := newTestIdentity(t)
+	newIdentity := newTestIdentity(t)
+	plaintext := randomBytes(t, 2*DefaultChunkSize)
+	archive := encrypt(t, oldIdentity, plaintext)
+
+	header, err := ReadHeader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix, err := Rekey(header, []Identity{oldIdentity}, []Recipient{newIdentity.Recipient()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rekeyed := append(prefix, archive[header.Size():]...)
+
+	got, err := decrypt(t, newIdentity, rekeyed)
+	if err != nil {
+		t.Fatalf("DecryptStream() with the new identity error = %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Error("DecryptStream() returned bytes that differ from the plaintext")
+	}
+	if _, err := decrypt(t, oldIdentity, rekeyed); err == nil {
+		t.Error("DecryptStream() still accepts the old identity")
+	}
+
+	if _, err := Rekey(header, []Identity{newTestIdentity(t)}, []Recipient{newIdentity.Recipient()}); err == nil {
+		t.Error("Rekey() accepted an identity the archive is not encrypted for")
+	}
+}
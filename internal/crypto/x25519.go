@@ -0,0 +1,209 @@
+package crypto
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Text encodings of X25519 keys
+const (
+	publicKeyPrefix = "cloudsafe-pub-"
+	secretKeyPrefix = "CLOUDSAFE-SECRET-KEY-"
+)
+
+var x25519WrapInfo = []byte("cloud_safe X25519 wrap")
+
+// ErrIncorrectIdentity is returned by Identity.Unwrap when a stanza was not
+// wrapped for that identity
+var ErrIncorrectIdentity = errors.New("stanza is not for this identity")
+
+// Recipient wraps archive keys so only the matching Identity can unwrap them
+type Recipient interface {
+	Wrap(archiveKey []byte) (Stanza, error)
+}
+
+// Identity unwraps archive keys from stanzas addressed to it
+type Identity interface {
+	Unwrap(stanza Stanza) ([]byte, error)
+}
+
+// X25519Recipient is the public half of an X25519 key pair
+type X25519Recipient struct {
+	publicKey []byte
+}
+
+// ParseX25519Recipient parses a public key in the form produced by String
+func ParseX25519Recipient(s string) (*X25519Recipient, error) {
+	key, err := decodeKey(s, publicKeyPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	return &X25519Recipient{publicKey: key}, nil
+}
+
+// String encodes the public key for config files and the command line
+func (r *X25519Recipient) String() string {
+	return publicKeyPrefix + base64.RawURLEncoding.EncodeToString(r.publicKey)
+}
+
+// Wrap encrypts archiveKey to the recipient using a fresh ephemeral key pair.
+// The stanza body is the ephemeral public key followed by the sealed key.
+func (r *X25519Recipient) Wrap(archiveKey []byte) (Stanza, error) {
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand.Reader, ephemeral); err != nil {
+		return Stanza{}, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	ephemeralPublic, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return Stanza{}, err
+	}
+	shared, err := curve25519.X25519(ephemeral, r.publicKey)
+	if err != nil {
+		return Stanza{}, fmt.Errorf("failed to compute shared secret: %w", err)
+	}
+
+	kek, err := x25519WrapKey(shared, ephemeralPublic, r.publicKey)
+	if err != nil {
+		return Stanza{}, err
+	}
+	body, err := sealArchiveKey(append([]byte{}, ephemeralPublic...), kek, archiveKey)
+	if err != nil {
+		return Stanza{}, err
+	}
+
+	return Stanza{Type: StanzaX25519, Body: body}, nil
+}
+
+// X25519Identity is an X25519 private key
+type X25519Identity struct {
+	secretKey []byte
+	publicKey []byte
+}
+
+// GenerateX25519Identity creates a new random key pair
+func GenerateX25519Identity() (*X25519Identity, error) {
+	secret := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	return newX25519Identity(secret)
+}
+
+// ParseX25519Identity parses a private key in the form produced by String
+func ParseX25519Identity(s string) (*X25519Identity, error) {
+	secret, err := decodeKey(s, secretKeyPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	return newX25519Identity(secret)
+}
+
+func newX25519Identity(secret []byte) (*X25519Identity, error) {
+	public, err := curve25519.X25519(secret, curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute public key: %w", err)
+	}
+	return &X25519Identity{secretKey: secret, publicKey: public}, nil
+}
+
+// String encodes the private key for identity files
+func (i *X25519Identity) String() string {
+	return secretKeyPrefix + base64.RawURLEncoding.EncodeToString(i.secretKey)
+}
+
+// Recipient returns the public key archives should be encrypted to
+func (i *X25519Identity) Recipient() *X25519Recipient {
+	return &X25519Recipient{publicKey: i.publicKey}
+}
+
+// Unwrap recovers the archive key from an X25519 stanza addressed to this identity
+func (i *X25519Identity) Unwrap(stanza Stanza) ([]byte, error) {
+	if stanza.Type != StanzaX25519 {
+		return nil, ErrIncorrectIdentity
+	}
+	if len(stanza.Body) != curve25519.PointSize+keySize+chacha20poly1305.Overhead {
+		return nil, fmt.Errorf("malformed X25519 stanza")
+	}
+
+	ephemeralPublic := stanza.Body[:curve25519.PointSize]
+	shared, err := curve25519.X25519(i.secretKey, ephemeralPublic)
+	if err != nil {
+		return nil, fmt.Errorf("invalid X25519 stanza: %w", err)
+	}
+
+	kek, err := x25519WrapKey(shared, ephemeralPublic, i.publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return openArchiveKey(kek, stanza.Body[curve25519.PointSize:])
+}
+
+// x25519WrapKey derives the key-encryption key from a shared secret, bound to
+// both public keys
+func x25519WrapKey(shared, ephemeralPublic, recipientPublic []byte) ([]byte, error) {
+	salt := append(append([]byte{}, ephemeralPublic...), recipientPublic...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, x25519WrapInfo), key); err != nil {
+		return nil, fmt.Errorf("failed to derive wrapping key: %w", err)
+	}
+	return key, nil
+}
+
+// decodeKey strips prefix from s and decodes the 32-byte key that follows
+func decodeKey(s, prefix string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, prefix) {
+		return nil, fmt.Errorf("expected prefix %q", prefix)
+	}
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, prefix))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != curve25519.ScalarSize {
+		return nil, fmt.Errorf("expected %d key bytes, got %d", curve25519.ScalarSize, len(key))
+	}
+	return key, nil
+}
+
+// ReadIdentityFile reads private keys from path, one per line. Blank lines
+// and lines starting with # are ignored.
+func ReadIdentityFile(path string) ([]*X25519Identity, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open identity file: %w", err)
+	}
+	defer file.Close()
+
+	var identities []*X25519Identity
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		identity, err := ParseX25519Identity(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		identities = append(identities, identity)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read identity file: %w", err)
+	}
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("no private keys found in %s", path)
+	}
+
+	return identities, nil
+}
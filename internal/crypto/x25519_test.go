@@ -0,0 +1,177 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestX25519KeyEncoding(t *testing.T) {
+	identity := newTestIdentity(t)
+
+	parsed, err := ParseX25519Identity(identity.String())
+	if err != nil {
+		t.Fatalf("ParseX25519Identity() error = %v", err)
+	}
+	if parsed.Recipient().String() != identity.Recipient().String() {
+		t.Error("parsed identity has a different public key")
+	}
+	recipient, err := ParseX25519Recipient(" " + identity.Recipient().String() + "\n")
+	if err != nil {
+		t.Fatalf("ParseX25519Recipient() error = %v", err)
+	}
+	if recipient.String() != identity.Recipient().String() {
+		t.Error("parsed recipient differs")
+	}
+
+	for _, s := range []string{
+		"",
+		identity.String(),
+		strings.TrimPrefix(identity.Recipient().String(), publicKeyPrefix),
+		publicKeyPrefix + "not base64!",
+		publicKeyPrefix + "AAAA",
+	} {
+		if _, err := ParseX25519Recipient(s); err == nil {
+			t.Errorf("ParseX25519Recipient(%q) succeeded", s)
+		}
+	}
+	if _, err := ParseX25519Identity(identity.Recipient().String()); err == nil {
+		t.Error("ParseX25519Identity() accepted a public key")
+	}
+}
+
+func TestX25519Stanza(t *testing.T) {
+	identity := newTestIdentity(t)
+	other := newTestIdentity(t)
+	archiveKey := randomBytes(t, keySize)
+
+	header, err := NewHeader(archiveKey, []Recipient{other.Recipient(), identity.Recipient()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var encoded bytes.Buffer
+	if _, err := header.WriteTo(&encoded, archiveKey); err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ReadHeader(bytes.NewReader(encoded.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadHeader() error = %v", err)
+	}
+	if parsed.Version != FormatV2 || len(parsed.Stanzas) != 2 {
+		t.Fatalf("ReadHeader() = version %d with %d stanzas", parsed.Version, len(parsed.Stanzas))
+	}
+	for _, stanza := range parsed.Stanzas {
+		if stanza.Type != StanzaX25519 {
+			t.Errorf("stanza type = %s", stanza.Type)
+		}
+	}
+
+	// Each identity unwraps its own stanza only
+	if _, err := identity.Unwrap(parsed.Stanzas[0]); !errors.Is(err, ErrIncorrectIdentity) {
+		t.Errorf("Unwrap() of another recipient's stanza error = %v, want ErrIncorrectIdentity", err)
+	}
+	key, err := identity.Unwrap(parsed.Stanzas[1])
+	if err != nil {
+		t.Fatalf("Unwrap() error = %v", err)
+	}
+	if !bytes.Equal(key, archiveKey) {
+		t.Error("Unwrap() returned a different archive key")
+	}
+	if err := parsed.Verify(key); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+
+	key, err = UnwrapArchiveKey(parsed, []Identity{newTestIdentity(t), other})
+	if err != nil || !bytes.Equal(key, archiveKey) {
+		t.Errorf("UnwrapArchiveKey() = %x, %v", key, err)
+	}
+	if _, err := UnwrapArchiveKey(parsed, []Identity{newTestIdentity(t)}); err == nil {
+		t.Error("UnwrapArchiveKey() accepted an identity the header is not for")
+	}
+
+	// Stanzas of other types or with a damaged body are refused
+	if _, err := identity.Unwrap(Stanza{Type: StanzaPassphrase, Body: parsed.Stanzas[1].Body}); !errors.Is(err, ErrIncorrectIdentity) {
+		t.Errorf("Unwrap() of a passphrase stanza error = %v, want ErrIncorrectIdentity", err)
+	}
+	if _, err := identity.Unwrap(Stanza{Type: StanzaX25519, Body: parsed.Stanzas[1].Body[1:]}); err == nil {
+		t.Error("Unwrap() accepted a short stanza")
+	}
+	damaged := append([]byte{}, parsed.Stanzas[1].Body...)
+	damaged[len(damaged)-1] ^= 1
+	if _, err := identity.Unwrap(Stanza{Type: StanzaX25519, Body: damaged}); err == nil {
+		t.Error("Unwrap() accepted a damaged stanza")
+	}
+}
+
+func TestRecipientRoundTrip(t *testing.T) {
+	identities := []*X25519Identity{newTestIdentity(t), newTestIdentity(t)}
+	plaintext := randomBytes(t, DefaultChunkSize+1)
+
+	encryptor, err := NewRecipientEncryptor([]Recipient{identities[0].Recipient(), identities[1].Recipient()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := encryptor.EncryptStream(bytes.NewReader(plaintext), &archive); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, identity := range identities {
+		got, err := decrypt(t, identity, archive.Bytes())
+		if err != nil {
+			t.Fatalf("identity %d: DecryptStream() error = %v", i, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("identity %d: DecryptStream() returned bytes that differ from the plaintext", i)
+		}
+	}
+
+	// A passphrase cannot open an archive encrypted to public keys
+	decryptor, err := NewStreamDecryptor([]byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := decryptor.DecryptStream(bytes.NewReader(archive.Bytes()), &bytes.Buffer{}); err == nil {
+		t.Error("DecryptStream() opened an archive encrypted to public keys with a passphrase")
+	}
+}
+
+func TestReadIdentityFile(t *testing.T) {
+	first := newTestIdentity(t)
+	second := newTestIdentity(t)
+	dir := t.TempDir()
+
+	tests := []struct {
+		name    string
+		content string
+		want    int
+		wantErr bool
+	}{
+		{name: "keys with comments", content: "# backup key\n" + first.String() + "\n\n  " + second.String() + "  \n", want: 2},
+		{name: "no keys", content: "# nothing here\n\n", wantErr: true},
+		{name: "public key", content: first.Recipient().String() + "\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.ReplaceAll(tt.name, " ", "-"))
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			identities, err := ReadIdentityFile(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadIdentityFile() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if len(identities) != tt.want {
+				t.Fatalf("ReadIdentityFile() returned %d identities, want %d", len(identities), tt.want)
+			}
+			if tt.want > 0 && identities[1].String() != second.String() {
+				t.Error("ReadIdentityFile() returned the keys out of order")
+			}
+		})
+	}
+}
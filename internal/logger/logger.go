@@ -7,6 +7,7 @@ import (
 
 type Logger struct {
         verbose bool
+        quiet   bool
         info    *log.Logger
         error   *log.Logger
         debug   *log.Logger
@@ -21,12 +22,24 @@ func New(verbose bool) *Logger {
         }
 }
 
+// Quiet returns a logger that prints info messages only in verbose mode, for
+// components that are created many times in one run
+func (l *Logger) Quiet() *Logger {
+        quiet := *l
+        quiet.quiet = true
+        return &quiet
+}
+
 func (l *Logger) Info(msg string) {
-        l.info.Println(msg)
+        if !l.quiet || l.verbose {
+                l.info.Println(msg)
+        }
 }
 
 func (l *Logger) Infof(format string, args ...interface{}) {
-        l.info.Printf(format, args...)
+        if !l.quiet || l.verbose {
+                l.info.Printf(format, args...)
+        }
 }
 
 func (l *Logger) Error(msg string) {
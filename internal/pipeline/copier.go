@@ -0,0 +1,189 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+	"github.com/seriousconsult/cloud_safe/internal/progress"
+	"github.com/seriousconsult/cloud_safe/internal/setup"
+	"github.com/seriousconsult/cloud_safe/internal/storage"
+)
+
+// Copier streams a stored archive from one provider to another. It copies the
+// stored bytes as they are, so encrypted archives are copied without the key.
+// An archive split into volumes is read whole, and split again when a volume
+// size is configured.
+type Copier struct {
+	config    *setup.Config
+	logger    *logger.Logger
+	from      string
+	to        string
+	source    storage.StorageProvider
+	target    storage.StorageProvider
+	sourceKey string
+	targetKey string
+	// volumes splits the copy into volumes, or is nil
+	volumes *volumeUpload
+}
+
+// NewCopier creates a copier from provider from to provider to. The archive
+// named by the configured filename is stored as targetKey, or under the same
+// name when targetKey is empty.
+func NewCopier(cfg *setup.Config, from, to, targetKey string, log *logger.Logger) (*Copier, error) {
+	if targetKey == "" {
+		targetKey = cfg.S3Filename
+	}
+	// Both providers are configured from the same settings, so copying within
+	// one provider only makes sense under another name
+	if from == to && targetKey == cfg.S3Filename {
+		return nil, fmt.Errorf("source and destination are both %s://%s", from, targetKey)
+	}
+	if err := ValidateVolumeSize(cfg.VolumeSize); err != nil {
+		return nil, err
+	}
+
+	sourceCfg := *cfg
+	sourceCfg.StorageProvider = from
+	source, err := storage.NewStorageProvider(&sourceCfg, log)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage provider %s: %w", from, err)
+	}
+
+	targetCfg := *cfg
+	targetCfg.StorageProvider = to
+	targetCfg.S3Filename = targetKey
+	target, err := storage.NewStorageProvider(&targetCfg, log)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage provider %s: %w", to, err)
+	}
+
+	var volumes *volumeUpload
+	if cfg.VolumeSize > 0 {
+		volumes = newVolumeUpload(target, to, targetKey, cfg.VolumeSize, log)
+		volumes.resume = cfg.Resume
+	}
+
+	return &Copier{
+		config:    cfg,
+		logger:    log,
+		from:      from,
+		to:        to,
+		source:    newVolumeStorage(source),
+		target:    newVolumeStorage(target),
+		sourceKey: cfg.S3Filename,
+		targetKey: targetKey,
+		volumes:   volumes,
+	}, nil
+}
+
+// Copy downloads the archive from the source provider and uploads the same
+// bytes to the target provider, along with the index uploaded with it. With
+// resume enabled an interrupted copy is continued: the archive is downloaded
+// again and the target skips the parts it already stored. If the archive
+// changed since, the interrupted copy is aborted and the archive copied again
+// from the start.
+func (c *Copier) Copy(ctx context.Context) error {
+	err := c.copy(ctx)
+	if errors.Is(err, storage.ErrStreamChanged) {
+		c.logger.Infof("The archive changed since the interrupted copy (%v); starting over", err)
+		err = c.copy(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	return c.copyIndex(ctx)
+}
+
+// copyIndex copies the index of the archive as it is stored, so an encrypted
+// index stays readable with the keys of the archive
+func (c *Copier) copyIndex(ctx context.Context) error {
+	sourceKey, targetKey := IndexKey(c.sourceKey), IndexKey(c.targetKey)
+
+	// Archives uploaded without --index have none
+	exists, err := hasObject(ctx, c.source, sourceKey)
+	if err != nil {
+		return fmt.Errorf("failed to look for archive index on %s: %w", c.from, err)
+	}
+	if !exists {
+		return nil
+	}
+
+	var index bytes.Buffer
+	if err := c.source.DownloadStream(ctx, sourceKey, &index, nil); err != nil {
+		return fmt.Errorf("failed to download archive index from %s: %w", c.from, err)
+	}
+	if err := c.target.PutObject(ctx, targetKey, &index, int64(index.Len()), nil); err != nil {
+		return fmt.Errorf("failed to upload archive index to %s: %w", c.to, err)
+	}
+
+	c.logger.Infof("Copied archive index %s", targetKey)
+	return nil
+}
+
+// copy runs the copy once
+func (c *Copier) copy(ctx context.Context) error {
+	info, err := c.source.Stat(ctx, c.sourceKey)
+	if err != nil {
+		return fmt.Errorf("failed to stat archive on %s: %w", c.from, err)
+	}
+
+	c.logger.Infof("Archive size: %.2f MB (last modified %s)", float64(info.Size)/(1024*1024), info.LastModified.Format(time.RFC3339))
+
+	// Create progress tracker
+	tracker := progress.NewTracker(info.Size)
+	defer tracker.Finish()
+
+	// A copy split into volumes resumes the volume it was uploading
+	var resumable storage.ResumableUpload
+	if c.config.Resume && c.volumes == nil {
+		resumable, err = c.target.CheckResumability(ctx)
+		if err != nil {
+			c.logger.Errorf("Failed to check resumability: %v", err)
+			resumable = nil
+		}
+	}
+
+	// Start download in a goroutine
+	downloadReader, downloadWriter := io.Pipe()
+	go func() {
+		err := c.source.DownloadStream(ctx, c.sourceKey, downloadWriter, nil)
+		// Closing with the download error makes the upload fail instead of
+		// storing a truncated archive
+		downloadWriter.CloseWithError(err)
+	}()
+	defer downloadReader.Close()
+
+	switch {
+	case c.volumes != nil:
+		err = c.volumes.upload(ctx, downloadReader, tracker)
+	case resumable != nil:
+		c.logger.Infof("Resuming previous copy to %s (%.2f MB already uploaded)", c.to, float64(resumable.GetUploadedSize())/(1024*1024))
+		err = resumable.Resume(ctx, downloadReader, tracker)
+	case c.config.Resume:
+		// UploadStream records the progress a later copy resumes from
+		err = c.target.UploadStream(ctx, downloadReader, info.Size, tracker)
+	default:
+		// The size of the archive is known, so the upload needs no estimate
+		err = c.target.PutObject(ctx, c.targetKey, downloadReader, info.Size, tracker)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The copy must have the size of the original
+	copied, err := c.target.Stat(ctx, c.targetKey)
+	if err != nil {
+		return fmt.Errorf("failed to stat copied archive on %s: %w", c.to, err)
+	}
+	if copied.Size != info.Size {
+		return fmt.Errorf("copied archive is %d bytes, expected %d", copied.Size, info.Size)
+	}
+
+	c.logger.Debug("Copy completed successfully")
+	return nil
+}
@@ -0,0 +1,143 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+	"github.com/seriousconsult/cloud_safe/internal/progress"
+	"github.com/seriousconsult/cloud_safe/internal/setup"
+	"github.com/seriousconsult/cloud_safe/internal/storage"
+)
+
+// truncatingProvider is a memoryProvider that stores every object but its
+// last byte
+type truncatingProvider struct {
+	*memoryProvider
+}
+
+func (p *truncatingProvider) PutObject(ctx context.Context, key string, reader io.Reader, size int64, tracker progress.Tracker) error {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	return p.memoryProvider.PutObject(ctx, key, bytes.NewReader(data[:len(data)-1]), size-1, tracker)
+}
+
+// newTestCopier returns a copier of the archive stored under sourceKey by
+// source to targetKey on target
+func newTestCopier(cfg *setup.Config, source *memoryProvider, target storage.StorageProvider, sourceKey, targetKey string) *Copier {
+	return &Copier{
+		config:    cfg,
+		logger:    logger.New(false).Quiet(),
+		from:      "source",
+		to:        "target",
+		source:    newVolumeStorage(source),
+		target:    newVolumeStorage(target),
+		sourceKey: sourceKey,
+		targetKey: targetKey,
+	}
+}
+
+func TestCopyIndex(t *testing.T) {
+	for name, indexed := range map[string]bool{"with index": true, "without index": false} {
+		t.Run(name, func(t *testing.T) {
+			source := newMemoryProvider("backup.tar", nil)
+			source.objects["backup.tar"] = []byte("archive")
+			if indexed {
+				source.objects[IndexKey("backup.tar")] = []byte("index")
+			}
+			target := newMemoryProvider("copy.tar", nil)
+
+			if err := newTestCopier(&setup.Config{}, source, target, "backup.tar", "copy.tar").Copy(context.Background()); err != nil {
+				t.Fatalf("Copy() error = %v", err)
+			}
+
+			if got := string(target.objects["copy.tar"]); got != "archive" {
+				t.Errorf("copied archive = %q, want %q", got, "archive")
+			}
+			index, ok := target.objects[IndexKey("copy.tar")]
+			if ok != indexed || (indexed && string(index) != "index") {
+				t.Errorf("copied index = %q (stored %v), want it stored %v", index, ok, indexed)
+			}
+			if len(target.objects) != len(source.objects) {
+				t.Errorf("target holds %d objects, want %d", len(target.objects), len(source.objects))
+			}
+		})
+	}
+}
+
+func TestCopyVolumesToSingle(t *testing.T) {
+	ctx := context.Background()
+	stream := bytes.Repeat([]byte("0123456789abcdefghijklmnopqrstuvwxyz"), 100) // 3600 bytes in 4 volumes
+	source := newMemoryProvider("backup.tar", nil)
+	if err := newVolumeUpload(source, "source", "backup.tar", testVolumeSize, logger.New(false).Quiet()).upload(ctx, bytes.NewReader(stream), nil); err != nil {
+		t.Fatal(err)
+	}
+	target := newMemoryProvider("copy.tar", nil)
+
+	if err := newTestCopier(&setup.Config{}, source, target, "backup.tar", "copy.tar").Copy(ctx); err != nil {
+		t.Fatalf("Copy() error = %v", err)
+	}
+
+	// The volumes are joined into one object
+	if len(target.objects) != 1 || !bytes.Equal(target.objects["copy.tar"], stream) {
+		t.Errorf("target holds %d objects instead of the joined archive", len(target.objects))
+	}
+}
+
+func TestCopyResume(t *testing.T) {
+	archive := bytes.Repeat([]byte("0123456789"), 1000)
+	changed := append([]byte("changed"), archive...)
+
+	tests := []struct {
+		name string
+		// resumed is the archive stored by the source when the copy is resumed
+		resumed []byte
+		// wantResumed is set when the interrupted copy is continued
+		wantResumed bool
+	}{
+		{name: "same archive", resumed: archive, wantResumed: true},
+		{name: "archive changed", resumed: changed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			source := newMemoryProvider("backup.tar", nil)
+			source.objects["backup.tar"] = archive
+			target := &interruptedProvider{memoryProvider: newMemoryProvider("copy.tar", nil), limit: 3000}
+			cfg := &setup.Config{Resume: true}
+
+			if err := newTestCopier(cfg, source, target, "backup.tar", "copy.tar").Copy(ctx); err == nil {
+				t.Fatal("Copy() to an interrupted target succeeded")
+			}
+
+			source.objects["backup.tar"] = tt.resumed
+			target.limit = 0
+			if err := newTestCopier(cfg, source, target, "backup.tar", "copy.tar").Copy(ctx); err != nil {
+				t.Fatalf("resumed Copy() error = %v", err)
+			}
+			if resumed := target.resumed == 1; resumed != tt.wantResumed {
+				t.Errorf("interrupted copy resumed = %v, want %v", resumed, tt.wantResumed)
+			}
+			if !bytes.Equal(target.objects["copy.tar"], tt.resumed) {
+				t.Error("copied archive differs from the source")
+			}
+		})
+	}
+}
+
+func TestCopySizeMismatch(t *testing.T) {
+	source := newMemoryProvider("backup.tar", nil)
+	source.objects["backup.tar"] = []byte("archive")
+	target := &truncatingProvider{memoryProvider: newMemoryProvider("copy.tar", nil)}
+
+	err := newTestCopier(&setup.Config{}, source, target, "backup.tar", "copy.tar").Copy(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "copied archive is 6 bytes, expected 7") {
+		t.Errorf("Copy() error = %v, want a size mismatch", err)
+	}
+}
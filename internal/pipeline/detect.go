@@ -0,0 +1,32 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/seriousconsult/cloud_safe/internal/crypto"
+	"github.com/seriousconsult/cloud_safe/internal/storage"
+)
+
+// DetectArchives sets CloudSafe on the objects that start like an encrypted
+// cloud_safe archive or the manifest of an archive split into volumes. It is
+// used for providers that store no tags, and reads the first bytes of every
+// object.
+func DetectArchives(ctx context.Context, provider storage.StorageProvider, objects []storage.ObjectInfo) error {
+	prefixSize := int64(max(len(crypto.Magic), len(volumeManifestMagic)))
+
+	for i := range objects {
+		length := min(objects[i].Size, prefixSize)
+		if length < int64(min(len(crypto.Magic), len(volumeManifestMagic))) {
+			objects[i].CloudSafe = false
+			continue
+		}
+
+		prefix, err := readObjectRange(ctx, provider, objects[i].Key, 0, length)
+		if err != nil {
+			return err
+		}
+		objects[i].CloudSafe = crypto.HasMagic(prefix) || bytes.HasPrefix(prefix, volumeManifestMagic)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package pipeline
+
+import (
+	"context"
+	"testing"
+
+	"github.com/seriousconsult/cloud_safe/internal/crypto"
+)
+
+func TestDetectArchives(t *testing.T) {
+	provider := newMemoryProvider("", nil)
+	provider.objects["encrypted"] = append(append([]byte{}, crypto.Magic...), make([]byte, 100)...)
+	provider.objects["manifest"] = append(append([]byte{}, volumeManifestMagic...), `{"version":1,"sizes":[1]}`...)
+	provider.objects["plain"] = []byte("just some notes that are long enough to be read")
+	provider.objects["short"] = []byte("CLOUD")
+	provider.objects["empty"] = nil
+
+	objects, err := provider.List(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DetectArchives(context.Background(), provider, objects); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]bool{"encrypted": true, "manifest": true}
+	for _, object := range objects {
+		if object.CloudSafe != want[object.Key] {
+			t.Errorf("%s: CloudSafe = %v, want %v", object.Key, object.CloudSafe, want[object.Key])
+		}
+	}
+}
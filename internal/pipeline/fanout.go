@@ -0,0 +1,294 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+	"github.com/seriousconsult/cloud_safe/internal/progress"
+	"github.com/seriousconsult/cloud_safe/internal/setup"
+	"github.com/seriousconsult/cloud_safe/internal/storage"
+)
+
+// FailurePolicy decides what a failed upload to one destination does to the
+// uploads to the other destinations
+type FailurePolicy string
+
+const (
+	// FailureAbort cancels the uploads to all destinations
+	FailureAbort FailurePolicy = "abort"
+	// FailureContinue lets the other destinations finish; the failure is
+	// reported when they are done, and the backup completes on the
+	// destinations that stored it
+	FailureContinue FailurePolicy = "continue"
+)
+
+// teeBufferSize is the amount of the stream copied to all destinations at a time
+const teeBufferSize = 1024 * 1024
+
+// ParseFailurePolicy returns the failure policy for name. An empty name
+// selects FailureAbort.
+func ParseFailurePolicy(name string) (FailurePolicy, error) {
+	switch FailurePolicy(name) {
+	case "", FailureAbort:
+		return FailureAbort, nil
+	case FailureContinue:
+		return FailureContinue, nil
+	default:
+		return "", fmt.Errorf("unsupported failure policy: %s (use abort or continue)", name)
+	}
+}
+
+// Destination is a storage provider the archive is uploaded to
+type Destination struct {
+	Name     string
+	Provider storage.StorageProvider
+}
+
+// NewDestinations creates the storage provider of every configured
+// destination. Each provider is configured as if it had been selected with
+// --provider, so all of them store the archive under the same filename.
+func NewDestinations(cfg *setup.Config, log *logger.Logger) ([]Destination, error) {
+	var destinations []Destination
+	for _, name := range cfg.GetDestinations() {
+		providerCfg := *cfg
+		providerCfg.StorageProvider = name
+
+		provider, err := storage.NewStorageProvider(&providerCfg, log)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create storage provider %s: %w", name, err)
+		}
+		destinations = append(destinations, Destination{Name: name, Provider: provider})
+	}
+	return destinations, nil
+}
+
+// destinationUpload is the upload of the archive stream to one destination
+type destinationUpload struct {
+	Destination
+	resumable storage.ResumableUpload
+	tracker   progress.Tracker
+	writer    *io.PipeWriter
+	// volumes stores the archive as volumes, or is nil; see uploadVolumes
+	volumes *volumeUpload
+	// err is the error the upload failed with, or nil once it succeeded
+	err error
+}
+
+// upload sends reader to the destination, resuming its interrupted upload
+// when there is one
+func (u *destinationUpload) upload(ctx context.Context, reader io.Reader, totalSize int64) error {
+	if u.resumable != nil {
+		return u.resumable.Resume(ctx, reader, u.tracker)
+	}
+	return u.Provider.UploadStream(ctx, reader, totalSize, u.tracker)
+}
+
+// uploadAll uploads the archive stream to every destination. Each
+// destination reads its own copy of the stream from a pipe, so the uploads
+// run at the same time and move at the pace of the slowest one. With
+// FailureContinue an error is only returned when no destination stored the
+// archive; the failures of the others are logged and left in their err.
+func (p *Processor) uploadAll(ctx context.Context, reader io.Reader, uploads []*destinationUpload, totalSize int64) error {
+	if p.config.VolumeSize > 0 {
+		return p.uploadVolumes(ctx, reader, uploads)
+	}
+	if len(uploads) == 1 {
+		uploads[0].err = uploads[0].upload(ctx, reader, totalSize)
+		return uploads[0].err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mutex sync.Mutex
+	var failures []error
+	var wg sync.WaitGroup
+
+	for _, u := range uploads {
+		pipeReader, pipeWriter := io.Pipe()
+		u.writer = pipeWriter
+
+		wg.Add(1)
+		go func(u *destinationUpload) {
+			defer wg.Done()
+			err := u.upload(ctx, pipeReader, totalSize)
+			// An upload that returned takes no more of the stream
+			pipeReader.CloseWithError(err)
+			u.err = err
+			if err == nil {
+				return
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			// A changed stream makes the whole backup start over
+			if p.failurePolicy == FailureAbort || errors.Is(err, storage.ErrStreamChanged) {
+				// Uploads cancelled because of this failure are not worth reporting
+				if len(failures) == 0 {
+					p.logger.Errorf("Upload to %s failed, aborting the other destinations: %v", u.Name, err)
+					failures = append(failures, fmt.Errorf("%s: %w", u.Name, err))
+				}
+				cancel()
+				return
+			}
+			p.logger.Errorf("Upload to %s failed, continuing with the other destinations: %v", u.Name, err)
+			failures = append(failures, fmt.Errorf("%s: %w", u.Name, err))
+		}(u)
+	}
+
+	p.tee(ctx, reader, uploads)
+	wg.Wait()
+
+	return p.uploadResult(failures, len(uploads))
+}
+
+// uploadVolumes splits the archive stream into volumes and uploads each of
+// them to every destination before reading the next. A volume is spooled to
+// disk once, however many destinations it is uploaded to, and they read it at
+// the same time.
+func (p *Processor) uploadVolumes(ctx context.Context, reader io.Reader, uploads []*destinationUpload) error {
+	active := uploads
+	var failures []error
+
+	// failed records the failure of u and returns the error that ends all
+	// uploads, or nil when the others go on
+	failed := func(u *destinationUpload, err error) error {
+		u.err = err
+		if p.failurePolicy == FailureAbort || errors.Is(err, storage.ErrStreamChanged) {
+			p.logger.Errorf("Upload to %s failed, aborting the other destinations: %v", u.Name, err)
+			return fmt.Errorf("%s: %w", u.Name, err)
+		}
+		p.logger.Errorf("Upload to %s failed, continuing with the other destinations: %v", u.Name, err)
+		failures = append(failures, fmt.Errorf("%s: %w", u.Name, err))
+		return nil
+	}
+
+	sizes, err := splitVolumes(reader, p.config.VolumeSize, func(volume int, spool *os.File, size int64, sum string) error {
+		errs := make([]error, len(active))
+		var wg sync.WaitGroup
+		for i, u := range active {
+			wg.Add(1)
+			go func(i int, u *destinationUpload) {
+				defer wg.Done()
+				errs[i] = u.volumes.put(ctx, volume, io.NewSectionReader(spool, 0, size), size, sum, u.tracker)
+			}(i, u)
+		}
+		wg.Wait()
+
+		var remaining []*destinationUpload
+		for i, u := range active {
+			if errs[i] == nil {
+				remaining = append(remaining, u)
+			} else if err := failed(u, errs[i]); err != nil {
+				return err
+			}
+		}
+		active = remaining
+		if len(active) == 0 {
+			return errors.Join(failures...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, u := range active {
+		if err := u.volumes.finish(ctx, sizes); err != nil {
+			if err := failed(u, err); err != nil {
+				return err
+			}
+		}
+	}
+	return p.uploadResult(failures, len(uploads))
+}
+
+// uploadResult returns the error of an upload to total destinations of which
+// failures failed. With FailureContinue the backup is complete as long as one
+// destination stored it, so the failures are only logged, unless the stream
+// changed since an interrupted upload.
+func (p *Processor) uploadResult(failures []error, total int) error {
+	if len(failures) == 0 {
+		return nil
+	}
+	err := errors.Join(failures...)
+	if p.failurePolicy == FailureContinue && len(failures) < total && !errors.Is(err, storage.ErrStreamChanged) {
+		for _, failure := range failures {
+			p.logger.Errorf("Not stored on %v", failure)
+		}
+		p.logger.Errorf("%d of %d destinations failed; the backup is stored on the others", len(failures), total)
+		return nil
+	}
+	return err
+}
+
+// succeeded returns the destinations whose upload stored the archive
+func succeeded(uploads []*destinationUpload) []Destination {
+	var destinations []Destination
+	for _, u := range uploads {
+		if u.err == nil {
+			destinations = append(destinations, u.Destination)
+		}
+	}
+	return destinations
+}
+
+// tee copies the stream to the pipe of every destination that is still
+// uploading, and closes the pipes at the end of the stream
+func (p *Processor) tee(ctx context.Context, reader io.Reader, uploads []*destinationUpload) {
+	active := uploads
+	buffer := make([]byte, teeBufferSize)
+
+	var err error
+	for len(active) > 0 {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+
+		n, readErr := reader.Read(buffer)
+		if n > 0 {
+			active = writeAll(active, buffer[:n])
+		}
+		if readErr != nil {
+			if readErr != io.EOF {
+				err = readErr
+			}
+			break
+		}
+	}
+
+	// A nil error ends the remaining uploads with a clean EOF
+	for _, u := range active {
+		u.writer.CloseWithError(err)
+	}
+}
+
+// writeAll writes data to every upload at the same time and returns the
+// uploads that are still reading
+func writeAll(uploads []*destinationUpload, data []byte) []*destinationUpload {
+	failed := make([]bool, len(uploads))
+	var wg sync.WaitGroup
+	for i, u := range uploads {
+		wg.Add(1)
+		go func(i int, u *destinationUpload) {
+			defer wg.Done()
+			if _, err := u.writer.Write(data); err != nil {
+				failed[i] = true
+			}
+		}(i, u)
+	}
+	wg.Wait()
+
+	var active []*destinationUpload
+	for i, u := range uploads {
+		if !failed[i] {
+			active = append(active, u)
+		}
+	}
+	return active
+}
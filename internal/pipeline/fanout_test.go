@@ -0,0 +1,215 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+	"github.com/seriousconsult/cloud_safe/internal/progress"
+	"github.com/seriousconsult/cloud_safe/internal/setup"
+	"github.com/seriousconsult/cloud_safe/internal/storage"
+)
+
+// memoryProvider is a StorageProvider kept in memory. UploadStream stores
+// under key; with err set every upload fails with it after reading part of
+// the stream.
+type memoryProvider struct {
+	mutex   sync.Mutex
+	key     string
+	err     error
+	objects map[string][]byte
+}
+
+func newMemoryProvider(key string, err error) *memoryProvider {
+	return &memoryProvider{key: key, err: err, objects: make(map[string][]byte)}
+}
+
+func (m *memoryProvider) UploadStream(ctx context.Context, reader io.Reader, estimatedSize int64, tracker progress.Tracker) error {
+	return m.PutObject(ctx, m.key, reader, estimatedSize, tracker)
+}
+
+func (m *memoryProvider) PutObject(ctx context.Context, key string, reader io.Reader, size int64, tracker progress.Tracker) error {
+	if m.err != nil {
+		io.CopyN(io.Discard, reader, 1024)
+		return m.err
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.objects[key] = data
+	return nil
+}
+
+func (m *memoryProvider) WithKey(key string) storage.StorageProvider {
+	return &keyedProvider{StorageProvider: m, key: key}
+}
+
+func (m *memoryProvider) DeleteObject(ctx context.Context, key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.objects[key]; !ok {
+		return os.ErrNotExist
+	}
+	delete(m.objects, key)
+	return nil
+}
+
+// keyedProvider uploads streams under key with the PutObject of the provider
+// it wraps
+type keyedProvider struct {
+	storage.StorageProvider
+	key string
+}
+
+func (k *keyedProvider) UploadStream(ctx context.Context, reader io.Reader, estimatedSize int64, tracker progress.Tracker) error {
+	return k.PutObject(ctx, k.key, reader, estimatedSize, tracker)
+}
+
+func (m *memoryProvider) DownloadStream(ctx context.Context, key string, writer io.Writer, tracker progress.Tracker) error {
+	m.mutex.Lock()
+	data, ok := m.objects[key]
+	m.mutex.Unlock()
+	if !ok {
+		return os.ErrNotExist
+	}
+	_, err := writer.Write(data)
+	return err
+}
+
+func (m *memoryProvider) Stat(ctx context.Context, key string) (*storage.ObjectInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	data, ok := m.objects[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return &storage.ObjectInfo{Key: key, Size: int64(len(data)), LastModified: time.Now()}, nil
+}
+
+func (m *memoryProvider) List(ctx context.Context, prefix string) ([]storage.ObjectInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var objects []storage.ObjectInfo
+	for key, data := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, storage.ObjectInfo{Key: key, Size: int64(len(data))})
+		}
+	}
+	return objects, nil
+}
+
+func (m *memoryProvider) CheckResumability(ctx context.Context) (storage.ResumableUpload, error) {
+	return nil, nil
+}
+
+func (m *memoryProvider) GetProviderType() storage.Provider {
+	return "memory"
+}
+
+func (m *memoryProvider) ValidateConfig() error {
+	return nil
+}
+
+func TestFailureContinue(t *testing.T) {
+	ctx := context.Background()
+	errUpload := errors.New("upload failed")
+
+	tests := []struct {
+		name       string
+		working    bool
+		volumeSize int64
+		wantErr    bool
+	}{
+		{name: "one destination fails", working: true},
+		{name: "every destination fails", wantErr: true},
+		{name: "one destination of volumes fails", working: true, volumeSize: MinVolumeSize},
+		{name: "every destination of volumes fails", volumeSize: MinVolumeSize, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := t.TempDir()
+			if err := os.WriteFile(filepath.Join(source, "file"), bytes.Repeat([]byte("content"), 400000), 0600); err != nil {
+				t.Fatal(err)
+			}
+			cfg := &setup.Config{
+				SourcePaths:     []string{source},
+				S3Filename:      "backup.tar",
+				StorageProvider: string(storage.ProviderLocal),
+				LocalPath:       t.TempDir(),
+				FailurePolicy:   string(FailureContinue),
+				Compression:     "none",
+				Index:           true,
+				Incremental:     true,
+				Resume:          true,
+				StateDir:        t.TempDir(),
+				ManifestDir:     t.TempDir(),
+				VolumeSize:      tt.volumeSize,
+			}
+			processor, err := NewProcessor(cfg, logger.New(false).Quiet())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			working := newMemoryProvider(cfg.S3Filename, nil)
+			if !tt.working {
+				working.err = errUpload
+			}
+			failing := newMemoryProvider(cfg.S3Filename, errUpload)
+			processor.destinations = []Destination{{Name: "working", Provider: working}, {Name: "failing", Provider: failing}}
+
+			err = processor.Process(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Process() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if len(failing.objects) != 0 {
+				t.Errorf("failing destination stored %d objects", len(failing.objects))
+			}
+
+			manifest, err := manifestPath(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, statErr := os.Stat(manifest)
+			if tt.wantErr {
+				if statErr == nil {
+					t.Error("manifest of a failed backup was saved")
+				}
+				return
+			}
+
+			// The backup completes on the destination that stored it
+			if _, ok := working.objects[cfg.S3Filename]; !ok {
+				t.Error("working destination has no archive")
+			}
+			if _, ok := working.objects[VolumeKey(cfg.S3Filename, 1)]; tt.volumeSize > 0 && !ok {
+				t.Error("working destination has no second volume")
+			}
+			if _, ok := working.objects[IndexKey(cfg.S3Filename)]; !ok {
+				t.Error("working destination has no index")
+			}
+			if statErr != nil {
+				t.Errorf("manifest was not saved: %v", statErr)
+			}
+			// The failed destination can still be resumed
+			state, err := streamStatePath(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(state); err != nil {
+				t.Errorf("stream state was not kept for the failed destination: %v", err)
+			}
+		})
+	}
+}
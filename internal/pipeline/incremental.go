@@ -0,0 +1,93 @@
+package pipeline
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/seriousconsult/cloud_safe/internal/compressor"
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+	"github.com/seriousconsult/cloud_safe/internal/setup"
+	"github.com/seriousconsult/cloud_safe/internal/storage"
+)
+
+// backupSet identifies the sources and destinations of a backup. The backups
+// of a chain share it while each has its own archive name.
+func backupSet(cfg *setup.Config) string {
+	sources := make([]string, len(cfg.SourcePaths))
+	for i, source := range cfg.SourcePaths {
+		if abs, err := filepath.Abs(source); err == nil {
+			source = abs
+		}
+		sources[i] = source
+	}
+
+	setCfg := *cfg
+	setCfg.S3Filename = ""
+	var locations []string
+	for _, provider := range cfg.GetDestinations() {
+		locations = append(locations, providerTarget(&setCfg, provider))
+	}
+	return strings.Join(sources, ",") + " -> " + strings.Join(locations, ",")
+}
+
+// manifestPath returns the file the manifest of the last backup of the
+// configured sources to the configured destinations is kept in
+func manifestPath(cfg *setup.Config) (string, error) {
+	dir, err := cfg.GetManifestDir()
+	if err != nil {
+		return "", err
+	}
+	return storage.StatePath(dir, "manifest", backupSet(cfg)), nil
+}
+
+// loadBaseManifest returns the manifest an incremental backup is made
+// against, or nil when a full backup has to be made
+func loadBaseManifest(cfg *setup.Config, log *logger.Logger) (*compressor.Manifest, error) {
+	if cfg.FullBackup {
+		log.Info("Making a full backup that starts a new chain")
+		return nil, nil
+	}
+
+	path, err := manifestPath(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var base compressor.Manifest
+	found, err := storage.LoadState(path, &base)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load manifest of the previous backup: %w", err)
+	}
+	if !found {
+		log.Info("No manifest of a previous backup of these sources; making a full backup")
+		return nil, nil
+	}
+	if base.Version > compressor.ManifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d in %s", base.Version, path)
+	}
+	// Uploading under the same name would replace the archive the new one
+	// depends on
+	if base.Archive == cfg.S3Filename {
+		return nil, fmt.Errorf("%s is the previous backup of these sources; give the incremental backup a new filename or pass --full", base.Archive)
+	}
+
+	log.Infof("Making an incremental backup on top of %s (%d entries)", base.Archive, len(base.Files))
+	return &base, nil
+}
+
+// saveManifest keeps the manifest of a completed backup for the next
+// incremental backup
+func (p *Processor) saveManifest() error {
+	manifest := p.compressor.Manifest()
+	if manifest == nil {
+		return nil
+	}
+	manifest.Archive = p.config.S3Filename
+
+	path, err := manifestPath(p.config)
+	if err != nil {
+		return err
+	}
+	return storage.SaveState(path, manifest)
+}
@@ -0,0 +1,125 @@
+package pipeline
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+	"github.com/seriousconsult/cloud_safe/internal/setup"
+	"github.com/seriousconsult/cloud_safe/internal/storage"
+)
+
+// readTree returns the content of every file under dir by slash-separated path
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestRestoreSnapshotChain(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(false).Quiet()
+	source := t.TempDir()
+	write := func(name, content string) {
+		path := filepath.Join(source, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	remove := func(name string) {
+		if err := os.RemoveAll(filepath.Join(source, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store, stateDir, manifestDir := t.TempDir(), t.TempDir(), t.TempDir()
+	config := func(archive string) *setup.Config {
+		return &setup.Config{
+			SourcePaths:     []string{source},
+			S3Filename:      archive,
+			StorageProvider: string(storage.ProviderLocal),
+			LocalPath:       store,
+			Compression:     "zstd",
+			Incremental:     true,
+			StateDir:        stateDir,
+			ManifestDir:     manifestDir,
+		}
+	}
+	backup := func(archive string) {
+		t.Helper()
+		processor, err := NewProcessor(config(archive), log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := processor.Process(ctx); err != nil {
+			t.Fatalf("backup to %s failed: %v", archive, err)
+		}
+	}
+
+	write("kept.txt", "kept")
+	write("changed.txt", "first version")
+	write("deleted.txt", "deleted later")
+	write("dir/deleted.txt", "deleted with its folder")
+	backup("full.tar")
+
+	write("changed.txt", "second, longer version")
+	write("added.txt", "added")
+	remove("deleted.txt")
+	remove("dir")
+	backup("first.tar")
+
+	// The last backup of the chain does not mention the deleted files
+	write("last.txt", "added last")
+	backup("second.tar")
+
+	restorer, err := NewRestorer(config("second.tar"), log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := restorer.chain(ctx, "second.tar")
+	if want := []string{"full.tar", "first.tar", "second.tar"}; err != nil || !reflect.DeepEqual(chain, want) {
+		t.Fatalf("chain() = %v, %v, want %v", chain, err, want)
+	}
+	target := t.TempDir()
+	if err := restorer.Restore(ctx, target); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+
+	base := filepath.Base(source)
+	want := map[string]string{
+		base + "/kept.txt":    "kept",
+		base + "/changed.txt": "second, longer version",
+		base + "/added.txt":   "added",
+		base + "/last.txt":    "added last",
+	}
+	if got := readTree(t, target); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored files = %v, want %v", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(target, base, "dir")); !os.IsNotExist(err) {
+		t.Errorf("deleted folder was restored: %v", err)
+	}
+}
@@ -0,0 +1,445 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/seriousconsult/cloud_safe/internal/compressor"
+	"github.com/seriousconsult/cloud_safe/internal/crypto"
+	"github.com/seriousconsult/cloud_safe/internal/storage"
+)
+
+// IndexKey returns the key the index of the archive stored under key is
+// stored under
+func IndexKey(key string) string {
+	return key + ".index"
+}
+
+// saveIndex uploads the index recorded while compressing to every
+// destination. It is compressed like the archive and encrypted with a data
+// key of its own.
+func (p *Processor) saveIndex(ctx context.Context, archiveKey *crypto.ArchiveKey, destinations []Destination) error {
+	index := p.compressor.Index()
+	if index == nil {
+		return nil
+	}
+	index.Codec = p.codec
+	if archiveKey != nil {
+		layout, err := archiveKey.Layout()
+		if err != nil {
+			return err
+		}
+		index.SetEncryption(&compressor.IndexEncryption{
+			HeaderSize:      layout.HeaderSize,
+			ChunkSize:       layout.ChunkSize,
+			SealedChunkSize: layout.SealedChunkSize,
+		})
+	}
+
+	var compressed bytes.Buffer
+	codecWriter, err := compressor.NewCompressWriter(&compressed, p.codec, p.config.CompressionLevel)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(codecWriter).Encode(index); err != nil {
+		return fmt.Errorf("failed to encode index: %w", err)
+	}
+	if err := codecWriter.Close(); err != nil {
+		return fmt.Errorf("failed to compress index: %w", err)
+	}
+
+	data := compressed.Bytes()
+	if p.encryptor != nil {
+		var sealed bytes.Buffer
+		if err := p.encryptor.EncryptStream(bytes.NewReader(data), &sealed); err != nil {
+			return fmt.Errorf("failed to encrypt index: %w", err)
+		}
+		data = sealed.Bytes()
+	}
+
+	var errs []error
+	for _, destination := range destinations {
+		err := destination.Provider.PutObject(ctx, IndexKey(p.config.S3Filename), bytes.NewReader(data), int64(len(data)), nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", destination.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	p.logger.Infof("Uploaded index of %d entries: %s", len(index.Entries), IndexKey(p.config.S3Filename))
+	return nil
+}
+
+// LoadIndex downloads and decrypts the index of the configured archive
+func (r *Restorer) LoadIndex(ctx context.Context) (*compressor.Index, error) {
+	key := IndexKey(r.config.S3Filename)
+	var stored bytes.Buffer
+	if err := r.storage.DownloadStream(ctx, key, &stored, nil); err != nil {
+		return nil, fmt.Errorf("failed to download index %s (archives have one when uploaded with --index): %w", key, err)
+	}
+
+	var data io.Reader = &stored
+	if crypto.HasMagic(stored.Bytes()) {
+		if r.decryptor == nil {
+			return nil, fmt.Errorf("archive index is encrypted; restore with --encrypt and the key used for upload")
+		}
+		var opened bytes.Buffer
+		if err := r.decryptor.DecryptStream(&stored, &opened); err != nil {
+			return nil, fmt.Errorf("failed to decrypt index: %w", err)
+		}
+		data = &opened
+	}
+
+	decompressor, _, err := compressor.NewDecompressReader(data)
+	if err != nil {
+		return nil, err
+	}
+	defer decompressor.Close()
+
+	var index compressor.Index
+	if err := json.NewDecoder(decompressor).Decode(&index); err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+	if index.Version > compressor.IndexVersion {
+		return nil, fmt.Errorf("unsupported index version %d", index.Version)
+	}
+	return &index, nil
+}
+
+// RestorePaths extracts the entries of the configured archive named by
+// paths, and the entries below them, into targetDir. Only the frames of the
+// archive that hold them are downloaded.
+func (r *Restorer) RestorePaths(ctx context.Context, targetDir string, paths []string) error {
+	index, err := r.LoadIndex(ctx)
+	if err != nil {
+		return err
+	}
+	selected, err := selectEntries(index, paths)
+	if err != nil {
+		return err
+	}
+	r.logger.Infof("Restoring %d entries from %d of %d frames", len(selected), countFrames(selected), len(index.Frames))
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(r.copyEntries(ctx, index, selected, writer))
+	}()
+	defer reader.Close()
+
+	if err := r.extractor.Extract(ctx, reader, targetDir); err != nil {
+		return fmt.Errorf("restore failed: %w", err)
+	}
+	return nil
+}
+
+// selectEntries returns the entries named by paths or below them, in archive
+// order, together with the files that selected hard links point at
+func selectEntries(index *compressor.Index, paths []string) ([]compressor.IndexEntry, error) {
+	wanted := make(map[string]bool)
+	for i, entry := range index.Entries {
+		name := strings.TrimSuffix(entry.Name, "/")
+		for _, path := range paths {
+			path = strings.Trim(path, "/")
+			if name == path || strings.HasPrefix(name, path+"/") {
+				wanted[name] = true
+				if index.Entries[i].HardLink {
+					wanted[strings.TrimSuffix(entry.Linkname, "/")] = true
+				}
+			}
+		}
+	}
+
+	for _, path := range paths {
+		path = strings.Trim(path, "/")
+		found := false
+		for name := range wanted {
+			if name == path || strings.HasPrefix(name, path+"/") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("archive has no entry %s", path)
+		}
+	}
+
+	var selected []compressor.IndexEntry
+	for _, entry := range index.Entries {
+		if wanted[strings.TrimSuffix(entry.Name, "/")] {
+			selected = append(selected, entry)
+		}
+	}
+	return selected, nil
+}
+
+// countFrames returns the number of frames entries are in
+func countFrames(entries []compressor.IndexEntry) int {
+	frames := 0
+	for i, entry := range entries {
+		if i == 0 || entry.Frame != entries[i-1].Frame {
+			frames++
+		}
+	}
+	return frames
+}
+
+// copyEntries writes the tar stream of entries to writer, reading each frame
+// that holds some of them once
+func (r *Restorer) copyEntries(ctx context.Context, index *compressor.Index, entries []compressor.IndexEntry, writer io.Writer) error {
+	key := r.config.S3Filename
+	source, err := r.newFrameSource(ctx, key, index)
+	if err != nil {
+		return err
+	}
+
+	for len(entries) > 0 {
+		frame := entries[0].Frame
+		if frame < 0 || frame >= len(index.Frames) {
+			return fmt.Errorf("index entry %s is in frame %d of %d", entries[0].Name, frame, len(index.Frames))
+		}
+		stream, err := source.open(ctx, frame)
+		if err != nil {
+			return err
+		}
+
+		position := index.Frames[frame].Offset
+		for len(entries) > 0 && entries[0].Frame == frame {
+			entry := entries[0]
+			entries = entries[1:]
+			if _, err := io.CopyN(io.Discard, stream, entry.Offset-position); err != nil {
+				stream.Close()
+				return fmt.Errorf("failed to read frame %d: %w", frame, err)
+			}
+			if _, err := io.CopyN(writer, stream, entry.Length); err != nil {
+				stream.Close()
+				return fmt.Errorf("failed to read %s: %w", entry.Name, err)
+			}
+			position = entry.Offset + entry.Length
+		}
+		stream.Close()
+	}
+	return nil
+}
+
+// frameSource reads single frames of a stored archive
+type frameSource struct {
+	restorer *Restorer
+	key      string
+	index    *compressor.Index
+	// opener and lastChunk are set for an encrypted archive
+	opener    *crypto.ChunkOpener
+	lastChunk int64
+}
+
+// newFrameSource prepares to read frames of the archive stored under key.
+// For an encrypted archive it reads the header to recover the data key. The
+// header is parsed from the start of the archive rather than read by the size
+// the index recorded, since rekeying the archive changes that size.
+func (r *Restorer) newFrameSource(ctx context.Context, key string, index *compressor.Index) (*frameSource, error) {
+	source := &frameSource{restorer: r, key: key, index: index}
+	if index.Encryption == nil {
+		return source, nil
+	}
+	if r.decryptor == nil {
+		return nil, fmt.Errorf("archive is encrypted; restore with --encrypt and the key used for upload")
+	}
+
+	header := r.fetchRange(ctx, key, 0, -1)
+	defer header.Close()
+	opener, err := r.decryptor.NewChunkOpener(header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive header: %w", err)
+	}
+
+	info, err := r.storage.Stat(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat archive: %w", err)
+	}
+	source.opener = opener
+	source.lastChunk = opener.Layout().LastChunk(info.Size)
+	return source, nil
+}
+
+// open returns the decompressed tar stream of a frame, which starts at the
+// frame's offset in the tar stream
+func (s *frameSource) open(ctx context.Context, frame int) (io.ReadCloser, error) {
+	start := s.index.Frames[frame].CompressedOffset
+	// The last frame runs to the end of the archive
+	end := int64(-1)
+	if frame+1 < len(s.index.Frames) {
+		end = s.index.Frames[frame+1].CompressedOffset
+	}
+
+	var compressed io.ReadCloser
+	if s.opener == nil {
+		length := int64(-1)
+		if end >= 0 {
+			length = end - start
+		}
+		compressed = s.restorer.fetchRange(ctx, s.key, start, length)
+	} else {
+		compressed = s.decryptRange(ctx, start, end)
+	}
+
+	var decompressor io.ReadCloser
+	var err error
+	if s.index.Codec != "" {
+		decompressor, err = compressor.NewCodecReader(compressed, s.index.Codec)
+	} else {
+		decompressor, _, err = compressor.NewDecompressReader(compressed)
+	}
+	if err != nil {
+		compressed.Close()
+		return nil, fmt.Errorf("failed to read frame %d: %w", frame, err)
+	}
+	return &frameReader{ReadCloser: decompressor, compressed: compressed}, nil
+}
+
+// decryptRange returns the plaintext of an encrypted archive from start to
+// end, or to the end of the archive for a negative end. Only the sealed
+// chunks holding that range are downloaded.
+func (s *frameSource) decryptRange(ctx context.Context, start, end int64) io.ReadCloser {
+	layout := s.opener.Layout()
+	first := layout.Chunk(start)
+	last := s.lastChunk
+	length := int64(-1)
+	if end >= 0 && layout.Chunk(end-1) < last {
+		length = layout.ChunkOffset(layout.Chunk(end-1)+1) - layout.ChunkOffset(first)
+	}
+	sealed := s.restorer.fetchRange(ctx, s.key, layout.ChunkOffset(first), length)
+
+	reader, writer := io.Pipe()
+	go func() {
+		defer sealed.Close()
+		writer.CloseWithError(s.opener.DecryptChunks(sealed, writer, first, last))
+	}()
+
+	// Drop the start of the first chunk and the end of the last
+	var plain io.Reader = reader
+	if _, err := io.CopyN(io.Discard, plain, start-first*layout.ChunkSize); err != nil {
+		reader.CloseWithError(err)
+	}
+	if end >= 0 {
+		plain = io.LimitReader(plain, end-start)
+	}
+	return &readCloser{Reader: plain, close: reader.Close}
+}
+
+// frameReader closes the download under a decompressed frame with it
+type frameReader struct {
+	io.ReadCloser
+	compressed io.Closer
+}
+
+func (f *frameReader) Close() error {
+	f.ReadCloser.Close()
+	return f.compressed.Close()
+}
+
+// readCloser pairs a reader with the Close of the stream under it
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r *readCloser) Close() error {
+	return r.close()
+}
+
+// errRangeComplete stops a download once the wanted range is written
+var errRangeComplete = errors.New("range complete")
+
+// fetchRange returns length bytes of the object stored under key from
+// offset, or the rest of the object for a negative length
+func (r *Restorer) fetchRange(ctx context.Context, key string, offset, length int64) io.ReadCloser {
+	return fetchRange(ctx, r.storage, key, offset, length)
+}
+
+// fetchRange returns length bytes of the object stored under key from
+// offset, or the rest of the object for a negative length. Providers that
+// read ranges fetch only those bytes; with the others the object is
+// downloaded from its start and the download stops when the range is
+// complete or the reader is closed.
+func fetchRange(ctx context.Context, provider storage.StorageProvider, key string, offset, length int64) io.ReadCloser {
+	reader, writer := io.Pipe()
+	go func() {
+		if ranger, ok := provider.(storage.RangeReader); ok {
+			writer.CloseWithError(readRange(ctx, ranger, key, offset, length, writer))
+			return
+		}
+
+		window := &rangeWriter{writer: writer, skip: offset, remaining: length}
+		err := provider.DownloadStream(ctx, key, window, nil)
+		if window.remaining == 0 {
+			err = nil
+		} else if err == nil && window.remaining > 0 {
+			err = fmt.Errorf("object %s ends before byte %d", key, offset+length)
+		}
+		writer.CloseWithError(err)
+	}()
+	return reader
+}
+
+// readRange copies a range of the object stored under key to writer
+func readRange(ctx context.Context, ranger storage.RangeReader, key string, offset, length int64, writer io.Writer) error {
+	body, err := ranger.ReadRange(ctx, key, offset, length)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	n, err := io.Copy(writer, body)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	if length >= 0 && n < length {
+		return fmt.Errorf("object %s ends before byte %d", key, offset+length)
+	}
+	return nil
+}
+
+// rangeWriter passes on a range of the bytes written to it
+type rangeWriter struct {
+	writer io.Writer
+	// skip is the number of bytes before the range still to be dropped
+	skip int64
+	// remaining is the number of bytes of the range still to be written,
+	// or negative for all the rest
+	remaining int64
+}
+
+func (w *rangeWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if w.skip > 0 {
+		if int64(len(p)) <= w.skip {
+			w.skip -= int64(len(p))
+			return n, nil
+		}
+		p = p[w.skip:]
+		w.skip = 0
+	}
+	if w.remaining == 0 {
+		return 0, errRangeComplete
+	}
+	if w.remaining > 0 && int64(len(p)) > w.remaining {
+		p = p[:w.remaining]
+	}
+	written, err := w.writer.Write(p)
+	if w.remaining > 0 {
+		w.remaining -= int64(written)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if w.remaining == 0 {
+		return n, errRangeComplete
+	}
+	return n, nil
+}
@@ -0,0 +1,36 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/seriousconsult/cloud_safe/internal/crypto"
+	"github.com/seriousconsult/cloud_safe/internal/setup"
+	"github.com/seriousconsult/cloud_safe/internal/storage"
+)
+
+// NewKeyManager creates the configured key manager, or returns nil when data
+// keys are wrapped locally with recipients or a passphrase instead
+func NewKeyManager(cfg *setup.Config) (crypto.KeyManager, error) {
+	switch cfg.KeyManager {
+	case "", "none":
+		return nil, nil
+
+	case crypto.AWSKMSName:
+		// KMS uses the same region and credential chain as the S3 provider
+		awsCfg, err := storage.LoadAWSConfig(context.Background(), cfg.AWSRegion, cfg.AWSProfile)
+		if err != nil {
+			return nil, err
+		}
+		return crypto.NewAWSKMSManager(awsCfg, cfg.KMSKeyID)
+
+	case crypto.KeyringName:
+		if cfg.KeyringFile == "" {
+			return nil, fmt.Errorf("keyring file is required: set --keyring or default_settings.keyring_file")
+		}
+		return crypto.LoadKeyring(cfg.KeyringFile)
+
+	default:
+		return nil, fmt.Errorf("unsupported key manager: %s (supported: none, %s, %s)", cfg.KeyManager, crypto.AWSKMSName, crypto.KeyringName)
+	}
+}
@@ -2,9 +2,9 @@ package pipeline
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"os"
 	"time"
 
 	"github.com/seriousconsult/cloud_safe/internal/compressor"
@@ -20,65 +20,244 @@ type Processor struct {
 	config     *setup.Config
 	logger     *logger.Logger
 	compressor *compressor.TarCompressor
+	codec      compressor.Codec
 	encryptor  *crypto.StreamEncryptor
-	storage    storage.StorageProvider
+
+	// destinations receive the same archive stream; see uploadAll
+	destinations  []Destination
+	failurePolicy FailurePolicy
 }
 
 // NewProcessor creates a new processor instance
 func NewProcessor(cfg *setup.Config, log *logger.Logger) (*Processor, error) {
-	// Initialize compressor
+	// Initialize compressor with the file selection
 	comp := compressor.NewTarCompressor(log)
+	filter, err := newFilter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	comp.SetFilter(filter)
+	special, err := compressor.ParseSpecialFilePolicy(cfg.SpecialFiles)
+	if err != nil {
+		return nil, err
+	}
+	comp.SetSpecialFilePolicy(special)
+	if cfg.Incremental {
+		base, err := loadBaseManifest(cfg, log)
+		if err != nil {
+			return nil, err
+		}
+		comp.SetIncremental(base)
+	}
+	comp.SetIndexed(cfg.Index)
+
+	// Resolve the compression codec applied to the tar stream
+	codec, err := compressor.ParseCodec(cfg.Compression)
+	if err != nil {
+		return nil, err
+	}
+	if err := compressor.ValidateLevel(codec, cfg.CompressionLevel); err != nil {
+		return nil, err
+	}
 
 	// Initialize encryptor if encryption is enabled
 	var enc *crypto.StreamEncryptor
 	if cfg.Encrypt {
-		var err error
-		enc, err = crypto.NewStreamEncryptor(cfg.GetEncryptionKey())
+		enc, err = newEncryptor(cfg, log)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create encryptor: %w", err)
+			return nil, err
 		}
 	}
 
-	// Initialize storage provider
-	storageProvider, err := storage.NewStorageProvider(cfg, log)
+	failurePolicy, err := ParseFailurePolicy(cfg.FailurePolicy)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create storage provider: %w", err)
+		return nil, err
+	}
+	if err := ValidateVolumeSize(cfg.VolumeSize); err != nil {
+		return nil, err
+	}
+
+	// Initialize the storage provider of every destination
+	destinations, err := NewDestinations(cfg, log)
+	if err != nil {
+		return nil, err
+	}
+
+	// Mega needs the size of a file before its upload starts, which only a
+	// volume has before the archive is written
+	for _, destination := range destinations {
+		if cfg.VolumeSize == 0 && destination.Provider.GetProviderType() == storage.ProviderMega {
+			log.Infof("Splitting the archive into volumes of %d MB for Mega", MegaVolumeSize/(1024*1024))
+			cfg.VolumeSize = MegaVolumeSize
+		}
 	}
 
 	return &Processor{
 		config:     cfg,
 		logger:     log,
 		compressor: comp,
+		codec:      codec,
 		encryptor:  enc,
-		storage:    storageProvider,
+
+		destinations:  destinations,
+		failurePolicy: failurePolicy,
 	}, nil
 }
 
+// newFilter creates the filter that selects the files archived from source
+// directories
+func newFilter(cfg *setup.Config) (*compressor.Filter, error) {
+	newerThan, err := compressor.ParseAge(cfg.NewerThan)
+	if err != nil {
+		return nil, err
+	}
+	olderThan, err := compressor.ParseAge(cfg.OlderThan)
+	if err != nil {
+		return nil, err
+	}
+
+	return compressor.NewFilter(compressor.FilterOptions{
+		Excludes:  cfg.Excludes,
+		Includes:  cfg.Includes,
+		MinSize:   cfg.MinFileSize,
+		MaxSize:   cfg.MaxFileSize,
+		NewerThan: newerThan,
+		OlderThan: olderThan,
+	})
+}
+
+// newEncryptor creates the encryptor for the configured mode: data keys from
+// the key manager when one is configured, recipient mode when public keys are
+// configured, otherwise a passphrase-derived key
+func newEncryptor(cfg *setup.Config, log *logger.Logger) (*crypto.StreamEncryptor, error) {
+	recipients, err := newRecipients(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	manager, err := NewKeyManager(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if manager != nil {
+		// Public keys are optional extra recipients of the same data key
+		log.Infof("Encrypting with data keys from %s key %s", manager.Name(), manager.KeyID())
+		enc, err := crypto.NewKeyManagerEncryptor(manager, recipients)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create encryptor: %w", err)
+		}
+		return enc, nil
+	}
+
+	if len(recipients) > 0 {
+		log.Infof("Encrypting to %d recipient public key(s)", len(recipients))
+		enc, err := crypto.NewRecipientEncryptor(recipients)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create encryptor: %w", err)
+		}
+		return enc, nil
+	}
+
+	passphrase, err := cfg.GetPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	if string(passphrase) == setup.InsecureDefaultPassphrase {
+		log.Error("WARNING: encrypting with the publicly known default key; anyone can decrypt this archive")
+	}
+
+	kdf, err := crypto.ParseKDF(cfg.KDF)
+	if err != nil {
+		return nil, err
+	}
+
+	enc, err := crypto.NewStreamEncryptor(passphrase, kdf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create encryptor: %w", err)
+	}
+	return enc, nil
+}
+
+// newRecipients parses the configured recipient public keys
+func newRecipients(cfg *setup.Config) ([]crypto.Recipient, error) {
+	recipients := make([]crypto.Recipient, 0, len(cfg.Recipients))
+	for _, key := range cfg.Recipients {
+		recipient, err := crypto.ParseX25519Recipient(key)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, recipient)
+	}
+	return recipients, nil
+}
+
 // Process executes the complete pipeline
 func (p *Processor) Process(ctx context.Context) error {
+	err := p.process(ctx)
+	if !errors.Is(err, storage.ErrStreamChanged) {
+		return err
+	}
+
+	// The interrupted upload was aborted; its archive key must not encrypt the
+	// changed stream, so the stream state is dropped and a new key created
+	p.logger.Infof("The sources changed since the interrupted upload (%v); starting over with a new archive key", err)
+	if err := p.forgetStream(); err != nil {
+		return err
+	}
+	return p.process(ctx)
+}
+
+// process runs the pipeline once
+func (p *Processor) process(ctx context.Context) error {
 	// Estimate total size for progress tracking
 	totalSize, err := p.compressor.EstimateSize(p.config.SourcePaths)
 	if err != nil {
 		return fmt.Errorf("failed to estimate size: %w", err)
 	}
 
-	p.logger.Infof("Estimated size: %.2f MB", float64(totalSize)/(1024*1024))
+	p.logger.Infof("Estimated size: %.2f MB (before %s compression)", float64(totalSize)/(1024*1024), p.codec)
 	p.logger.Infof("Size: %d bytes", totalSize)
 
-	// Create progress tracker
-	tracker := progress.NewTracker(totalSize)
-	defer tracker.Finish()
+	uploads := make([]*destinationUpload, len(p.destinations))
+	for i, destination := range p.destinations {
+		uploads[i] = &destinationUpload{Destination: destination}
+		// Each destination stores the volumes of the archive under its name
+		if p.config.VolumeSize > 0 {
+			uploads[i].volumes = newVolumeUpload(destination.Provider, destination.Name, p.config.S3Filename, p.config.VolumeSize, p.logger)
+		}
+	}
+
+	// Create progress trackers, printed together when there are several destinations
+	if len(uploads) == 1 {
+		tracker := progress.NewTracker(totalSize)
+		defer tracker.Finish()
+		uploads[0].tracker = tracker
+	} else {
+		names := make([]string, len(uploads))
+		for i, u := range uploads {
+			names[i] = u.Name
+		}
+		group := progress.NewGroup(totalSize, names...)
+		defer group.Finish()
+		for i, u := range uploads {
+			u.tracker = group.Tracker(i)
+		}
+	}
 
 	// Check for resumable uploads
-	resumableUpload, err := p.storage.CheckResumability(ctx)
-	if err != nil {
-		p.logger.Errorf("Failed to check resumability: %v", err)
+	for _, u := range uploads {
+		resumable, err := u.Provider.CheckResumability(ctx)
+		if err != nil {
+			p.logger.Errorf("Failed to check resumability of %s: %v", u.Name, err)
+			resumable = nil
+		}
+		u.resumable = resumable
 	}
 
-	if resumableUpload != nil {
-		p.logger.Info("Resuming previous upload")
-		// TODO: Implement resume logic by calculating already uploaded size
-		// and adjusting the tracker accordingly
+	// Reuse the archive key of a resumed upload so the stream is regenerated exactly
+	archiveKey, err := p.prepareStream(ctx, uploads)
+	if err != nil {
+		return err
 	}
 
 	// Create the processing pipeline
@@ -91,11 +270,26 @@ func (p *Processor) Process(ctx context.Context) error {
 		// once this goroutine finishes.
 		defer close(compressionDone)
 		// This defer closes the writer, which will cause the reader to unblock
-		// with an EOF or a pipe error.
-		defer pipelineWriter.Close()
+		// with an EOF, or with the compression error so that a truncated
+		// archive is never uploaded as if it were complete.
+		var err error
+		defer func() { pipelineWriter.CloseWithError(err) }()
+
+		// Compress the tar stream with the configured codec before encryption,
+		// after the archive header that records it. An indexed archive is
+		// compressed in frames that can be read on their own.
+		codecWriter, err := compressor.NewArchiveWriter(pipelineWriter, p.codec, p.config.CompressionLevel, p.config.Index)
+		if err != nil {
+			compressionDone <- err
+			return
+		}
 
 		p.logger.Debug("About to start compression in goroutine")
-		err := p.compressor.Compress(ctx, p.config.SourcePaths, pipelineWriter)
+		err = p.compressor.Compress(ctx, p.config.SourcePaths, codecWriter)
+		// Closing the codec writer flushes the final compressed frame
+		if closeErr := codecWriter.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("failed to flush %s stream: %w", p.codec, closeErr)
+		}
 		p.logger.Debugf("Compression goroutine finished with error: %v", err)
 		p.logger.Debug("About to send compression result to channel")
 		compressionDone <- err
@@ -112,8 +306,9 @@ func (p *Processor) Process(ctx context.Context) error {
 		encryptionDone := make(chan error, 1)
 		go func() {
 			defer close(encryptionDone) // Essential to unblock the main goroutine
-			defer encryptionWriter.Close()
-			encryptionDone <- p.encryptor.EncryptStream(pipelineReader, encryptionWriter)
+			err := crypto.EncryptStreamWithKey(archiveKey, pipelineReader, encryptionWriter)
+			encryptionWriter.CloseWithError(err)
+			encryptionDone <- err
 		}()
 
 		finalReader = encryptionReader
@@ -126,20 +321,24 @@ func (p *Processor) Process(ctx context.Context) error {
 		}()
 	}
 
-	// Start upload
+	// Start the uploads, or feed the regenerated stream to the interrupted uploads
 	p.logger.Debug("Starting upload stream")
-	uploadErr := p.storage.UploadStream(ctx, finalReader, totalSize, tracker)
+	uploadErr := p.uploadAll(ctx, finalReader, uploads, totalSize)
 	p.logger.Debug("Upload stream completed")
 
-	// Close the pipeline reader to signal completion to compression goroutine
+	// Close the pipeline readers to signal completion to the producer goroutines
 	pipelineReader.Close()
+	if encryptionReader, ok := finalReader.(*io.PipeReader); ok {
+		encryptionReader.Close()
+	}
 
 	// Wait for compression to complete
 	p.logger.Debug("Waiting for compression to complete")
 	p.logger.Debug("About to read from compressionDone channel")
 	compressionErr := <-compressionDone
 	p.logger.Debugf("Received compression result from channel: %v", compressionErr)
-	if compressionErr != nil {
+	// A failed upload closes the pipe under the compressor; report the upload error instead
+	if compressionErr != nil && !(uploadErr != nil && errors.Is(compressionErr, io.ErrClosedPipe)) {
 		return fmt.Errorf("compression failed: %w", compressionErr)
 	}
 	p.logger.Debug("Compression completed successfully")
@@ -149,6 +348,18 @@ func (p *Processor) Process(ctx context.Context) error {
 		return fmt.Errorf("upload failed: %w", uploadErr)
 	}
 
+	p.finishStream(uploads)
+
+	// The archive can still be restored as a whole without its index
+	if err := p.saveIndex(ctx, archiveKey, succeeded(uploads)); err != nil {
+		p.logger.Errorf("WARNING: failed to upload the archive index, the archive can only be restored as a whole: %v", err)
+	}
+
+	// The backup is complete even if its manifest cannot be kept
+	if err := p.saveManifest(); err != nil {
+		p.logger.Errorf("WARNING: failed to save manifest, the next incremental backup will be a full backup: %v", err)
+	}
+
 	p.logger.Debug("Process completed successfully")
 	return nil
 }
@@ -185,72 +396,3 @@ func (p *Processor) ProcessWithProgress(ctx context.Context, progressCallback fu
 
 	return p.Process(ctx)
 }
-
-// Validate validates the processor configuration
-func (p *Processor) Validate() error {
-	// Check source paths
-	if len(p.config.SourcePaths) == 0 {
-		return fmt.Errorf("at least one source path must be specified")
-	}
-
-	for _, sourcePath := range p.config.SourcePaths {
-		if _, err := os.Stat(sourcePath); os.IsNotExist(err) {
-			return fmt.Errorf("source path does not exist: %s", sourcePath)
-		}
-	}
-
-	// Validate configuration parameters (common)
-	if p.config.Workers <= 0 {
-		return fmt.Errorf("workers must be greater than 0")
-	}
-
-	if p.config.ChunkSize <= 0 {
-		return fmt.Errorf("chunk size must be greater than 0")
-	}
-
-	if p.config.BufferSize <= 0 {
-		return fmt.Errorf("buffer size must be greater than 0")
-	}
-
-	// Provider-specific validation
-	switch p.config.StorageProvider {
-	case "s3":
-		if p.config.S3Bucket == "" {
-			return fmt.Errorf("S3 bucket is required")
-		}
-		if p.config.S3Filename == "" {
-			return fmt.Errorf("target filename is required")
-		}
-	case "googledrive":
-		if p.config.GoogleDriveCredentialsPath == "" {
-			return fmt.Errorf("Google Drive credentials path is required")
-		}
-		if p.config.S3Filename == "" {
-			return fmt.Errorf("target filename is required")
-		}
-	case "mega":
-		if p.config.MegaUsername == "" || p.config.MegaPassword == "" {
-			return fmt.Errorf("Mega username and password are required")
-		}
-		if p.config.S3Filename == "" {
-			return fmt.Errorf("target filename is required")
-		}
-	case "minio":
-		if p.config.MinIOEndpoint == "" {
-			return fmt.Errorf("MinIO endpoint is required")
-		}
-		if p.config.MinIOAccessKeyID == "" || p.config.MinIOSecretAccessKey == "" {
-			return fmt.Errorf("MinIO access key and secret key are required")
-		}
-		if p.config.MinIOBucket == "" {
-			return fmt.Errorf("MinIO bucket is required")
-		}
-		if p.config.S3Filename == "" {
-			return fmt.Errorf("target filename is required")
-		}
-	default:
-		return fmt.Errorf("unsupported storage provider: %s", p.config.StorageProvider)
-	}
-
-	return nil
-}
@@ -0,0 +1,195 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/seriousconsult/cloud_safe/internal/crypto"
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+	"github.com/seriousconsult/cloud_safe/internal/setup"
+	"github.com/seriousconsult/cloud_safe/internal/storage"
+)
+
+// Rekeyer rewraps the data key in the header of an existing archive under new
+// key-encryption keys, leaving the encrypted payload untouched
+type Rekeyer struct {
+	config     *setup.Config
+	logger     *logger.Logger
+	identities []crypto.Identity
+	recipients []crypto.Recipient
+	storage    storage.StorageProvider
+}
+
+// NewRekeyer creates a rekeyer that unwraps data keys with the configured
+// private key file or passphrase and wraps them for recipients
+func NewRekeyer(cfg *setup.Config, recipients []crypto.Recipient, log *logger.Logger) (*Rekeyer, error) {
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("at least one new key is required")
+	}
+
+	identities, err := newIdentities(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Initialize storage provider
+	storageProvider, err := storage.NewStorageProvider(cfg, log)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage provider: %w", err)
+	}
+
+	return &Rekeyer{
+		config:     cfg,
+		logger:     log,
+		identities: identities,
+		recipients: recipients,
+		storage:    storageProvider,
+	}, nil
+}
+
+// Rekey replaces the header of the configured archive with one that wraps the
+// same data key for the new recipients. The header of an archive split into
+// volumes is in its first volume, whose new size is recorded in the manifest.
+// The index uploaded with the archive, which is encrypted for the same keys,
+// is rekeyed with it.
+func (r *Rekeyer) Rekey(ctx context.Context) error {
+	key := r.config.S3Filename
+
+	if err := r.rekeyArchive(ctx, key); err != nil {
+		return err
+	}
+
+	// Archives uploaded without --index have none
+	indexKey := IndexKey(key)
+	exists, err := hasObject(ctx, r.storage, indexKey)
+	if err != nil {
+		return fmt.Errorf("failed to look for archive index: %w", err)
+	}
+	if !exists {
+		return nil
+	}
+	if _, err := r.rekeyObject(ctx, r.storage, indexKey); err != nil {
+		return fmt.Errorf("failed to rekey archive index %s: %w", indexKey, err)
+	}
+	return nil
+}
+
+// rekeyArchive replaces the header of the archive stored under key
+func (r *Rekeyer) rekeyArchive(ctx context.Context, key string) error {
+	manifest, _, err := readVolumeManifest(ctx, r.storage, key)
+	if err != nil {
+		return fmt.Errorf("failed to stat archive: %w", err)
+	}
+	if manifest == nil {
+		_, err := r.rekeyObject(ctx, r.storage, key)
+		return err
+	}
+
+	// Only the first volume holds the encryption header
+	if manifest.Sizes[0], err = r.rekeyObject(ctx, r.storage, VolumeKey(key, 0)); err != nil {
+		return err
+	}
+
+	data, err := manifest.encode()
+	if err != nil {
+		return err
+	}
+	if err := r.storage.PutObject(ctx, key, bytes.NewReader(data), int64(len(data)), nil); err != nil {
+		return fmt.Errorf("failed to upload volume manifest: %w", err)
+	}
+	return nil
+}
+
+// hasObject reports whether provider stores an object under key
+func hasObject(ctx context.Context, provider storage.StorageProvider, key string) (bool, error) {
+	objects, err := provider.List(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	for _, object := range objects {
+		if object.Key == key {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// rekeyObject replaces the header at the start of the object stored under key
+// by provider and returns the new size of the object
+func (r *Rekeyer) rekeyObject(ctx context.Context, provider storage.StorageProvider, key string) (int64, error) {
+	info, err := provider.Stat(ctx, key)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat archive: %w", err)
+	}
+
+	header, err := readHeader(ctx, provider, key)
+	if err != nil {
+		return 0, err
+	}
+
+	prefix, err := crypto.Rekey(header, r.identities, r.recipients)
+	if err != nil {
+		return 0, err
+	}
+	r.logger.Infof("Replacing %d byte header with %d byte header wrapping the data key for %d key(s)", header.Size(), len(prefix), len(r.recipients))
+
+	if rewriter, ok := provider.(storage.PrefixRewriter); ok {
+		err = rewriter.RewritePrefix(ctx, key, header.Size(), prefix)
+	} else {
+		r.logger.Infof("%s cannot rewrite objects in place; uploading the archive again", provider.GetProviderType())
+		err = rewriteStream(ctx, provider, key, header.Size(), prefix, info.Size)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to rewrite archive header: %w", err)
+	}
+
+	// The payload must have survived the rewrite byte for byte
+	expected := info.Size - header.Size() + int64(len(prefix))
+	rewritten, err := provider.Stat(ctx, key)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat rekeyed archive: %w", err)
+	}
+	if rewritten.Size != expected {
+		return 0, fmt.Errorf("rekeyed archive is %d bytes, expected %d", rewritten.Size, expected)
+	}
+
+	return rewritten.Size, nil
+}
+
+// readHeader downloads just enough of key to parse its encryption header
+func readHeader(ctx context.Context, provider storage.StorageProvider, key string) (*crypto.Header, error) {
+	// Cancelling the download once the header is parsed avoids fetching the payload
+	downloadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	downloadReader, downloadWriter := io.Pipe()
+	go func() {
+		downloadWriter.CloseWithError(provider.DownloadStream(downloadCtx, key, downloadWriter, nil))
+	}()
+	defer downloadReader.Close()
+
+	header, err := crypto.ReadHeader(downloadReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive header: %w", err)
+	}
+	return header, nil
+}
+
+// rewriteStream uploads the archive again with its first oldLength bytes
+// replaced by prefix, streaming the payload from the provider itself
+func rewriteStream(ctx context.Context, provider storage.StorageProvider, key string, oldLength int64, prefix []byte, size int64) error {
+	downloadReader, downloadWriter := io.Pipe()
+	go func() {
+		downloadWriter.CloseWithError(provider.DownloadStream(ctx, key, downloadWriter, nil))
+	}()
+	defer downloadReader.Close()
+
+	if _, err := io.CopyN(io.Discard, downloadReader, oldLength); err != nil {
+		return fmt.Errorf("failed to skip old header: %w", err)
+	}
+
+	reader := io.MultiReader(bytes.NewReader(prefix), downloadReader)
+	return provider.PutObject(ctx, key, reader, size-oldLength+int64(len(prefix)), nil)
+}
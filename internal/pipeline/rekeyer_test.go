@@ -0,0 +1,128 @@
+package pipeline
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/seriousconsult/cloud_safe/internal/crypto"
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+	"github.com/seriousconsult/cloud_safe/internal/setup"
+	"github.com/seriousconsult/cloud_safe/internal/storage"
+)
+
+// writeIdentityFile saves identity to a private key file and returns its path
+func writeIdentityFile(t *testing.T, identity *crypto.X25519Identity) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "key.txt")
+	if err := os.WriteFile(path, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRekeyIndexedArchive(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(false).Quiet()
+	var identities [3]*crypto.X25519Identity
+	for i := range identities {
+		identity, err := crypto.GenerateX25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		identities[i] = identity
+	}
+	oldIdentity, newIdentity, otherIdentity := identities[0], identities[1], identities[2]
+
+	for name, volumeSize := range map[string]int64{"stored whole": 0, "split into volumes": MinVolumeSize} {
+		t.Run(name, func(t *testing.T) {
+			source := t.TempDir()
+			for name, content := range map[string]string{"a/one.txt": "first file", "b/two.txt": "second file"} {
+				path := filepath.Join(source, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			store := t.TempDir()
+			config := func() *setup.Config {
+				return &setup.Config{
+					SourcePaths:     []string{source},
+					S3Filename:      "backup.tar",
+					StorageProvider: string(storage.ProviderLocal),
+					LocalPath:       store,
+					Compression:     "zstd",
+					Encrypt:         true,
+					Index:           true,
+					StateDir:        t.TempDir(),
+					VolumeSize:      volumeSize,
+				}
+			}
+
+			cfg := config()
+			cfg.Recipients = []string{oldIdentity.Recipient().String()}
+			processor, err := NewProcessor(cfg, log)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := processor.Process(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			// Wrapping the data key for two keys makes the header larger
+			cfg = config()
+			cfg.IdentityFile = writeIdentityFile(t, oldIdentity)
+			rekeyer, err := NewRekeyer(cfg, []crypto.Recipient{newIdentity.Recipient(), otherIdentity.Recipient()}, log)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := rekeyer.Rekey(ctx); err != nil {
+				t.Fatalf("Rekey() error = %v", err)
+			}
+
+			cfg = config()
+			cfg.IdentityFile = writeIdentityFile(t, newIdentity)
+			restorer, err := NewRestorer(cfg, log)
+			if err != nil {
+				t.Fatal(err)
+			}
+			index, err := restorer.LoadIndex(ctx)
+			if err != nil {
+				t.Fatalf("LoadIndex() with the new key error = %v", err)
+			}
+			var wanted string
+			for _, entry := range index.Entries {
+				if strings.HasSuffix(entry.Name, "two.txt") {
+					wanted = entry.Name
+				}
+			}
+			if wanted == "" {
+				t.Fatalf("index lists no two.txt among %d entries", len(index.Entries))
+			}
+
+			target := t.TempDir()
+			if err := restorer.RestorePaths(ctx, target, []string{wanted}); err != nil {
+				t.Fatalf("RestorePaths() with the new key error = %v", err)
+			}
+			content, err := os.ReadFile(filepath.Join(target, wanted))
+			if err != nil || string(content) != "second file" {
+				t.Errorf("restored %s = %q, %v", wanted, content, err)
+			}
+
+			// The old key opens neither the archive nor its index any more
+			cfg = config()
+			cfg.IdentityFile = writeIdentityFile(t, oldIdentity)
+			old, err := NewRestorer(cfg, log)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := old.LoadIndex(ctx); err == nil {
+				t.Error("LoadIndex() with the old key succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/seriousconsult/cloud_safe/internal/compressor"
+	"github.com/seriousconsult/cloud_safe/internal/crypto"
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+	"github.com/seriousconsult/cloud_safe/internal/progress"
+	"github.com/seriousconsult/cloud_safe/internal/repository"
+	"github.com/seriousconsult/cloud_safe/internal/setup"
+	"github.com/seriousconsult/cloud_safe/internal/storage"
+)
+
+// providerStore stores the objects of a repository with the configured
+// storage provider, under the configured filename
+type providerStore struct {
+	prefix   string
+	provider storage.StorageProvider
+}
+
+// newProviderStore creates the object store of the repository named by the
+// configured filename
+func newProviderStore(cfg *setup.Config, log *logger.Logger) (*providerStore, error) {
+	// A backup stores many objects, so the provider logs quietly
+	provider, err := storage.NewStorageProvider(cfg, log.Quiet())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage provider: %w", err)
+	}
+
+	return &providerStore{
+		prefix:   strings.TrimSuffix(cfg.S3Filename, "/") + "/",
+		provider: provider,
+	}, nil
+}
+
+// Save uploads an object
+func (s *providerStore) Save(ctx context.Context, key string, data []byte) error {
+	return s.provider.PutObject(ctx, s.prefix+key, bytes.NewReader(data), int64(len(data)), nil)
+}
+
+// Load downloads an object
+func (s *providerStore) Load(ctx context.Context, key string) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := s.provider.DownloadStream(ctx, s.prefix+key, &buffer, nil); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// List returns the keys of the objects that start with prefix
+func (s *providerStore) List(ctx context.Context, prefix string) ([]string, error) {
+	objects, err := s.provider.List(ctx, s.prefix+prefix)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(objects))
+	for _, object := range objects {
+		keys = append(keys, strings.TrimPrefix(object.Key, s.prefix))
+	}
+	return keys, nil
+}
+
+// InitRepository creates a repository under the configured filename. Its
+// keys are encrypted like an archive when encryption is enabled.
+func InitRepository(ctx context.Context, cfg *setup.Config, log *logger.Logger) (*repository.Repository, error) {
+	codec, err := compressor.ParseCodec(cfg.Compression)
+	if err != nil {
+		return nil, err
+	}
+	if err := compressor.ValidateLevel(codec, cfg.CompressionLevel); err != nil {
+		return nil, err
+	}
+
+	store, err := newProviderStore(cfg, log)
+	if err != nil {
+		return nil, err
+	}
+
+	var seal func([]byte) ([]byte, error)
+	if cfg.Encrypt {
+		enc, err := newEncryptor(cfg, log)
+		if err != nil {
+			return nil, err
+		}
+		seal = func(data []byte) ([]byte, error) {
+			var sealed bytes.Buffer
+			if err := enc.EncryptStream(bytes.NewReader(data), &sealed); err != nil {
+				return nil, err
+			}
+			return sealed.Bytes(), nil
+		}
+	}
+
+	return repository.Init(ctx, store, repository.InitOptions{
+		Codec:            codec,
+		CompressionLevel: cfg.CompressionLevel,
+		Encrypted:        cfg.Encrypt,
+	}, seal)
+}
+
+// OpenRepository opens the repository under the configured filename
+func OpenRepository(ctx context.Context, cfg *setup.Config, log *logger.Logger) (*repository.Repository, error) {
+	store, err := newProviderStore(cfg, log)
+	if err != nil {
+		return nil, err
+	}
+
+	open := func(data []byte) ([]byte, error) {
+		if !crypto.HasMagic(data) {
+			// A plain config would let whoever wrote it choose the keys
+			// later backups are encrypted with, or turn encryption off
+			if cfg.Encrypt {
+				return nil, fmt.Errorf("repository is not encrypted; open it with encryption disabled")
+			}
+			return data, nil
+		}
+		dec, err := newDecryptor(cfg)
+		if err != nil {
+			return nil, err
+		}
+		var opened bytes.Buffer
+		if err := dec.DecryptStream(bytes.NewReader(data), &opened); err != nil {
+			return nil, err
+		}
+		return opened.Bytes(), nil
+	}
+
+	return repository.Open(ctx, store, open)
+}
+
+// BackupToRepository stores the configured sources in the repository under
+// the configured filename and returns the new snapshot
+func BackupToRepository(ctx context.Context, cfg *setup.Config, log *logger.Logger) (*repository.Snapshot, error) {
+	repo, err := OpenRepository(ctx, cfg, log)
+	if err != nil {
+		return nil, err
+	}
+
+	filter, err := newFilter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	archiver := repository.NewArchiver(repo, log)
+	archiver.SetFilter(filter)
+
+	// Snapshots record where their sources were
+	sources := make([]string, len(cfg.SourcePaths))
+	for i, source := range cfg.SourcePaths {
+		if sources[i], err = filepath.Abs(source); err != nil {
+			return nil, fmt.Errorf("failed to resolve source path %s: %w", source, err)
+		}
+	}
+
+	totalSize, err := archiver.EstimateSize(sources)
+	if err != nil {
+		return nil, fmt.Errorf("failed to estimate size: %w", err)
+	}
+	tracker := progress.NewTracker(totalSize)
+	archiver.SetTracker(tracker)
+
+	snapshot, err := archiver.Backup(ctx, sources)
+	tracker.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := archiver.Stats()
+	log.Infof("Snapshot %s: %d files, %d bytes read, %d bytes added to the repository",
+		snapshot.ID.String()[:8], stats.Files, stats.Size, stats.Added)
+	return snapshot, nil
+}
+
+// RestoreFromRepository restores the snapshot whose ID starts with
+// snapshotID, or the latest one for "latest", into targetDir
+func RestoreFromRepository(ctx context.Context, cfg *setup.Config, snapshotID, targetDir string, log *logger.Logger) error {
+	repo, err := OpenRepository(ctx, cfg, log)
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := repo.FindSnapshot(ctx, snapshotID)
+	if err != nil {
+		return err
+	}
+	log.Infof("Restoring snapshot %s of %s", snapshot.ID.String()[:8], snapshot.Time.Local().Format("2006-01-02 15:04:05"))
+
+	restorer := repository.NewRestorer(repo, log)
+	tracker := progress.NewTracker(snapshot.Size)
+	restorer.SetTracker(tracker)
+	defer tracker.Finish()
+
+	return restorer.Restore(ctx, snapshot, targetDir)
+}
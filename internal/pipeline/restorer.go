@@ -0,0 +1,312 @@
+package pipeline
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/seriousconsult/cloud_safe/internal/compressor"
+	"github.com/seriousconsult/cloud_safe/internal/crypto"
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+	"github.com/seriousconsult/cloud_safe/internal/progress"
+	"github.com/seriousconsult/cloud_safe/internal/setup"
+	"github.com/seriousconsult/cloud_safe/internal/storage"
+)
+
+// Restorer orchestrates the reverse pipeline: download, decrypt and extract
+type Restorer struct {
+	config    *setup.Config
+	logger    *logger.Logger
+	extractor *compressor.TarExtractor
+	decryptor *crypto.StreamDecryptor
+	storage   storage.StorageProvider
+}
+
+// NewRestorer creates a new restorer instance
+func NewRestorer(cfg *setup.Config, log *logger.Logger) (*Restorer, error) {
+	// Initialize extractor
+	ext := compressor.NewTarExtractor(log)
+
+	// Initialize decryptor if the archive is encrypted
+	var dec *crypto.StreamDecryptor
+	if cfg.Encrypt {
+		var err error
+		dec, err = newDecryptor(cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Initialize storage provider
+	storageProvider, err := storage.NewStorageProvider(cfg, log)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage provider: %w", err)
+	}
+
+	// Archives split into volumes are read as if they were stored whole
+	return &Restorer{
+		config:    cfg,
+		logger:    log,
+		extractor: ext,
+		decryptor: dec,
+		storage:   newVolumeStorage(storageProvider),
+	}, nil
+}
+
+// newDecryptor creates a decryptor from the configured key manager and
+// private key file, or from the passphrase when neither is configured
+func newDecryptor(cfg *setup.Config) (*crypto.StreamDecryptor, error) {
+	if cfg.IdentityFile != "" || cfg.KeyManager != "" {
+		identities, err := newIdentities(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		dec, err := crypto.NewIdentityDecryptor(identities)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create decryptor: %w", err)
+		}
+		return dec, nil
+	}
+
+	passphrase, err := cfg.GetPassphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	dec, err := crypto.NewStreamDecryptor(passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create decryptor: %w", err)
+	}
+	return dec, nil
+}
+
+// newIdentities returns the keys that can unwrap archive data keys: the
+// configured key manager and private key file, or the passphrase when neither
+// is configured
+func newIdentities(cfg *setup.Config) ([]crypto.Identity, error) {
+	var identities []crypto.Identity
+
+	manager, err := NewKeyManager(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if manager != nil {
+		identities = append(identities, crypto.NewKeyManagerIdentity(manager))
+	}
+
+	if cfg.IdentityFile != "" {
+		keys, err := crypto.ReadIdentityFile(cfg.IdentityFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			identities = append(identities, key)
+		}
+	}
+
+	if len(identities) == 0 {
+		passphrase, err := cfg.GetPassphrase()
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, crypto.NewPassphraseIdentity(passphrase))
+	}
+	return identities, nil
+}
+
+// Restore downloads the configured archive and extracts it into targetDir.
+// An incremental archive is restored on top of the archives it depends on,
+// which are restored first, from the full backup onwards.
+func (r *Restorer) Restore(ctx context.Context, targetDir string) error {
+	chain, err := r.chain(ctx, r.config.S3Filename)
+	if err != nil {
+		return err
+	}
+
+	if len(chain) > 1 {
+		r.logger.Infof("Restoring a chain of %d archives: %s", len(chain), strings.Join(chain, " -> "))
+	}
+	for i, key := range chain {
+		if len(chain) > 1 {
+			r.logger.Infof("Restoring archive %d of %d: %s", i+1, len(chain), key)
+		}
+		if err := r.restoreArchive(ctx, key, targetDir); err != nil {
+			return err
+		}
+	}
+
+	r.logger.Debug("Restore completed successfully")
+	return nil
+}
+
+// chain returns the archives to restore for the archive stored under key,
+// oldest first. It follows the parent named by the snapshot entry of each
+// incremental archive, reading only the start of each archive.
+func (r *Restorer) chain(ctx context.Context, key string) ([]string, error) {
+	chain := []string{key}
+	seen := map[string]bool{key: true}
+	for {
+		snapshot, err := r.readSnapshot(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive %s: %w", key, err)
+		}
+		if snapshot == nil || snapshot.Parent == "" {
+			return chain, nil
+		}
+		if seen[snapshot.Parent] {
+			return nil, fmt.Errorf("archive chain of %s loops at %s", r.config.S3Filename, snapshot.Parent)
+		}
+		seen[snapshot.Parent] = true
+		key = snapshot.Parent
+		chain = append([]string{key}, chain...)
+	}
+}
+
+// readSnapshot reads the snapshot entry of the archive stored under key,
+// which is nil when the archive was not made in incremental mode
+func (r *Restorer) readSnapshot(ctx context.Context, key string) (*compressor.Snapshot, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	archive, err := r.open(ctx, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	return compressor.ReadSnapshot(archive)
+}
+
+// restoreArchive downloads the archive stored under key and extracts it into
+// targetDir
+func (r *Restorer) restoreArchive(ctx context.Context, key, targetDir string) error {
+	// Stat the archive so progress can be reported against its real size
+	info, err := r.storage.Stat(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to stat archive: %w", err)
+	}
+
+	r.logger.Infof("Archive size: %.2f MB (last modified %s)", float64(info.Size)/(1024*1024), info.LastModified.Format(time.RFC3339))
+
+	// Create progress tracker
+	tracker := progress.NewTracker(info.Size)
+	defer tracker.Finish()
+
+	archive, err := r.open(ctx, key, tracker)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	if archive.version > 0 {
+		r.logger.Infof("Archive format: encrypted v%d", archive.version)
+	} else if archive.legacy {
+		r.logger.Error("WARNING: archive has no format header; decrypting as a legacy archive without truncation detection")
+	}
+	r.logger.Infof("Archive compression: %s", archive.codec)
+
+	// Extract in the calling goroutine so the pipeline finishes with it
+	r.logger.Debug("Starting extraction")
+	if err := r.extractor.Extract(ctx, archive, targetDir); err != nil {
+		return fmt.Errorf("restore failed: %w", err)
+	}
+
+	// Drain anything after the end-of-archive marker so download, decryption
+	// and decompression errors are still reported
+	if _, err := io.Copy(io.Discard, archive); err != nil {
+		return fmt.Errorf("restore failed: %w", err)
+	}
+	return nil
+}
+
+// archiveReader is the tar stream of a stored archive, downloaded, decrypted
+// and decompressed as it is read
+type archiveReader struct {
+	io.Reader
+	// version is the format version of an encrypted archive with a header
+	version int
+	// legacy is set for an encrypted archive without a header
+	legacy  bool
+	codec   compressor.Codec
+	closers []func() error
+}
+
+// Close stops the download and the stages reading from it
+func (a *archiveReader) Close() error {
+	for i := len(a.closers) - 1; i >= 0; i-- {
+		a.closers[i]()
+	}
+	return nil
+}
+
+// open starts the download of the archive stored under key and returns its
+// tar stream. The download stops when the stream is closed or ctx is done.
+func (r *Restorer) open(ctx context.Context, key string, tracker progress.Tracker) (*archiveReader, error) {
+	archive := &archiveReader{}
+
+	// Start download in a goroutine
+	downloadReader, downloadWriter := io.Pipe()
+	go func() {
+		err := r.storage.DownloadStream(ctx, key, downloadWriter, tracker)
+		// Closing with the download error makes it visible to the reading stage
+		downloadWriter.CloseWithError(err)
+	}()
+	archive.closers = append(archive.closers, downloadReader.Close)
+
+	// Encrypted archives start with a magic number; older encrypted archives
+	// carry no marker at all and are only recognised through configuration
+	downloaded := bufio.NewReader(downloadReader)
+	magic, err := downloaded.Peek(len(crypto.Magic) + 1)
+	if err != nil && err != io.EOF {
+		archive.Close()
+		return nil, fmt.Errorf("failed to read archive header: %w", err)
+	}
+	versioned := crypto.HasMagic(magic) && len(magic) > len(crypto.Magic)
+
+	var finalReader io.Reader = downloaded
+
+	if versioned && r.decryptor == nil {
+		archive.Close()
+		return nil, fmt.Errorf("archive is encrypted; restore with --encrypt and the key used for upload")
+	}
+
+	// Add decryption layer if enabled
+	if r.decryptor != nil {
+		decrypt := r.decryptor.DecryptStream
+		if versioned {
+			archive.version = int(magic[len(crypto.Magic)])
+		} else {
+			archive.legacy = true
+			decrypt = r.decryptor.DecryptLegacyStream
+		}
+
+		decryptionReader, decryptionWriter := io.Pipe()
+
+		// Start decryption in a goroutine
+		go func() {
+			err := decrypt(downloaded, decryptionWriter)
+			if err != nil {
+				err = fmt.Errorf("decryption failed: %w", err)
+			}
+			decryptionWriter.CloseWithError(err)
+		}()
+		archive.closers = append(archive.closers, decryptionReader.Close)
+
+		finalReader = decryptionReader
+	}
+
+	// The archive header records the compression codec
+	decompressor, codec, err := compressor.NewArchiveReader(finalReader)
+	if err != nil {
+		archive.Close()
+		return nil, fmt.Errorf("restore failed: %w", err)
+	}
+	archive.closers = append(archive.closers, decompressor.Close)
+	archive.Reader = decompressor
+	archive.codec = codec
+	return archive, nil
+}
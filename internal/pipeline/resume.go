@@ -0,0 +1,329 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/seriousconsult/cloud_safe/internal/crypto"
+	"github.com/seriousconsult/cloud_safe/internal/setup"
+	"github.com/seriousconsult/cloud_safe/internal/storage"
+)
+
+// streamState records what is needed to regenerate the exact byte stream of
+// an interrupted upload. The storage provider keeps its own record of what it
+// already stored; resuming feeds it the same stream again so it can skip that.
+// For an archive split into volumes it also records the SHA-256 of each volume
+// each destination stored, so those volumes are skipped without asking the
+// provider.
+//
+// Only the encoded archive header is stored. The data key it wraps is
+// recovered with the passphrase or key manager when resuming, so an archive
+// encrypted only to public-key recipients is never resumed.
+type streamState struct {
+	Target           string              `json:"target"`
+	Sources          []string            `json:"sources"`
+	Codec            string              `json:"codec"`
+	CompressionLevel int                 `json:"compression_level"`
+	Indexed          bool                `json:"indexed,omitempty"`
+	VolumeSize       int64               `json:"volume_size,omitempty"`
+	VolumeSums       map[string][]string `json:"volume_sums,omitempty"`
+	ArchiveHeader    []byte              `json:"archive_header,omitempty"`
+	Created          time.Time           `json:"created"`
+}
+
+// providerTarget identifies the destination of the upload to one provider
+func providerTarget(cfg *setup.Config, provider string) string {
+	var location string
+	switch provider {
+	case string(storage.ProviderS3):
+		location = cfg.S3Bucket
+		if cfg.S3Endpoint != "" {
+			location = cfg.S3Endpoint + "/" + cfg.S3Bucket
+		}
+	case string(storage.ProviderGoogleDrive):
+		location = cfg.GoogleDriveFolderID
+	case string(storage.ProviderMinIO):
+		location = cfg.MinIOEndpoint + "/" + cfg.MinIOBucket
+	case string(storage.ProviderLocal):
+		location = cfg.LocalPath
+	}
+	return fmt.Sprintf("%s://%s/%s", provider, location, cfg.S3Filename)
+}
+
+// uploadTarget identifies the destinations of the configured upload
+func uploadTarget(cfg *setup.Config) string {
+	var targets []string
+	for _, provider := range cfg.GetDestinations() {
+		targets = append(targets, providerTarget(cfg, provider))
+	}
+	return strings.Join(targets, ",")
+}
+
+// streamStatePath returns the state file of the configured upload
+func streamStatePath(cfg *setup.Config) (string, error) {
+	dir, err := cfg.GetStateDir()
+	if err != nil {
+		return "", err
+	}
+	return storage.StatePath(dir, "stream", uploadTarget(cfg)), nil
+}
+
+// prepareStream decides how the archive stream is produced. When some
+// destinations have an interrupted upload and the stream state matches the
+// current run, the archive key is recovered from the saved header so the
+// stream is byte-for-byte the same; otherwise the interrupted uploads are
+// aborted and a new archive key is created and its header saved.
+func (p *Processor) prepareStream(ctx context.Context, uploads []*destinationUpload) (*crypto.ArchiveKey, error) {
+	current := streamState{
+		Target:           uploadTarget(p.config),
+		Sources:          p.config.SourcePaths,
+		Codec:            string(p.codec),
+		CompressionLevel: p.config.CompressionLevel,
+		Indexed:          p.config.Index,
+		VolumeSize:       p.config.VolumeSize,
+		Created:          time.Now().UTC(),
+	}
+
+	if !p.config.Resume {
+		for _, u := range uploads {
+			u.resumable = nil
+		}
+		return p.newArchiveKey()
+	}
+
+	statePath, err := streamStatePath(p.config)
+	if err != nil {
+		return nil, err
+	}
+
+	// The backup host holds no secret that unwraps a data key wrapped only
+	// for public keys, and the data key itself is never saved
+	if p.config.Encrypt && !p.encryptor.CanRecoverArchiveKey() {
+		p.abortInterrupted(ctx, uploads, "Archives encrypted only to public-key recipients cannot be resumed; starting over")
+		if err := storage.RemoveState(statePath); err != nil {
+			p.logger.Errorf("%v", err)
+		}
+		return p.newArchiveKey()
+	}
+
+	if p.config.VolumeSize > 0 {
+		return p.prepareVolumes(ctx, uploads, statePath, &current)
+	}
+
+	resuming := false
+	for _, u := range uploads {
+		resuming = resuming || u.resumable != nil
+	}
+
+	if resuming {
+		var saved streamState
+		found, err := storage.LoadState(statePath, &saved)
+		if err != nil {
+			p.logger.Errorf("Failed to read stream state: %v", err)
+		}
+
+		switch {
+		case !found:
+			p.logger.Info("Interrupted upload has no stream state; starting over")
+		case !sameInput(&saved, &current):
+			p.logger.Info("Interrupted upload was made from different sources or settings; starting over")
+		case p.config.Encrypt && saved.ArchiveHeader == nil, !p.config.Encrypt && saved.ArchiveHeader != nil:
+			p.logger.Info("Interrupted upload used a different encryption setting; starting over")
+		default:
+			archiveKey, err := p.savedArchiveKey(&saved)
+			if err != nil {
+				p.logger.Infof("Failed to recover the archive key of the interrupted upload: %v; starting over", err)
+				break
+			}
+			for _, u := range uploads {
+				if u.resumable != nil {
+					p.logger.Infof("Resuming previous upload to %s (%.2f MB already uploaded)", u.Name, float64(u.resumable.GetUploadedSize())/(1024*1024))
+				}
+			}
+			return archiveKey, nil
+		}
+
+		p.abortInterrupted(ctx, uploads, "")
+	}
+
+	archiveKey, err := p.newArchiveKey()
+	if err != nil {
+		return nil, err
+	}
+	current.ArchiveHeader = archiveHeader(archiveKey)
+	if err := storage.SaveState(statePath, &current); err != nil {
+		return nil, err
+	}
+	return archiveKey, nil
+}
+
+// prepareVolumes decides how the stream of an archive split into volumes is
+// produced. An interrupted upload continues after the volumes a destination
+// stored, which the stream state records by their SHA-256, and resumes the
+// volume it was storing; the archive key recovered from the saved header
+// regenerates the stream of those volumes, which is checked against them.
+func (p *Processor) prepareVolumes(ctx context.Context, uploads []*destinationUpload, statePath string, current *streamState) (*crypto.ArchiveKey, error) {
+	// An interrupted upload of the archive as one object is not continued
+	p.abortInterrupted(ctx, uploads, "")
+
+	var saved streamState
+	found, err := storage.LoadState(statePath, &saved)
+	if err != nil {
+		p.logger.Errorf("Failed to read stream state: %v", err)
+	}
+
+	state := current
+	var archiveKey *crypto.ArchiveKey
+	switch {
+	case !found || len(saved.VolumeSums) == 0:
+	case !sameInput(&saved, current):
+		p.logger.Info("Interrupted upload was made from different sources or settings; starting over")
+	case p.config.Encrypt && saved.ArchiveHeader == nil, !p.config.Encrypt && saved.ArchiveHeader != nil:
+		p.logger.Info("Interrupted upload used a different encryption setting; starting over")
+	default:
+		archiveKey, err = p.savedArchiveKey(&saved)
+		if err != nil {
+			p.logger.Infof("Failed to recover the archive key of the interrupted upload: %v; starting over", err)
+			break
+		}
+		state = &saved
+		for _, u := range uploads {
+			u.volumes.resume = true
+			if stored := saved.VolumeSums[u.Name]; len(stored) > 0 {
+				p.logger.Infof("Resuming previous upload to %s after the %d volume(s) it stored", u.Name, len(stored))
+				u.volumes.stored = stored
+			}
+		}
+	}
+
+	if state == current {
+		archiveKey, err = p.newArchiveKey()
+		if err != nil {
+			return nil, err
+		}
+		current.ArchiveHeader = archiveHeader(archiveKey)
+		current.VolumeSums = make(map[string][]string)
+		if err := storage.SaveState(statePath, current); err != nil {
+			return nil, err
+		}
+	}
+
+	progress := &volumeProgress{path: statePath, state: state}
+	for _, u := range uploads {
+		u.volumes.progress = progress
+	}
+	return archiveKey, nil
+}
+
+// abortInterrupted aborts the interrupted uploads of the destinations, logging
+// reason first when there are any
+func (p *Processor) abortInterrupted(ctx context.Context, uploads []*destinationUpload, reason string) {
+	for _, u := range uploads {
+		if u.resumable == nil {
+			continue
+		}
+		if reason != "" {
+			p.logger.Info(reason)
+			reason = ""
+		}
+		if err := u.resumable.Abort(ctx); err != nil {
+			p.logger.Errorf("Failed to abort interrupted upload to %s: %v", u.Name, err)
+		}
+		u.resumable = nil
+	}
+}
+
+// savedArchiveKey recovers the archive key of an interrupted upload from the
+// header saved in its stream state, or returns nil when encryption is disabled
+func (p *Processor) savedArchiveKey(saved *streamState) (*crypto.ArchiveKey, error) {
+	if saved.ArchiveHeader == nil {
+		return nil, nil
+	}
+	return p.encryptor.RecoverArchiveKey(saved.ArchiveHeader)
+}
+
+// archiveHeader returns the encoded header of archiveKey, which may be nil
+func archiveHeader(archiveKey *crypto.ArchiveKey) []byte {
+	if archiveKey == nil {
+		return nil
+	}
+	return archiveKey.Header
+}
+
+// newArchiveKey creates the data key for a new archive, or nil when
+// encryption is disabled
+func (p *Processor) newArchiveKey() (*crypto.ArchiveKey, error) {
+	if !p.config.Encrypt {
+		return nil, nil
+	}
+	archiveKey, err := p.encryptor.NewArchiveKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create archive key: %w", err)
+	}
+	return archiveKey, nil
+}
+
+// finishStream removes the stream state once the upload has completed. When
+// some destinations failed the state is kept for them, so running again with
+// --resume regenerates the same stream, and only the volumes recorded for the
+// destinations that completed are dropped.
+func (p *Processor) finishStream(uploads []*destinationUpload) {
+	if !p.config.Resume {
+		return
+	}
+	statePath, err := streamStatePath(p.config)
+	if err != nil {
+		return
+	}
+
+	var failed bool
+	for _, u := range uploads {
+		failed = failed || u.err != nil
+	}
+	if !failed {
+		if err := storage.RemoveState(statePath); err != nil {
+			p.logger.Errorf("%v", err)
+		}
+		return
+	}
+
+	var state streamState
+	found, err := storage.LoadState(statePath, &state)
+	if err != nil {
+		p.logger.Errorf("Failed to read stream state: %v", err)
+	}
+	if !found {
+		return
+	}
+	for _, u := range uploads {
+		if u.err == nil {
+			delete(state.VolumeSums, u.Name)
+		}
+	}
+	if err := storage.SaveState(statePath, &state); err != nil {
+		p.logger.Errorf("Failed to save stream state: %v", err)
+	}
+}
+
+// forgetStream removes the stream state, so the next run of the pipeline does
+// not resume and creates a new archive key
+func (p *Processor) forgetStream() error {
+	statePath, err := streamStatePath(p.config)
+	if err != nil {
+		return err
+	}
+	return storage.RemoveState(statePath)
+}
+
+// sameInput reports whether two stream states describe the same input
+func sameInput(a, b *streamState) bool {
+	return a.Target == b.Target &&
+		reflect.DeepEqual(a.Sources, b.Sources) &&
+		a.Codec == b.Codec &&
+		a.CompressionLevel == b.CompressionLevel &&
+		a.Indexed == b.Indexed &&
+		a.VolumeSize == b.VolumeSize
+}
@@ -0,0 +1,242 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/seriousconsult/cloud_safe/internal/crypto"
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+	"github.com/seriousconsult/cloud_safe/internal/progress"
+	"github.com/seriousconsult/cloud_safe/internal/setup"
+	"github.com/seriousconsult/cloud_safe/internal/storage"
+)
+
+// interruptedProvider is a memoryProvider whose UploadStream stops after
+// limit bytes while limit is positive. The bytes it read are kept as an
+// interrupted upload, which is resumed if the stream starts with them.
+type interruptedProvider struct {
+	*memoryProvider
+	limit   int
+	partial []byte
+	// resumed counts the uploads that were resumed
+	resumed int
+}
+
+func (i *interruptedProvider) UploadStream(ctx context.Context, reader io.Reader, estimatedSize int64, tracker progress.Tracker) error {
+	if i.limit <= 0 {
+		return i.memoryProvider.UploadStream(ctx, reader, estimatedSize, tracker)
+	}
+	i.partial = make([]byte, i.limit)
+	if _, err := io.ReadFull(reader, i.partial); err != nil {
+		return err
+	}
+	return errors.New("upload interrupted")
+}
+
+func (i *interruptedProvider) CheckResumability(ctx context.Context) (storage.ResumableUpload, error) {
+	if i.partial == nil {
+		return nil, nil
+	}
+	return &interruptedUpload{provider: i}, nil
+}
+
+// interruptedUpload is the interrupted upload of an interruptedProvider
+type interruptedUpload struct {
+	provider *interruptedProvider
+}
+
+func (u *interruptedUpload) Resume(ctx context.Context, reader io.Reader, tracker progress.Tracker) error {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	partial := u.provider.partial
+	u.provider.partial = nil
+	if !bytes.HasPrefix(data, partial) {
+		return storage.ErrStreamChanged
+	}
+	u.provider.resumed++
+	return u.provider.memoryProvider.UploadStream(ctx, bytes.NewReader(data), int64(len(data)), tracker)
+}
+
+func (u *interruptedUpload) Abort(ctx context.Context) error {
+	u.provider.partial = nil
+	return nil
+}
+
+func (u *interruptedUpload) GetUploadedSize() int64 {
+	return int64(len(u.provider.partial))
+}
+
+func TestStreamStateHoldsNoDataKey(t *testing.T) {
+	ctx := context.Background()
+	identity, err := crypto.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		passphrase string
+		recipients []string
+		volumeSize int64
+		// resumable is whether the stream state is kept for the failed destination
+		resumable bool
+	}{
+		{name: "passphrase", passphrase: "correct horse", resumable: true},
+		{name: "passphrase with volumes", passphrase: "correct horse", volumeSize: MinVolumeSize, resumable: true},
+		{name: "recipients", recipients: []string{identity.Recipient().String()}},
+		{name: "recipients with volumes", recipients: []string{identity.Recipient().String()}, volumeSize: MinVolumeSize},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := t.TempDir()
+			if err := os.WriteFile(filepath.Join(source, "file"), bytes.Repeat([]byte("content"), 400000), 0600); err != nil {
+				t.Fatal(err)
+			}
+			cfg := &setup.Config{
+				SourcePaths:     []string{source},
+				S3Filename:      "backup.tar",
+				StorageProvider: string(storage.ProviderLocal),
+				LocalPath:       t.TempDir(),
+				FailurePolicy:   string(FailureContinue),
+				Compression:     "none",
+				Encrypt:         true,
+				EncryptionKey:   []byte(tt.passphrase),
+				Recipients:      tt.recipients,
+				KDF:             crypto.KDFScrypt.String(),
+				Resume:          true,
+				StateDir:        t.TempDir(),
+				VolumeSize:      tt.volumeSize,
+			}
+			processor, err := NewProcessor(cfg, logger.New(false).Quiet())
+			if err != nil {
+				t.Fatal(err)
+			}
+			working := newMemoryProvider(cfg.S3Filename, nil)
+			failing := newMemoryProvider(cfg.S3Filename, errors.New("upload failed"))
+			processor.destinations = []Destination{{Name: "working", Provider: working}, {Name: "failing", Provider: failing}}
+
+			if err := processor.Process(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			statePath, err := streamStatePath(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var state streamState
+			found, err := storage.LoadState(statePath, &state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != tt.resumable {
+				t.Fatalf("stream state kept = %t, want %t", found, tt.resumable)
+			}
+			if !found {
+				return
+			}
+
+			// The saved header matches the stored archive and unwraps with the passphrase
+			archive := working.objects[cfg.S3Filename]
+			if tt.volumeSize > 0 {
+				archive = working.objects[VolumeKey(cfg.S3Filename, 0)]
+			}
+			if !bytes.HasPrefix(archive, state.ArchiveHeader) {
+				t.Fatal("saved header is not the header of the stored archive")
+			}
+			archiveKey, err := processor.encryptor.RecoverArchiveKey(state.ArchiveHeader)
+			if err != nil {
+				t.Fatalf("RecoverArchiveKey() error = %v", err)
+			}
+			raw, err := os.ReadFile(statePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(raw, archiveKey.Key) || bytes.Contains(raw, []byte(`"archive_key"`)) {
+				t.Error("stream state holds the data key")
+			}
+		})
+	}
+}
+
+func TestResumeChangedSources(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  bool
+		resumed bool
+	}{
+		{name: "same sources", resumed: true},
+		{name: "changed sources", change: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			source := t.TempDir()
+			file := filepath.Join(source, "file")
+			if err := os.WriteFile(file, bytes.Repeat([]byte("content"), 400000), 0600); err != nil {
+				t.Fatal(err)
+			}
+			cfg := &setup.Config{
+				SourcePaths:     []string{source},
+				S3Filename:      "backup.tar",
+				StorageProvider: string(storage.ProviderLocal),
+				LocalPath:       t.TempDir(),
+				Compression:     "none",
+				Encrypt:         true,
+				EncryptionKey:   []byte("correct horse"),
+				KDF:             crypto.KDFScrypt.String(),
+				Resume:          true,
+				StateDir:        t.TempDir(),
+			}
+			processor, err := NewProcessor(cfg, logger.New(false).Quiet())
+			if err != nil {
+				t.Fatal(err)
+			}
+			provider := &interruptedProvider{memoryProvider: newMemoryProvider(cfg.S3Filename, nil), limit: 100000}
+			processor.destinations = []Destination{{Name: "interrupted", Provider: provider}}
+
+			// The first run stops after sending the start of the archive
+			if err := processor.Process(ctx); err == nil {
+				t.Fatal("Process() of an interrupted upload succeeded")
+			}
+			statePath, err := streamStatePath(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var state streamState
+			if found, err := storage.LoadState(statePath, &state); err != nil || !found {
+				t.Fatalf("LoadState() = %t, %v", found, err)
+			}
+
+			// Change the start of the file, which the first run already sent
+			if tt.change {
+				if err := os.WriteFile(file, bytes.Repeat([]byte("CONTENT"), 400000), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			provider.limit = 0
+			if err := processor.Process(ctx); err != nil {
+				t.Fatalf("Process() error = %v", err)
+			}
+
+			if got := provider.resumed == 1; got != tt.resumed {
+				t.Errorf("upload resumed = %t, want %t", got, tt.resumed)
+			}
+			archive := provider.objects[cfg.S3Filename]
+			if got := bytes.HasPrefix(archive, state.ArchiveHeader); got != tt.resumed {
+				t.Errorf("archive stored with the header of the interrupted upload = %t, want %t", got, tt.resumed)
+			}
+			if found, _ := storage.LoadState(statePath, &state); found {
+				t.Error("stream state kept after the upload completed")
+			}
+		})
+	}
+}
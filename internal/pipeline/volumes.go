@@ -0,0 +1,482 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+	"github.com/seriousconsult/cloud_safe/internal/progress"
+	"github.com/seriousconsult/cloud_safe/internal/storage"
+)
+
+// MinVolumeSize is the smallest volume an archive can be split into, which
+// keeps the encryption header of an archive within its first volume
+const MinVolumeSize = 1024 * 1024
+
+// MegaVolumeSize is the size of the volumes archives are split into when
+// they are uploaded to Mega and no volume size is configured
+const MegaVolumeSize = 1024 * 1024 * 1024
+
+// VolumeManifestVersion is the version of the volume manifest format
+const VolumeManifestVersion = 1
+
+// volumeManifestMagic starts the manifest of an archive split into volumes,
+// which sets it apart from an archive stored whole
+var volumeManifestMagic = []byte("CLOUDSAFE-VOLUMES\n")
+
+// maxVolumeManifestSize is the size above which a stored object is taken to
+// be an archive without reading it
+const maxVolumeManifestSize = 1024 * 1024
+
+// VolumeManifest ties together the volumes an archive is split into. It is
+// stored under the name of the archive once every volume is stored; volume i
+// is stored under VolumeKey(name, i).
+type VolumeManifest struct {
+	Version int `json:"version"`
+	// Sizes holds the size of every volume, in order
+	Sizes []int64 `json:"sizes"`
+}
+
+// Size returns the size of the archive
+func (m *VolumeManifest) Size() int64 {
+	var size int64
+	for _, volume := range m.Sizes {
+		size += volume
+	}
+	return size
+}
+
+// encode returns the stored form of the manifest
+func (m *VolumeManifest) encode() ([]byte, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode volume manifest: %w", err)
+	}
+	return append(append([]byte{}, volumeManifestMagic...), data...), nil
+}
+
+// VolumeKey returns the key volume i of the archive stored under key is
+// stored under
+func VolumeKey(key string, volume int) string {
+	return fmt.Sprintf("%s.%03d", key, volume)
+}
+
+// ValidateVolumeSize checks a configured volume size; 0 disables volumes
+func ValidateVolumeSize(size int64) error {
+	if size != 0 && size < MinVolumeSize {
+		return fmt.Errorf("volume size must be at least %d bytes", MinVolumeSize)
+	}
+	return nil
+}
+
+// readVolumeManifest returns the volume manifest stored under key, or nil
+// when key holds an archive stored whole, and the object stored under key
+func readVolumeManifest(ctx context.Context, provider storage.StorageProvider, key string) (*VolumeManifest, *storage.ObjectInfo, error) {
+	info, err := provider.Stat(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.Size < int64(len(volumeManifestMagic)) || info.Size > maxVolumeManifestSize {
+		return nil, info, nil
+	}
+
+	// Only the start of a small archive is read to tell it apart
+	magic, err := readObjectRange(ctx, provider, key, 0, int64(len(volumeManifestMagic)))
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(magic, volumeManifestMagic) {
+		return nil, info, nil
+	}
+
+	data, err := readObjectRange(ctx, provider, key, 0, info.Size)
+	if err != nil {
+		return nil, nil, err
+	}
+	var manifest VolumeManifest
+	if err := json.Unmarshal(data[len(volumeManifestMagic):], &manifest); err != nil {
+		return nil, nil, fmt.Errorf("failed to read volume manifest %s: %w", key, err)
+	}
+	if manifest.Version > VolumeManifestVersion {
+		return nil, nil, fmt.Errorf("unsupported volume manifest version %d", manifest.Version)
+	}
+	if len(manifest.Sizes) == 0 {
+		return nil, nil, fmt.Errorf("volume manifest %s lists no volumes", key)
+	}
+	return &manifest, info, nil
+}
+
+// readObjectRange reads a range of the object stored under key into memory
+func readObjectRange(ctx context.Context, provider storage.StorageProvider, key string, offset, length int64) ([]byte, error) {
+	reader := fetchRange(ctx, provider, key, offset, length)
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	return data, nil
+}
+
+// volumeUpload uploads the volumes of an archive to one destination as
+// objects of their own and then uploads the manifest that ties them together
+type volumeUpload struct {
+	provider storage.StorageProvider
+	logger   *logger.Logger
+	// destination names the provider in the stream state
+	destination string
+	key         string
+	size        int64
+	// stored holds the SHA-256 of each volume an interrupted upload already
+	// stored; volumes of the stream that still match them are not uploaded
+	// again
+	stored []string
+	// resume continues the interrupted upload of a volume the provider
+	// recorded; otherwise such an upload is aborted
+	resume bool
+	// progress records the volumes stored for a later run, or is nil
+	progress *volumeProgress
+}
+
+// newVolumeUpload creates the upload of the archive stored under key to
+// provider, in volumes of size bytes
+func newVolumeUpload(provider storage.StorageProvider, destination, key string, size int64, log *logger.Logger) *volumeUpload {
+	return &volumeUpload{
+		provider:    provider,
+		logger:      log,
+		destination: destination,
+		key:         key,
+		size:        size,
+	}
+}
+
+// upload stores the stream read from reader as volumes, followed by their
+// manifest
+func (v *volumeUpload) upload(ctx context.Context, reader io.Reader, tracker progress.Tracker) error {
+	sizes, err := splitVolumes(reader, v.size, func(volume int, spool *os.File, size int64, sum string) error {
+		return v.put(ctx, volume, io.NewSectionReader(spool, 0, size), size, sum, tracker)
+	})
+	if err != nil {
+		return err
+	}
+	return v.finish(ctx, sizes)
+}
+
+// put uploads one volume of size bytes read from reader with the UploadStream
+// of a provider for the volume's key, resuming the volume an interrupted
+// upload was storing. The volumes an interrupted upload stored are skipped; a
+// stored volume that differs from the stream fails with ErrStreamChanged.
+func (v *volumeUpload) put(ctx context.Context, volume int, reader io.Reader, size int64, sum string, tracker progress.Tracker) error {
+	volumeKey := VolumeKey(v.key, volume)
+
+	// Fast-forward past volumes that are already stored
+	if volume < len(v.stored) {
+		// Stored volumes are full, since a short one ends the archive
+		if size != v.size || sum != v.stored[volume] {
+			return fmt.Errorf("volume %s: %w", volumeKey, storage.ErrStreamChanged)
+		}
+		if tracker != nil {
+			tracker.Update(size)
+		}
+		return nil
+	}
+	if volume > 0 && volume == len(v.stored) {
+		v.logger.Infof("Skipped %d already stored volume(s) on %s", volume, v.destination)
+	}
+
+	provider := v.provider.WithKey(volumeKey)
+	resumable, err := provider.CheckResumability(ctx)
+	if err != nil {
+		v.logger.Errorf("Failed to check resumability of volume %s: %v", volumeKey, err)
+		resumable = nil
+	}
+	if resumable != nil && v.resume {
+		v.logger.Infof("Resuming upload of volume %s to %s", volumeKey, v.destination)
+		err = resumable.Resume(ctx, reader, tracker)
+	} else {
+		// An interrupted upload made with another archive key is not continued
+		if resumable != nil {
+			if err := resumable.Abort(ctx); err != nil {
+				v.logger.Errorf("Failed to abort interrupted upload of volume %s: %v", volumeKey, err)
+			}
+		}
+		v.logger.Infof("Uploading volume %s to %s", volumeKey, v.destination)
+		err = provider.UploadStream(ctx, reader, size, tracker)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to upload volume %s: %w", volumeKey, err)
+	}
+
+	if v.progress != nil {
+		if err := v.progress.stored(v.destination, volume, sum); err != nil {
+			v.logger.Errorf("Failed to record uploaded volume: %v", err)
+		}
+	}
+	return nil
+}
+
+// finish uploads the manifest listing the sizes of the volumes, then removes
+// the volumes an earlier, longer archive left under the same name
+func (v *volumeUpload) finish(ctx context.Context, sizes []int64) error {
+	manifest := &VolumeManifest{Version: VolumeManifestVersion, Sizes: sizes}
+	data, err := manifest.encode()
+	if err != nil {
+		return err
+	}
+	if err := v.provider.PutObject(ctx, v.key, bytes.NewReader(data), int64(len(data)), nil); err != nil {
+		return fmt.Errorf("failed to upload volume manifest %s: %w", v.key, err)
+	}
+	v.logger.Infof("Stored %s on %s as %d volume(s)", v.key, v.destination, len(sizes))
+
+	// The archive is complete without them, so failures are only logged
+	if err := v.removeVolumes(ctx, len(sizes)); err != nil {
+		v.logger.Errorf("WARNING: failed to remove old volumes of %s from %s: %v", v.key, v.destination, err)
+	}
+	return nil
+}
+
+// removeVolumes deletes the volumes stored under the archive's name from
+// volume count on
+func (v *volumeUpload) removeVolumes(ctx context.Context, count int) error {
+	objects, err := v.provider.List(ctx, v.key+".")
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		volume, err := strconv.Atoi(strings.TrimPrefix(object.Key, v.key+"."))
+		if err != nil || volume < count || object.Key != VolumeKey(v.key, volume) {
+			continue
+		}
+		if err := v.provider.DeleteObject(ctx, object.Key); err != nil {
+			return err
+		}
+		v.logger.Infof("Removed old volume %s from %s", object.Key, v.destination)
+	}
+	return nil
+}
+
+// splitVolumes reads the stream from reader in volumes of size bytes and
+// calls store with each of them, and returns the sizes of the volumes. Each
+// volume is spooled to the same temporary file, so store is given its exact
+// size and its hex SHA-256; the file holds the volume until store returns.
+func splitVolumes(reader io.Reader, size int64, store func(volume int, spool *os.File, size int64, sum string) error) ([]int64, error) {
+	stream := bufio.NewReader(reader)
+
+	spool, err := os.CreateTemp("", "cloud_safe-volume-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	var sizes []int64
+	for volume := 0; ; volume++ {
+		read, sum, err := spoolVolume(spool, io.LimitReader(stream, size))
+		if err != nil {
+			return nil, err
+		}
+		if err := store(volume, spool, read, sum); err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, read)
+
+		// Only a full volume can be followed by more of the stream
+		if read < size {
+			return sizes, nil
+		}
+		if _, err := stream.Peek(1); err == io.EOF {
+			return sizes, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// spoolVolume replaces the content of file with the volume read from reader,
+// returning the size and the hex SHA-256 of the volume
+func spoolVolume(file *os.File, reader io.Reader) (int64, string, error) {
+	if err := file.Truncate(0); err != nil {
+		return 0, "", fmt.Errorf("failed to spool volume: %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, "", fmt.Errorf("failed to spool volume: %w", err)
+	}
+	hasher := sha256.New()
+	read, err := io.Copy(io.MultiWriter(file, hasher), reader)
+	if err != nil {
+		return 0, "", err
+	}
+	return read, hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// volumeProgress records in the stream state the SHA-256 of each volume each
+// destination has stored, so a rerun can skip them
+type volumeProgress struct {
+	mutex sync.Mutex
+	path  string
+	state *streamState
+}
+
+// stored records that destination has stored volume with the SHA-256 sum,
+// replacing what it stored from that volume on
+func (v *volumeProgress) stored(destination string, volume int, sum string) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	sums := v.state.VolumeSums[destination]
+	v.state.VolumeSums[destination] = append(sums[:min(volume, len(sums))], sum)
+	return storage.SaveState(v.path, v.state)
+}
+
+// volumeStorage reads archives split into volumes as if they were stored
+// whole; other objects are read as they are stored
+type volumeStorage struct {
+	storage.StorageProvider
+	mutex   sync.Mutex
+	objects map[string]*volumeObject
+}
+
+// volumeObject is an object read through a volumeStorage
+type volumeObject struct {
+	info *storage.ObjectInfo
+	// manifest is nil for an object stored whole
+	manifest *VolumeManifest
+}
+
+// newVolumeStorage wraps provider so split archives are joined when read
+func newVolumeStorage(provider storage.StorageProvider) *volumeStorage {
+	return &volumeStorage{
+		StorageProvider: provider,
+		objects:         make(map[string]*volumeObject),
+	}
+}
+
+// object returns the object stored under key, reading its volume manifest if
+// it has one
+func (s *volumeStorage) object(ctx context.Context, key string) (*volumeObject, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if object, ok := s.objects[key]; ok {
+		return object, nil
+	}
+	manifest, info, err := readVolumeManifest(ctx, s.StorageProvider, key)
+	if err != nil {
+		return nil, err
+	}
+	object := &volumeObject{info: info, manifest: manifest}
+	s.objects[key] = object
+	return object, nil
+}
+
+// DownloadStream downloads the object stored under key, joining the volumes
+// of a split archive
+func (s *volumeStorage) DownloadStream(ctx context.Context, key string, writer io.Writer, tracker progress.Tracker) error {
+	object, err := s.object(ctx, key)
+	if err != nil {
+		return err
+	}
+	if object.manifest == nil {
+		return s.StorageProvider.DownloadStream(ctx, key, writer, tracker)
+	}
+
+	for volume, size := range object.manifest.Sizes {
+		counter := &countingWriter{writer: writer}
+		if err := s.StorageProvider.DownloadStream(ctx, VolumeKey(key, volume), counter, tracker); err != nil {
+			return err
+		}
+		if counter.written != size {
+			return fmt.Errorf("volume %s is %d bytes, expected %d", VolumeKey(key, volume), counter.written, size)
+		}
+	}
+	return nil
+}
+
+// Stat returns information about the object stored under key; the size of a
+// split archive is the size of all its volumes
+func (s *volumeStorage) Stat(ctx context.Context, key string) (*storage.ObjectInfo, error) {
+	object, err := s.object(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	info := *object.info
+	if object.manifest != nil {
+		info.Size = object.manifest.Size()
+	}
+	return &info, nil
+}
+
+// ReadRange returns a byte range of the object stored under key, read from
+// the volumes that hold it for a split archive
+func (s *volumeStorage) ReadRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	object, err := s.object(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if object.manifest == nil {
+		return fetchRange(ctx, s.StorageProvider, key, offset, length), nil
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(s.copyRange(ctx, key, object.manifest, offset, length, writer))
+	}()
+	return reader, nil
+}
+
+// copyRange copies length bytes of a split archive from offset, or the rest
+// of it for a negative length, to writer
+func (s *volumeStorage) copyRange(ctx context.Context, key string, manifest *VolumeManifest, offset, length int64, writer io.Writer) error {
+	var start int64
+	for volume, size := range manifest.Sizes {
+		if length == 0 {
+			return nil
+		}
+		end := start + size
+		if offset < end {
+			volumeLength := end - offset
+			if length >= 0 && length < volumeLength {
+				volumeLength = length
+			}
+
+			body := fetchRange(ctx, s.StorageProvider, VolumeKey(key, volume), offset-start, volumeLength)
+			n, err := io.Copy(writer, body)
+			body.Close()
+			if err != nil {
+				return err
+			}
+			// A short volume would shift everything after it
+			if n != volumeLength {
+				return fmt.Errorf("volume %s ended after %d of %d bytes: %w", VolumeKey(key, volume), n, volumeLength, io.ErrUnexpectedEOF)
+			}
+			offset += n
+			if length > 0 {
+				length -= n
+			}
+		}
+		start = end
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	writer  io.Writer
+	written int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	c.written += int64(n)
+	return n, err
+}
@@ -0,0 +1,296 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+	"github.com/seriousconsult/cloud_safe/internal/progress"
+	"github.com/seriousconsult/cloud_safe/internal/storage"
+)
+
+const testVolumeSize = 1000
+
+// volumeProvider is a memoryProvider that records the keys stored with
+// PutObject and fails the upload of failKey
+type volumeProvider struct {
+	*memoryProvider
+	mutex   sync.Mutex
+	failKey string
+	stored  []string
+}
+
+func (v *volumeProvider) PutObject(ctx context.Context, key string, reader io.Reader, size int64, tracker progress.Tracker) error {
+	if key == v.failKey {
+		return errors.New("upload failed")
+	}
+	v.mutex.Lock()
+	v.stored = append(v.stored, key)
+	v.mutex.Unlock()
+	return v.memoryProvider.PutObject(ctx, key, reader, size, tracker)
+}
+
+func (v *volumeProvider) WithKey(key string) storage.StorageProvider {
+	return &keyedProvider{StorageProvider: v, key: key}
+}
+
+// reset forgets the keys stored so far and returns them
+func (v *volumeProvider) reset() []string {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	stored := v.stored
+	v.stored = nil
+	return stored
+}
+
+// volumeKeys returns the keys of volumes first to last of key, followed by key
+func volumeKeys(key string, first, last int) []string {
+	var keys []string
+	for volume := first; volume <= last; volume++ {
+		keys = append(keys, VolumeKey(key, volume))
+	}
+	return append(keys, key)
+}
+
+func TestVolumeResume(t *testing.T) {
+	const key = "backup.tar"
+	original := bytes.Repeat([]byte("0123456789abcdefghijklmnopqrstuvwxyz"), 100) // 3600 bytes in 4 volumes
+
+	changed := func(offset int) []byte {
+		data := append([]byte{}, original...)
+		data[offset] ^= 1
+		return data
+	}
+
+	tests := []struct {
+		name   string
+		resume []byte
+		// want lists the keys the resumed upload stores, or is nil when the
+		// stream is refused
+		want []string
+	}{
+		{name: "same stream", resume: original, want: volumeKeys(key, 2, 3)},
+		{name: "first volume differs", resume: changed(0)},
+		{name: "last byte of a stored volume differs", resume: changed(2*testVolumeSize - 1)},
+		{name: "volume after the stored ones differs", resume: changed(3 * testVolumeSize), want: volumeKeys(key, 2, 3)},
+		{name: "stream ends in a stored volume", resume: original[:testVolumeSize+10]},
+		{name: "stream ends with the stored volumes", resume: original[:2*testVolumeSize], want: []string{key}},
+		{name: "different stream of the same length", resume: bytes.Repeat([]byte("x"), len(original))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			log := logger.New(false).Quiet()
+			provider := &volumeProvider{memoryProvider: newMemoryProvider(key, nil), failKey: VolumeKey(key, 2)}
+			statePath := filepath.Join(t.TempDir(), "stream.json")
+			progress := &volumeProgress{path: statePath, state: &streamState{VolumeSums: make(map[string][]string)}}
+
+			// The first run stores two volumes before the third fails
+			first := newVolumeUpload(provider, "memory", key, testVolumeSize, log)
+			first.progress = progress
+			if err := first.upload(ctx, bytes.NewReader(original), nil); err == nil {
+				t.Fatal("upload() with a failing volume succeeded")
+			}
+			if got := provider.reset(); !reflect.DeepEqual(got, []string{VolumeKey(key, 0), VolumeKey(key, 1)}) {
+				t.Fatalf("interrupted upload stored %v", got)
+			}
+
+			var saved streamState
+			if found, err := storage.LoadState(statePath, &saved); err != nil || !found {
+				t.Fatalf("LoadState() = %t, %v", found, err)
+			}
+			if len(saved.VolumeSums["memory"]) != 2 {
+				t.Fatalf("stream state records %d volumes, want 2", len(saved.VolumeSums["memory"]))
+			}
+
+			provider.failKey = ""
+			resumed := newVolumeUpload(provider, "memory", key, testVolumeSize, log)
+			resumed.stored = saved.VolumeSums["memory"]
+			resumed.progress = &volumeProgress{path: statePath, state: &saved}
+			err := resumed.upload(ctx, bytes.NewReader(tt.resume), nil)
+			if tt.want == nil {
+				if !errors.Is(err, storage.ErrStreamChanged) {
+					t.Fatalf("upload() error = %v, want ErrStreamChanged", err)
+				}
+				if got := provider.reset(); len(got) != 0 {
+					t.Errorf("refused upload stored %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("upload() error = %v", err)
+			}
+			if got := provider.reset(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resumed upload stored %v, want %v", got, tt.want)
+			}
+
+			var archive bytes.Buffer
+			if err := newVolumeStorage(provider).DownloadStream(ctx, key, &archive, nil); err != nil {
+				t.Fatalf("DownloadStream() error = %v", err)
+			}
+			if !bytes.Equal(archive.Bytes(), tt.resume) {
+				t.Errorf("stored archive has %d bytes that differ from the %d bytes of the stream", archive.Len(), len(tt.resume))
+			}
+		})
+	}
+}
+
+func TestVolumeResumesInterruptedVolume(t *testing.T) {
+	const key = "backup.tar"
+	stream := bytes.Repeat([]byte("0123456789abcdefghijklmnopqrstuvwxyz"), 100) // 3600 bytes in 4 volumes
+
+	tests := []struct {
+		name string
+		// partial is what the interrupted run wrote of volume 2
+		partial []byte
+		resume  bool
+		wantErr error
+	}{
+		{name: "resumed", partial: stream[2*testVolumeSize : 2*testVolumeSize+300], resume: true},
+		{name: "resumed volume differs", partial: []byte("other"), resume: true, wantErr: storage.ErrStreamChanged},
+		{name: "not resumed", partial: []byte("other")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			log := logger.New(false).Quiet()
+			dir := t.TempDir()
+			provider, err := storage.NewLocalProvider(&storage.LocalConfig{Path: dir, Filename: key, Resume: true}, log)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The interrupted run stored volumes 0 and 1 and part of volume 2
+			var stored []string
+			for volume := 0; volume < 2; volume++ {
+				data := stream[volume*testVolumeSize : (volume+1)*testVolumeSize]
+				if err := provider.PutObject(ctx, VolumeKey(key, volume), bytes.NewReader(data), int64(len(data)), nil); err != nil {
+					t.Fatal(err)
+				}
+				sum := sha256.Sum256(data)
+				stored = append(stored, hex.EncodeToString(sum[:]))
+			}
+			if err := os.WriteFile(filepath.Join(dir, VolumeKey(key, 2)+".partial"), tt.partial, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			resumed := newVolumeUpload(provider, "local", key, testVolumeSize, log)
+			resumed.stored = stored
+			resumed.resume = tt.resume
+			err = resumed.upload(ctx, bytes.NewReader(stream), nil)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("upload() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("upload() error = %v", err)
+			}
+
+			var archive bytes.Buffer
+			if err := newVolumeStorage(provider).DownloadStream(ctx, key, &archive, nil); err != nil {
+				t.Fatalf("DownloadStream() error = %v", err)
+			}
+			if !bytes.Equal(archive.Bytes(), stream) {
+				t.Error("stored archive differs from the stream")
+			}
+		})
+	}
+}
+
+func TestVolumeUploadRemovesOldVolumes(t *testing.T) {
+	ctx := context.Background()
+	const key = "backup.tar"
+	log := logger.New(false).Quiet()
+	provider := newMemoryProvider(key, nil)
+	provider.objects[IndexKey(key)] = []byte("index")
+
+	long := bytes.Repeat([]byte("a"), 4*testVolumeSize)
+	if err := newVolumeUpload(provider, "memory", key, testVolumeSize, log).upload(ctx, bytes.NewReader(long), nil); err != nil {
+		t.Fatal(err)
+	}
+	short := bytes.Repeat([]byte("b"), testVolumeSize+10)
+	if err := newVolumeUpload(provider, "memory", key, testVolumeSize, log).upload(ctx, bytes.NewReader(short), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for stored := range provider.objects {
+		keys = append(keys, stored)
+	}
+	sort.Strings(keys)
+	if want := []string{key, VolumeKey(key, 0), VolumeKey(key, 1), IndexKey(key)}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("provider holds %v, want %v", keys, want)
+	}
+}
+
+func TestVolumeUpload(t *testing.T) {
+	const key = "backup.tar"
+	ctx := context.Background()
+	log := logger.New(false).Quiet()
+	dir := t.TempDir()
+
+	// Two whole volumes and half of a third
+	stream := make([]byte, 5*MinVolumeSize/2)
+	rand.New(rand.NewSource(1)).Read(stream)
+
+	provider, err := storage.NewLocalProvider(&storage.LocalConfig{Path: dir, Filename: key}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := newVolumeUpload(provider, "local", key, MinVolumeSize, log).upload(ctx, bytes.NewReader(stream), nil); err != nil {
+		t.Fatalf("upload() error = %v", err)
+	}
+	for volume, size := range []int{MinVolumeSize, MinVolumeSize, MinVolumeSize / 2} {
+		info, err := os.Stat(filepath.Join(dir, VolumeKey(key, volume)))
+		if err != nil || info.Size() != int64(size) {
+			t.Fatalf("volume %d: %v, want %d bytes", volume, err, size)
+		}
+	}
+
+	manifest, _, err := readVolumeManifest(ctx, provider, key)
+	if err != nil || manifest == nil {
+		t.Fatalf("readVolumeManifest() = %v, %v", manifest, err)
+	}
+	if want := []int64{MinVolumeSize, MinVolumeSize, MinVolumeSize / 2}; !reflect.DeepEqual(manifest.Sizes, want) {
+		t.Errorf("manifest lists volumes of %v bytes, want %v", manifest.Sizes, want)
+	}
+
+	volumes := newVolumeStorage(provider)
+	info, err := volumes.Stat(ctx, key)
+	if err != nil || info.Size != int64(len(stream)) {
+		t.Fatalf("Stat() = %v, %v, want %d bytes", info, err, len(stream))
+	}
+	var archive bytes.Buffer
+	if err := volumes.DownloadStream(ctx, key, &archive, nil); err != nil {
+		t.Fatalf("DownloadStream() error = %v", err)
+	}
+	if !bytes.Equal(archive.Bytes(), stream) {
+		t.Errorf("stored archive has %d bytes that differ from the %d bytes of the stream", archive.Len(), len(stream))
+	}
+
+	// A range across the end of the first volume is read from both
+	reader, err := volumes.ReadRange(ctx, key, MinVolumeSize-10, 20)
+	if err != nil {
+		t.Fatalf("ReadRange() error = %v", err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(data, stream[MinVolumeSize-10:MinVolumeSize+10]) {
+		t.Errorf("ReadRange() across volumes = %d bytes, %v", len(data), err)
+	}
+}
@@ -0,0 +1,91 @@
+package progress
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Group tracks several transfers of the same data, such as one archive
+// uploaded to several destinations, and prints their progress on one line
+type Group struct {
+	mu        sync.Mutex
+	names     []string
+	trackers  []*groupTracker
+	startTime time.Time
+}
+
+// NewGroup creates a progress group with one tracker per name
+func NewGroup(totalSize int64, names ...string) *Group {
+	g := &Group{
+		names:     names,
+		startTime: time.Now(),
+	}
+	for range names {
+		g.trackers = append(g.trackers, &groupTracker{
+			SimpleTracker: NewSimpleTracker(totalSize),
+			group:         g,
+		})
+	}
+	return g
+}
+
+// Tracker returns the tracker of the i-th name
+func (g *Group) Tracker(i int) Tracker {
+	return g.trackers[i]
+}
+
+// printProgress prints the progress of every transfer on the current line
+func (g *Group) printProgress() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	parts := make([]string, len(g.trackers))
+	for i, t := range g.trackers {
+		transferred, total, percentage := t.GetProgress()
+		if total > 0 {
+			parts[i] = fmt.Sprintf("%s %.1f%%", g.names[i], percentage)
+		} else {
+			parts[i] = fmt.Sprintf("%s %.2f MB", g.names[i], float64(transferred)/(1024*1024))
+		}
+	}
+	fmt.Printf("\rProgress: %s", strings.Join(parts, " | "))
+}
+
+// Finish completes the progress tracking of the whole group
+func (g *Group) Finish() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	elapsed := time.Since(g.startTime)
+	fmt.Printf("\n\nTransfer completed in %v\n", elapsed.Round(time.Second))
+	for i, t := range g.trackers {
+		transferred, _, _ := t.GetProgress()
+		fmt.Printf("  %s: %.2f MB (average speed: %.2f MB/s)\n",
+			g.names[i],
+			float64(transferred)/(1024*1024),
+			t.GetSpeed()/(1024*1024))
+	}
+}
+
+// groupTracker is the tracker of one transfer in a Group. It leaves printing
+// to the group so the transfers do not overwrite each other's progress line.
+type groupTracker struct {
+	*SimpleTracker
+	group *Group
+}
+
+// Update updates the progress with the number of bytes transferred
+func (t *groupTracker) Update(bytes int64) {
+	t.mu.Lock()
+	count := t.add(bytes)
+	t.mu.Unlock()
+
+	if count%50 == 0 {
+		t.group.printProgress()
+	}
+}
+
+// Finish does nothing; the group reports all transfers in Group.Finish
+func (t *groupTracker) Finish() {}
@@ -30,22 +30,35 @@ func (t *SimpleTracker) Update(bytes int64) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	
-	t.transferred += bytes
-	t.updateCount++
-	t.lastUpdate = time.Now()
-	
 	// Print progress every 50 updates to avoid spam
-	if t.updateCount%50 == 0 {
+	if t.add(bytes)%50 == 0 {
 		t.printProgress()
 	}
 }
 
+// add records transferred bytes and returns the number of updates so far.
+// The caller holds the lock.
+func (t *SimpleTracker) add(bytes int64) int64 {
+	t.transferred += bytes
+	t.updateCount++
+	t.lastUpdate = time.Now()
+	return t.updateCount
+}
+
 // printProgress prints current progress to console
 func (t *SimpleTracker) printProgress() {
-	percentage := float64(t.transferred) / float64(t.totalSize) * 100
 	elapsed := time.Since(t.startTime)
 	speed := float64(t.transferred) / elapsed.Seconds() / (1024 * 1024) // MB/s
 	
+	// Without a known total only the transferred amount can be shown
+	if t.totalSize <= 0 {
+		fmt.Printf("\rProgress: %.2f MB Speed: %.2f MB/s", 
+			float64(t.transferred)/(1024*1024), 
+			speed)
+		return
+	}
+	
+	percentage := float64(t.transferred) / float64(t.totalSize) * 100
 	fmt.Printf("\rProgress: %.1f%% (%.2f MB/%.2f MB) Speed: %.2f MB/s", 
 		percentage, 
 		float64(t.transferred)/(1024*1024), 
@@ -97,9 +110,9 @@ func (t *SimpleTracker) Finish() {
 	defer t.mu.Unlock()
 	
 	elapsed := time.Since(t.startTime)
-	avgSpeed := float64(t.totalSize) / elapsed.Seconds() / (1024 * 1024)
+	avgSpeed := float64(t.transferred) / elapsed.Seconds() / (1024 * 1024)
 	
-	fmt.Printf("\n\nUpload completed in %v (average speed: %.2f MB/s)\n", 
+	fmt.Printf("\n\nTransfer completed in %v (average speed: %.2f MB/s)\n", 
 		elapsed.Round(time.Second), avgSpeed)
 }
 
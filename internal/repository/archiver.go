@@ -0,0 +1,270 @@
+package repository
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/seriousconsult/cloud_safe/internal/compressor"
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+	"github.com/seriousconsult/cloud_safe/internal/progress"
+)
+
+// BackupStats counts what a backup read and what it added to the repository
+type BackupStats struct {
+	Files int64
+	Size  int64
+	// Added is the number of bytes stored, after deduplication, compression
+	// and encryption
+	Added int64
+}
+
+// Archiver backs up files and directories into a repository
+type Archiver struct {
+	repo    *Repository
+	logger  *logger.Logger
+	filter  *compressor.Filter
+	tracker progress.Tracker
+	chunker *Chunker
+	stats   BackupStats
+}
+
+// NewArchiver creates an archiver storing into repo
+func NewArchiver(repo *Repository, log *logger.Logger) *Archiver {
+	return &Archiver{
+		repo:    repo,
+		logger:  log,
+		chunker: NewChunker(nil, repo.gear),
+	}
+}
+
+// SetFilter selects the files backed up from source directories; a nil
+// filter backs up everything
+func (a *Archiver) SetFilter(filter *compressor.Filter) {
+	a.filter = filter
+}
+
+// SetTracker reports the bytes read to tracker
+func (a *Archiver) SetTracker(tracker progress.Tracker) {
+	a.tracker = tracker
+}
+
+// Stats returns what the last backup read and stored
+func (a *Archiver) Stats() BackupStats {
+	return a.stats
+}
+
+// Backup stores sourcePaths and saves a snapshot of them. Each source is an
+// entry of the snapshot's root tree, named after its last path element as
+// in an archive.
+func (a *Archiver) Backup(ctx context.Context, sourcePaths []string) (*Snapshot, error) {
+	a.stats = BackupStats{}
+	root := &Tree{}
+	names := make(map[string]string)
+
+	for _, sourcePath := range sourcePaths {
+		info, err := os.Stat(sourcePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat source path %s: %w", sourcePath, err)
+		}
+		if other, ok := names[info.Name()]; ok {
+			return nil, fmt.Errorf("sources %s and %s have the same name", other, sourcePath)
+		}
+		names[info.Name()] = sourcePath
+
+		var node *Node
+		if info.IsDir() {
+			a.logger.Debugf("Backing up directory: %s", sourcePath)
+			node, err = a.saveDirectory(ctx, sourcePath)
+		} else {
+			a.logger.Debugf("Backing up file: %s", sourcePath)
+			node, err = a.saveNode(ctx, sourcePath, info)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if node != nil {
+			root.Nodes = append(root.Nodes, node)
+		}
+	}
+
+	treeID, added, err := a.repo.SaveTree(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+	a.stats.Added += added
+
+	// The snapshot may only refer to blobs that later runs can find
+	if err := a.repo.Flush(ctx); err != nil {
+		return nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	snapshot := &Snapshot{
+		Time:     time.Now(),
+		Hostname: hostname,
+		Paths:    sourcePaths,
+		Tree:     treeID,
+		Files:    a.stats.Files,
+		Size:     a.stats.Size,
+	}
+	if err := a.repo.SaveSnapshot(ctx, snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// saveDirectory stores a source directory and returns its node
+func (a *Archiver) saveDirectory(ctx context.Context, sourcePath string) (*Node, error) {
+	trees := make(map[string]*Tree)
+	dirs := make(map[string]*Node)
+	var order []string
+
+	err := compressor.WalkSource(sourcePath, a.filter, a.logger, func(filePath, relPath string, info os.FileInfo) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		node, err := a.saveNode(ctx, filePath, info)
+		if err != nil || node == nil {
+			return err
+		}
+		if relPath != "." {
+			parent := trees[path.Dir(relPath)]
+			parent.Nodes = append(parent.Nodes, node)
+		}
+		if node.Type == NodeDir {
+			trees[relPath] = &Tree{}
+			dirs[relPath] = node
+			order = append(order, relPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Directories are walked before their entries, so in reverse order every
+	// subtree is stored before the tree that refers to it
+	for i := len(order) - 1; i >= 0; i-- {
+		id, added, err := a.repo.SaveTree(ctx, trees[order[i]])
+		if err != nil {
+			return nil, err
+		}
+		a.stats.Added += added
+		dirs[order[i]].Subtree = &id
+	}
+	return dirs["."], nil
+}
+
+// saveNode returns the node of a directory entry, storing the content of
+// files. Directories get their subtree later. Special files are skipped.
+func (a *Archiver) saveNode(ctx context.Context, filePath string, info os.FileInfo) (*Node, error) {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file info for %s: %w", filePath, err)
+	}
+	node := &Node{
+		Name:    info.Name(),
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
+		UID:     header.Uid,
+		GID:     header.Gid,
+	}
+
+	switch {
+	case info.IsDir():
+		node.Type = NodeDir
+
+	case info.Mode()&os.ModeSymlink != 0:
+		node.Type = NodeSymlink
+		if node.LinkTarget, err = os.Readlink(filePath); err != nil {
+			return nil, fmt.Errorf("failed to read symlink %s: %w", filePath, err)
+		}
+
+	case info.Mode().IsRegular():
+		node.Type = NodeFile
+		node.Size = info.Size()
+		if err := a.saveContent(ctx, filePath, node); err != nil {
+			return nil, err
+		}
+
+	default:
+		a.logger.Infof("Skipping special file %s: repositories store only directories, files and symlinks", filePath)
+		return nil, nil
+	}
+	return node, nil
+}
+
+// saveContent splits a file into chunks and stores those the repository
+// does not have yet
+func (a *Archiver) saveContent(ctx context.Context, filePath string, node *Node) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %w", filePath, err)
+	}
+	defer file.Close()
+
+	a.logger.Debugf("Storing file: %s", filePath)
+	a.chunker.Reset(file)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		chunk, err := a.chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read file %s: %w", filePath, err)
+		}
+
+		id, added, err := a.repo.SaveBlob(ctx, BlobData, chunk)
+		if err != nil {
+			return err
+		}
+		node.Content = append(node.Content, id)
+		a.stats.Size += int64(len(chunk))
+		a.stats.Added += added
+		if a.tracker != nil {
+			a.tracker.Update(int64(len(chunk)))
+		}
+	}
+
+	a.stats.Files++
+	return nil
+}
+
+// EstimateSize returns the size of the files a backup of sourcePaths reads
+func (a *Archiver) EstimateSize(sourcePaths []string) (int64, error) {
+	var total int64
+	for _, sourcePath := range sourcePaths {
+		info, err := os.Stat(sourcePath)
+		if err != nil {
+			return 0, fmt.Errorf("failed to stat source path %s: %w", sourcePath, err)
+		}
+		if !info.IsDir() {
+			total += info.Size()
+			continue
+		}
+		err = compressor.WalkSource(sourcePath, a.filter, a.logger, func(filePath, relPath string, info os.FileInfo) error {
+			if info.Mode().IsRegular() {
+				total += info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,199 @@
+package repository
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/seriousconsult/cloud_safe/internal/compressor"
+)
+
+// ID identifies a blob by its keyed hash, or a repository object by the hash
+// of its stored bytes
+type ID [32]byte
+
+// String returns the ID in hex
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// MarshalText encodes the ID in hex
+func (id ID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+// UnmarshalText decodes an ID from hex
+func (id *ID) UnmarshalText(text []byte) error {
+	parsed, err := ParseID(string(text))
+	if err != nil {
+		return err
+	}
+	*id = parsed
+	return nil
+}
+
+// ParseID parses an ID written in hex
+func ParseID(s string) (ID, error) {
+	var id ID
+	data, err := hex.DecodeString(s)
+	if err != nil || len(data) != len(id) {
+		return id, fmt.Errorf("invalid ID %q", s)
+	}
+	copy(id[:], data)
+	return id, nil
+}
+
+// BlobType tells file content from directory trees
+type BlobType string
+
+const (
+	// BlobData is a chunk of file content
+	BlobData BlobType = "data"
+	// BlobTree is an encoded Tree
+	BlobTree BlobType = "tree"
+)
+
+// Keys are the secrets of a repository. They are created with it and kept in
+// its config object.
+type Keys struct {
+	// ID keys the hash that identifies blobs, so IDs reveal nothing about
+	// their content to anyone without the keys
+	ID []byte `json:"id"`
+	// Chunker keys the gear table of the chunker
+	Chunker []byte `json:"chunker"`
+	// Data encrypts blobs and repository objects; it is empty in an
+	// unencrypted repository
+	Data []byte `json:"data,omitempty"`
+}
+
+// newKeys creates random keys
+func newKeys(encrypted bool) (*Keys, error) {
+	keys := &Keys{
+		ID:      make([]byte, 32),
+		Chunker: make([]byte, 32),
+	}
+	if encrypted {
+		keys.Data = make([]byte, 32)
+	}
+	for _, key := range [][]byte{keys.ID, keys.Chunker, keys.Data} {
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to create repository keys: %w", err)
+		}
+	}
+	return keys, nil
+}
+
+// Flags of the first byte of a stored blob
+const (
+	blobStored     byte = 0
+	blobCompressed byte = 1
+)
+
+// blobID returns the ID of a blob
+func (r *Repository) blobID(data []byte) ID {
+	mac := hmac.New(sha256.New, r.config.Keys.ID)
+	mac.Write(data)
+	var id ID
+	copy(id[:], mac.Sum(nil))
+	return id
+}
+
+// encodeBlob compresses and encrypts a blob for storage. Data that does not
+// shrink is stored as it is.
+func (r *Repository) encodeBlob(data []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	compressed.WriteByte(blobCompressed)
+	writer, err := compressor.NewCompressWriter(&compressed, r.codec, r.config.CompressionLevel)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to compress blob: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress blob: %w", err)
+	}
+
+	plaintext := compressed.Bytes()
+	if r.codec == compressor.CodecNone || len(plaintext) >= len(data)+1 {
+		plaintext = append([]byte{blobStored}, data...)
+	}
+	return r.seal(plaintext)
+}
+
+// decodeBlob reverses encodeBlob
+func (r *Repository) decodeBlob(stored []byte) ([]byte, error) {
+	plaintext, err := r.open(stored)
+	if err != nil {
+		return nil, err
+	}
+	if len(plaintext) == 0 {
+		return nil, fmt.Errorf("empty blob")
+	}
+
+	switch plaintext[0] {
+	case blobStored:
+		return plaintext[1:], nil
+	case blobCompressed:
+		reader, _, err := compressor.NewDecompressReader(bytes.NewReader(plaintext[1:]))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress blob: %w", err)
+		}
+		return data, nil
+	default:
+		return nil, fmt.Errorf("unknown blob encoding %d", plaintext[0])
+	}
+}
+
+// seal encrypts data with the data key as nonce || AES-256-GCM ciphertext.
+// Unencrypted repositories store data as it is.
+func (r *Repository) seal(data []byte) ([]byte, error) {
+	if r.aead == nil {
+		return data, nil
+	}
+	nonce := make([]byte, r.aead.NonceSize(), r.aead.NonceSize()+len(data)+r.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to create nonce: %w", err)
+	}
+	return r.aead.Seal(nonce, nonce, data, nil), nil
+}
+
+// open decrypts data sealed by seal
+func (r *Repository) open(data []byte) ([]byte, error) {
+	if r.aead == nil {
+		return data, nil
+	}
+	if len(data) < r.aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted object is truncated")
+	}
+	nonce, ciphertext := data[:r.aead.NonceSize()], data[r.aead.NonceSize():]
+	plaintext, err := r.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt object: %w", err)
+	}
+	return plaintext, nil
+}
+
+// newAEAD creates the cipher of the data key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return aead, nil
+}
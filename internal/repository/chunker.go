@@ -0,0 +1,143 @@
+package repository
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+)
+
+// Chunk sizes of content-defined chunking
+const (
+	MinChunkSize = 512 * 1024
+	AvgChunkSize = 1024 * 1024
+	MaxChunkSize = 8 * 1024 * 1024
+)
+
+// Boundary masks of normalized chunking: below the average chunk size a cut
+// needs more zero bits than above it, which keeps chunk sizes close to the
+// average. The masks use the high bits of the gear hash, which depend on the
+// last 64 bytes; the low bits depend on only the last few.
+const (
+	maskHard uint64 = 0xFFFFFC0000000000
+	maskEasy uint64 = 0xFFFFC00000000000
+)
+
+// GearTable holds the random values the rolling hash adds for every byte
+type GearTable [256]uint64
+
+// NewGearTable derives the gear table of a repository from its chunker key,
+// so chunk boundaries cannot be predicted without the key
+func NewGearTable(key []byte) *GearTable {
+	var table GearTable
+	mac := hmac.New(sha256.New, key)
+	for i := range table {
+		mac.Reset()
+		mac.Write([]byte{byte(i)})
+		table[i] = binary.LittleEndian.Uint64(mac.Sum(nil))
+	}
+	return &table
+}
+
+// Chunker splits a stream into chunks at content-defined boundaries found
+// with a gear rolling hash (FastCDC). Boundaries depend only on the bytes
+// around them, so inserting or removing data changes only the chunks near
+// the edit, and the same data in different files or at different offsets
+// gives the same chunks.
+type Chunker struct {
+	reader io.Reader
+	gear   *GearTable
+	buffer []byte
+	// The buffered data is buffer[start:end]
+	start int
+	end   int
+	eof   bool
+}
+
+// NewChunker creates a chunker reading from reader
+func NewChunker(reader io.Reader, gear *GearTable) *Chunker {
+	return &Chunker{
+		reader: reader,
+		gear:   gear,
+		buffer: make([]byte, MaxChunkSize),
+	}
+}
+
+// Reset makes the chunker read a new stream, reusing its buffer
+func (c *Chunker) Reset(reader io.Reader) {
+	c.reader = reader
+	c.start = 0
+	c.end = 0
+	c.eof = false
+}
+
+// Next returns the next chunk, or io.EOF after the last one. The chunk is
+// only valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := c.cut(c.buffer[c.start:c.end])
+	chunk := c.buffer[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// fill buffers a maximum-size chunk, or what is left of the stream
+func (c *Chunker) fill() error {
+	if c.end-c.start >= MaxChunkSize || c.eof {
+		return nil
+	}
+
+	copy(c.buffer, c.buffer[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+
+	for c.end < len(c.buffer) {
+		n, err := c.reader.Read(c.buffer[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cut returns the length of the chunk at the start of data
+func (c *Chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= MinChunkSize {
+		return n
+	}
+	if n > MaxChunkSize {
+		n = MaxChunkSize
+	}
+	normal := AvgChunkSize
+	if normal > n {
+		normal = n
+	}
+
+	var hash uint64
+	i := MinChunkSize
+	for ; i < normal; i++ {
+		hash = hash<<1 + c.gear[data[i]]
+		if hash&maskHard == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		hash = hash<<1 + c.gear[data[i]]
+		if hash&maskEasy == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
@@ -0,0 +1,164 @@
+package repository
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// testData returns size bytes of reproducible random data
+func testData(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// unevenReader returns reads of varying sizes, unlike a bytes.Reader
+type unevenReader struct {
+	data []byte
+	read int
+}
+
+func (r *unevenReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	r.read++
+	n := min(len(p), len(r.data), 1000+r.read*7919%65536)
+	copy(p, r.data[:n])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// chunksOf returns the chunks chunker splits its stream into
+func chunksOf(t *testing.T, chunker *Chunker) [][]byte {
+	t.Helper()
+	var chunks [][]byte
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, append([]byte{}, chunk...))
+	}
+}
+
+// chunkSums returns the SHA-256 of every chunk
+func chunkSums(chunks [][]byte) [][sha256.Size]byte {
+	sums := make([][sha256.Size]byte, len(chunks))
+	for i, chunk := range chunks {
+		sums[i] = sha256.Sum256(chunk)
+	}
+	return sums
+}
+
+func TestChunkerSizes(t *testing.T) {
+	gear := NewGearTable([]byte("chunker key"))
+
+	tests := []struct {
+		name       string
+		data       []byte
+		wantChunks int
+	}{
+		{name: "empty", data: nil, wantChunks: 0},
+		{name: "one byte", data: []byte{1}, wantChunks: 1},
+		{name: "minimum chunk", data: testData(MinChunkSize, 1), wantChunks: 1},
+		// Data without boundaries is cut at the maximum chunk size
+		{name: "zeros", data: make([]byte, 2*MaxChunkSize+1), wantChunks: 3},
+		{name: "random", data: testData(24*1024*1024, 2), wantChunks: -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := chunksOf(t, NewChunker(bytes.NewReader(tt.data), gear))
+			if tt.wantChunks >= 0 && len(chunks) != tt.wantChunks {
+				t.Fatalf("got %d chunks, want %d", len(chunks), tt.wantChunks)
+			}
+			if got := bytes.Join(chunks, nil); !bytes.Equal(got, tt.data) {
+				t.Fatal("chunks do not join back into the data")
+			}
+			for i, chunk := range chunks {
+				if len(chunk) > MaxChunkSize {
+					t.Errorf("chunk %d is %d bytes, above the maximum", i, len(chunk))
+				}
+				if i < len(chunks)-1 && len(chunk) < MinChunkSize {
+					t.Errorf("chunk %d is %d bytes, below the minimum", i, len(chunk))
+				}
+			}
+			if tt.wantChunks < 0 && len(chunks) < 8 {
+				t.Errorf("random data gave only %d chunks", len(chunks))
+			}
+		})
+	}
+}
+
+func TestChunkerBoundariesAreDeterministic(t *testing.T) {
+	data := testData(16*1024*1024, 3)
+	gear := NewGearTable([]byte("chunker key"))
+
+	want := chunkSums(chunksOf(t, NewChunker(bytes.NewReader(data), gear)))
+
+	// Boundaries must not depend on how the stream is read or on what the
+	// chunker read before
+	chunker := NewChunker(bytes.NewReader(testData(3*1024*1024, 4)), gear)
+	chunksOf(t, chunker)
+	chunker.Reset(&unevenReader{data: data})
+	got := chunkSums(chunksOf(t, chunker))
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d chunks, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("chunk %d differs between runs", i)
+		}
+	}
+
+	other := chunkSums(chunksOf(t, NewChunker(bytes.NewReader(data), NewGearTable([]byte("other key")))))
+	if len(other) == len(want) && other[0] == want[0] {
+		t.Error("a different chunker key gave the same boundaries")
+	}
+}
+
+func TestChunkerResynchronizesAfterEdit(t *testing.T) {
+	data := testData(16*1024*1024, 5)
+	gear := NewGearTable([]byte("chunker key"))
+	original := chunkSums(chunksOf(t, NewChunker(bytes.NewReader(data), gear)))
+
+	middle := len(data) / 2
+	tests := []struct {
+		name   string
+		edited []byte
+	}{
+		{name: "insertion", edited: bytes.Join([][]byte{data[:middle], []byte("inserted bytes"), data[middle:]}, nil)},
+		{name: "deletion", edited: append(append([]byte{}, data[:middle]...), data[middle+100:]...)},
+		{name: "prefix", edited: append([]byte("prefix"), data...)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			edited := chunkSums(chunksOf(t, NewChunker(bytes.NewReader(tt.edited), gear)))
+
+			unchanged := make(map[[sha256.Size]byte]bool)
+			for _, sum := range original {
+				unchanged[sum] = true
+			}
+			var changed int
+			for _, sum := range edited {
+				if !unchanged[sum] {
+					changed++
+				}
+			}
+			// A local edit changes the chunk holding it and at most the
+			// chunk after it until the boundaries line up again
+			if changed == 0 || changed > 2 {
+				t.Errorf("%d of %d chunks changed, want 1 or 2", changed, len(edited))
+			}
+		})
+	}
+}
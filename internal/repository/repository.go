@@ -0,0 +1,467 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/seriousconsult/cloud_safe/internal/compressor"
+)
+
+// Version is the version of the repository format
+const Version = 1
+
+// PackSize is the size at which a pack is closed and stored
+const PackSize = 16 * 1024 * 1024
+
+// packCacheSize is the number of downloaded packs kept in memory
+const packCacheSize = 4
+
+// Object keys, relative to the repository
+const (
+	configKey       = "config"
+	packsPrefix     = "packs/"
+	indexPrefix     = "index/"
+	snapshotsPrefix = "snapshots/"
+)
+
+// ObjectStore stores the objects of a repository under "/"-separated keys
+// relative to the repository
+type ObjectStore interface {
+	// Save stores data under key
+	Save(ctx context.Context, key string, data []byte) error
+	// Load returns the object stored under key
+	Load(ctx context.Context, key string) ([]byte, error)
+	// List returns the keys that start with prefix
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// Config is the content of the config object of a repository
+type Config struct {
+	Version          int    `json:"version"`
+	ID               string `json:"id"`
+	Compression      string `json:"compression"`
+	CompressionLevel int    `json:"compression_level"`
+	Keys             Keys   `json:"keys"`
+}
+
+// InitOptions are the settings of a new repository
+type InitOptions struct {
+	Codec            compressor.Codec
+	CompressionLevel int
+	Encrypted        bool
+}
+
+// Repository stores file content as deduplicated blobs. Files are split into
+// chunks by content-defined chunking and each chunk is stored once, under
+// the keyed hash of its content, however many files, snapshots or hosts
+// contain it. Blobs are compressed, encrypted and collected into pack
+// objects; index objects record which pack holds each blob, and snapshot
+// objects point at the tree of directories and files that was backed up.
+//
+// The config object holds the repository keys. It is encrypted by the caller,
+// with the same key-encryption keys as archives.
+type Repository struct {
+	store  ObjectStore
+	config *Config
+	codec  compressor.Codec
+	gear   *GearTable
+	aead   cipher.AEAD
+
+	// index locates every stored blob
+	index map[ID]location
+	// pack collects blobs until it is large enough to be stored
+	pack packWriter
+	// unindexed are the packs stored since the last index object
+	unindexed []indexPack
+	cache     packCache
+}
+
+// location is where a blob is stored
+type location struct {
+	pack   ID
+	offset int64
+	length int64
+}
+
+// packedBlob describes a blob in a pack
+type packedBlob struct {
+	Type   BlobType `json:"type"`
+	ID     ID       `json:"id"`
+	Offset int64    `json:"offset"`
+	Length int64    `json:"length"`
+}
+
+// indexPack lists the blobs of one pack
+type indexPack struct {
+	ID    ID           `json:"id"`
+	Blobs []packedBlob `json:"blobs"`
+}
+
+// indexFile is the content of an index object
+type indexFile struct {
+	Packs []indexPack `json:"packs"`
+}
+
+// packWriter collects the blobs of the next pack
+type packWriter struct {
+	data  bytes.Buffer
+	blobs []packedBlob
+	ids   map[ID]int
+}
+
+// Init creates a repository in store. seal encrypts the config object, which
+// holds the repository keys; it is required for an encrypted repository.
+func Init(ctx context.Context, store ObjectStore, options InitOptions, seal func([]byte) ([]byte, error)) (*Repository, error) {
+	existing, err := store.List(ctx, configKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for an existing repository: %w", err)
+	}
+	for _, key := range existing {
+		if key == configKey {
+			return nil, fmt.Errorf("repository already exists")
+		}
+	}
+	if options.Encrypted && seal == nil {
+		return nil, fmt.Errorf("an encrypted repository needs a key to seal its config")
+	}
+
+	keys, err := newKeys(options.Encrypted)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to create repository ID: %w", err)
+	}
+
+	config := &Config{
+		Version:          Version,
+		ID:               hex.EncodeToString(id),
+		Compression:      string(options.Codec),
+		CompressionLevel: options.CompressionLevel,
+		Keys:             *keys,
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode repository config: %w", err)
+	}
+	if seal != nil {
+		if data, err = seal(data); err != nil {
+			return nil, fmt.Errorf("failed to encrypt repository config: %w", err)
+		}
+	}
+	if err := store.Save(ctx, configKey, data); err != nil {
+		return nil, fmt.Errorf("failed to save repository config: %w", err)
+	}
+
+	return newRepository(store, config)
+}
+
+// Open opens the repository in store. open decrypts the config object and
+// may be nil for an unencrypted repository.
+func Open(ctx context.Context, store ObjectStore, open func([]byte) ([]byte, error)) (*Repository, error) {
+	data, err := store.Load(ctx, configKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load repository config: %w", err)
+	}
+	if open != nil {
+		if data, err = open(data); err != nil {
+			return nil, fmt.Errorf("failed to decrypt repository config: %w", err)
+		}
+	}
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to read repository config: %w", err)
+	}
+	if config.Version > Version {
+		return nil, fmt.Errorf("unsupported repository version %d", config.Version)
+	}
+
+	repo, err := newRepository(store, &config)
+	if err != nil {
+		return nil, err
+	}
+	if err := repo.loadIndex(ctx); err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+// newRepository sets up a repository with config
+func newRepository(store ObjectStore, config *Config) (*Repository, error) {
+	codec, err := compressor.ParseCodec(config.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	repo := &Repository{
+		store:  store,
+		config: config,
+		codec:  codec,
+		gear:   NewGearTable(config.Keys.Chunker),
+		index:  make(map[ID]location),
+		pack:   packWriter{ids: make(map[ID]int)},
+	}
+	if len(config.Keys.Data) > 0 {
+		if repo.aead, err = newAEAD(config.Keys.Data); err != nil {
+			return nil, err
+		}
+	}
+	return repo, nil
+}
+
+// Config returns the configuration of the repository
+func (r *Repository) Config() *Config {
+	return r.config
+}
+
+// Encrypted reports whether the repository encrypts its objects
+func (r *Repository) Encrypted() bool {
+	return r.aead != nil
+}
+
+// Has reports whether a blob is stored, or about to be
+func (r *Repository) Has(id ID) bool {
+	if _, ok := r.index[id]; ok {
+		return true
+	}
+	_, ok := r.pack.ids[id]
+	return ok
+}
+
+// SaveBlob stores data unless the repository already has it, and returns its
+// ID and the number of bytes added to the repository
+func (r *Repository) SaveBlob(ctx context.Context, blobType BlobType, data []byte) (ID, int64, error) {
+	id := r.blobID(data)
+	if r.Has(id) {
+		return id, 0, nil
+	}
+
+	stored, err := r.encodeBlob(data)
+	if err != nil {
+		return id, 0, err
+	}
+
+	r.pack.ids[id] = len(r.pack.blobs)
+	r.pack.blobs = append(r.pack.blobs, packedBlob{
+		Type:   blobType,
+		ID:     id,
+		Offset: int64(r.pack.data.Len()),
+		Length: int64(len(stored)),
+	})
+	r.pack.data.Write(stored)
+
+	if r.pack.data.Len() >= PackSize {
+		if err := r.savePack(ctx); err != nil {
+			return id, 0, err
+		}
+	}
+	return id, int64(len(stored)), nil
+}
+
+// LoadBlob returns the content of a blob
+func (r *Repository) LoadBlob(ctx context.Context, id ID) ([]byte, error) {
+	var stored []byte
+	if i, ok := r.pack.ids[id]; ok {
+		blob := r.pack.blobs[i]
+		stored = r.pack.data.Bytes()[blob.Offset : blob.Offset+blob.Length]
+	} else {
+		loc, ok := r.index[id]
+		if !ok {
+			return nil, fmt.Errorf("blob %s is not in the repository", id)
+		}
+		pack, err := r.loadPack(ctx, loc.pack)
+		if err != nil {
+			return nil, err
+		}
+		if loc.offset+loc.length > int64(len(pack)) {
+			return nil, fmt.Errorf("blob %s lies outside pack %s", id, loc.pack)
+		}
+		stored = pack[loc.offset : loc.offset+loc.length]
+	}
+
+	data, err := r.decodeBlob(stored)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob %s: %w", id, err)
+	}
+	if r.blobID(data) != id {
+		return nil, fmt.Errorf("blob %s is corrupt", id)
+	}
+	return data, nil
+}
+
+// Flush stores the pack being filled and an index object for the packs
+// stored since the last one. Blobs are only found by later runs once they
+// are flushed.
+func (r *Repository) Flush(ctx context.Context) error {
+	if len(r.pack.blobs) > 0 {
+		if err := r.savePack(ctx); err != nil {
+			return err
+		}
+	}
+	if len(r.unindexed) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(&indexFile{Packs: r.unindexed})
+	if err != nil {
+		return fmt.Errorf("failed to encode index: %w", err)
+	}
+	if _, err := r.saveObject(ctx, indexPrefix, data); err != nil {
+		return fmt.Errorf("failed to save index: %w", err)
+	}
+	r.unindexed = nil
+	return nil
+}
+
+// savePack stores the pack being filled. A pack is its blobs followed by an
+// encrypted list of them and the length of that list, so the index can be
+// rebuilt from the packs.
+func (r *Repository) savePack(ctx context.Context) error {
+	header, err := json.Marshal(r.pack.blobs)
+	if err != nil {
+		return fmt.Errorf("failed to encode pack header: %w", err)
+	}
+	sealed, err := r.seal(header)
+	if err != nil {
+		return err
+	}
+	r.pack.data.Write(sealed)
+	binary.Write(&r.pack.data, binary.LittleEndian, uint32(len(sealed)))
+
+	data := r.pack.data.Bytes()
+	id := ID(sha256.Sum256(data))
+	if err := r.store.Save(ctx, packsPrefix+id.String(), data); err != nil {
+		return fmt.Errorf("failed to save pack %s: %w", id, err)
+	}
+
+	for _, blob := range r.pack.blobs {
+		r.index[blob.ID] = location{pack: id, offset: blob.Offset, length: blob.Length}
+	}
+	r.unindexed = append(r.unindexed, indexPack{ID: id, Blobs: r.pack.blobs})
+	r.pack = packWriter{ids: make(map[ID]int)}
+	return nil
+}
+
+// loadIndex reads every index object
+func (r *Repository) loadIndex(ctx context.Context) error {
+	keys, err := r.store.List(ctx, indexPrefix)
+	if err != nil {
+		return fmt.Errorf("failed to list index: %w", err)
+	}
+
+	for _, key := range keys {
+		data, err := r.loadObject(ctx, key)
+		if err != nil {
+			return fmt.Errorf("failed to load index %s: %w", key, err)
+		}
+		var index indexFile
+		if err := json.Unmarshal(data, &index); err != nil {
+			return fmt.Errorf("failed to read index %s: %w", key, err)
+		}
+		for _, pack := range index.Packs {
+			for _, blob := range pack.Blobs {
+				r.index[blob.ID] = location{pack: pack.ID, offset: blob.Offset, length: blob.Length}
+			}
+		}
+	}
+	return nil
+}
+
+// loadPack returns a pack, downloading it unless it is cached
+func (r *Repository) loadPack(ctx context.Context, id ID) ([]byte, error) {
+	if data := r.cache.get(id); data != nil {
+		return data, nil
+	}
+	data, err := r.store.Load(ctx, packsPrefix+id.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load pack %s: %w", id, err)
+	}
+	if ID(sha256.Sum256(data)) != id {
+		return nil, fmt.Errorf("pack %s is corrupt", id)
+	}
+	r.cache.add(id, data)
+	return data, nil
+}
+
+// saveObject encrypts data and stores it under prefix and the hash of the
+// stored bytes, which it returns
+func (r *Repository) saveObject(ctx context.Context, prefix string, data []byte) (ID, error) {
+	sealed, err := r.seal(data)
+	if err != nil {
+		return ID{}, err
+	}
+	id := ID(sha256.Sum256(sealed))
+	if err := r.store.Save(ctx, prefix+id.String(), sealed); err != nil {
+		return ID{}, err
+	}
+	return id, nil
+}
+
+// loadObject loads and decrypts the object stored under key
+func (r *Repository) loadObject(ctx context.Context, key string) ([]byte, error) {
+	sealed, err := r.store.Load(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if ID(sha256.Sum256(sealed)).String() != path.Base(key) {
+		return nil, fmt.Errorf("object %s is corrupt", key)
+	}
+	return r.open(sealed)
+}
+
+// listObjects returns the IDs of the objects stored under prefix
+func (r *Repository) listObjects(ctx context.Context, prefix string) ([]ID, error) {
+	keys, err := r.store.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var ids []ID
+	for _, key := range keys {
+		id, err := ParseID(strings.TrimPrefix(key, prefix))
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i][:], ids[j][:]) < 0 })
+	return ids, nil
+}
+
+// packCache keeps the most recently used packs, since the blobs of a file
+// are mostly stored next to each other
+type packCache struct {
+	ids  []ID
+	data [][]byte
+}
+
+// get returns a cached pack, or nil
+func (c *packCache) get(id ID) []byte {
+	for i, cached := range c.ids {
+		if cached == id {
+			return c.data[i]
+		}
+	}
+	return nil
+}
+
+// add caches a pack, evicting the oldest one when the cache is full
+func (c *packCache) add(id ID, data []byte) {
+	if len(c.ids) == packCacheSize {
+		c.ids = c.ids[1:]
+		c.data = c.data[1:]
+	}
+	c.ids = append(c.ids, id)
+	c.data = append(c.data, data)
+}
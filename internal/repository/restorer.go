@@ -0,0 +1,150 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+	"github.com/seriousconsult/cloud_safe/internal/progress"
+)
+
+// Restorer recreates snapshots from a repository
+type Restorer struct {
+	repo    *Repository
+	logger  *logger.Logger
+	tracker progress.Tracker
+}
+
+// NewRestorer creates a restorer reading from repo
+func NewRestorer(repo *Repository, log *logger.Logger) *Restorer {
+	return &Restorer{
+		repo:   repo,
+		logger: log,
+	}
+}
+
+// SetTracker reports the bytes restored to tracker
+func (r *Restorer) SetTracker(tracker progress.Tracker) {
+	r.tracker = tracker
+}
+
+// Restore recreates the tree of snapshot under targetDir
+func (r *Restorer) Restore(ctx context.Context, snapshot *Snapshot, targetDir string) error {
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		return fmt.Errorf("failed to create target directory %s: %w", targetDir, err)
+	}
+	return r.restoreTree(ctx, snapshot.Tree, targetDir)
+}
+
+// restoreTree recreates the entries of a tree in dir. Entries must be single
+// path elements and existing symlinks are replaced rather than followed, so
+// nothing is written outside targetDir.
+func (r *Restorer) restoreTree(ctx context.Context, id ID, dir string) error {
+	tree, err := r.repo.LoadTree(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	for _, node := range tree.Nodes {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		if err := checkNodeName(node.Name); err != nil {
+			return fmt.Errorf("tree %s: %w", id, err)
+		}
+		path := filepath.Join(dir, node.Name)
+		if info, err := os.Lstat(path); err == nil && !info.IsDir() {
+			os.Remove(path)
+		}
+
+		switch node.Type {
+		case NodeDir:
+			r.logger.Debugf("Creating directory: %s", path)
+			if err := os.MkdirAll(path, restorableMode(node.Mode)|0700); err != nil {
+				return fmt.Errorf("failed to create directory %s: %w", path, err)
+			}
+			if node.Subtree != nil {
+				if err := r.restoreTree(ctx, *node.Subtree, path); err != nil {
+					return err
+				}
+			}
+
+		case NodeFile:
+			r.logger.Debugf("Restoring file: %s", path)
+			if err := r.restoreContent(ctx, node, path); err != nil {
+				return err
+			}
+
+		case NodeSymlink:
+			r.logger.Debugf("Creating symlink: %s -> %s", path, node.LinkTarget)
+			if err := os.Symlink(node.LinkTarget, path); err != nil {
+				return fmt.Errorf("failed to create symlink %s: %w", path, err)
+			}
+			r.restoreOwner(node, path)
+			continue
+
+		default:
+			r.logger.Infof("Skipping unsupported entry %s (type %s)", path, node.Type)
+			continue
+		}
+
+		// Metadata is set after the content, so directories get their
+		// permissions and times once their entries are restored
+		r.restoreOwner(node, path)
+		if err := os.Chmod(path, restorableMode(node.Mode)); err != nil {
+			r.logger.Debugf("Failed to set permissions for %s: %v", path, err)
+		}
+		if err := os.Chtimes(path, node.ModTime, node.ModTime); err != nil {
+			r.logger.Debugf("Failed to set modification time for %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// restoreContent writes the blobs of a file to path
+func (r *Restorer) restoreContent(ctx context.Context, node *Node, path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	for _, id := range node.Content {
+		data, err := r.repo.LoadBlob(ctx, id)
+		if err != nil {
+			return fmt.Errorf("failed to restore %s: %w", path, err)
+		}
+		if _, err := file.Write(data); err != nil {
+			return fmt.Errorf("failed to write file content for %s: %w", path, err)
+		}
+		if r.tracker != nil {
+			r.tracker.Update(int64(len(data)))
+		}
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close file %s: %w", path, err)
+	}
+	return nil
+}
+
+// restoreOwner sets the recorded owner when running as root, the only user
+// allowed to give files away
+func (r *Restorer) restoreOwner(node *Node, path string) {
+	if os.Geteuid() != 0 {
+		return
+	}
+	if err := os.Lchown(path, node.UID, node.GID); err != nil {
+		r.logger.Debugf("Failed to set owner of %s: %v", path, err)
+	}
+}
+
+// restorableMode is the part of a mode that chmod sets
+func restorableMode(mode os.FileMode) os.FileMode {
+	return mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+}
@@ -0,0 +1,96 @@
+package repository
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+)
+
+// memoryStore is an ObjectStore kept in memory
+type memoryStore map[string][]byte
+
+func (s memoryStore) Save(ctx context.Context, key string, data []byte) error {
+	s[key] = append([]byte{}, data...)
+	return nil
+}
+
+func (s memoryStore) Load(ctx context.Context, key string) ([]byte, error) {
+	data, ok := s[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return data, nil
+}
+
+func (s memoryStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	for key := range s {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func TestRestoreRejectsInvalidNames(t *testing.T) {
+	ctx := context.Background()
+	repo, err := Init(ctx, memoryStore{}, InitOptions{Codec: "none"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _, err := repo.SaveBlob(ctx, BlobData, []byte("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		entry   string
+		wantErr bool
+	}{
+		{name: "single element", entry: "file"},
+		{name: "empty", entry: "", wantErr: true},
+		{name: "current directory", entry: ".", wantErr: true},
+		{name: "parent directory", entry: "..", wantErr: true},
+		{name: "slash", entry: "../escaped", wantErr: true},
+		{name: "separator", entry: "a" + string(filepath.Separator) + "b", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tree := &Tree{Nodes: []*Node{{
+				Name:    tt.entry,
+				Type:    NodeFile,
+				Mode:    0644,
+				ModTime: time.Now(),
+				Content: []ID{content},
+			}}}
+			id, _, err := repo.SaveTree(ctx, tree)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			parent := t.TempDir()
+			target := filepath.Join(parent, "target")
+			err = NewRestorer(repo, logger.New(false).Quiet()).Restore(ctx, &Snapshot{Tree: id}, target)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Restore() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if entries, _ := os.ReadDir(parent); len(entries) != 1 {
+					t.Errorf("Restore() wrote next to the target directory")
+				}
+				return
+			}
+			data, err := os.ReadFile(filepath.Join(target, tt.entry))
+			if err != nil || string(data) != "content" {
+				t.Errorf("restored file = %q, %v; want %q", data, err, "content")
+			}
+		})
+	}
+}
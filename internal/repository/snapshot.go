@@ -0,0 +1,95 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Snapshot records one backup: the tree of its sources and when and where
+// it was made
+type Snapshot struct {
+	Time     time.Time `json:"time"`
+	Hostname string    `json:"hostname"`
+	Paths    []string  `json:"paths"`
+	Tree     ID        `json:"tree"`
+	Files    int64     `json:"files"`
+	Size     int64     `json:"size"`
+
+	// ID is the ID of the snapshot object, set when it is saved or loaded
+	ID ID `json:"-"`
+}
+
+// SaveSnapshot stores a snapshot and sets its ID
+func (r *Repository) SaveSnapshot(ctx context.Context, snapshot *Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+	id, err := r.saveObject(ctx, snapshotsPrefix, data)
+	if err != nil {
+		return fmt.Errorf("failed to save snapshot: %w", err)
+	}
+	snapshot.ID = id
+	return nil
+}
+
+// Snapshots returns every snapshot, oldest first
+func (r *Repository) Snapshots(ctx context.Context) ([]*Snapshot, error) {
+	ids, err := r.listObjects(ctx, snapshotsPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+
+	var snapshots []*Snapshot
+	for _, id := range ids {
+		data, err := r.loadObject(ctx, snapshotsPrefix+id.String())
+		if err != nil {
+			return nil, fmt.Errorf("failed to load snapshot %s: %w", id, err)
+		}
+		var snapshot Snapshot
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			return nil, fmt.Errorf("failed to read snapshot %s: %w", id, err)
+		}
+		snapshot.ID = id
+		snapshots = append(snapshots, &snapshot)
+	}
+
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.Before(snapshots[j].Time)
+	})
+	return snapshots, nil
+}
+
+// FindSnapshot returns the snapshot whose ID starts with prefix, or the
+// latest one for "latest"
+func (r *Repository) FindSnapshot(ctx context.Context, prefix string) (*Snapshot, error) {
+	snapshots, err := r.Snapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		return nil, fmt.Errorf("repository has no snapshots")
+	}
+	if prefix == "latest" {
+		return snapshots[len(snapshots)-1], nil
+	}
+
+	var found *Snapshot
+	for _, snapshot := range snapshots {
+		if !strings.HasPrefix(snapshot.ID.String(), strings.ToLower(prefix)) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("snapshot ID %s is ambiguous", prefix)
+		}
+		found = snapshot
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no snapshot matches %s", prefix)
+	}
+	return found, nil
+}
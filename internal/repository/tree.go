@@ -0,0 +1,78 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Node types
+const (
+	NodeDir     = "dir"
+	NodeFile    = "file"
+	NodeSymlink = "symlink"
+)
+
+// Node is a directory, file or symlink in a tree
+type Node struct {
+	Name    string      `json:"name"`
+	Type    string      `json:"type"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+	UID     int         `json:"uid"`
+	GID     int         `json:"gid"`
+	Size    int64       `json:"size,omitempty"`
+	// LinkTarget is the target of a symlink
+	LinkTarget string `json:"link_target,omitempty"`
+	// Content lists the data blobs of a file in order
+	Content []ID `json:"content,omitempty"`
+	// Subtree is the tree blob of a directory
+	Subtree *ID `json:"subtree,omitempty"`
+}
+
+// Tree lists the entries of a directory. Trees are stored as blobs, so
+// directories that did not change between snapshots are stored once.
+type Tree struct {
+	Nodes []*Node `json:"nodes"`
+}
+
+// SaveTree stores a tree and returns its ID and the number of bytes added to
+// the repository
+func (r *Repository) SaveTree(ctx context.Context, tree *Tree) (ID, int64, error) {
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return ID{}, 0, fmt.Errorf("failed to encode tree: %w", err)
+	}
+	return r.SaveBlob(ctx, BlobTree, data)
+}
+
+// LoadTree loads a tree, rejecting node names that are not a single path
+// element
+func (r *Repository) LoadTree(ctx context.Context, id ID) (*Tree, error) {
+	data, err := r.LoadBlob(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	var tree Tree
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return nil, fmt.Errorf("failed to read tree %s: %w", id, err)
+	}
+	for _, node := range tree.Nodes {
+		if err := checkNodeName(node.Name); err != nil {
+			return nil, fmt.Errorf("tree %s has an invalid entry: %w", id, err)
+		}
+	}
+	return &tree, nil
+}
+
+// checkNodeName returns an error unless name is a single path element
+func checkNodeName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") || strings.ContainsRune(name, filepath.Separator) {
+		return fmt.Errorf("invalid entry name %q", name)
+	}
+	return nil
+}
@@ -12,15 +12,48 @@ import (
 type Config struct {
 	// Source configuration
 	SourcePaths []string
+	// File selection in source directories; see compressor.FilterOptions.
+	// Ages are durations such as "72h" or "30d".
+	Excludes    []string
+	Includes    []string
+	MinFileSize int64
+	MaxFileSize int64
+	NewerThan   string
+	OlderThan   string
+	// Handling of device files, FIFOs and sockets: "archive", "skip" or "fail"
+	SpecialFiles string
+	// Incremental backups archive only what changed since the manifest of
+	// the previous backup; FullBackup starts a new chain with a full backup
+	Incremental bool
+	FullBackup  bool
+	// Directory for the manifests of the last backups
+	ManifestDir string
+	// Index uploads an index of the archive next to it, for listing and
+	// extracting single entries
+	Index bool
 
 	// Storage provider configuration
 	StorageProvider string
+	// Further providers the same archive is uploaded to at the same time
+	Destinations []string
+	// What a failed destination does to the others: "abort" or "continue"
+	FailurePolicy string
+	// VolumeSize splits the stored archive into volumes of at most this many
+	// bytes; 0 stores it as a single object
+	VolumeSize int64
 
 	// S3 configuration
 	S3Bucket 	string
 	S3Filename 	string
 	AWSRegion 	string
 	AWSProfile 	string
+	// S3-compatible service options; see storage.S3Config
+	S3Endpoint         string
+	S3UsePathStyle     bool
+	S3CABundle         string
+	S3SignatureVersion string
+	// S3Tagging sets whether uploads are tagged; nil tags them on AWS only
+	S3Tagging *bool
 
 	// Google Drive configuration
 	GoogleDriveCredentialsPath string
@@ -38,40 +71,107 @@ type Config struct {
 	MinIOBucket 	   string
 	MinIOUseSSL 	   bool
 
+	// Local filesystem configuration
+	LocalPath string
+
 	// Processing configuration
 	Workers 	int
 	ChunkSize 	int64
 	BufferSize 	int
 	Encrypt 	bool
 	Resume 		bool
+	// Directory for the state files of interrupted uploads
+	StateDir string
+
+	// Compression configuration
+	Compression      string
+	CompressionLevel int
 
 	// Encryption configuration
-	EncryptionKey []byte
+	EncryptionKey    []byte `json:"-"`
+	KDF              string
+	AllowInsecureKey bool
+
+	// Public keys archives are encrypted to; when set no passphrase is used
+	Recipients []string
+	// Private key file used to restore recipient-encrypted archives
+	IdentityFile string
+
+	// Key manager that generates and unwraps data keys: "", "aws-kms" or "keyring"
+	KeyManager  string
+	KMSKeyID    string
+	KeyringFile string
 }
 
-// GetEncryptionKey returns the encryption key from environment or generates one
-func (c *Config) GetEncryptionKey() []byte {
+// InsecureDefaultPassphrase is publicly known and only used when AllowInsecureKey is set
+const InsecureDefaultPassphrase = "default-32-byte-encryption-key!!"
+
+// GetPassphrase returns the passphrase archive keys are derived from, taken from
+// config.json or the ENCRYPTION_KEY environment variable. It refuses to fall back
+// to InsecureDefaultPassphrase unless AllowInsecureKey is set.
+func (c *Config) GetPassphrase() ([]byte, error) {
 	if len(c.EncryptionKey) == 0 {
 		// In production, this should come from a secure key management system
-		// For now, use a key from environment or a default
-		keyStr := os.Getenv("ENCRYPTION_KEY")
-		if keyStr == "" {
-			// Generate a default key (32 bytes for AES-256)
-			c.EncryptionKey = []byte("default-32-byte-encryption-key!!")
-		} else {
+		if keyStr := os.Getenv("ENCRYPTION_KEY"); keyStr != "" {
 			c.EncryptionKey = []byte(keyStr)
 		}
+	}
+
+	if len(c.EncryptionKey) > 0 {
+		return c.EncryptionKey, nil
+	}
 
-		// Ensure key is exactly 32 bytes for AES-256
-		if len(c.EncryptionKey) < 32 {
-			key := make([]byte, 32)
-			copy(key, c.EncryptionKey)
-			c.EncryptionKey = key
-		} else if len(c.EncryptionKey) > 32 {
-			c.EncryptionKey = c.EncryptionKey[:32]
+	if c.AllowInsecureKey {
+		return []byte(InsecureDefaultPassphrase), nil
+	}
+
+	return nil, fmt.Errorf("no encryption key provided: set ENCRYPTION_KEY or default_settings.encryption_key, or pass --insecure-default-key to use the publicly known default key")
+}
+
+// GetStateDir returns the directory resume state is kept in: the configured
+// state directory, or cloud_safe/uploads in the user's cache directory
+func (c *Config) GetStateDir() (string, error) {
+	if c.StateDir != "" {
+		return c.StateDir, nil
+	}
+
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine state directory: %w", err)
+	}
+	return filepath.Join(cacheDir, "cloud_safe", "uploads"), nil
+}
+
+// GetManifestDir returns the directory the manifests of incremental backups
+// are kept in: the configured manifest directory, or cloud_safe/manifests in
+// the user's config directory. Unlike resume state, losing a manifest makes
+// the next incremental backup a full one.
+func (c *Config) GetManifestDir() (string, error) {
+	if c.ManifestDir != "" {
+		return c.ManifestDir, nil
+	}
+
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine manifest directory: %w", err)
+	}
+	return filepath.Join(configDir, "cloud_safe", "manifests"), nil
+}
+
+// GetDestinations returns every provider the archive is uploaded to:
+// StorageProvider followed by Destinations, without duplicates
+func (c *Config) GetDestinations() []string {
+	seen := make(map[string]bool)
+	var destinations []string
+	for _, name := range append([]string{c.StorageProvider}, c.Destinations...) {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
 		}
+		seen[name] = true
+		destinations = append(destinations, name)
 	}
-	return c.EncryptionKey
+	return destinations
 }
 
 // ProviderConfig represents the common configuration for all storage providers
@@ -89,6 +189,13 @@ type S3ProviderConfig struct {
 	Workers    int    `json:"workers"`
 	BufferSize int    `json:"buffer_size"`
 	Resume     bool   `json:"resume"`
+	// Options for S3-compatible services such as R2, Wasabi, B2 or Ceph RGW
+	Endpoint         string `json:"endpoint"`
+	UsePathStyle     bool   `json:"use_path_style"`
+	CABundle         string `json:"ca_bundle"`
+	SignatureVersion string `json:"signature_version"`
+	// Tagging defaults to true on AWS and false with an endpoint
+	Tagging *bool `json:"tagging,omitempty"`
 }
 
 // GoogleDriveProviderConfig represents Google Drive provider configuration
@@ -107,6 +214,7 @@ type MegaProviderConfig struct {
 	Username  string `json:"username"`
 	Password  string `json:"password"`
 	ChunkSize int64  `json:"chunk_size"`
+	Workers   int    `json:"workers"`
 	Resume    bool   `json:"resume"`
 }
 
@@ -124,12 +232,21 @@ type MinIOProviderConfig struct {
 	Resume          bool   `json:"resume"`
 }
 
+// LocalProviderConfig represents local filesystem provider configuration
+type LocalProviderConfig struct {
+	ProviderConfig `json:",inline"`
+	Path       string `json:"path"`
+	BufferSize int    `json:"buffer_size"`
+	Resume     bool   `json:"resume"`
+}
+
 // StorageProvidersConfig holds all storage provider configurations
 type StorageProvidersConfig struct {
 	S3         *S3ProviderConfig         `json:"s3,omitempty"`
 	GoogleDrive *GoogleDriveProviderConfig `json:"googledrive,omitempty"`
 	Mega        *MegaProviderConfig       `json:"mega,omitempty"`
 	MinIO       *MinIOProviderConfig      `json:"minio,omitempty"`
+	Local       *LocalProviderConfig      `json:"local,omitempty"`
 }
 
 // FileConfig represents the JSON configuration file structure
@@ -146,6 +263,30 @@ type FileConfig struct {
 		EncryptionKey  string `json:"encryption_key"`
 		SourcePath     string `json:"source_path"`
 		S3Filename     string `json:"s3_filename"`
+		Compression      string   `json:"compression"`
+		CompressionLevel int      `json:"compression_level"`
+		KDF              string   `json:"kdf"`
+		AllowInsecureKey bool     `json:"allow_insecure_key"`
+		Recipients       []string `json:"recipients"`
+		IdentityFile     string   `json:"identity_file"`
+		KeyManager       string   `json:"key_manager"`
+		KMSKeyID         string   `json:"kms_key_id"`
+		KeyringFile      string   `json:"keyring_file"`
+		StateDir         string   `json:"state_dir"`
+		Destinations     []string `json:"destinations"`
+		FailurePolicy    string   `json:"failure_policy"`
+		VolumeSize       int64    `json:"volume_size"`
+		Exclude          []string `json:"exclude"`
+		Include          []string `json:"include"`
+		MinFileSize      int64    `json:"min_file_size"`
+		MaxFileSize      int64    `json:"max_file_size"`
+		NewerThan        string   `json:"newer_than"`
+		OlderThan        string   `json:"older_than"`
+		SpecialFiles     string   `json:"special_files"`
+		Incremental      bool     `json:"incremental"`
+		FullBackup       bool     `json:"full_backup"`
+		ManifestDir      string   `json:"manifest_dir"`
+		Index            bool     `json:"index"`
 	} `json:"default_settings"`
 }
 
@@ -204,6 +345,78 @@ func (c *Config) LoadFromFile(configPath string) error {
 	if c.S3Filename == "" && fileConfig.DefaultSettings.S3Filename != "" {
 		c.S3Filename = fileConfig.DefaultSettings.S3Filename
 	}
+	if c.Compression == "" && fileConfig.DefaultSettings.Compression != "" {
+		c.Compression = fileConfig.DefaultSettings.Compression
+	}
+	if c.CompressionLevel == 0 && fileConfig.DefaultSettings.CompressionLevel != 0 {
+		c.CompressionLevel = fileConfig.DefaultSettings.CompressionLevel
+	}
+	if c.KDF == "" && fileConfig.DefaultSettings.KDF != "" {
+		c.KDF = fileConfig.DefaultSettings.KDF
+	}
+	if !c.AllowInsecureKey {
+		c.AllowInsecureKey = fileConfig.DefaultSettings.AllowInsecureKey
+	}
+	if len(c.Recipients) == 0 && len(fileConfig.DefaultSettings.Recipients) > 0 {
+		c.Recipients = fileConfig.DefaultSettings.Recipients
+	}
+	if c.IdentityFile == "" && fileConfig.DefaultSettings.IdentityFile != "" {
+		c.IdentityFile = fileConfig.DefaultSettings.IdentityFile
+	}
+	if c.KeyManager == "" && fileConfig.DefaultSettings.KeyManager != "" {
+		c.KeyManager = fileConfig.DefaultSettings.KeyManager
+	}
+	if c.KMSKeyID == "" && fileConfig.DefaultSettings.KMSKeyID != "" {
+		c.KMSKeyID = fileConfig.DefaultSettings.KMSKeyID
+	}
+	if c.KeyringFile == "" && fileConfig.DefaultSettings.KeyringFile != "" {
+		c.KeyringFile = fileConfig.DefaultSettings.KeyringFile
+	}
+	if c.StateDir == "" && fileConfig.DefaultSettings.StateDir != "" {
+		c.StateDir = fileConfig.DefaultSettings.StateDir
+	}
+	if len(c.Destinations) == 0 && len(fileConfig.DefaultSettings.Destinations) > 0 {
+		c.Destinations = fileConfig.DefaultSettings.Destinations
+	}
+	if c.FailurePolicy == "" && fileConfig.DefaultSettings.FailurePolicy != "" {
+		c.FailurePolicy = fileConfig.DefaultSettings.FailurePolicy
+	}
+	if c.VolumeSize == 0 && fileConfig.DefaultSettings.VolumeSize > 0 {
+		c.VolumeSize = fileConfig.DefaultSettings.VolumeSize
+	}
+	if len(c.Excludes) == 0 && len(fileConfig.DefaultSettings.Exclude) > 0 {
+		c.Excludes = fileConfig.DefaultSettings.Exclude
+	}
+	if len(c.Includes) == 0 && len(fileConfig.DefaultSettings.Include) > 0 {
+		c.Includes = fileConfig.DefaultSettings.Include
+	}
+	if c.MinFileSize == 0 && fileConfig.DefaultSettings.MinFileSize > 0 {
+		c.MinFileSize = fileConfig.DefaultSettings.MinFileSize
+	}
+	if c.MaxFileSize == 0 && fileConfig.DefaultSettings.MaxFileSize > 0 {
+		c.MaxFileSize = fileConfig.DefaultSettings.MaxFileSize
+	}
+	if c.NewerThan == "" && fileConfig.DefaultSettings.NewerThan != "" {
+		c.NewerThan = fileConfig.DefaultSettings.NewerThan
+	}
+	if c.OlderThan == "" && fileConfig.DefaultSettings.OlderThan != "" {
+		c.OlderThan = fileConfig.DefaultSettings.OlderThan
+	}
+	if c.SpecialFiles == "" && fileConfig.DefaultSettings.SpecialFiles != "" {
+		c.SpecialFiles = fileConfig.DefaultSettings.SpecialFiles
+	}
+	if !c.Incremental {
+		c.Incremental = fileConfig.DefaultSettings.Incremental
+	}
+	if !c.FullBackup {
+		c.FullBackup = fileConfig.DefaultSettings.FullBackup
+	}
+	if c.ManifestDir == "" && fileConfig.DefaultSettings.ManifestDir != "" {
+		c.ManifestDir = fileConfig.DefaultSettings.ManifestDir
+	}
+	if !c.Index {
+		c.Index = fileConfig.DefaultSettings.Index
+	}
 	
 	// Only set these if they haven't been set by CLI flags
 	if !c.Encrypt {
@@ -227,6 +440,11 @@ func (c *Config) LoadFromFile(configPath string) error {
 		if s3.BufferSize > 0 {
 			c.BufferSize = s3.BufferSize
 		}
+		c.S3Endpoint = s3.Endpoint
+		c.S3UsePathStyle = s3.UsePathStyle
+		c.S3CABundle = s3.CABundle
+		c.S3SignatureVersion = s3.SignatureVersion
+		c.S3Tagging = s3.Tagging
 		c.Resume = s3.Resume
 	}
 
@@ -248,6 +466,9 @@ func (c *Config) LoadFromFile(configPath string) error {
 		if mega.ChunkSize > 0 {
 			c.ChunkSize = mega.ChunkSize
 		}
+		if mega.Workers > 0 {
+			c.Workers = mega.Workers
+		}
 		c.Resume = mega.Resume
 	}
 
@@ -270,6 +491,15 @@ func (c *Config) LoadFromFile(configPath string) error {
 		c.Resume = minio.Resume
 	}
 
+	// Apply local filesystem provider settings if enabled
+	if local := fileConfig.StorageProviders.Local; local != nil && local.Enabled {
+		c.LocalPath = local.Path
+		if local.BufferSize > 0 {
+			c.BufferSize = local.BufferSize
+		}
+		c.Resume = local.Resume
+	}
+
 	return nil
 }
 
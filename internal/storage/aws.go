@@ -0,0 +1,25 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+)
+
+// LoadAWSConfig loads the shared AWS configuration for region and profile, so
+// every AWS client cloud_safe creates resolves credentials the same way.
+// optFns adjust the loading, e.g. to trust a custom CA bundle.
+func LoadAWSConfig(ctx context.Context, region, profile string, optFns ...func(*awsconfig.LoadOptions) error) (aws.Config, error) {
+	optFns = append([]func(*awsconfig.LoadOptions) error{
+		awsconfig.WithRegion(region),
+		awsconfig.WithSharedConfigProfile(profile),
+	}, optFns...)
+
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, optFns...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	return awsCfg, nil
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+)
+
+// objectServer stores the objects put to a bucket of an S3-compatible
+// service in a single part and serves them back
+type objectServer struct {
+	testServer
+	objects map[string][]byte
+}
+
+func newObjectServer(t *testing.T) *objectServer {
+	server := &objectServer{objects: make(map[string][]byte)}
+	server.start(t, server.serve)
+	return server
+}
+
+func (s *objectServer) serve(w http.ResponseWriter, r *http.Request, body []byte) {
+	switch r.Method {
+	case http.MethodPut:
+		s.objects[r.URL.Path] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(body)))
+	case http.MethodHead, http.MethodGet:
+		data, ok := s.objects[r.URL.Path]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				fmt.Fprint(w, "<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>")
+			}
+			return
+		}
+		w.Header().Set("Last-Modified", "Sat, 03 Feb 2001 04:05:06 GMT")
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(data)))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func TestDownloadStreamAndStat(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(false).Quiet()
+
+	s3Server := newObjectServer(t)
+	s3Client, err := newS3Client(ctx, &S3Config{
+		Bucket:           "bucket",
+		Region:           "us-east-1",
+		Endpoint:         s3Server.URL,
+		UsePathStyle:     true,
+		SignatureVersion: S3SignatureAnonymous,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	minioServer := newObjectServer(t)
+	minioClient, err := minio.New(strings.TrimPrefix(minioServer.URL, "http://"), &minio.Options{
+		Creds:  credentials.NewStaticV4("", "", ""),
+		Region: "us-east-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	providers := []struct {
+		name     string
+		provider func(t *testing.T) StorageProvider
+	}{
+		{name: "s3", provider: func(t *testing.T) StorageProvider {
+			return &S3Provider{client: s3Client, config: &S3Config{Bucket: "bucket", ChunkSize: s3MinPartSize}, logger: log}
+		}},
+		{name: "minio", provider: func(t *testing.T) StorageProvider {
+			return &MinIOProvider{client: minioClient, config: &MinIOConfig{Bucket: "bucket", ChunkSize: s3MinPartSize}, logger: log}
+		}},
+		{name: "googledrive", provider: func(t *testing.T) StorageProvider {
+			return newTestDriveProvider(t, newDriveServer(t), &GoogleDriveConfig{})
+		}},
+		{name: "mega", provider: func(t *testing.T) StorageProvider {
+			return newTestMegaProvider(t, newMegaServer(t), &MegaConfig{Workers: 1})
+		}},
+		{name: "local", provider: func(t *testing.T) StorageProvider {
+			return &LocalProvider{config: &LocalConfig{Path: t.TempDir()}, logger: log}
+		}},
+	}
+
+	stored := randomStream(300 * 1024)
+	for _, p := range providers {
+		t.Run(p.name, func(t *testing.T) {
+			provider := p.provider(t)
+
+			if err := provider.PutObject(ctx, "backups/backup.tar", bytes.NewReader(stored), int64(len(stored)), nil); err != nil {
+				t.Fatalf("PutObject() error = %v", err)
+			}
+
+			info, err := provider.Stat(ctx, "backups/backup.tar")
+			if err != nil {
+				t.Fatalf("Stat() error = %v", err)
+			}
+			if info.Size != int64(len(stored)) {
+				t.Errorf("Stat() size = %d, want %d", info.Size, len(stored))
+			}
+			if info.LastModified.IsZero() {
+				t.Error("Stat() has no modification time")
+			}
+
+			var downloaded bytes.Buffer
+			if err := provider.DownloadStream(ctx, "backups/backup.tar", &downloaded, nil); err != nil {
+				t.Fatalf("DownloadStream() error = %v", err)
+			}
+			if !bytes.Equal(downloaded.Bytes(), stored) {
+				t.Errorf("DownloadStream() returned %d bytes that differ from the %d stored", downloaded.Len(), len(stored))
+			}
+
+			if _, err := provider.Stat(ctx, "backups/missing.tar"); err == nil {
+				t.Error("Stat() of a missing object succeeded")
+			}
+			if err := provider.DownloadStream(ctx, "backups/missing.tar", &downloaded, nil); err == nil {
+				t.Error("DownloadStream() of a missing object succeeded")
+			}
+		})
+	}
+}
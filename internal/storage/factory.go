@@ -12,6 +12,18 @@ func NewStorageProvider(cfg *setup.Config, log *logger.Logger) (StorageProvider,
 	// Get the provider-specific config from the main config
 	switch cfg.StorageProvider {
 	case string(ProviderS3):
+		stateDir, err := cfg.GetStateDir()
+		if err != nil {
+			return nil, err
+		}
+
+		// Tags are only set on AWS unless configured, since several
+		// S3-compatible services reject them
+		tagging := cfg.S3Endpoint == ""
+		if cfg.S3Tagging != nil {
+			tagging = *cfg.S3Tagging
+		}
+
 		// S3 provider
 		s3Cfg := &S3Config{
 			Bucket:     cfg.S3Bucket,
@@ -22,10 +34,22 @@ func NewStorageProvider(cfg *setup.Config, log *logger.Logger) (StorageProvider,
 			Workers:    cfg.Workers,
 			BufferSize: cfg.BufferSize,
 			Resume:     cfg.Resume,
+			StateDir:   stateDir,
+
+			Endpoint:         cfg.S3Endpoint,
+			UsePathStyle:     cfg.S3UsePathStyle,
+			CABundle:         cfg.S3CABundle,
+			SignatureVersion: cfg.S3SignatureVersion,
+			Tagging:          tagging,
 		}
 		return NewS3Provider(s3Cfg, log)
 
 	case string(ProviderGoogleDrive):
+		stateDir, err := cfg.GetStateDir()
+		if err != nil {
+			return nil, err
+		}
+
 		// Google Drive provider
 		gdCfg := &GoogleDriveConfig{
 			CredentialsPath: cfg.GoogleDriveCredentialsPath,
@@ -34,21 +58,34 @@ func NewStorageProvider(cfg *setup.Config, log *logger.Logger) (StorageProvider,
 			Filename:        cfg.S3Filename,
 			ChunkSize:       cfg.ChunkSize,
 			Resume:          cfg.Resume,
+			StateDir:        stateDir,
 		}
 		return NewGoogleDriveProvider(gdCfg, log)
 
 	case string(ProviderMega):
+		stateDir, err := cfg.GetStateDir()
+		if err != nil {
+			return nil, err
+		}
+
 		// Mega.nz provider
 		megaCfg := &MegaConfig{
 			Username:  cfg.MegaUsername,
 			Password:  cfg.MegaPassword,
 			Filename:  cfg.S3Filename,
 			ChunkSize: cfg.ChunkSize,
+			Workers:   cfg.Workers,
 			Resume:    cfg.Resume,
+			StateDir:  stateDir,
 		}
 		return NewMegaProvider(megaCfg, log)
 
 	case string(ProviderMinIO):
+		stateDir, err := cfg.GetStateDir()
+		if err != nil {
+			return nil, err
+		}
+
 		// MinIO provider
 		minioCfg := &MinIOConfig{
 			Endpoint:        cfg.MinIOEndpoint,
@@ -61,9 +98,20 @@ func NewStorageProvider(cfg *setup.Config, log *logger.Logger) (StorageProvider,
 			Workers:         cfg.Workers,
 			BufferSize:      cfg.BufferSize,
 			Resume:          cfg.Resume,
+			StateDir:        stateDir,
 		}
 		return NewMinIOProvider(minioCfg, log)
 
+	case string(ProviderLocal):
+		// Local filesystem provider
+		localCfg := &LocalConfig{
+			Path:       cfg.LocalPath,
+			Filename:   cfg.S3Filename,
+			BufferSize: cfg.BufferSize,
+			Resume:     cfg.Resume,
+		}
+		return NewLocalProvider(localCfg, log)
+
 	default:
 		return nil, fmt.Errorf("unsupported storage provider: %s", cfg.StorageProvider)
 	}
@@ -101,6 +149,11 @@ func ValidateProviderConfig(cfg *setup.Config) error {
 			return fmt.Errorf("MinIO bucket name is required")
 		}
 
+	case string(ProviderLocal):
+		if cfg.LocalPath == "" {
+			return fmt.Errorf("local storage path is required")
+		}
+
 	default:
 		return fmt.Errorf("unsupported storage provider: %s", cfg.StorageProvider)
 	}
@@ -0,0 +1,465 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+	"github.com/seriousconsult/cloud_safe/internal/progress"
+)
+
+const (
+	// driveUploadURL starts a resumable upload session
+	driveUploadURL = "https://www.googleapis.com/upload/drive/v3/files?uploadType=resumable&fields=id"
+
+	// driveChunkAlignment is the granularity Drive requires for every chunk but the last
+	driveChunkAlignment = 256 * 1024
+
+	// driveMaxRetries is the number of attempts made to send a chunk
+	driveMaxRetries = 5
+)
+
+// errDriveSessionExpired is returned when Drive no longer knows an upload session
+var errDriveSessionExpired = errors.New("Google Drive upload session has expired")
+
+// errDriveStreamChanged is returned when a resumed stream does not match the
+// bytes already sent to Drive. Drive cannot overwrite them, so the session is
+// cancelled.
+var errDriveStreamChanged = fmt.Errorf("%w to Google Drive", ErrStreamChanged)
+
+// driveUploadState is the local record of a resumable upload session, saved
+// before and after every chunk so the session can be continued by a later run
+type driveUploadState struct {
+	SessionURI string `json:"session_uri"`
+	FolderID   string `json:"folder_id"`
+	Name       string `json:"name"`
+	ChunkSize  int64  `json:"chunk_size"`
+	// Offset is the number of bytes Drive has confirmed
+	Offset int64 `json:"offset"`
+	// Checkpoints hold the SHA-256 of the stream up to the end of the last
+	// chunk that was sent, so a resumed stream can be checked against it
+	Checkpoints []driveCheckpoint `json:"checkpoints"`
+	Created     time.Time         `json:"created"`
+}
+
+// driveCheckpoint records the hash of the first Offset bytes of the stream
+type driveCheckpoint struct {
+	Offset int64  `json:"offset"`
+	SHA256 string `json:"sha256"`
+}
+
+// DriveResumableUpload is a Google Drive resumable upload session and implements ResumableUpload
+type DriveResumableUpload struct {
+	client    *http.Client
+	statePath string
+	logger    *logger.Logger
+	tracker   progress.Tracker
+	state     driveUploadState
+}
+
+// NewDriveResumableUpload starts a resumable upload session for file name in
+// folderID. Progress is recorded in statePath when it is not empty.
+func NewDriveResumableUpload(ctx context.Context, client *http.Client, folderID, name string, chunkSize int64, statePath string, logger *logger.Logger, tracker progress.Tracker) (*DriveResumableUpload, error) {
+	metadata := map[string]interface{}{
+		"name":          name,
+		"appProperties": map[string]string{driveSourceProperty: CloudSafeTagValue},
+	}
+	if folderID != "" {
+		metadata["parents"] = []string{folderID}
+	}
+	body, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode file metadata: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, driveUploadURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload session request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", "application/octet-stream")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload session: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to create upload session: %s", driveResponseError(resp))
+	}
+	sessionURI := resp.Header.Get("Location")
+	if sessionURI == "" {
+		return nil, fmt.Errorf("failed to create upload session: response has no session URI")
+	}
+
+	logger.Debugf("Created Google Drive upload session for %s", name)
+
+	u := &DriveResumableUpload{
+		client:    client,
+		statePath: statePath,
+		logger:    logger,
+		tracker:   tracker,
+		state: driveUploadState{
+			SessionURI: sessionURI,
+			FolderID:   folderID,
+			Name:       name,
+			ChunkSize:  driveChunkSize(chunkSize),
+			Created:    time.Now().UTC(),
+		},
+	}
+
+	if err := u.saveState(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// driveChunkSize rounds the configured chunk size down to a multiple of the
+// granularity Drive accepts
+func driveChunkSize(chunkSize int64) int64 {
+	chunkSize -= chunkSize % driveChunkAlignment
+	if chunkSize < driveChunkAlignment {
+		chunkSize = driveChunkAlignment
+	}
+	return chunkSize
+}
+
+// upload sends the stream to the session in chunks. The first state.Offset
+// bytes are already stored by Drive; they are read from the stream and
+// checked against the saved checkpoints instead of being sent again.
+func (u *DriveResumableUpload) upload(ctx context.Context, reader io.Reader) error {
+	hasher := sha256.New()
+	offset := u.state.Offset
+	hashed := offset
+
+	if offset > 0 {
+		pending, err := u.skipCommitted(reader, hasher)
+		if err != nil {
+			return err
+		}
+		if u.tracker != nil {
+			u.tracker.Update(offset)
+		}
+		u.logger.Infof("Skipped %d already uploaded bytes", offset)
+
+		// The bytes read past the offset to reach the checkpoint are sent first
+		reader = io.MultiReader(bytes.NewReader(pending), reader)
+		hashed += int64(len(pending))
+	}
+
+	buffer := make([]byte, u.state.ChunkSize)
+	for {
+		n, err := io.ReadFull(reader, buffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("failed to read data: %w", err)
+		}
+		data := buffer[:n]
+		final := n < len(buffer)
+
+		// Record what is about to be sent so a later run can check its stream
+		// against whatever part of this chunk Drive ends up storing
+		end := offset + int64(n)
+		if end > hashed {
+			hasher.Write(data[hashed-offset:])
+			hashed = end
+		}
+		u.addCheckpoint(end, hex.EncodeToString(hasher.Sum(nil)))
+		if err := u.saveState(); err != nil {
+			u.logger.Errorf("Failed to save upload state: %v", err)
+		}
+
+		total := int64(-1)
+		if final {
+			total = end
+		}
+		done, err := u.sendChunk(ctx, data, offset, total)
+		if err != nil {
+			return err
+		}
+		offset = end
+
+		if final {
+			if !done {
+				return fmt.Errorf("Google Drive did not finish the upload after the last chunk")
+			}
+			return nil
+		}
+	}
+}
+
+// skipCommitted reads the bytes Drive already stored from reader and checks
+// them, along with every byte sent after them, against the last checkpoint.
+// Drive may have stored only part of what was sent, so the bytes read past
+// state.Offset are returned to be sent again.
+func (u *DriveResumableUpload) skipCommitted(reader io.Reader, hasher hash.Hash) ([]byte, error) {
+	offset := u.state.Offset
+
+	var checkpoint *driveCheckpoint
+	if last := len(u.state.Checkpoints) - 1; last >= 0 && u.state.Checkpoints[last].Offset >= offset {
+		checkpoint = &u.state.Checkpoints[last]
+	}
+	if checkpoint == nil {
+		// Without a hash of every stored byte the stream cannot be checked
+		return nil, errDriveStreamChanged
+	}
+
+	n, err := io.CopyN(hasher, reader, offset)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read data: %w", err)
+	}
+	if n != offset {
+		return nil, errDriveStreamChanged
+	}
+
+	pending := make([]byte, checkpoint.Offset-offset)
+	if _, err := io.ReadFull(reader, pending); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errDriveStreamChanged
+		}
+		return nil, fmt.Errorf("failed to read data: %w", err)
+	}
+	hasher.Write(pending)
+	if hex.EncodeToString(hasher.Sum(nil)) != checkpoint.SHA256 {
+		return nil, errDriveStreamChanged
+	}
+	return pending, nil
+}
+
+// addCheckpoint records the stream hash at offset, the end of the chunk about
+// to be sent. The earlier checkpoints are forgotten: the last one covers every
+// byte sent so far.
+func (u *DriveResumableUpload) addCheckpoint(offset int64, sum string) {
+	u.state.Checkpoints = []driveCheckpoint{{Offset: offset, SHA256: sum}}
+}
+
+// sendChunk sends data, which starts at offset in the stream, retrying with
+// exponential backoff. Drive may store only part of a request, in which case
+// the rest is sent again. total is the stream size for the last chunk and -1
+// otherwise. It reports whether Drive finished the upload.
+func (u *DriveResumableUpload) sendChunk(ctx context.Context, data []byte, offset, total int64) (bool, error) {
+	const baseDelay = time.Second
+
+	end := offset + int64(len(data))
+	sent := offset
+	for attempt := 0; attempt < driveMaxRetries; {
+		committed, done, err := u.put(ctx, data[sent-offset:], sent, total)
+		if err == nil {
+			u.confirm(committed)
+			if done {
+				u.confirm(end)
+				return true, nil
+			}
+			if committed >= end {
+				return false, nil
+			}
+			if committed < offset {
+				return false, fmt.Errorf("Google Drive reports %d bytes stored while sending bytes %d-%d", committed, offset, end)
+			}
+			// Drive stored only part of the chunk; send the rest, counting
+			// an attempt when nothing new was stored
+			if committed <= sent {
+				attempt++
+			}
+			sent = committed
+			continue
+		}
+		if errors.Is(err, errDriveSessionExpired) {
+			return false, err
+		}
+
+		attempt++
+		u.logger.Errorf("Upload attempt %d of bytes %d-%d failed: %v", attempt, sent, end, err)
+		if attempt == driveMaxRetries {
+			break
+		}
+
+		delay := baseDelay * time.Duration(1<<(attempt-1)) // Exponential backoff
+		u.logger.Debugf("Retrying in %v...", delay)
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(delay):
+		}
+
+		// Ask Drive how much it stored before sending again
+		committed, done, err = u.status(ctx)
+		if err != nil {
+			u.logger.Errorf("Failed to query upload session: %v", err)
+			continue
+		}
+		if done {
+			u.confirm(end)
+			return true, nil
+		}
+		if committed < offset || committed > end {
+			return false, fmt.Errorf("Google Drive reports %d bytes stored while sending bytes %d-%d", committed, offset, end)
+		}
+		u.confirm(committed)
+		sent = committed
+	}
+
+	return false, fmt.Errorf("failed to upload bytes %d-%d after %d attempts", offset, end, driveMaxRetries)
+}
+
+// confirm records that Drive stored the stream up to offset
+func (u *DriveResumableUpload) confirm(offset int64) {
+	if offset <= u.state.Offset {
+		return
+	}
+	if u.tracker != nil {
+		u.tracker.Update(offset - u.state.Offset)
+	}
+	u.state.Offset = offset
+	if err := u.saveState(); err != nil {
+		u.logger.Errorf("Failed to save upload state: %v", err)
+	}
+}
+
+// put sends data as the bytes starting at offset. It returns the number of
+// bytes Drive has stored and whether the upload is finished.
+func (u *DriveResumableUpload) put(ctx context.Context, data []byte, offset, total int64) (int64, bool, error) {
+	size := "*"
+	if total >= 0 {
+		size = strconv.FormatInt(total, 10)
+	}
+	contentRange := "bytes */" + size
+	if len(data) > 0 {
+		contentRange = fmt.Sprintf("bytes %d-%d/%s", offset, offset+int64(len(data))-1, size)
+	}
+	return u.request(ctx, data, contentRange)
+}
+
+// status asks Drive how many bytes of the session it has stored
+func (u *DriveResumableUpload) status(ctx context.Context) (int64, bool, error) {
+	return u.request(ctx, nil, "bytes */*")
+}
+
+// request sends a PUT to the session and interprets the reply
+func (u *DriveResumableUpload) request(ctx context.Context, data []byte, contentRange string) (int64, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.state.SessionURI, bytes.NewReader(data))
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to create upload request: %w", err)
+	}
+	req.ContentLength = int64(len(data))
+	req.Header.Set("Content-Range", contentRange)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated:
+		io.Copy(io.Discard, resp.Body)
+		return 0, true, nil
+	case resp.StatusCode == http.StatusPermanentRedirect:
+		// "Resume Incomplete": Range holds the bytes stored so far, if any
+		committed, err := parseDriveRange(resp.Header.Get("Range"))
+		return committed, false, err
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return 0, false, errDriveSessionExpired
+	default:
+		return 0, false, fmt.Errorf("unexpected response: %s", driveResponseError(resp))
+	}
+}
+
+// parseDriveRange parses a Range header of the form "bytes=0-N" into the
+// number of bytes stored
+func parseDriveRange(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	_, last, ok := strings.Cut(strings.TrimPrefix(value, "bytes="), "-")
+	if !ok {
+		return 0, fmt.Errorf("invalid Range header %q", value)
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Range header %q", value)
+	}
+	return end + 1, nil
+}
+
+// driveResponseError describes an unsuccessful response
+func driveResponseError(resp *http.Response) string {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if len(body) == 0 {
+		return resp.Status
+	}
+	return resp.Status + ": " + strings.TrimSpace(string(body))
+}
+
+// Abort cancels the upload session
+func (u *DriveResumableUpload) Abort(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, u.state.SessionURI, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create cancel request: %w", err)
+	}
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to cancel upload session: %w", err)
+	}
+	resp.Body.Close()
+
+	// Drive answers a cancelled session with 499; an expired one is gone already
+	u.logger.Infof("Cancelled Google Drive upload session for %s", u.state.Name)
+	u.removeState()
+	return nil
+}
+
+// Resume continues an interrupted upload (implements ResumableUpload interface).
+// reader must supply the whole stream again; the bytes Drive already stored
+// are checked and skipped.
+func (u *DriveResumableUpload) Resume(ctx context.Context, reader io.Reader, tracker progress.Tracker) error {
+	u.tracker = tracker
+
+	u.logger.Infof("Resuming Google Drive upload of %s (%d bytes already uploaded)", u.state.Name, u.state.Offset)
+
+	if err := u.upload(ctx, reader); err != nil {
+		if errors.Is(err, errDriveStreamChanged) {
+			if abortErr := u.Abort(ctx); abortErr != nil {
+				u.logger.Errorf("Failed to cancel upload session: %v", abortErr)
+			}
+		}
+		return err
+	}
+	u.removeState()
+	return nil
+}
+
+// GetUploadedSize returns the amount of data already uploaded
+func (u *DriveResumableUpload) GetUploadedSize() int64 {
+	return u.state.Offset
+}
+
+// saveState writes the upload state file
+func (u *DriveResumableUpload) saveState() error {
+	if u.statePath == "" {
+		return nil
+	}
+	return SaveState(u.statePath, &u.state)
+}
+
+// removeState deletes the upload state file once it is no longer needed
+func (u *DriveResumableUpload) removeState() {
+	if u.statePath == "" {
+		return
+	}
+	if err := RemoveState(u.statePath); err != nil {
+		u.logger.Errorf("%v", err)
+	}
+}
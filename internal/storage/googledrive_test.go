@@ -0,0 +1,379 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+)
+
+// driveSession serves a Google Drive resumable upload session
+type driveSession struct {
+	testServer
+	data      []byte
+	done      bool
+	cancelled bool
+	// partial makes the session store only half of every whole chunk but the last
+	partial bool
+	// limit, when positive, is the number of bytes stored before interrupt is called
+	limit     int
+	interrupt func()
+}
+
+func newDriveSession(t *testing.T) *driveSession {
+	session := &driveSession{}
+	session.start(t, session.serve)
+	return session
+}
+
+func (s *driveSession) serve(w http.ResponseWriter, r *http.Request, body []byte) {
+	if r.Method == http.MethodDelete {
+		s.cancelled = true
+		w.WriteHeader(499)
+		return
+	}
+	if s.cancelled {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	byteRange, total, _ := strings.Cut(strings.TrimPrefix(r.Header.Get("Content-Range"), "bytes "), "/")
+	if byteRange != "*" {
+		first, _, _ := strings.Cut(byteRange, "-")
+		if start, _ := strconv.Atoi(first); start != len(s.data) {
+			http.Error(w, fmt.Sprintf("chunk starts at %d, but %d bytes are stored", start, len(s.data)), http.StatusBadRequest)
+			return
+		}
+		if s.partial && total == "*" && len(body) == driveChunkAlignment {
+			body = body[:len(body)/2]
+		}
+		if s.limit > 0 && len(s.data)+len(body) >= s.limit {
+			body = body[:s.limit-len(s.data)]
+			s.limit = 0
+			s.interrupt()
+		}
+		s.data = append(s.data, body...)
+	}
+
+	if size, err := strconv.Atoi(total); err == nil && size == len(s.data) {
+		s.done = true
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	if s.done {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if len(s.data) > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(s.data)-1))
+	}
+	w.WriteHeader(http.StatusPermanentRedirect)
+}
+
+// randomStream returns size random bytes
+func randomStream(size int) []byte {
+	stream := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(stream)
+	return stream
+}
+
+func TestDriveUpload(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		partial bool
+	}{
+		{name: "last chunk short", size: 3*driveChunkAlignment + 123},
+		{name: "whole chunks", size: 2 * driveChunkAlignment},
+		{name: "empty", size: 0},
+		{name: "chunks stored in part", size: 3*driveChunkAlignment + 123, partial: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newDriveSession(t)
+			session.partial = tt.partial
+			stream := randomStream(tt.size)
+
+			upload := &DriveResumableUpload{
+				client: session.Client(),
+				logger: logger.New(false).Quiet(),
+				state:  driveUploadState{SessionURI: session.URL, ChunkSize: driveChunkAlignment},
+			}
+			if err := upload.upload(context.Background(), bytes.NewReader(stream)); err != nil {
+				t.Fatalf("upload() error = %v", err)
+			}
+			if !session.done || !bytes.Equal(session.data, stream) {
+				t.Errorf("session holds %d bytes that differ from the %d bytes of the stream", len(session.data), len(stream))
+			}
+		})
+	}
+}
+
+func TestDriveResume(t *testing.T) {
+	stream := randomStream(5*driveChunkAlignment + 123)
+	// The first run stops after Drive stored part of the third chunk
+	stored := 2*driveChunkAlignment + 500
+
+	changed := func(offset int) []byte {
+		data := append([]byte{}, stream...)
+		data[offset] ^= 1
+		return data
+	}
+
+	tests := []struct {
+		name    string
+		resume  []byte
+		wantErr bool
+	}{
+		{name: "same stream", resume: stream},
+		{name: "first chunk differs", resume: changed(10), wantErr: true},
+		{name: "stored part of the last chunk differs", resume: changed(2*driveChunkAlignment + 100), wantErr: true},
+		{name: "stream ends in the stored part", resume: stream[:stored-1], wantErr: true},
+		{name: "stream ends before the last checkpoint", resume: stream[:stored+10], wantErr: true},
+		{name: "sent part of the third chunk differs", resume: changed(stored + 100), wantErr: true},
+		{name: "chunk after the sent ones differs", resume: changed(3*driveChunkAlignment + 100)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newDriveSession(t)
+			provider := &GoogleDriveProvider{
+				client: session.Client(),
+				logger: logger.New(false).Quiet(),
+				config: &GoogleDriveConfig{Filename: "backup.tar", Resume: true, StateDir: t.TempDir()},
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			session.limit, session.interrupt = stored, cancel
+			first := &DriveResumableUpload{
+				client:    session.Client(),
+				statePath: provider.statePath(),
+				logger:    provider.logger,
+				state:     driveUploadState{SessionURI: session.URL, Name: "backup.tar", ChunkSize: driveChunkAlignment},
+			}
+			if err := first.upload(ctx, bytes.NewReader(stream)); err == nil {
+				t.Fatal("upload() of an interrupted session succeeded")
+			}
+
+			resumable, err := provider.CheckResumability(context.Background())
+			if err != nil || resumable == nil {
+				t.Fatalf("CheckResumability() = %v, %v", resumable, err)
+			}
+			if got := resumable.GetUploadedSize(); got != int64(stored) {
+				t.Fatalf("GetUploadedSize() = %d, want %d", got, stored)
+			}
+
+			err = resumable.Resume(context.Background(), bytes.NewReader(tt.resume), nil)
+			if tt.wantErr {
+				if !errors.Is(err, ErrStreamChanged) {
+					t.Fatalf("Resume() error = %v, want ErrStreamChanged", err)
+				}
+				if !session.cancelled {
+					t.Error("Resume() kept a session whose stream changed")
+				}
+				if again, _ := provider.CheckResumability(context.Background()); again != nil {
+					t.Error("CheckResumability() offers a cancelled session")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resume() error = %v", err)
+			}
+			if !session.done || !bytes.Equal(session.data, tt.resume) {
+				t.Errorf("session holds %d bytes that differ from the stream", len(session.data))
+			}
+		})
+	}
+}
+
+// driveFile is a file stored on a driveServer
+type driveFile struct {
+	drive.File
+	data []byte
+}
+
+// driveServer serves the parts of the Google Drive API the provider uses
+// for one folder: resumable uploads, searching files by name, downloading
+// them and updating their content
+type driveServer struct {
+	testServer
+	files    []*driveFile
+	sessions map[string]*driveFile
+}
+
+func newDriveServer(t *testing.T) *driveServer {
+	server := &driveServer{sessions: make(map[string]*driveFile)}
+	server.start(t, server.serve)
+	return server
+}
+
+// driveRedirect sends every request to a test server, whatever Google API
+// host it was made for
+type driveRedirect struct {
+	target *url.URL
+}
+
+func (d driveRedirect) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme, r.URL.Host = d.target.Scheme, d.target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// newTestDriveProvider returns a provider whose requests go to server
+func newTestDriveProvider(t *testing.T, server *driveServer, cfg *GoogleDriveConfig) *GoogleDriveProvider {
+	t.Helper()
+	target, _ := url.Parse(server.URL)
+	client := &http.Client{Transport: driveRedirect{target: target}}
+	service, err := drive.NewService(context.Background(), option.WithHTTPClient(client))
+	if err != nil {
+		t.Fatalf("drive.NewService() error = %v", err)
+	}
+	return &GoogleDriveProvider{service: service, client: client, config: cfg, logger: logger.New(false).Quiet()}
+}
+
+// driveQueryName matches the name a files.list query searches for
+var driveQueryName = regexp.MustCompile(`name = '((?:[^'\\]|\\.)*)'`)
+
+func (s *driveServer) serve(w http.ResponseWriter, r *http.Request, body []byte) {
+	path := r.URL.Path
+	switch {
+	case r.Method == http.MethodPost && path == "/upload/drive/v3/files":
+		file := &driveFile{}
+		if err := json.Unmarshal(body, &file.File); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		session := fmt.Sprintf("/session/%d", len(s.sessions))
+		s.sessions[session] = file
+		w.Header().Set("Location", s.URL+session)
+	case r.Method == http.MethodPut && s.sessions[path] != nil:
+		file := s.sessions[path]
+		file.data = append(file.data, body...)
+		_, total, _ := strings.Cut(r.Header.Get("Content-Range"), "/")
+		if size, err := strconv.Atoi(total); err != nil || size != len(file.data) {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(file.data)-1))
+			w.WriteHeader(http.StatusPermanentRedirect)
+			return
+		}
+		delete(s.sessions, path)
+		s.store(file)
+		json.NewEncoder(w).Encode(file.File)
+	case r.Method == http.MethodGet && path == "/drive/v3/files":
+		match := driveQueryName.FindStringSubmatch(r.URL.Query().Get("q"))
+		list := drive.FileList{Files: []*drive.File{}}
+		// Newest first, as the provider asks for
+		for i := len(s.files) - 1; i >= 0; i-- {
+			if match != nil && s.files[i].Name == strings.ReplaceAll(match[1], `\'`, "'") {
+				list.Files = append(list.Files, &s.files[i].File)
+			}
+		}
+		json.NewEncoder(w).Encode(list)
+	case r.Method == http.MethodGet && r.URL.Query().Get("alt") == "media":
+		file := s.file(strings.TrimPrefix(path, "/drive/v3/files/"))
+		if file == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(file.data)
+	case r.Method == http.MethodPatch && strings.HasPrefix(path, "/upload/drive/v3/files/"):
+		file := s.file(strings.TrimPrefix(path, "/upload/drive/v3/files/"))
+		if file == nil {
+			http.NotFound(w, r)
+			return
+		}
+		data, err := driveMultipartMedia(r, body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		file.data = data
+		file.Size = int64(len(data))
+		json.NewEncoder(w).Encode(file.File)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+// store adds an uploaded file
+func (s *driveServer) store(file *driveFile) {
+	file.Id = fmt.Sprintf("file%d", len(s.files))
+	file.Size = int64(len(file.data))
+	file.ModifiedTime = time.Now().UTC().Format(time.RFC3339)
+	s.files = append(s.files, file)
+}
+
+// file returns the file with id, or nil
+func (s *driveServer) file(id string) *driveFile {
+	for _, file := range s.files {
+		if file.Id == id {
+			return file
+		}
+	}
+	return nil
+}
+
+// named returns the content of every file called name
+func (s *driveServer) named(name string) [][]byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var data [][]byte
+	for _, file := range s.files {
+		if file.Name == name {
+			data = append(data, file.data)
+		}
+	}
+	return data
+}
+
+// driveMultipartMedia returns the media of a multipart upload: the part
+// after the file metadata
+func driveMultipartMedia(r *http.Request, body []byte) ([]byte, error) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	parts := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	if _, err := parts.NextPart(); err != nil {
+		return nil, err
+	}
+	media, err := parts.NextPart()
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(media)
+}
+
+func TestDrivePutObjectReplaces(t *testing.T) {
+	ctx := context.Background()
+	server := newDriveServer(t)
+	provider := newTestDriveProvider(t, server, &GoogleDriveConfig{})
+
+	for _, data := range []string{"first version", "second version"} {
+		if err := provider.PutObject(ctx, "repository/config", strings.NewReader(data), int64(len(data)), nil); err != nil {
+			t.Fatalf("PutObject(%q) error = %v", data, err)
+		}
+	}
+
+	files := server.named("repository/config")
+	if len(files) != 1 || string(files[0]) != "second version" {
+		t.Errorf("Drive holds %q under the key, want only the second version", files)
+	}
+}
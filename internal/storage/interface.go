@@ -2,7 +2,9 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"io"
+	"time"
 
 	"github.com/seriousconsult/cloud_safe/internal/progress"
 )
@@ -15,12 +17,33 @@ const (
 	ProviderGoogleDrive Provider = "googledrive"
 	ProviderMega       Provider = "mega"
 	ProviderMinIO      Provider = "minio"
+	ProviderLocal      Provider = "local"
 )
 
 // StorageProvider defines the interface that all storage providers must implement
 type StorageProvider interface {
 	// UploadStream uploads data from a reader to the storage provider
 	UploadStream(ctx context.Context, reader io.Reader, estimatedSize int64, tracker progress.Tracker) error
+
+	// PutObject uploads exactly size bytes from reader as the object stored
+	// under key. Unlike UploadStream it is never resumed.
+	PutObject(ctx context.Context, key string, reader io.Reader, size int64, tracker progress.Tracker) error
+	
+	// WithKey returns a provider with the same configuration and connection
+	// whose UploadStream and CheckResumability work on the object stored under key
+	WithKey(key string) StorageProvider
+	
+	// DeleteObject removes the object stored under key
+	DeleteObject(ctx context.Context, key string) error
+	
+	// DownloadStream downloads the object stored under key and writes it to writer
+	DownloadStream(ctx context.Context, key string, writer io.Writer, tracker progress.Tracker) error
+	
+	// Stat returns the size, modification time and metadata of the object stored under key
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	
+	// List returns the objects whose keys start with prefix
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
 	
 	// CheckResumability checks if an upload can be resumed
 	CheckResumability(ctx context.Context) (ResumableUpload, error)
@@ -32,6 +55,53 @@ type StorageProvider interface {
 	ValidateConfig() error
 }
 
+// PrefixRewriter is implemented by providers that can replace the first bytes
+// of a stored object without the caller uploading the rest of it again
+type PrefixRewriter interface {
+	// RewritePrefix replaces the first oldLength bytes of the object stored under key with prefix
+	RewritePrefix(ctx context.Context, key string, oldLength int64, prefix []byte) error
+}
+
+// RangeReader is implemented by providers that can read part of a stored
+// object without downloading the bytes before it
+type RangeReader interface {
+	// ReadRange returns length bytes of the object stored under key from
+	// offset, or the rest of the object for a negative length. The reader
+	// ends early if the object does, and is empty from an offset at or past
+	// its end.
+	ReadRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+}
+
+// MarkerReader is implemented by providers whose List cannot tell which
+// objects carry the cloud_safe marker without a request per object
+type MarkerReader interface {
+	// ReadMarkers sets CloudSafe on each of objects, making one request per object
+	ReadMarkers(ctx context.Context, objects []ObjectInfo) error
+}
+
+// ObjectInfo describes an object stored by a storage provider
+type ObjectInfo struct {
+	Key          string            `json:"key"`
+	Size         int64             `json:"size"`
+	LastModified time.Time         `json:"last_modified"`
+	ETag         string            `json:"etag,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	// CloudSafe reports whether the object carries the marker cloud_safe sets on upload
+	CloudSafe bool `json:"cloud_safe"`
+}
+
+// Marker cloud_safe attaches to uploaded objects so they can be recognised when listing
+const (
+	CloudSafeTagKey   = "Source"
+	CloudSafeTagValue = "cloud_safe"
+)
+
+// ErrStreamChanged is returned by Resume when the stream differs from what the
+// interrupted upload already sent. The interrupted upload is aborted: it cannot
+// be continued with other data, and an encrypted stream that changed must not
+// be sent again under the same archive key.
+var ErrStreamChanged = errors.New("the stream differs from the data the interrupted upload sent")
+
 // ResumableUpload represents a resumable upload session
 type ResumableUpload interface {
 	// Resume continues an interrupted upload
@@ -64,6 +134,9 @@ type Config struct {
 	
 	// MinIO Configuration
 	MinIOConfig *MinIOConfig `json:"minio_config,omitempty"`
+
+	// Local filesystem Configuration
+	LocalConfig *LocalConfig `json:"local_config,omitempty"`
 }
 
 // S3Config holds S3-specific configuration
@@ -77,8 +150,34 @@ type S3Config struct {
 	Workers    int    `json:"workers"`
 	BufferSize int    `json:"buffer_size"`
 	Resume     bool   `json:"resume"`
+	// StateDir holds the local state of interrupted multipart uploads
+	StateDir string `json:"state_dir"`
+
+	// Endpoint is the URL of an S3-compatible service; empty uses AWS
+	Endpoint string `json:"endpoint"`
+	// UsePathStyle addresses buckets as endpoint/bucket instead of bucket.endpoint
+	UsePathStyle bool `json:"use_path_style"`
+	// CABundle is a PEM file of extra certificate authorities to trust
+	CABundle string `json:"ca_bundle"`
+	// SignatureVersion is one of the S3Signature values; empty means S3SignatureV4
+	SignatureVersion string `json:"signature_version"`
+	// Tagging sets the cloud_safe tag on uploaded objects. Some S3-compatible
+	// services, such as R2 and B2, reject uploads that carry tags.
+	Tagging bool `json:"tagging"`
 }
 
+// Request signing for S3-compatible services
+const (
+	// S3SignatureV4 signs requests and their payloads with SigV4
+	S3SignatureV4 = "v4"
+	// S3SignatureV4UnsignedPayload signs requests with SigV4 but never their
+	// payloads; uploads over HTTPS skip the payload hash already, so this
+	// matters for plain HTTP endpoints
+	S3SignatureV4UnsignedPayload = "v4-unsigned-payload"
+	// S3SignatureAnonymous sends unsigned requests, e.g. to a local test server
+	S3SignatureAnonymous = "anonymous"
+)
+
 // GoogleDriveConfig holds Google Drive-specific configuration
 type GoogleDriveConfig struct {
 	ProviderConfig `json:",inline"`
@@ -88,6 +187,8 @@ type GoogleDriveConfig struct {
 	Filename        string `json:"filename"`
 	ChunkSize       int64  `json:"chunk_size"`
 	Resume          bool   `json:"resume"`
+	// StateDir holds the local state of interrupted upload sessions
+	StateDir string `json:"state_dir"`
 }
 
 // MegaConfig holds Mega-specific configuration
@@ -97,7 +198,10 @@ type MegaConfig struct {
 	Password  string `json:"password"`
 	Filename  string `json:"filename"`
 	ChunkSize int64  `json:"chunk_size"`
+	Workers   int    `json:"workers"`
 	Resume    bool   `json:"resume"`
+	// StateDir holds the local state of interrupted uploads
+	StateDir string `json:"state_dir"`
 }
 
 // MinIOConfig holds MinIO-specific configuration
@@ -113,4 +217,15 @@ type MinIOConfig struct {
 	Workers         int    `json:"workers"`
 	BufferSize      int    `json:"buffer_size"`
 	Resume          bool   `json:"resume"`
+	// StateDir holds the local state of interrupted multipart uploads
+	StateDir string `json:"state_dir"`
+}
+
+// LocalConfig holds local filesystem-specific configuration
+type LocalConfig struct {
+	ProviderConfig `json:",inline"`
+	Path       string `json:"path"`
+	Filename   string `json:"filename"`
+	BufferSize int    `json:"buffer_size"`
+	Resume     bool   `json:"resume"`
 }
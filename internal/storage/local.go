@@ -0,0 +1,520 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+	"github.com/seriousconsult/cloud_safe/internal/progress"
+)
+
+// localPartialSuffix marks archives that are still being written
+const localPartialSuffix = ".partial"
+
+// LocalProvider implements the StorageProvider interface for a local directory,
+// such as a NAS mount or a USB disk
+type LocalProvider struct {
+	config *LocalConfig
+	logger *logger.Logger
+}
+
+// NewLocalProvider creates a new local filesystem storage provider
+func NewLocalProvider(cfg *LocalConfig, logger *logger.Logger) (*LocalProvider, error) {
+	logger.Infof("Local Configuration:")
+	logger.Infof("  Path: %s", cfg.Path)
+	logger.Infof("  Filename: %s", cfg.Filename)
+
+	// The directory must already exist, so an unmounted NAS or disk is
+	// reported instead of silently filling the mount point
+	info, err := os.Stat(cfg.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to access local storage directory %s: %w", cfg.Path, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("local storage path %s is not a directory", cfg.Path)
+	}
+
+	return &LocalProvider{
+		config: cfg,
+		logger: logger,
+	}, nil
+}
+
+// GetProviderType returns the provider type
+func (l *LocalProvider) GetProviderType() Provider {
+	return ProviderLocal
+}
+
+// ValidateConfig validates the local configuration
+func (l *LocalProvider) ValidateConfig() error {
+	if l.config.Path == "" {
+		return fmt.Errorf("local storage path is required")
+	}
+	if l.config.Filename == "" {
+		return fmt.Errorf("local filename is required")
+	}
+	return nil
+}
+
+// objectPath returns the file a key is stored in, rejecting keys that would
+// escape the storage directory
+func (l *LocalProvider) objectPath(key string) (string, error) {
+	name := filepath.FromSlash(key)
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("invalid key for local storage: %s", key)
+	}
+	return filepath.Join(l.config.Path, name), nil
+}
+
+// UploadStream writes data from a reader to a partial file and renames it into
+// place once complete. With resume enabled, an existing partial file is
+// continued instead of rewritten.
+func (l *LocalProvider) UploadStream(ctx context.Context, reader io.Reader, size int64, tracker progress.Tracker) error {
+	upload, err := l.partialUpload(l.config.Filename)
+	if err != nil {
+		return err
+	}
+
+	if l.config.Resume && upload.size > 0 {
+		return upload.Resume(ctx, reader, tracker)
+	}
+	return l.upload(ctx, upload, reader, size, tracker)
+}
+
+// PutObject writes exactly size bytes from reader to the file stored under
+// key, through a partial file like UploadStream
+func (l *LocalProvider) PutObject(ctx context.Context, key string, reader io.Reader, size int64, tracker progress.Tracker) error {
+	upload, err := l.partialUpload(key)
+	if err != nil {
+		return err
+	}
+	return l.upload(ctx, upload, reader, size, tracker)
+}
+
+// WithKey returns a provider that writes streams to the file stored under key
+func (l *LocalProvider) WithKey(key string) StorageProvider {
+	cfg := *l.config
+	cfg.Filename = key
+	return &LocalProvider{config: &cfg, logger: l.logger}
+}
+
+// DeleteObject removes the file stored under key
+func (l *LocalProvider) DeleteObject(ctx context.Context, key string) error {
+	path, err := l.objectPath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to delete local file: %w", err)
+	}
+	return nil
+}
+
+// upload writes reader to a new partial file and renames it into place
+func (l *LocalProvider) upload(ctx context.Context, upload *LocalPartialUpload, reader io.Reader, size int64, tracker progress.Tracker) error {
+	l.logger.Infof("Starting local upload to %s (size: %d bytes)", upload.path, size)
+
+	if err := os.MkdirAll(filepath.Dir(upload.path), 0755); err != nil {
+		return fmt.Errorf("failed to create local directory: %w", err)
+	}
+	file, err := os.OpenFile(upload.partial, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create local file: %w", err)
+	}
+
+	return upload.write(ctx, file, reader, tracker)
+}
+
+// DownloadStream reads the file stored under key and writes it to writer
+func (l *LocalProvider) DownloadStream(ctx context.Context, key string, writer io.Writer, tracker progress.Tracker) error {
+	path, err := l.objectPath(key)
+	if err != nil {
+		return err
+	}
+
+	l.logger.Infof("Starting local download of %s", path)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open local file %s: %w", key, err)
+	}
+	defer file.Close()
+
+	reader := &localProgressReader{
+		ctx:     ctx,
+		reader:  file,
+		tracker: tracker,
+	}
+
+	if _, err := io.CopyBuffer(writer, reader, make([]byte, l.bufferSize())); err != nil {
+		return fmt.Errorf("failed to read local file: %w", err)
+	}
+
+	l.logger.Info("Local download completed successfully")
+	return nil
+}
+
+// ReadRange returns a byte range of a file in the storage directory, read
+// with ReadAt
+func (l *LocalProvider) ReadRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	path, err := l.objectPath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open local file %s: %w", key, err)
+	}
+	if length < 0 {
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to stat local file %s: %w", key, err)
+		}
+		length = max(info.Size()-offset, 0)
+	}
+	l.logger.Debugf("Reading %s of %s", httpRange(offset, length), path)
+
+	return &localRangeReader{
+		SectionReader: io.NewSectionReader(file, offset, length),
+		file:          file,
+	}, nil
+}
+
+// Stat returns information about a file in the storage directory
+func (l *LocalProvider) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	path, err := l.objectPath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat local file %s: %w", key, err)
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("local path %s is a directory", key)
+	}
+
+	return &ObjectInfo{
+		Key:          key,
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+	}, nil
+}
+
+// List returns the files below the storage directory whose "/"-separated paths
+// start with prefix. Partial uploads are skipped.
+func (l *LocalProvider) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	err := filepath.WalkDir(l.config.Path, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		rel, err := filepath.Rel(l.config.Path, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+
+		if entry.IsDir() {
+			// Only descend into directories that can still contain matching paths
+			if path != l.config.Path && !strings.HasPrefix(key+"/", prefix) && !strings.HasPrefix(prefix, key+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() || !strings.HasPrefix(key, prefix) || strings.HasSuffix(key, localPartialSuffix) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		// Plain files carry no tags; list tells archives apart by their contents
+		objects = append(objects, ObjectInfo{
+			Key:          key,
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list local directory %s: %w", l.config.Path, err)
+	}
+
+	return objects, nil
+}
+
+// RewritePrefix replaces the first oldLength bytes of key with prefix. A prefix
+// of the same length is overwritten in place; otherwise the file is copied
+// behind the new prefix and renamed over the original.
+func (l *LocalProvider) RewritePrefix(ctx context.Context, key string, oldLength int64, prefix []byte) error {
+	path, err := l.objectPath(key)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open local file %s: %w", key, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat local file %s: %w", key, err)
+	}
+	if oldLength > info.Size() {
+		return fmt.Errorf("file %s is shorter than its %d byte header", key, oldLength)
+	}
+
+	if int64(len(prefix)) == oldLength {
+		if _, err := file.WriteAt(prefix, 0); err != nil {
+			return fmt.Errorf("failed to rewrite local file %s: %w", key, err)
+		}
+		if err := file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync local file %s: %w", key, err)
+		}
+		return nil
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".rekey-*")
+	if err != nil {
+		return fmt.Errorf("failed to create local file: %w", err)
+	}
+	defer os.Remove(temp.Name())
+
+	if err := temp.Chmod(info.Mode().Perm()); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to create local file: %w", err)
+	}
+	rest := &localProgressReader{ctx: ctx, reader: io.NewSectionReader(file, oldLength, info.Size()-oldLength)}
+	if _, err := io.Copy(temp, io.MultiReader(bytes.NewReader(prefix), rest)); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to rewrite local file %s: %w", key, err)
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to sync local file %s: %w", key, err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("failed to rewrite local file %s: %w", key, err)
+	}
+	if err := os.Rename(temp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace local file %s: %w", key, err)
+	}
+	return nil
+}
+
+// CheckResumability returns the partial file of an interrupted upload, if any
+func (l *LocalProvider) CheckResumability(ctx context.Context) (ResumableUpload, error) {
+	if !l.config.Resume {
+		return nil, nil
+	}
+
+	upload, err := l.partialUpload(l.config.Filename)
+	if err != nil {
+		return nil, err
+	}
+	if upload.size == 0 {
+		return nil, nil
+	}
+
+	l.logger.Infof("Found partial local upload: %s (%d bytes)", upload.partial, upload.size)
+	return upload, nil
+}
+
+// partialUpload describes the partial file for the file stored under key
+func (l *LocalProvider) partialUpload(key string) (*LocalPartialUpload, error) {
+	path, err := l.objectPath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	upload := &LocalPartialUpload{
+		provider: l,
+		path:     path,
+		partial:  path + localPartialSuffix,
+	}
+	if info, err := os.Stat(upload.partial); err == nil {
+		upload.size = info.Size()
+	}
+	return upload, nil
+}
+
+// bufferSize returns the configured copy buffer size
+func (l *LocalProvider) bufferSize() int {
+	if l.config.BufferSize > 0 {
+		return l.config.BufferSize
+	}
+	return 64 * 1024
+}
+
+// LocalPartialUpload is an interrupted local upload and implements ResumableUpload
+type LocalPartialUpload struct {
+	provider *LocalProvider
+	path     string
+	partial  string
+	size     int64
+}
+
+// Resume continues the partial file from a fresh copy of the whole stream. The
+// bytes already on disk are compared with the start of the stream rather than
+// trusted; if the stream changed since the interrupted upload, the partial
+// file is removed and ErrStreamChanged returned.
+func (u *LocalPartialUpload) Resume(ctx context.Context, reader io.Reader, tracker progress.Tracker) error {
+	file, err := os.OpenFile(u.partial, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open partial local file: %w", err)
+	}
+
+	matched, err := u.matchPrefix(file, reader)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if tracker != nil {
+		tracker.Update(matched)
+	}
+
+	if matched < u.size {
+		file.Close()
+		if err := u.Abort(ctx); err != nil {
+			u.provider.logger.Errorf("%v", err)
+		}
+		return fmt.Errorf("partial file differs after %d of %d bytes: %w", matched, u.size, ErrStreamChanged)
+	}
+	u.provider.logger.Infof("Resuming local upload to %s at byte %d", u.path, matched)
+
+	if _, err := file.Seek(matched, io.SeekStart); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to seek partial local file: %w", err)
+	}
+
+	return u.write(ctx, file, reader, tracker)
+}
+
+// matchPrefix reads the stream alongside the partial file and returns the
+// number of identical leading bytes
+func (u *LocalPartialUpload) matchPrefix(file *os.File, reader io.Reader) (int64, error) {
+	bufferSize := u.provider.bufferSize()
+	streamBuf := make([]byte, bufferSize)
+	fileBuf := make([]byte, bufferSize)
+
+	var matched int64
+	for matched < u.size {
+		want := int64(bufferSize)
+		if remaining := u.size - matched; remaining < want {
+			want = remaining
+		}
+
+		n, err := io.ReadFull(reader, streamBuf[:want])
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return 0, fmt.Errorf("failed to read stream: %w", err)
+		}
+		if _, err := io.ReadFull(file, fileBuf[:n]); err != nil {
+			return 0, fmt.Errorf("failed to read partial local file: %w", err)
+		}
+
+		for i := 0; i < n; i++ {
+			if streamBuf[i] != fileBuf[i] {
+				return matched + int64(i), nil
+			}
+		}
+		matched += int64(n)
+
+		// The stream ended inside the partial file
+		if n < int(want) {
+			break
+		}
+	}
+
+	return matched, nil
+}
+
+// write copies reader to the end of the partial file, then syncs it and renames
+// it to its final name
+func (u *LocalPartialUpload) write(ctx context.Context, file *os.File, reader io.Reader, tracker progress.Tracker) error {
+	progressReader := &localProgressReader{
+		ctx:     ctx,
+		reader:  reader,
+		tracker: tracker,
+	}
+
+	written, err := io.CopyBuffer(file, progressReader, make([]byte, u.provider.bufferSize()))
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write local file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync local file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write local file: %w", err)
+	}
+
+	if err := os.Rename(u.partial, u.path); err != nil {
+		return fmt.Errorf("failed to rename local file: %w", err)
+	}
+
+	u.provider.logger.Infof("Successfully wrote %s (%d bytes written)", u.path, written)
+	return nil
+}
+
+// Abort removes the partial file
+func (u *LocalPartialUpload) Abort(ctx context.Context) error {
+	if err := os.Remove(u.partial); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove partial local file: %w", err)
+	}
+	return nil
+}
+
+// GetUploadedSize returns the size of the partial file
+func (u *LocalPartialUpload) GetUploadedSize() int64 {
+	return u.size
+}
+
+// localProgressReader wraps an io.Reader to provide progress tracking and
+// stop copying once the context is cancelled
+type localProgressReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	tracker progress.Tracker
+}
+
+func (pr *localProgressReader) Read(p []byte) (n int, err error) {
+	if err := pr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err = pr.reader.Read(p)
+	if n > 0 && pr.tracker != nil {
+		pr.tracker.Update(int64(n))
+	}
+	return n, err
+}
+
+// localRangeReader reads a section of a local file and closes the file with it
+type localRangeReader struct {
+	*io.SectionReader
+	file *os.File
+}
+
+func (r *localRangeReader) Close() error {
+	return r.file.Close()
+}
@@ -1,18 +1,23 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"time"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/seriousconsult/cloud_safe/internal/logger"
 	"github.com/seriousconsult/cloud_safe/internal/progress"
-
-	"github.com/t3rm1n4l/go-mega"
+	mega "github.com/seriousconsult/cloud_safe/third_party/go-mega"
 )
 
 // MegaProvider implements StorageProvider for Mega.nz
@@ -110,118 +115,534 @@ func (m *MegaProvider) ValidateConfig() error {
 	return nil
 }
 
-// UploadStream uploads data from a reader to Mega
+// UploadStream uploads data from a reader to Mega. Mega fixes the size of a
+// file when its upload is created, so estimatedSize must be the exact size of
+// the stream; archives are uploaded to Mega in volumes, whose size is known
+// before they are uploaded. With resume enabled the upload is recorded so
+// that a later run can finish it.
 func (m *MegaProvider) UploadStream(ctx context.Context, reader io.Reader, estimatedSize int64, tracker progress.Tracker) error {
 	m.logger.Info("Starting Mega upload")
 
-	// Get root node
-	root := m.client.FS.GetRoot()
-	if root == nil {
-		return fmt.Errorf("failed to get Mega root directory")
+	statePath := ""
+	if m.config.Resume {
+		statePath = m.statePath()
 	}
 
-	// Create new upload
-	upload, err := m.client.NewUpload(root, m.config.Filename, estimatedSize)
+	folder, name, err := m.makeFolders(m.config.Filename)
 	if err != nil {
-		return fmt.Errorf("failed to create Mega upload: %w", err)
+		return err
+	}
+	upload, err := m.startUpload(folder, name, m.config.Filename, estimatedSize, statePath)
+	if err != nil {
+		return err
 	}
 
-	// Upload chunks using Mega's predefined chunk sizes
-	totalUploaded := int64(0)
-	
-	for chunkID := 0; chunkID < upload.Chunks(); chunkID++ {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
+	node, totalUploaded, err := m.finishUpload(ctx, upload, reader, tracker)
+	if err != nil {
+		if statePath != "" {
+			m.logger.Infof("Keeping Mega upload for resume (%d bytes uploaded)", upload.uploadedSize())
 		}
+		return err
+	}
+
+	m.logger.Infof("Mega upload completed successfully: %s (%d bytes)", node.GetName(), totalUploaded)
+	return nil
+}
+
+// WithKey returns a provider sharing the session of m that uploads streams as
+// the file stored under key
+func (m *MegaProvider) WithKey(key string) StorageProvider {
+	cfg := *m.config
+	cfg.Filename = key
+	provider := *m
+	provider.config = &cfg
+	return &provider
+}
+
+// DeleteObject moves the file stored under key to the trash
+func (m *MegaProvider) DeleteObject(ctx context.Context, key string) error {
+	node, err := m.findNode(key)
+	if err != nil {
+		return err
+	}
+	if err := m.client.Delete(node, false); err != nil {
+		return fmt.Errorf("failed to move %s to the Mega trash: %w", key, err)
+	}
+	return nil
+}
+
+// resumeNode finishes the interrupted upload recorded in state with the
+// stream read from reader
+func (m *MegaProvider) resumeNode(ctx context.Context, state megaUploadState, reader io.Reader, tracker progress.Tracker) error {
+	folder, name, err := m.makeFolders(state.Key)
+	if err != nil {
+		return err
+	}
+
+	upload, err := m.restoreUpload(folder, name, state, m.statePath())
+	if err != nil {
+		// A record the upload cannot be restored from is of no use to a later run
+		m.forgetUpload()
+		return err
+	}
+
+	node, totalUploaded, err := m.finishUpload(ctx, upload, reader, tracker)
+	if errors.Is(err, errMegaRejected) {
+		// Neither is an upload Mega no longer accepts; the next run starts over
+		m.forgetUpload()
+	}
+	if err != nil {
+		return err
+	}
+
+	m.logger.Infof("Mega upload completed successfully: %s (%d bytes uploaded in this run)", node.GetName(), totalUploaded)
+	return nil
+}
+
+// forgetUpload removes the record of the interrupted upload of the
+// configured file
+func (m *MegaProvider) forgetUpload() {
+	if err := RemoveState(m.statePath()); err != nil {
+		m.logger.Errorf("%v", err)
+	}
+}
+
+// PutObject uploads exactly size bytes from reader as the file stored under
+// key, replacing the file stored under it before
+func (m *MegaProvider) PutObject(ctx context.Context, key string, reader io.Reader, size int64, tracker progress.Tracker) error {
+	node, totalUploaded, err := m.uploadNode(ctx, key, reader, size, tracker)
+	if err != nil {
+		return err
+	}
+
+	m.logger.Infof("Mega upload completed successfully: %s (%d bytes)", node.GetName(), totalUploaded)
+	return nil
+}
+
+// megaChunk is a chunk of a Mega upload waiting for a worker
+type megaChunk struct {
+	id   int
+	data []byte
+	// sum is the SHA-256 of data, which UploadChunk encrypts in place
+	sum string
+}
 
+// uploadNode uploads exactly size bytes from reader as a new file stored under
+// key, creating the folders of a "/"-separated key
+func (m *MegaProvider) uploadNode(ctx context.Context, key string, reader io.Reader, size int64, tracker progress.Tracker) (*mega.Node, int64, error) {
+	folder, name, err := m.makeFolders(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	upload, err := m.startUpload(folder, name, key, size, "")
+	if err != nil {
+		return nil, 0, err
+	}
+	return m.finishUpload(ctx, upload, reader, tracker)
+}
+
+// finishUpload sends the chunks of upload from reader and creates the file
+// from them, replacing the files of the same name in its folder. It returns
+// the file and the number of bytes sent.
+func (m *MegaProvider) finishUpload(ctx context.Context, upload *megaUpload, reader io.Reader, tracker progress.Tracker) (*mega.Node, int64, error) {
+	totalUploaded, err := m.sendChunks(ctx, upload, reader, tracker)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	node, err := upload.upload.Finish()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to finish Mega upload: %w", err)
+	}
+	upload.removeState()
+
+	if err := m.trashReplaced(upload.folder, node); err != nil {
+		return nil, 0, err
+	}
+	return node, totalUploaded, nil
+}
+
+// trashReplaced moves the files in folder that node replaces, the ones with
+// its name, to the trash. Mega allows several files of the same name in a
+// folder, so an upload never replaces one by itself.
+func (m *MegaProvider) trashReplaced(folder, node *mega.Node) error {
+	children, err := m.client.FS.GetChildren(folder)
+	if err != nil {
+		return fmt.Errorf("failed to list Mega folder %s: %w", folder.GetName(), err)
+	}
+
+	for _, child := range children {
+		if child == node || child.GetType() != mega.FILE || child.GetName() != node.GetName() {
+			continue
+		}
+		if err := m.client.Delete(child, false); err != nil {
+			return fmt.Errorf("failed to move previous version of %s to the Mega trash: %w", node.GetName(), err)
+		}
+	}
+	return nil
+}
+
+// sendChunks uploads the chunks of upload that Mega does not have yet.
+// Chunks are uploaded concurrently by Workers goroutines; it returns once
+// every chunk has been stored, with the number of bytes sent.
+func (m *MegaProvider) sendChunks(ctx context.Context, upload *megaUpload, reader io.Reader, tracker progress.Tracker) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := m.config.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	chunkChan := make(chan megaChunk)
+	errorChan := make(chan error, workers)
+	var totalUploaded atomic.Int64
+	var wg sync.WaitGroup
+
+	// Start worker goroutines; the unbuffered channel bounds memory to one
+	// chunk per worker plus the one being read
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range chunkChan {
+				// UploadChunk encrypts the data in place, so take the size first
+				size := int64(len(chunk.data))
+				if err := upload.upload.UploadChunk(chunk.id, chunk.data); err != nil {
+					errorChan <- fmt.Errorf("failed to upload chunk %d: %w", chunk.id, err)
+					cancel()
+					return
+				}
+				upload.record(chunk.id, size, chunk.sum)
+
+				totalUploaded.Add(size)
+				if tracker != nil {
+					tracker.Update(size)
+				}
+				m.logger.Debugf("Uploaded chunk %d: %d bytes", chunk.id, size)
+			}
+		}()
+	}
+
+	readErr := m.readChunks(ctx, upload, reader, tracker, chunkChan)
+	close(chunkChan)
+	wg.Wait()
+	close(errorChan)
+
+	// Report the upload error that caused the cancellation first
+	for err := range errorChan {
+		return 0, err
+	}
+	if readErr != nil {
+		return 0, readErr
+	}
+
+	if err := upload.complete(); err != nil {
+		return 0, err
+	}
+	return totalUploaded.Load(), nil
+}
+
+// readChunks reads the stream in the chunk sizes Mega chose for the upload and
+// hands the chunks Mega does not have yet to the workers. The stream must be
+// exactly as long as the upload.
+func (m *MegaProvider) readChunks(ctx context.Context, upload *megaUpload, reader io.Reader, tracker progress.Tracker, chunkChan chan<- megaChunk) error {
+	size := upload.state.Size
+	var read, skipped int64
+	for chunkID := 0; chunkID < upload.upload.Chunks(); chunkID++ {
 		// Get chunk location info from Mega
-		position, expectedSize, err := upload.ChunkLocation(chunkID)
+		_, expectedSize, err := upload.upload.ChunkLocation(chunkID)
 		if err != nil {
 			return fmt.Errorf("failed to get chunk location: %w", err)
 		}
 
 		// Read exactly the amount Mega expects for this chunk
 		chunkData := make([]byte, expectedSize)
-		n, readErr := io.ReadFull(reader, chunkData)
-		
-		// Handle partial read (last chunk or end of stream)
-		if readErr == io.ErrUnexpectedEOF || readErr == io.EOF {
-			if n == 0 {
-				break // No more data
+		n, err := io.ReadFull(reader, chunkData)
+		read += int64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w: it ended after %d of %d bytes", errMegaStreamSize, read, size)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read data: %w", err)
+		}
+
+		sum := sha256.Sum256(chunkData)
+		chunk := megaChunk{id: chunkID, data: chunkData, sum: hex.EncodeToString(sum[:])}
+		send, err := upload.send(chunkID, chunk.sum)
+		if err != nil {
+			return fmt.Errorf("chunk %d: %w", chunkID, err)
+		}
+		if !send {
+			skipped += int64(n)
+			if tracker != nil {
+				tracker.Update(int64(n))
 			}
-			// Truncate to actual size read
-			chunkData = chunkData[:n]
-		} else if readErr != nil {
-			return fmt.Errorf("failed to read data: %w", readErr)
+			continue
 		}
 
-		// Upload the chunk with exact size
-		err = upload.UploadChunk(chunkID, chunkData)
+		select {
+		case chunkChan <- chunk:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// Mega fixes the file size when the upload is created
+	if n, _ := reader.Read(make([]byte, 1)); n > 0 {
+		return fmt.Errorf("%w: it is longer than %d bytes", errMegaStreamSize, size)
+	}
+	if skipped > 0 {
+		m.logger.Infof("Skipped %d already uploaded bytes", skipped)
+	}
+	return nil
+}
+
+// DownloadStream downloads a file from Mega and writes it to writer
+func (m *MegaProvider) DownloadStream(ctx context.Context, key string, writer io.Writer, tracker progress.Tracker) error {
+	m.logger.Infof("Starting Mega download of %s", key)
+
+	node, err := m.findNode(key)
+	if err != nil {
+		return err
+	}
+
+	download, err := m.client.NewDownload(node)
+	if err != nil {
+		return fmt.Errorf("failed to create Mega download: %w", err)
+	}
+
+	// Download chunks in order so they can be streamed straight to the writer
+	for chunkID := 0; chunkID < download.Chunks(); chunkID++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		chunkData, err := download.DownloadChunk(chunkID)
 		if err != nil {
-			return fmt.Errorf("failed to upload chunk %d: %w", chunkID, err)
+			return fmt.Errorf("failed to download chunk %d: %w", chunkID, err)
+		}
+
+		if _, err := writer.Write(chunkData); err != nil {
+			return fmt.Errorf("failed to write chunk %d: %w", chunkID, err)
 		}
 
-		totalUploaded += int64(len(chunkData))
 		if tracker != nil {
 			tracker.Update(int64(len(chunkData)))
 		}
+	}
 
-		m.logger.Debugf("Uploaded chunk %d: %d bytes (position: %d, expected: %d)", 
-			chunkID, len(chunkData), position, expectedSize)
-
-		// If we read less than expected, we're done
-		if len(chunkData) < expectedSize {
-			break
-		}
+	// Finish verifies the MAC of the downloaded file
+	if err := download.Finish(); err != nil {
+		return fmt.Errorf("failed to finish Mega download: %w", err)
 	}
 
-	// Finish the upload
-	node, err := upload.Finish()
+	m.logger.Infof("Mega download completed successfully: %s (%d bytes)", node.GetName(), node.GetSize())
+	return nil
+}
+
+// RewritePrefix replaces the first oldLength bytes of key with prefix. Mega
+// cannot modify stored files, so the file is streamed into a new upload with
+// the new prefix, which moves the old file to the trash once it succeeds.
+func (m *MegaProvider) RewritePrefix(ctx context.Context, key string, oldLength int64, prefix []byte) error {
+	old, err := m.findNode(key)
 	if err != nil {
-		return fmt.Errorf("failed to finish Mega upload: %w", err)
+		return err
+	}
+	if oldLength > old.GetSize() {
+		return fmt.Errorf("file %s is shorter than its %d byte header", key, oldLength)
 	}
 
-	m.logger.Infof("Mega upload completed successfully: %s (%d bytes)", node.GetName(), totalUploaded)
-	
-	m.logger.Debug("Starting Mega client cleanup")
-	// Force cleanup of Mega client to prevent hanging
-	// The go-mega library doesn't provide a proper Close() method
-	// Set client to nil to release reference
-	m.client = nil
-	m.logger.Debug("Mega client set to nil")
-	
-	// Force cleanup with a small delay to allow any pending operations to complete
+	downloadReader, downloadWriter := io.Pipe()
 	go func() {
-		m.logger.Debug("Starting background cleanup goroutine")
-		time.Sleep(100 * time.Millisecond)
-		// Force garbage collection to clean up any remaining resources
-		// This is a workaround for the go-mega library's background goroutines
-		m.logger.Debug("Background cleanup goroutine completed")
+		downloadWriter.CloseWithError(m.DownloadStream(ctx, key, downloadWriter, nil))
 	}()
-	
-	m.logger.Debug("Returning from UploadStream")
+	defer downloadReader.Close()
+
+	if _, err := io.CopyN(io.Discard, downloadReader, oldLength); err != nil {
+		return fmt.Errorf("failed to skip old header: %w", err)
+	}
+
+	size := old.GetSize() - oldLength + int64(len(prefix))
+	reader := io.MultiReader(bytes.NewReader(prefix), downloadReader)
+	if _, _, err := m.uploadNode(ctx, key, reader, size, nil); err != nil {
+		return err
+	}
+
+	m.logger.Infof("Rewrote header of %s in Mega; the previous version was moved to the trash", key)
 	return nil
 }
 
-// CheckResumability checks if an upload can be resumed (Mega doesn't support resumable uploads in this implementation)
-func (m *MegaProvider) CheckResumability(ctx context.Context) (ResumableUpload, error) {
-	// Mega API supports resumable uploads, but for simplicity we'll return nil
-	// In a full implementation, you would implement the resumable upload protocol
-	return nil, nil
+// Stat returns information about a file stored in Mega
+func (m *MegaProvider) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	node, err := m.findNode(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Mega nodes carry no user metadata; the node handle identifies the file
+	return &ObjectInfo{
+		Key:          key,
+		Size:         node.GetSize(),
+		LastModified: node.GetTimeStamp(),
+		ETag:         node.GetHash(),
+	}, nil
+}
+
+// List walks the Mega filesystem tree and returns files whose paths start with prefix
+func (m *MegaProvider) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	root := m.client.FS.GetRoot()
+	if root == nil {
+		return nil, fmt.Errorf("failed to get Mega root directory")
+	}
+
+	var objects []ObjectInfo
+	if err := m.walk(ctx, root, "", prefix, &objects); err != nil {
+		return nil, err
+	}
+
+	return objects, nil
+}
+
+// walk recursively collects files below node, using "/"-separated paths relative to the root
+func (m *MegaProvider) walk(ctx context.Context, node *mega.Node, dir, prefix string, objects *[]ObjectInfo) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	children, err := m.client.FS.GetChildren(node)
+	if err != nil {
+		return fmt.Errorf("failed to list Mega directory %s: %w", dir, err)
+	}
+
+	for _, child := range children {
+		path := dir + child.GetName()
+
+		switch child.GetType() {
+		case mega.FOLDER:
+			// Only descend into folders that can still contain matching paths
+			folder := path + "/"
+			if strings.HasPrefix(folder, prefix) || strings.HasPrefix(prefix, folder) {
+				if err := m.walk(ctx, child, folder, prefix, objects); err != nil {
+					return err
+				}
+			}
+		case mega.FILE:
+			if strings.HasPrefix(path, prefix) {
+				// Mega nodes carry no tags, so cloud_safe archives cannot be told apart
+				*objects = append(*objects, ObjectInfo{
+					Key:          path,
+					Size:         child.GetSize(),
+					LastModified: child.GetTimeStamp(),
+					ETag:         child.GetHash(),
+				})
+			}
+		}
+	}
+
+	return nil
 }
 
-// megaProgressReader wraps an io.Reader to track progress for Mega uploads
-type megaProgressReader struct {
-	reader  io.Reader
-	tracker progress.Tracker
+// findNode looks up the file stored under key, a "/"-separated path from the
+// Mega root directory as List returns it
+func (m *MegaProvider) findNode(key string) (*mega.Node, error) {
+	root := m.client.FS.GetRoot()
+	if root == nil {
+		return nil, fmt.Errorf("failed to get Mega root directory")
+	}
+
+	node := root
+	names := strings.Split(key, "/")
+	for i, name := range names {
+		kind := mega.FOLDER
+		if i == len(names)-1 {
+			kind = mega.FILE
+		}
+		child, err := m.child(node, name, kind)
+		if err != nil {
+			return nil, err
+		}
+		if child == nil {
+			return nil, fmt.Errorf("file %s not found in Mega", key)
+		}
+		node = child
+	}
+	return node, nil
 }
 
-func (mpr *megaProgressReader) Read(p []byte) (n int, err error) {
-	n, err = mpr.reader.Read(p)
-	if n > 0 && mpr.tracker != nil {
-		mpr.tracker.Update(int64(n))
+// makeFolders returns the folder a file stored under key belongs in, creating
+// the folders of a "/"-separated key that do not exist yet, and the name of
+// the file in it
+func (m *MegaProvider) makeFolders(key string) (*mega.Node, string, error) {
+	folder := m.client.FS.GetRoot()
+	if folder == nil {
+		return nil, "", fmt.Errorf("failed to get Mega root directory")
 	}
-	return n, err
+
+	names := strings.Split(key, "/")
+	for _, name := range names[:len(names)-1] {
+		child, err := m.child(folder, name, mega.FOLDER)
+		if err != nil {
+			return nil, "", err
+		}
+		if child == nil {
+			if child, err = m.client.CreateDir(name, folder); err != nil {
+				return nil, "", fmt.Errorf("failed to create Mega folder %s: %w", name, err)
+			}
+		}
+		folder = child
+	}
+	return folder, names[len(names)-1], nil
+}
+
+// child returns the newest child of folder called name of the given node
+// type, or nil if there is none
+func (m *MegaProvider) child(folder *mega.Node, name string, kind int) (*mega.Node, error) {
+	children, err := m.client.FS.GetChildren(folder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Mega folder %s: %w", folder.GetName(), err)
+	}
+
+	// Uploads replace files of the same name, but older uploads may have
+	// left several; the newest is the one stored under the name
+	var found *mega.Node
+	for _, child := range children {
+		if child.GetType() == kind && child.GetName() == name &&
+			(found == nil || !child.GetTimeStamp().Before(found.GetTimeStamp())) {
+			found = child
+		}
+	}
+	return found, nil
+}
+
+// statePath returns the local file the upload of the configured file is recorded in
+func (m *MegaProvider) statePath() string {
+	return StatePath(m.config.StateDir, "mega", "mega://"+m.config.Filename)
+}
+
+// CheckResumability returns the interrupted upload of the configured file
+// recorded in the local state file. Mega cannot be asked which chunks of an
+// upload it holds, so the recorded ones are trusted; if Mega no longer
+// accepts the upload, Resume fails and forgets it.
+func (m *MegaProvider) CheckResumability(ctx context.Context) (ResumableUpload, error) {
+	if !m.config.Resume {
+		return nil, nil
+	}
+
+	var state megaUploadState
+	found, err := LoadState(m.statePath(), &state)
+	if err != nil || !found {
+		return nil, err
+	}
+	if state.Key != m.config.Filename {
+		return nil, fmt.Errorf("upload state %s belongs to %s", m.statePath(), state.Key)
+	}
+
+	m.logger.Infof("Found resumable Mega upload of %s (%d of %d bytes uploaded)", state.Key, megaStoredSize(&state), state.Size)
+	return &megaResumableUpload{provider: m, state: state}, nil
 }
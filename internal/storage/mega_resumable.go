@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+	"github.com/seriousconsult/cloud_safe/internal/progress"
+	mega "github.com/seriousconsult/cloud_safe/third_party/go-mega"
+)
+
+// errMegaStreamSize is returned when a stream is not as long as the Mega
+// upload it is sent to was created for
+var errMegaStreamSize = errors.New("the stream does not have the size the Mega upload was created for")
+
+// errMegaRejected is returned when Mega refuses to complete an upload
+var errMegaRejected = errors.New("Mega rejected the upload")
+
+// megaUploadState is the local record of a Mega upload, saved as chunks are
+// sent so the upload can be finished by a later run. Mega keeps the chunks
+// posted to an upload URL, but the file key and the chunk MACs that the file
+// is created with only exist on the uploading side.
+type megaUploadState struct {
+	Key       string `json:"key"`
+	Size      int64  `json:"size"`
+	UploadURL string `json:"upload_url"`
+	// FileKey is the key go-mega generated for the file
+	FileKey []uint32 `json:"file_key"`
+	// Chunks holds the chunks Mega stored, by chunk ID
+	Chunks map[int]megaChunkState `json:"chunks"`
+	// Sent holds the SHA-256 of every chunk being sent, saved before it is
+	// sent: Mega may have stored it even if the upload was interrupted
+	Sent map[int]string `json:"sent,omitempty"`
+	// CompletionHandle is returned by Mega once it has received every chunk
+	CompletionHandle string    `json:"completion_handle,omitempty"`
+	Created          time.Time `json:"created"`
+}
+
+// megaChunkState records a chunk Mega stored
+type megaChunkState struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	MAC    []byte `json:"mac"`
+}
+
+// megaUpload is a Mega upload into folder and, when statePath is set, the
+// local record that lets a later run finish it
+type megaUpload struct {
+	upload    *mega.Upload
+	folder    *mega.Node
+	statePath string
+	logger    *logger.Logger
+	mutex     sync.Mutex
+	state     megaUploadState
+}
+
+// newMegaUpload wraps upload into folder, recorded in state
+func newMegaUpload(upload *mega.Upload, folder *mega.Node, state megaUploadState, statePath string, log *logger.Logger) *megaUpload {
+	if state.Chunks == nil {
+		state.Chunks = make(map[int]megaChunkState)
+	}
+	if state.Sent == nil {
+		state.Sent = make(map[int]string)
+	}
+	return &megaUpload{
+		upload:    upload,
+		folder:    folder,
+		statePath: statePath,
+		logger:    log,
+		state:     state,
+	}
+}
+
+// startUpload creates an upload of size bytes as file name in folder, stored
+// under key. Progress is recorded in statePath when it is not empty.
+func (m *MegaProvider) startUpload(folder *mega.Node, name, key string, size int64, statePath string) (*megaUpload, error) {
+	upload, err := m.client.NewUpload(folder, name, size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Mega upload: %w", err)
+	}
+
+	started := upload.State()
+	u := newMegaUpload(upload, folder, megaUploadState{
+		Key:       key,
+		Size:      size,
+		UploadURL: started.URL,
+		FileKey:   started.Key,
+		Created:   time.Now().UTC(),
+	}, statePath, m.logger)
+	if err := u.saveState(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// restoreUpload recreates the interrupted upload recorded in state as file
+// name in folder
+func (m *MegaProvider) restoreUpload(folder *mega.Node, name string, state megaUploadState, statePath string) (*megaUpload, error) {
+	macs := make(map[int][]byte, len(state.Chunks))
+	for id, chunk := range state.Chunks {
+		macs[id] = chunk.MAC
+	}
+
+	upload, err := m.client.ResumeUpload(folder, name, state.Size, mega.UploadState{
+		URL:              state.UploadURL,
+		Key:              state.FileKey,
+		ChunkMACs:        macs,
+		CompletionHandle: []byte(state.CompletionHandle),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore Mega upload: %w", err)
+	}
+	return newMegaUpload(upload, folder, state, statePath, m.logger), nil
+}
+
+// send reports whether the chunk id with the SHA-256 sum has to be sent, and
+// records that it is being sent first. A chunk already stored or sent with
+// another sum means the stream has changed.
+func (u *megaUpload) send(id int, sum string) (bool, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if chunk, ok := u.state.Chunks[id]; ok {
+		if chunk.SHA256 != sum {
+			return false, ErrStreamChanged
+		}
+		return false, nil
+	}
+	if sent, ok := u.state.Sent[id]; ok && sent != sum {
+		return false, ErrStreamChanged
+	}
+
+	if u.statePath == "" {
+		return true, nil
+	}
+	u.state.Sent[id] = sum
+	if err := u.saveState(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// record adds the uploaded chunk id to the state file along with the MAC
+// go-mega computed for it
+func (u *megaUpload) record(id int, size int64, sum string) {
+	if u.statePath == "" {
+		return
+	}
+	mac := u.upload.ChunkMAC(id)
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.state.Chunks[id] = megaChunkState{Size: size, SHA256: sum, MAC: mac}
+	delete(u.state.Sent, id)
+	if err := u.saveState(); err != nil {
+		u.logger.Errorf("Failed to save upload state: %v", err)
+	}
+}
+
+// complete checks and records the completion handle Mega returned once it
+// received every chunk. It must be called after all chunks were uploaded.
+func (u *megaUpload) complete() error {
+	handle := string(u.upload.CompletionHandle())
+
+	// Mega answers with a negative error code instead of a handle
+	if code, err := strconv.Atoi(handle); err == nil && code < 0 {
+		return fmt.Errorf("%w with error %d", errMegaRejected, code)
+	}
+	if handle == "" {
+		return fmt.Errorf("Mega did not complete the upload after the last chunk")
+	}
+
+	if u.statePath != "" {
+		u.state.CompletionHandle = handle
+		if err := u.saveState(); err != nil {
+			u.logger.Errorf("Failed to save upload state: %v", err)
+		}
+	}
+	return nil
+}
+
+// uploadedSize returns the number of bytes in the chunks Mega stored
+func (u *megaUpload) uploadedSize() int64 {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return megaStoredSize(&u.state)
+}
+
+// megaStoredSize returns the number of bytes in the chunks recorded in state
+func megaStoredSize(state *megaUploadState) int64 {
+	var size int64
+	for _, chunk := range state.Chunks {
+		size += chunk.Size
+	}
+	return size
+}
+
+// saveState writes the upload state file
+func (u *megaUpload) saveState() error {
+	if u.statePath == "" {
+		return nil
+	}
+	return SaveState(u.statePath, &u.state)
+}
+
+// removeState deletes the upload state file once it is no longer needed
+func (u *megaUpload) removeState() {
+	if u.statePath == "" {
+		return
+	}
+	if err := RemoveState(u.statePath); err != nil {
+		u.logger.Errorf("%v", err)
+	}
+}
+
+// megaResumableUpload is an interrupted Mega upload and implements ResumableUpload
+type megaResumableUpload struct {
+	provider *MegaProvider
+	state    megaUploadState
+}
+
+// Resume finishes the interrupted upload (implements ResumableUpload interface).
+// reader must supply the whole stream again; the chunks Mega already stored
+// are checked and skipped. If the stream differs from the chunks sent before,
+// the upload is aborted and the error wraps ErrStreamChanged.
+func (r *megaResumableUpload) Resume(ctx context.Context, reader io.Reader, tracker progress.Tracker) error {
+	m := r.provider
+	m.logger.Infof("Resuming Mega upload of %s (%d bytes already uploaded)", r.state.Key, r.GetUploadedSize())
+
+	err := m.resumeNode(ctx, r.state, reader, tracker)
+	if errors.Is(err, errMegaStreamSize) && !errors.Is(err, ErrStreamChanged) {
+		err = fmt.Errorf("%w: %w", ErrStreamChanged, err)
+	}
+	if errors.Is(err, ErrStreamChanged) {
+		if abortErr := r.Abort(ctx); abortErr != nil {
+			m.logger.Errorf("Failed to abort interrupted Mega upload: %v", abortErr)
+		}
+	}
+	return err
+}
+
+// Abort forgets the interrupted upload. Mega offers no request to cancel an
+// upload, so only the local record is removed.
+func (r *megaResumableUpload) Abort(ctx context.Context) error {
+	r.provider.logger.Infof("Abandoning interrupted Mega upload of %s", r.state.Key)
+	return RemoveState(r.provider.statePath())
+}
+
+// GetUploadedSize returns the amount of data already uploaded
+func (r *megaResumableUpload) GetUploadedSize() int64 {
+	return megaStoredSize(&r.state)
+}
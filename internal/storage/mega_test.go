@@ -0,0 +1,428 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+	mega "github.com/seriousconsult/cloud_safe/third_party/go-mega"
+)
+
+// The account megaServer serves
+const (
+	megaTestUser     = "user@example.com"
+	megaTestPassword = "password"
+)
+
+// megaTestRSAKey is the RSA key of the account, which the session ID is
+// encrypted to at login
+var megaTestRSAKey = sync.OnceValue(func() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		panic(err)
+	}
+	return key
+})
+
+// megaServer serves the Mega API for one account: login, the filesystem,
+// uploads, downloads and moving files. Node keys and attributes are kept as
+// the client encrypted them.
+type megaServer struct {
+	testServer
+	masterKey []byte
+	salt      []byte
+	// nodes holds the filesystem in the order the nodes were created
+	nodes []mega.FSNode
+	// files holds the encrypted content of every file by node handle
+	files   map[string][]byte
+	uploads []*megaServerUpload
+	// failOffset, when positive, is a chunk offset the upload URLs reject
+	failOffset int64
+	received   []int64
+	polled     bool
+}
+
+// megaServerUpload is an upload created on a megaServer
+type megaServerUpload struct {
+	size   int64
+	chunks map[int64][]byte
+}
+
+func newMegaServer(t *testing.T) *megaServer {
+	server := &megaServer{
+		masterKey: bytes.Repeat([]byte{1}, 16),
+		salt:      bytes.Repeat([]byte{2}, 16),
+		nodes: []mega.FSNode{
+			{Hash: "root", T: mega.ROOT},
+			{Hash: "trash", T: mega.TRASH},
+		},
+		files: make(map[string][]byte),
+	}
+	server.start(t, server.serve)
+	return server
+}
+
+// newTestMegaProvider returns a provider logged in to server
+func newTestMegaProvider(t *testing.T, server *megaServer, cfg *MegaConfig) *MegaProvider {
+	t.Helper()
+	client := mega.New()
+	client.SetAPIUrl(server.URL)
+	if err := client.Login(megaTestUser, megaTestPassword); err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+	client.SetRetries(0)
+	client.SetLogger(nil)
+	return &MegaProvider{client: client, config: cfg, logger: logger.New(false).Quiet()}
+}
+
+func (s *megaServer) serve(w http.ResponseWriter, r *http.Request, body []byte) {
+	switch path := r.URL.Path; {
+	case path == "/cs":
+		var request [1]json.RawMessage
+		var command struct {
+			Cmd string `json:"a"`
+		}
+		if json.Unmarshal(body, &request) != nil || json.Unmarshal(request[0], &command) != nil {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		response, err := s.command(command.Cmd, request[0])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode([]interface{}{response})
+	case path == "/sc":
+		// Answer the first poll with a wait URL, which the login waits
+		// for, and drop the connection of the others so the client
+		// backs off
+		if s.polled {
+			if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+				conn.Close()
+			}
+			return
+		}
+		s.polled = true
+		fmt.Fprintf(w, `{"w":"%s/wait","sn":"1"}`, s.URL)
+	case path == "/wait":
+	case strings.HasPrefix(path, "/ul/"):
+		s.uploadChunk(w, path, body)
+	case strings.HasPrefix(path, "/dl/"):
+		handle, chunk, _ := strings.Cut(strings.TrimPrefix(path, "/dl/"), "/")
+		var first, last int64
+		if _, err := fmt.Sscanf(chunk, "%d-%d", &first, &last); err != nil {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		w.Write(s.files[handle][first : last+1])
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+// command answers an API command
+func (s *megaServer) command(cmd string, request json.RawMessage) (interface{}, error) {
+	switch cmd {
+	case "us0":
+		return mega.PreloginResp{Version: 2, Salt: megaBase64(s.salt)}, nil
+	case "us":
+		return s.login()
+	case "f":
+		return mega.FilesResp{F: s.nodes, Sn: "1"}, nil
+	case "u":
+		var msg mega.UploadMsg
+		json.Unmarshal(request, &msg)
+		s.uploads = append(s.uploads, &megaServerUpload{size: msg.S, chunks: make(map[int64][]byte)})
+		return mega.UploadResp{P: fmt.Sprintf("%s/ul/%d", s.URL, len(s.uploads)-1)}, nil
+	case "p":
+		var msg mega.UploadCompleteMsg
+		json.Unmarshal(request, &msg)
+		node := mega.FSNode{
+			Hash:   fmt.Sprintf("node%d", len(s.nodes)),
+			Parent: msg.T,
+			User:   "user",
+			T:      msg.N[0].T,
+			Attr:   msg.N[0].A,
+			Key:    "user:" + msg.N[0].K,
+			Ts:     time.Now().Unix(),
+		}
+		if node.T == mega.FILE {
+			var upload int
+			if _, err := fmt.Sscanf(msg.N[0].H, "upload%d", &upload); err != nil || upload >= len(s.uploads) {
+				return nil, fmt.Errorf("unknown completion handle %q", msg.N[0].H)
+			}
+			s.files[node.Hash] = s.uploads[upload].data()
+			node.Sz = int64(len(s.files[node.Hash]))
+		}
+		s.nodes = append(s.nodes, node)
+		return mega.UploadCompleteResp{F: []mega.FSNode{node}}, nil
+	case "g":
+		var msg mega.DownloadMsg
+		json.Unmarshal(request, &msg)
+		node := s.node(msg.N)
+		if node == nil {
+			return -9, nil
+		}
+		return mega.DownloadResp{G: s.URL + "/dl/" + node.Hash, Size: uint64(node.Sz), Attr: node.Attr}, nil
+	case "m":
+		var msg mega.MoveFileMsg
+		json.Unmarshal(request, &msg)
+		if node := s.node(msg.N); node != nil {
+			node.Parent = msg.T
+		}
+		return 0, nil
+	}
+	return nil, fmt.Errorf("unexpected command %q", cmd)
+}
+
+// login answers a login with the master key, encrypted with the key derived
+// from the password, and a session ID encrypted to the account's RSA key
+func (s *megaServer) login() (interface{}, error) {
+	passwordKey := pbkdf2.Key([]byte(megaTestPassword), s.salt, 100000, 32, sha512.New)[:16]
+	key := megaEncrypt(passwordKey, s.masterKey)
+
+	rsaKey := megaTestRSAKey()
+	privateKey := append(megaMPI(rsaKey.Primes[0]), megaMPI(rsaKey.Primes[1])...)
+	privateKey = append(privateKey, megaMPI(rsaKey.D)...)
+	privateKey = append(privateKey, megaMPI(rsaKey.Precomputed.Qinv)...)
+	privateKey = append(privateKey, make([]byte, 15-(len(privateKey)+15)%16)...)
+
+	sessionID := new(big.Int).SetBytes(bytes.Repeat([]byte{3}, 64))
+	encryptedID := new(big.Int).Exp(sessionID, big.NewInt(int64(rsaKey.E)), rsaKey.N)
+
+	return mega.LoginResp{
+		Key:   megaBase64(key),
+		Privk: megaBase64(megaEncrypt(s.masterKey, privateKey)),
+		Csid:  megaBase64(megaMPI(encryptedID)),
+	}, nil
+}
+
+// uploadChunk stores a chunk posted to an upload URL, and answers the last
+// chunk of an upload with its completion handle
+func (s *megaServer) uploadChunk(w http.ResponseWriter, path string, body []byte) {
+	var upload int
+	var offset int64
+	if _, err := fmt.Sscanf(path, "/ul/%d/%d", &upload, &offset); err != nil || upload >= len(s.uploads) {
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+	if s.failOffset > 0 && offset == s.failOffset {
+		http.Error(w, "interrupted", http.StatusServiceUnavailable)
+		return
+	}
+	s.uploads[upload].chunks[offset] = body
+	s.received = append(s.received, offset)
+
+	if int64(len(s.uploads[upload].data())) == s.uploads[upload].size {
+		fmt.Fprintf(w, "upload%d", upload)
+	}
+}
+
+// data returns the chunks of the upload in order
+func (u *megaServerUpload) data() []byte {
+	offsets := make([]int64, 0, len(u.chunks))
+	for offset := range u.chunks {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	var data []byte
+	for _, offset := range offsets {
+		data = append(data, u.chunks[offset]...)
+	}
+	return data
+}
+
+// node returns the node with handle, or nil
+func (s *megaServer) node(handle string) *mega.FSNode {
+	for i := range s.nodes {
+		if s.nodes[i].Hash == handle {
+			return &s.nodes[i]
+		}
+	}
+	return nil
+}
+
+// reset forgets the chunk offsets received so far and returns them in order
+func (s *megaServer) reset() []int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	received := s.received
+	s.received = nil
+	sort.Slice(received, func(i, j int) bool { return received[i] < received[j] })
+	return received
+}
+
+// setFailOffset makes the upload URLs reject the chunk at offset, or accept
+// every chunk when it is 0
+func (s *megaServer) setFailOffset(offset int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failOffset = offset
+}
+
+// megaBase64 encodes data the way the Mega API does
+func megaBase64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// megaEncrypt encrypts data, a multiple of the AES block size, block by block with key
+func megaEncrypt(key, data []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	encrypted := make([]byte, len(data))
+	for i := 0; i < len(data); i += aes.BlockSize {
+		block.Encrypt(encrypted[i:], data[i:])
+	}
+	return encrypted
+}
+
+// megaMPI encodes n as an MPI: its length in bits followed by its bytes
+func megaMPI(n *big.Int) []byte {
+	return append([]byte{byte(n.BitLen() >> 8), byte(n.BitLen())}, n.Bytes()...)
+}
+
+func TestMegaResume(t *testing.T) {
+	// Mega uploads this in chunks of 128, 256, 384 and 512 KiB and a last one of 256 KiB
+	stream := randomStream(1536 * 1024)
+	offsets := []int64{0, 128 * 1024, 384 * 1024, 768 * 1024, 1280 * 1024}
+
+	changed := func(offset int) []byte {
+		data := append([]byte{}, stream...)
+		data[offset] ^= 1
+		return data
+	}
+
+	tests := []struct {
+		name   string
+		resume []byte
+		// want lists the offsets of the chunks the resumed upload sends
+		want []int64
+		// refused is set when the stream differs from what was sent
+		refused bool
+	}{
+		{name: "same stream", resume: stream, want: offsets[2:]},
+		{name: "stored chunk differs", resume: changed(200 * 1024), refused: true},
+		// The interrupted upload sent this chunk before Mega rejected it
+		{name: "interrupted chunk differs", resume: changed(500 * 1024), refused: true},
+		{name: "chunk after the sent ones differs", resume: changed(1400 * 1024), want: offsets[2:]},
+		{name: "shorter stream", resume: stream[:len(stream)-1], refused: true},
+		{name: "longer stream", resume: append(append([]byte{}, stream...), 0), refused: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			server := newMegaServer(t)
+			provider := newTestMegaProvider(t, server, &MegaConfig{Filename: "backups/backup.tar", Workers: 1, Resume: true, StateDir: t.TempDir()})
+
+			// The first run stores two chunks before Mega rejects the third
+			server.setFailOffset(offsets[2])
+			if err := provider.UploadStream(ctx, bytes.NewReader(stream), int64(len(stream)), nil); err == nil {
+				t.Fatal("UploadStream() of an interrupted upload succeeded")
+			}
+			if got := server.reset(); !reflect.DeepEqual(got, offsets[:2]) {
+				t.Fatalf("interrupted upload sent chunks at %v, want %v", got, offsets[:2])
+			}
+			server.setFailOffset(0)
+
+			resumable, err := provider.CheckResumability(ctx)
+			if err != nil || resumable == nil {
+				t.Fatalf("CheckResumability() = %v, %v", resumable, err)
+			}
+			if got := resumable.GetUploadedSize(); got != offsets[2] {
+				t.Fatalf("GetUploadedSize() = %d, want %d", got, offsets[2])
+			}
+
+			err = resumable.Resume(ctx, bytes.NewReader(tt.resume), nil)
+			if tt.refused {
+				if !errors.Is(err, ErrStreamChanged) {
+					t.Fatalf("Resume() error = %v, want ErrStreamChanged", err)
+				}
+				// The upload is abandoned so its file key encrypts nothing else
+				if resumable, err := provider.CheckResumability(ctx); resumable != nil || err != nil {
+					t.Errorf("CheckResumability() after a refused resume = %v, %v", resumable, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resume() error = %v", err)
+			}
+			if got := server.reset(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resumed upload sent chunks at %v, want %v", got, tt.want)
+			}
+			if resumable, err := provider.CheckResumability(ctx); resumable != nil || err != nil {
+				t.Errorf("CheckResumability() after the upload = %v, %v", resumable, err)
+			}
+
+			// Downloading checks the MAC the file was created with
+			var downloaded bytes.Buffer
+			if err := provider.DownloadStream(ctx, "backups/backup.tar", &downloaded, nil); err != nil {
+				t.Fatalf("DownloadStream() error = %v", err)
+			}
+			if !bytes.Equal(downloaded.Bytes(), tt.resume) {
+				t.Error("resumed upload stored other data than the stream")
+			}
+		})
+	}
+}
+
+func TestMegaPutObjectReplaces(t *testing.T) {
+	ctx := context.Background()
+	server := newMegaServer(t)
+	provider := newTestMegaProvider(t, server, &MegaConfig{Workers: 2})
+
+	for _, data := range []string{"first version", "second version"} {
+		if err := provider.PutObject(ctx, "repository/config", strings.NewReader(data), int64(len(data)), nil); err != nil {
+			t.Fatalf("PutObject(%q) error = %v", data, err)
+		}
+	}
+
+	var downloaded bytes.Buffer
+	if err := provider.DownloadStream(ctx, "repository/config", &downloaded, nil); err != nil {
+		t.Fatalf("DownloadStream() error = %v", err)
+	}
+	if got := downloaded.String(); got != "second version" {
+		t.Errorf("DownloadStream() = %q, want the second version", got)
+	}
+
+	objects, err := provider.List(ctx, "repository/")
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(objects) != 1 {
+		t.Errorf("List() = %v, want only the second version", objects)
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	trashed := 0
+	for _, node := range server.nodes {
+		if node.Parent == "trash" {
+			trashed++
+		}
+	}
+	if trashed != 1 {
+		t.Errorf("%d files were moved to the trash, want the first version", trashed)
+	}
+}
@@ -1,9 +1,12 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/seriousconsult/cloud_safe/internal/logger"
@@ -16,6 +19,7 @@ import (
 // MinIOProvider implements the StorageProvider interface for MinIO
 type MinIOProvider struct {
 	client *minio.Client
+	core   *minio.Core
 	config *MinIOConfig
 	logger *logger.Logger
 }
@@ -51,6 +55,7 @@ func NewMinIOProvider(cfg *MinIOConfig, logger *logger.Logger) (*MinIOProvider,
 
 	return &MinIOProvider{
 		client: client,
+		core:   &minio.Core{Client: client},
 		config: cfg,
 		logger: logger,
 	}, nil
@@ -81,10 +86,52 @@ func (m *MinIOProvider) ValidateConfig() error {
 	return nil
 }
 
-// UploadStream uploads data from a reader to MinIO
+// UploadStream uploads data from a reader to MinIO. With resume enabled the
+// parts are tracked in a local state file so an interrupted upload can be
+// continued; otherwise PutObject streams the parts itself.
 func (m *MinIOProvider) UploadStream(ctx context.Context, reader io.Reader, size int64, tracker progress.Tracker) error {
-	m.logger.Infof("Starting MinIO upload to %s/%s (size: %d bytes)", m.config.Bucket, m.config.Key, size)
+	m.logger.Infof("Starting MinIO upload to %s/%s (estimated size: %d bytes)", m.config.Bucket, m.config.Key, size)
 
+	partSize := s3PartSize(m.config.ChunkSize, size)
+	if partSize != m.config.ChunkSize {
+		m.logger.Infof("Using %d byte parts to stay within the %d part limit", partSize, s3MaxParts)
+	}
+
+	if m.config.Resume {
+		return m.uploadMultipart(ctx, reader, partSize, tracker)
+	}
+
+	// The size is only an estimate taken before compression, so the stream
+	// is uploaded as one of unknown length
+	return m.putObject(ctx, m.config.Key, reader, -1, partSize, tracker)
+}
+
+// PutObject uploads exactly size bytes from reader to key
+func (m *MinIOProvider) PutObject(ctx context.Context, key string, reader io.Reader, size int64, tracker progress.Tracker) error {
+	m.logger.Infof("Starting MinIO upload to %s/%s (size: %d bytes)", m.config.Bucket, key, size)
+	return m.putObject(ctx, key, reader, size, s3PartSize(m.config.ChunkSize, size), tracker)
+}
+
+// WithKey returns a provider sharing the client of m that uploads streams to key
+func (m *MinIOProvider) WithKey(key string) StorageProvider {
+	cfg := *m.config
+	cfg.Key = key
+	provider := *m
+	provider.config = &cfg
+	return &provider
+}
+
+// DeleteObject deletes the object stored under key
+func (m *MinIOProvider) DeleteObject(ctx context.Context, key string) error {
+	if err := m.client.RemoveObject(ctx, m.config.Bucket, key, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("failed to delete %s from MinIO: %w", key, err)
+	}
+	return nil
+}
+
+// putObject uploads reader to key with PutObject, which streams the parts
+// itself; size is -1 when it is not known
+func (m *MinIOProvider) putObject(ctx context.Context, key string, reader io.Reader, size, partSize int64, tracker progress.Tracker) error {
 	// Create progress reader if tracker is provided
 	var finalReader io.Reader = reader
 	if tracker != nil {
@@ -94,12 +141,19 @@ func (m *MinIOProvider) UploadStream(ctx context.Context, reader io.Reader, size
 		}
 	}
 
-	// Use PutObject which automatically handles multipart for large files
+	workers := m.config.Workers
+	if workers < 1 {
+		workers = 1
+	}
 	opts := minio.PutObjectOptions{
-		ContentType: "application/octet-stream",
+		ContentType:           "application/octet-stream",
+		UserTags:              map[string]string{CloudSafeTagKey: CloudSafeTagValue},
+		PartSize:              uint64(partSize),
+		NumThreads:            uint(workers),
+		ConcurrentStreamParts: workers > 1,
 	}
 
-	info, err := m.client.PutObject(ctx, m.config.Bucket, m.config.Key, finalReader, size, opts)
+	info, err := m.client.PutObject(ctx, m.config.Bucket, key, finalReader, size, opts)
 	if err != nil {
 		return fmt.Errorf("failed to upload to MinIO: %w", err)
 	}
@@ -108,11 +162,334 @@ func (m *MinIOProvider) UploadStream(ctx context.Context, reader io.Reader, size
 	return nil
 }
 
-// CheckResumability checks if an upload can be resumed (MinIO doesn't support resumable uploads in this implementation)
+// uploadMultipart uploads the stream as a multipart upload recorded in the state file
+func (m *MinIOProvider) uploadMultipart(ctx context.Context, reader io.Reader, partSize int64, tracker progress.Tracker) error {
+	multipart, err := NewMinIOMultipartUpload(ctx, m.core, m.config.Bucket, m.config.Key, partSize, m.config.Workers, m.statePath(), m.logger, tracker)
+	if err != nil {
+		return err
+	}
+
+	if err := multipart.upload(ctx, reader); err != nil {
+		// Keep the parts for the next run
+		m.logger.Infof("Upload %s can be resumed by running the same command again", multipart.uploadID)
+		return err
+	}
+
+	return multipart.Complete(ctx)
+}
+
+// DownloadStream downloads an object from MinIO and writes it to writer
+func (m *MinIOProvider) DownloadStream(ctx context.Context, key string, writer io.Writer, tracker progress.Tracker) error {
+	m.logger.Infof("Starting MinIO download of %s/%s", m.config.Bucket, key)
+
+	object, err := m.client.GetObject(ctx, m.config.Bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get MinIO object %s: %w", key, err)
+	}
+	defer object.Close()
+
+	// Create progress reader if tracker is provided
+	var reader io.Reader = object
+	if tracker != nil {
+		reader = &minioProgressReader{
+			reader:  object,
+			tracker: tracker,
+		}
+	}
+
+	if _, err := io.Copy(writer, reader); err != nil {
+		return fmt.Errorf("failed to download from MinIO: %w", err)
+	}
+
+	m.logger.Info("MinIO download completed successfully")
+	return nil
+}
+
+// ReadRange returns a byte range of an object stored in MinIO
+func (m *MinIOProvider) ReadRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	m.logger.Debugf("Reading %s of %s/%s", httpRange(offset, length), m.config.Bucket, key)
+
+	opts := minio.GetObjectOptions{}
+	switch {
+	case length > 0:
+		if err := opts.SetRange(offset, offset+length-1); err != nil {
+			return nil, err
+		}
+	case offset > 0:
+		// An end of 0 reads to the end of the object
+		if err := opts.SetRange(offset, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	object, err := m.client.GetObject(ctx, m.config.Bucket, key, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get range of MinIO object %s: %w", key, err)
+	}
+	return &minioRangeReader{Object: object}, nil
+}
+
+// minioRangeReader reads a range of a MinIO object, which is only requested
+// on the first read. A range that starts at or past the end of the object
+// reads as empty.
+type minioRangeReader struct {
+	*minio.Object
+}
+
+func (r *minioRangeReader) Read(p []byte) (int, error) {
+	n, err := r.Object.Read(p)
+	if err != nil && minio.ToErrorResponse(err).StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return n, io.EOF
+	}
+	return n, err
+}
+
+// Stat returns information about an object stored in MinIO
+func (m *MinIOProvider) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	info, err := m.client.StatObject(ctx, m.config.Bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat MinIO object %s: %w", key, err)
+	}
+
+	return &ObjectInfo{
+		Key:          info.Key,
+		Size:         info.Size,
+		LastModified: info.LastModified,
+		ETag:         info.ETag,
+		Metadata:     info.UserMetadata,
+	}, nil
+}
+
+// List returns the objects in the bucket whose keys start with prefix
+func (m *MinIOProvider) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	// MinIO returns the tags of each object in the listing itself
+	for object := range m.client.ListObjects(ctx, m.config.Bucket, minio.ListObjectsOptions{
+		Prefix:       prefix,
+		Recursive:    true,
+		WithMetadata: true,
+	}) {
+		if object.Err != nil {
+			return nil, fmt.Errorf("failed to list MinIO objects: %w", object.Err)
+		}
+
+		objects = append(objects, ObjectInfo{
+			Key:          object.Key,
+			Size:         object.Size,
+			LastModified: object.LastModified,
+			ETag:         object.ETag,
+			// Objects uploaded by cloud_safe carry the Source=cloud_safe tag
+			CloudSafe: object.UserTags[CloudSafeTagKey] == CloudSafeTagValue,
+		})
+	}
+
+	return objects, nil
+}
+
+// minioMinPartSize is the smallest source ComposeObject accepts before the last one
+const minioMinPartSize = 5 * 1024 * 1024
+
+// RewritePrefix replaces the first oldLength bytes of key with prefix. The new
+// prefix and the following 5 MiB are uploaded as a temporary object, which is
+// then composed server-side with the rest of the original object.
+func (m *MinIOProvider) RewritePrefix(ctx context.Context, key string, oldLength int64, prefix []byte) error {
+	info, err := m.client.StatObject(ctx, m.config.Bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to stat MinIO object %s: %w", key, err)
+	}
+	if oldLength > info.Size {
+		return fmt.Errorf("object %s is shorter than its %d byte header", key, oldLength)
+	}
+
+	headEnd := oldLength + minioMinPartSize
+	if headEnd > info.Size {
+		headEnd = info.Size
+	}
+
+	// Read the payload that goes into the new first part
+	opts := minio.GetObjectOptions{}
+	if err := opts.SetMatchETag(info.ETag); err != nil {
+		return err
+	}
+	var head []byte
+	if headEnd > oldLength {
+		if err := opts.SetRange(oldLength, headEnd-1); err != nil {
+			return err
+		}
+		object, err := m.client.GetObject(ctx, m.config.Bucket, key, opts)
+		if err != nil {
+			return fmt.Errorf("failed to get MinIO object %s: %w", key, err)
+		}
+		head, err = io.ReadAll(object)
+		object.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read MinIO object %s: %w", key, err)
+		}
+	}
+	firstPart := append(append([]byte{}, prefix...), head...)
+
+	putOpts := minio.PutObjectOptions{
+		ContentType:  "application/octet-stream",
+		UserMetadata: info.UserMetadata,
+		UserTags:     map[string]string{CloudSafeTagKey: CloudSafeTagValue},
+	}
+
+	// Small objects are simply rewritten
+	if headEnd == info.Size {
+		if _, err := m.client.PutObject(ctx, m.config.Bucket, key, bytes.NewReader(firstPart), int64(len(firstPart)), putOpts); err != nil {
+			return fmt.Errorf("failed to rewrite MinIO object %s: %w", key, err)
+		}
+		return nil
+	}
+
+	tempKey := key + ".rekey-tmp"
+	if _, err := m.client.PutObject(ctx, m.config.Bucket, tempKey, bytes.NewReader(firstPart), int64(len(firstPart)), putOpts); err != nil {
+		return fmt.Errorf("failed to upload MinIO object %s: %w", tempKey, err)
+	}
+	defer func() {
+		if err := m.client.RemoveObject(context.Background(), m.config.Bucket, tempKey, minio.RemoveObjectOptions{}); err != nil {
+			m.logger.Errorf("Failed to remove temporary MinIO object %s: %v", tempKey, err)
+		}
+	}()
+
+	dst := minio.CopyDestOptions{
+		Bucket:          m.config.Bucket,
+		Object:          key,
+		UserMetadata:    info.UserMetadata,
+		ReplaceMetadata: true,
+		UserTags:        map[string]string{CloudSafeTagKey: CloudSafeTagValue},
+		ReplaceTags:     true,
+	}
+	srcs := []minio.CopySrcOptions{
+		{Bucket: m.config.Bucket, Object: tempKey},
+		{
+			Bucket:     m.config.Bucket,
+			Object:     key,
+			MatchETag:  info.ETag,
+			MatchRange: true,
+			Start:      headEnd,
+			End:        info.Size - 1,
+		},
+	}
+	if _, err := m.client.ComposeObject(ctx, dst, srcs...); err != nil {
+		return fmt.Errorf("failed to compose MinIO object %s: %w", key, err)
+	}
+
+	m.logger.Infof("Rewrote header of %s/%s server-side", m.config.Bucket, key)
+	return nil
+}
+
+// statePath returns the local file the multipart upload of the configured key is recorded in
+func (m *MinIOProvider) statePath() string {
+	return StatePath(m.config.StateDir, "minio", "minio://"+m.config.Endpoint+"/"+m.config.Bucket+"/"+m.config.Key)
+}
+
+// CheckResumability returns the interrupted multipart upload recorded in the
+// local state file, after checking with the server that the upload is still
+// incomplete and which of its parts it holds
 func (m *MinIOProvider) CheckResumability(ctx context.Context) (ResumableUpload, error) {
-	// MinIO supports multipart uploads but for simplicity we'll return nil
-	// since PutObject handles multipart automatically
-	return nil, nil
+	if !m.config.Resume {
+		return nil, nil
+	}
+
+	var state multipartState
+	found, err := LoadState(m.statePath(), &state)
+	if err != nil {
+		return nil, err
+	}
+
+	incomplete, err := m.incompleteUploads(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !found {
+		// Uploads without local state cannot be resumed and keep costing storage
+		for _, uploadID := range incomplete {
+			m.logger.Infof("Multipart upload %s for %s has no local state and cannot be resumed", uploadID, m.config.Key)
+		}
+		return nil, nil
+	}
+	if state.Bucket != m.config.Bucket || state.Key != m.config.Key {
+		return nil, fmt.Errorf("upload state %s belongs to %s/%s", m.statePath(), state.Bucket, state.Key)
+	}
+
+	stillIncomplete := false
+	for _, uploadID := range incomplete {
+		stillIncomplete = stillIncomplete || uploadID == state.UploadID
+	}
+	if !stillIncomplete {
+		m.logger.Infof("Multipart upload %s no longer exists; starting a new upload", state.UploadID)
+		return nil, RemoveState(m.statePath())
+	}
+
+	serverParts, err := m.getExistingParts(ctx, state.UploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	multipart := &MinIOMultipartUpload{
+		core:     m.core,
+		bucket:   m.config.Bucket,
+		key:      m.config.Key,
+		uploadID: state.UploadID,
+		parts: &multipartParts{
+			partSize:  state.PartSize,
+			workers:   m.config.Workers,
+			statePath: m.statePath(),
+			logger:    m.logger,
+			state:     state,
+		},
+	}
+
+	// Only parts the server still has with the same size and ETag can be skipped.
+	// PutObjectPart returns the ETag without quotes but ListObjectParts keeps them.
+	multipart.parts.confirm(func(part multipartPart) bool {
+		server, ok := serverParts[part.Number]
+		return ok && server.Size == part.Size && strings.Trim(server.ETag, `"`) == strings.Trim(part.ETag, `"`)
+	})
+
+	m.logger.Infof("Found resumable upload: %s (%d parts, %d bytes)", state.UploadID, len(multipart.parts.state.Parts), multipart.GetUploadedSize())
+	return multipart, nil
+}
+
+// incompleteUploads returns the IDs of the incomplete multipart uploads for the configured key
+func (m *MinIOProvider) incompleteUploads(ctx context.Context) ([]string, error) {
+	var uploadIDs []string
+	for upload := range m.client.ListIncompleteUploads(ctx, m.config.Bucket, m.config.Key, true) {
+		if upload.Err != nil {
+			return nil, fmt.Errorf("failed to list incomplete uploads: %w", upload.Err)
+		}
+		if upload.Key == m.config.Key {
+			uploadIDs = append(uploadIDs, upload.UploadID)
+		}
+	}
+	return uploadIDs, nil
+}
+
+// getExistingParts retrieves the parts the server holds for an upload, by part number
+func (m *MinIOProvider) getExistingParts(ctx context.Context, uploadID string) (map[int32]minio.ObjectPart, error) {
+	parts := make(map[int32]minio.ObjectPart)
+	marker := 0
+	for {
+		result, err := m.core.ListObjectParts(ctx, m.config.Bucket, m.config.Key, uploadID, marker, 1000)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list parts: %w", err)
+		}
+
+		for _, part := range result.ObjectParts {
+			parts[int32(part.PartNumber)] = part
+		}
+
+		if !result.IsTruncated {
+			return parts, nil
+		}
+		marker = result.NextPartNumberMarker
+	}
 }
 
 // minioProgressReader wraps an io.Reader to provide progress tracking
@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+	"github.com/seriousconsult/cloud_safe/internal/progress"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// MinIOMultipartUpload handles MinIO multipart uploads and implements ResumableUpload
+type MinIOMultipartUpload struct {
+	core     *minio.Core
+	bucket   string
+	key      string
+	uploadID string
+	parts    *multipartParts
+}
+
+// NewMinIOMultipartUpload creates a new multipart upload. Progress is recorded
+// in statePath when it is not empty.
+func NewMinIOMultipartUpload(ctx context.Context, core *minio.Core, bucket, key string, partSize int64, workers int, statePath string, logger *logger.Logger, tracker progress.Tracker) (*MinIOMultipartUpload, error) {
+	uploadID, err := core.NewMultipartUpload(ctx, bucket, key, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+		UserTags:    map[string]string{CloudSafeTagKey: CloudSafeTagValue},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+
+	logger.Infof("Created multipart upload: %s", uploadID)
+
+	parts, err := newMultipartParts(bucket, key, uploadID, partSize, workers, statePath, logger, tracker)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MinIOMultipartUpload{
+		core:     core,
+		bucket:   bucket,
+		key:      key,
+		uploadID: uploadID,
+		parts:    parts,
+	}, nil
+}
+
+// UploadPart uploads data as part partNumber and records it in the state file
+func (m *MinIOMultipartUpload) UploadPart(ctx context.Context, partNumber int32, data []byte) error {
+	part, err := m.core.PutObjectPart(ctx, m.bucket, m.key, m.uploadID, int(partNumber), bytes.NewReader(data), int64(len(data)), minio.PutObjectPartOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to upload part %d: %w", partNumber, err)
+	}
+
+	m.parts.logger.Debugf("Uploaded part %d, ETag: %s", partNumber, part.ETag)
+	m.parts.record(partNumber, data, part.ETag)
+	return nil
+}
+
+// upload uploads the stream as the parts of this upload
+func (m *MinIOMultipartUpload) upload(ctx context.Context, reader io.Reader) error {
+	return m.parts.upload(ctx, reader, m.UploadPart)
+}
+
+// Complete completes the multipart upload with the parts of the current stream
+func (m *MinIOMultipartUpload) Complete(ctx context.Context) error {
+	var parts []minio.CompletePart
+	for _, part := range m.parts.completedParts() {
+		parts = append(parts, minio.CompletePart{
+			PartNumber: int(part.Number),
+			ETag:       part.ETag,
+		})
+	}
+
+	info, err := m.core.CompleteMultipartUpload(ctx, m.bucket, m.key, m.uploadID, parts, minio.PutObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+
+	m.parts.logger.Infof("Completed multipart upload: %s (ETag: %s)", m.uploadID, info.ETag)
+	m.parts.removeState()
+	return nil
+}
+
+// Abort aborts the multipart upload
+func (m *MinIOMultipartUpload) Abort(ctx context.Context) error {
+	if err := m.core.AbortMultipartUpload(ctx, m.bucket, m.key, m.uploadID); err != nil {
+		return fmt.Errorf("failed to abort multipart upload: %w", err)
+	}
+
+	m.parts.logger.Infof("Aborted multipart upload: %s", m.uploadID)
+	m.parts.removeState()
+	return nil
+}
+
+// Resume continues an interrupted upload (implements ResumableUpload interface).
+// reader must supply the whole stream again; parts already uploaded with the
+// same content are skipped. A stream that differs from the parts sent earlier
+// aborts the upload with ErrStreamChanged.
+func (m *MinIOMultipartUpload) Resume(ctx context.Context, reader io.Reader, tracker progress.Tracker) error {
+	m.parts.tracker = tracker
+
+	m.parts.logger.Infof("Resuming upload %s (%d parts, %d bytes already uploaded)", m.uploadID, len(m.parts.state.Parts), m.GetUploadedSize())
+
+	if err := m.upload(ctx, reader); err != nil {
+		if errors.Is(err, ErrStreamChanged) {
+			if abortErr := m.Abort(ctx); abortErr != nil {
+				m.parts.logger.Errorf("Failed to abort multipart upload: %v", abortErr)
+			}
+		}
+		return err
+	}
+	return m.Complete(ctx)
+}
+
+// GetUploadedSize returns the amount of data already uploaded
+func (m *MinIOMultipartUpload) GetUploadedSize() int64 {
+	return m.parts.uploadedSize()
+}
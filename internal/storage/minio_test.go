@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+)
+
+func TestMinIOResume(t *testing.T) {
+	original := randomStream(4 * s3MinPartSize)
+
+	changed := func(offset int) []byte {
+		data := append([]byte{}, original...)
+		data[offset] ^= 1
+		return data
+	}
+
+	tests := []struct {
+		name   string
+		resume []byte
+		// server changes the parts the server holds before the upload is resumed
+		server func(parts map[int][]byte)
+		// want lists the parts the resumed upload sends again, or is nil when
+		// the stream is refused
+		want []int
+	}{
+		{name: "same stream", resume: original, want: []int{3, 4}},
+		{name: "first part differs", resume: changed(0)},
+		{name: "second part differs", resume: changed(2*s3MinPartSize - 1)},
+		{
+			name:   "server lost a part",
+			resume: original,
+			server: func(parts map[int][]byte) { delete(parts, 2) },
+			want:   []int{2, 3, 4},
+		},
+		{
+			name:   "server holds a part with another ETag",
+			resume: original,
+			server: func(parts map[int][]byte) { parts[1] = changed(0)[:s3MinPartSize] },
+			want:   []int{1, 3, 4},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			server := newMultipartServer(t)
+			client, err := minio.New(strings.TrimPrefix(server.URL, "http://"), &minio.Options{
+				Creds:  credentials.NewStaticV4("", "", ""),
+				Region: "us-east-1",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			provider := &MinIOProvider{
+				client: client,
+				core:   &minio.Core{Client: client},
+				logger: logger.New(false).Quiet(),
+				config: &MinIOConfig{Bucket: "bucket", Key: "key", Workers: 2, Resume: true, StateDir: t.TempDir()},
+			}
+
+			// The first run stops partway into part 3
+			reader := &interruptedReader{reader: bytes.NewReader(original), limit: 2*s3MinPartSize + 100}
+			if err := provider.UploadStream(ctx, reader, int64(len(original)), nil); err == nil {
+				t.Fatal("UploadStream() of an interrupted stream succeeded")
+			}
+			if got := server.reset(); !reflect.DeepEqual(got, []int{1, 2}) {
+				t.Fatalf("interrupted upload sent parts %v, want 1 and 2", got)
+			}
+			if tt.server != nil {
+				tt.server(server.parts(t))
+			}
+
+			resumable, err := provider.CheckResumability(ctx)
+			if err != nil || resumable == nil {
+				t.Fatalf("CheckResumability() = %v, %v", resumable, err)
+			}
+			err = resumable.Resume(ctx, bytes.NewReader(tt.resume), nil)
+			if tt.want == nil {
+				// The refused upload is aborted so the next run starts over
+				if !errors.Is(err, ErrStreamChanged) {
+					t.Fatalf("Resume() error = %v, want ErrStreamChanged", err)
+				}
+				if len(server.uploads) != 0 {
+					t.Error("refused upload was not aborted")
+				}
+				if again, err := provider.CheckResumability(ctx); again != nil || err != nil {
+					t.Errorf("CheckResumability() after the refused upload = %v, %v", again, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resume() error = %v", err)
+			}
+			if got := server.reset(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resumed upload sent parts %v, want %v", got, tt.want)
+			}
+			if !bytes.Equal(server.object, tt.resume) {
+				t.Errorf("completed object has %d bytes that differ from the %d bytes of the stream", len(server.object), len(tt.resume))
+			}
+			if again, err := provider.CheckResumability(ctx); again != nil || err != nil {
+				t.Errorf("CheckResumability() after completion = %v, %v", again, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,371 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+	"github.com/seriousconsult/cloud_safe/internal/progress"
+)
+
+// multipartState is the local record of a multipart upload, saved after every
+// part so the upload can be resumed by a later run
+type multipartState struct {
+	Bucket   string          `json:"bucket"`
+	Key      string          `json:"key"`
+	UploadID string          `json:"upload_id"`
+	PartSize int64           `json:"part_size"`
+	Parts    []multipartPart `json:"parts"`
+	// Sent holds the SHA-256 of every part sent to the server by part
+	// number, saved before the part is sent, so a resumed stream can be
+	// checked against parts whose upload was never confirmed
+	Sent    map[int32]string `json:"sent,omitempty"`
+	Created time.Time        `json:"created"`
+}
+
+// multipartPart records one uploaded part
+type multipartPart struct {
+	Number int32  `json:"number"`
+	Size   int64  `json:"size"`
+	ETag   string `json:"etag"`
+	SHA256 string `json:"sha256"`
+}
+
+// multipartParts splits a stream into the numbered parts of a multipart
+// upload, uploads them concurrently and keeps the record of uploaded parts.
+// It is shared by the S3 and MinIO uploads, which supply the call that stores
+// a single part.
+type multipartParts struct {
+	partSize  int64
+	workers   int
+	statePath string
+	logger    *logger.Logger
+	tracker   progress.Tracker
+	mutex     sync.Mutex
+
+	// state holds every part uploaded so far, including parts from an
+	// interrupted run that were confirmed with the server
+	state multipartState
+}
+
+// newMultipartParts creates the part record of a new upload and saves it
+// to statePath when that is not empty
+func newMultipartParts(bucket, key, uploadID string, partSize int64, workers int, statePath string, logger *logger.Logger, tracker progress.Tracker) (*multipartParts, error) {
+	p := &multipartParts{
+		partSize:  partSize,
+		workers:   workers,
+		statePath: statePath,
+		logger:    logger,
+		tracker:   tracker,
+		state: multipartState{
+			Bucket:   bucket,
+			Key:      key,
+			UploadID: uploadID,
+			PartSize: partSize,
+			Created:  time.Now().UTC(),
+		},
+	}
+
+	if err := p.saveState(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// send records that the part partNumber with the SHA-256 sum is about to be
+// sent to the server
+func (p *multipartParts) send(partNumber int32, sum string) error {
+	p.mutex.Lock()
+	if p.state.Sent == nil {
+		p.state.Sent = make(map[int32]string)
+	}
+	p.state.Sent[partNumber] = sum
+	p.mutex.Unlock()
+
+	return p.saveState()
+}
+
+// uploadPartFunc stores data as part partNumber and records it with record
+type uploadPartFunc func(ctx context.Context, partNumber int32, data []byte) error
+
+// record adds an uploaded part to the state file and the progress tracker
+func (p *multipartParts) record(partNumber int32, data []byte, etag string) {
+	sum := sha256.Sum256(data)
+	part := multipartPart{
+		Number: partNumber,
+		Size:   int64(len(data)),
+		ETag:   etag,
+		SHA256: hex.EncodeToString(sum[:]),
+	}
+
+	// Replace any earlier upload of the same part number
+	p.mutex.Lock()
+	parts := p.state.Parts[:0]
+	for _, existing := range p.state.Parts {
+		if existing.Number != partNumber {
+			parts = append(parts, existing)
+		}
+	}
+	p.state.Parts = append(parts, part)
+	p.mutex.Unlock()
+
+	if err := p.saveState(); err != nil {
+		p.logger.Errorf("Failed to save upload state: %v", err)
+	}
+
+	// Update progress tracker
+	if p.tracker != nil {
+		p.tracker.Update(part.Size)
+	}
+}
+
+// uploadPartWithRetry uploads a part with retry logic
+func (p *multipartParts) uploadPartWithRetry(ctx context.Context, partNumber int32, data []byte, uploadPart uploadPartFunc) error {
+	const maxRetries = 3
+	const baseDelay = time.Second
+
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		err := uploadPart(ctx, partNumber, data)
+		if err == nil {
+			return nil
+		}
+
+		p.logger.Errorf("Upload attempt %d of part %d failed: %v", attempt+1, partNumber, err)
+
+		if attempt < maxRetries-1 {
+			delay := baseDelay * time.Duration(1<<attempt) // Exponential backoff
+			p.logger.Debugf("Retrying in %v...", delay)
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+	}
+
+	return fmt.Errorf("failed to upload part %d after %d attempts", partNumber, maxRetries)
+}
+
+// partData represents a part to be uploaded
+type partData struct {
+	number int32
+	data   []byte
+}
+
+// upload reads the stream in partSize parts and uploads them concurrently.
+// Parts already recorded in the state are not uploaded again. A part that
+// differs from the one sent under its number earlier fails the upload with
+// ErrStreamChanged.
+func (p *multipartParts) upload(ctx context.Context, reader io.Reader, uploadPart uploadPartFunc) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := p.workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	// A fixed set of buffers bounds memory to one part per worker plus the one being read
+	buffers := make(chan []byte, workers+1)
+	for i := 0; i < workers+1; i++ {
+		buffers <- make([]byte, p.partSize)
+	}
+
+	partChan := make(chan partData)
+	errorChan := make(chan error, workers+1)
+	var wg sync.WaitGroup
+
+	// Start worker goroutines
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range partChan {
+				err := p.uploadPartWithRetry(ctx, part.number, part.data, uploadPart)
+				buffers <- part.data[:cap(part.data)]
+				if err != nil {
+					errorChan <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+
+	// Read and send parts
+	readErr := p.readParts(ctx, reader, buffers, partChan)
+	close(partChan)
+	wg.Wait()
+	close(errorChan)
+
+	// Report the upload error that caused the cancellation first
+	for err := range errorChan {
+		return err
+	}
+	return readErr
+}
+
+// readParts splits the stream into numbered parts, skipping the parts the
+// state shows were already uploaded with the same content. Every other part
+// is recorded as sent before it is handed to the workers.
+func (p *multipartParts) readParts(ctx context.Context, reader io.Reader, buffers chan []byte, partChan chan<- partData) error {
+	p.mutex.Lock()
+	stored := make(map[int32]string, len(p.state.Parts))
+	sent := make(map[int32]string, len(p.state.Sent)+len(p.state.Parts))
+	for _, part := range p.state.Parts {
+		stored[part.Number] = part.SHA256
+		sent[part.Number] = part.SHA256
+	}
+	for number, sum := range p.state.Sent {
+		sent[number] = sum
+	}
+	p.mutex.Unlock()
+
+	var skipped int64
+	var lastPart int32
+
+	for partNumber := int32(1); ; partNumber++ {
+		var buffer []byte
+		select {
+		case buffer = <-buffers:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		n, err := io.ReadFull(reader, buffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("failed to read data: %w", err)
+		}
+		if n == 0 {
+			buffers <- buffer
+			break
+		}
+		data := buffer[:n]
+		lastPart = partNumber
+
+		hash := sha256.Sum256(data)
+		sum := hex.EncodeToString(hash[:])
+		if previous, ok := sent[partNumber]; ok && previous != sum {
+			buffers <- buffer
+			return fmt.Errorf("part %d: %w", partNumber, ErrStreamChanged)
+		}
+
+		// Fast-forward past parts that are already on the server
+		if stored[partNumber] == sum {
+			skipped += int64(n)
+			if p.tracker != nil {
+				p.tracker.Update(int64(n))
+			}
+			buffers <- buffer
+			if n < len(buffer) {
+				break
+			}
+			continue
+		}
+
+		if err := p.send(partNumber, sum); err != nil {
+			buffers <- buffer
+			return err
+		}
+		select {
+		case partChan <- partData{number: partNumber, data: data}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if n < len(buffer) {
+			break
+		}
+	}
+
+	if skipped > 0 {
+		p.logger.Infof("Skipped %d already uploaded bytes", skipped)
+	}
+
+	// Parts of an earlier, longer stream are left out of the completed upload
+	p.mutex.Lock()
+	parts := p.state.Parts[:0]
+	for _, part := range p.state.Parts {
+		if part.Number <= lastPart {
+			parts = append(parts, part)
+		}
+	}
+	p.state.Parts = parts
+	p.mutex.Unlock()
+	return nil
+}
+
+// completedParts returns the parts of the current stream in ascending order,
+// as required to complete the upload
+func (p *multipartParts) completedParts() []multipartPart {
+	p.mutex.Lock()
+	parts := append([]multipartPart{}, p.state.Parts...)
+	p.mutex.Unlock()
+
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+	return parts
+}
+
+// confirm keeps only the recorded parts for which matches reports that the
+// server still has them, so the others are uploaded again
+func (p *multipartParts) confirm(matches func(part multipartPart) bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var confirmed []multipartPart
+	for _, part := range p.state.Parts {
+		if !matches(part) {
+			p.logger.Infof("Part %d of upload %s does not match the server and will be uploaded again", part.Number, p.state.UploadID)
+			continue
+		}
+		confirmed = append(confirmed, part)
+	}
+	p.state.Parts = confirmed
+}
+
+// uploadedSize returns the amount of data already uploaded
+func (p *multipartParts) uploadedSize() int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var size int64
+	for _, part := range p.state.Parts {
+		size += part.Size
+	}
+	return size
+}
+
+// saveState writes the upload state file
+func (p *multipartParts) saveState() error {
+	if p.statePath == "" {
+		return nil
+	}
+
+	p.mutex.Lock()
+	state := p.state
+	state.Parts = append([]multipartPart{}, p.state.Parts...)
+	state.Sent = make(map[int32]string, len(p.state.Sent))
+	for number, sum := range p.state.Sent {
+		state.Sent[number] = sum
+	}
+	p.mutex.Unlock()
+
+	return SaveState(p.statePath, &state)
+}
+
+// removeState deletes the upload state file once it is no longer needed
+func (p *multipartParts) removeState() {
+	if p.statePath == "" {
+		return
+	}
+	if err := RemoveState(p.statePath); err != nil {
+		p.logger.Errorf("%v", err)
+	}
+}
@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+)
+
+const testPartSize = 1000
+
+// partStore stands in for the server side of a multipart upload
+type partStore struct {
+	mutex sync.Mutex
+	parts map[int32][]byte
+	// uploaded lists the part numbers uploaded since the last reset
+	uploaded []int32
+}
+
+func newPartStore() *partStore {
+	return &partStore{parts: make(map[int32][]byte)}
+}
+
+// uploadPart returns an uploadPartFunc that stores parts and records them in p
+func (s *partStore) uploadPart(p *multipartParts) uploadPartFunc {
+	return func(ctx context.Context, partNumber int32, data []byte) error {
+		sum := md5.Sum(data)
+		s.mutex.Lock()
+		s.parts[partNumber] = append([]byte{}, data...)
+		s.uploaded = append(s.uploaded, partNumber)
+		s.mutex.Unlock()
+		p.record(partNumber, data, hex.EncodeToString(sum[:]))
+		return nil
+	}
+}
+
+// reset forgets the part numbers uploaded so far and returns them in order
+func (s *partStore) reset() []int32 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	uploaded := s.uploaded
+	s.uploaded = nil
+	sort.Slice(uploaded, func(i, j int) bool { return uploaded[i] < uploaded[j] })
+	return uploaded
+}
+
+// object assembles the completed parts of p from the store
+func (s *partStore) object(p *multipartParts) []byte {
+	var object []byte
+	for _, part := range p.completedParts() {
+		object = append(object, s.parts[part.Number]...)
+	}
+	return object
+}
+
+// resumeParts loads the part record an interrupted upload saved to statePath
+func resumeParts(t *testing.T, statePath string) *multipartParts {
+	t.Helper()
+	var state multipartState
+	found, err := LoadState(statePath, &state)
+	if err != nil || !found {
+		t.Fatalf("LoadState() = %t, %v", found, err)
+	}
+	return &multipartParts{
+		partSize:  state.PartSize,
+		workers:   3,
+		statePath: statePath,
+		logger:    logger.New(false).Quiet(),
+		state:     state,
+	}
+}
+
+// partNumbers returns the part numbers from first to last
+func partNumbers(first, last int32) []int32 {
+	var numbers []int32
+	for n := first; n <= last; n++ {
+		numbers = append(numbers, n)
+	}
+	return numbers
+}
+
+func TestMultipartResume(t *testing.T) {
+	original := bytes.Repeat([]byte("0123456789abcdefghijklmnopqrstuvwxyz"), 300) // 10800 bytes in 11 parts
+
+	changed := func(offset int) []byte {
+		data := append([]byte{}, original...)
+		data[offset] ^= 1
+		return data
+	}
+
+	tests := []struct {
+		name   string
+		resume []byte
+		// unconfirmed is a part the first run sent but never recorded as uploaded
+		unconfirmed int32
+		// want lists the parts the resumed upload sends again, or is nil when
+		// the stream is refused
+		want []int32
+	}{
+		{name: "same stream", resume: original, want: partNumbers(5, 11)},
+		{name: "first part differs", resume: changed(10)},
+		{name: "last byte of a skipped part differs", resume: changed(4*testPartSize - 1)},
+		{name: "part after the uploaded prefix differs", resume: changed(6 * testPartSize), want: partNumbers(5, 11)},
+		{name: "shorter stream", resume: original[:3*testPartSize+10]},
+		{name: "different stream of the same length", resume: bytes.Repeat([]byte("x"), len(original))},
+		{name: "unconfirmed part is sent again", resume: original, unconfirmed: 4, want: partNumbers(4, 11)},
+		{name: "unconfirmed part differs", resume: changed(3 * testPartSize), unconfirmed: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			statePath := filepath.Join(t.TempDir(), "upload.json")
+			store := newPartStore()
+
+			// The first run stops partway into part 5
+			first, err := newMultipartParts("bucket", "key", "upload", testPartSize, 3, statePath, logger.New(false).Quiet(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reader := &interruptedReader{reader: bytes.NewReader(original), limit: 4*testPartSize + 500}
+			if err := first.upload(ctx, reader, store.uploadPart(first)); err == nil {
+				t.Fatal("upload() of an interrupted stream succeeded")
+			}
+			if got := store.reset(); !reflect.DeepEqual(got, partNumbers(1, 4)) {
+				t.Fatalf("interrupted upload sent parts %v, want 1 to 4", got)
+			}
+
+			resumed := resumeParts(t, statePath)
+			if tt.unconfirmed != 0 {
+				resumed.confirm(func(part multipartPart) bool { return part.Number != tt.unconfirmed })
+			}
+			err = resumed.upload(ctx, bytes.NewReader(tt.resume), store.uploadPart(resumed))
+			if tt.want == nil {
+				if !errors.Is(err, ErrStreamChanged) {
+					t.Fatalf("upload() error = %v, want ErrStreamChanged", err)
+				}
+				if got := store.reset(); len(got) != 0 {
+					t.Errorf("refused upload sent parts %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("upload() error = %v", err)
+			}
+			if got := store.reset(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resumed upload sent parts %v, want %v", got, tt.want)
+			}
+			if got := store.object(resumed); !bytes.Equal(got, tt.resume) {
+				t.Errorf("completed upload has %d bytes that differ from the %d bytes of the stream", len(got), len(tt.resume))
+			}
+		})
+	}
+}
+
+func TestMultipartConfirm(t *testing.T) {
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("abcdefghij"), 450) // 4500 bytes in 5 parts
+	statePath := filepath.Join(t.TempDir(), "upload.json")
+	store := newPartStore()
+
+	first, err := newMultipartParts("bucket", "key", "upload", testPartSize, 2, statePath, logger.New(false).Quiet(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.upload(ctx, bytes.NewReader(data), store.uploadPart(first)); err != nil {
+		t.Fatal(err)
+	}
+	store.reset()
+
+	// The server lost part 2 and holds part 4 with another ETag
+	delete(store.parts, 2)
+	store.parts[4] = []byte("replaced")
+	resumed := resumeParts(t, statePath)
+	resumed.confirm(func(part multipartPart) bool {
+		server, ok := store.parts[part.Number]
+		sum := md5.Sum(server)
+		return ok && int64(len(server)) == part.Size && hex.EncodeToString(sum[:]) == part.ETag
+	})
+	if got, want := resumed.uploadedSize(), int64(2*testPartSize+500); got != want {
+		t.Errorf("uploadedSize() after confirm = %d, want %d", got, want)
+	}
+
+	// Only the parts the server does not confirm are sent again
+	if err := resumed.upload(ctx, bytes.NewReader(data), store.uploadPart(resumed)); err != nil {
+		t.Fatal(err)
+	}
+	if got := store.reset(); !reflect.DeepEqual(got, []int32{2, 4}) {
+		t.Errorf("resumed upload sent parts %v, want 2 and 4", got)
+	}
+	if got := store.object(resumed); !bytes.Equal(got, data) {
+		t.Error("completed upload differs from the stream")
+	}
+}
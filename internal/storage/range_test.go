@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+)
+
+// rangeTestObject is the content of the object the range tests read
+const rangeTestObject = "0123456789"
+
+// rangeServer serves rangeTestObject as bucket/key of an S3-compatible
+// service, honouring Range headers, and records the Range header of every
+// request for the object
+type rangeServer struct {
+	testServer
+	ranges []string
+}
+
+func newRangeServer(t *testing.T) *rangeServer {
+	server := &rangeServer{}
+	server.start(t, server.serve)
+	return server
+}
+
+func (s *rangeServer) serve(w http.ResponseWriter, r *http.Request, body []byte) {
+	if r.URL.Path != "/bucket/key" {
+		http.NotFound(w, r)
+		return
+	}
+	header := r.Header.Get("Range")
+	s.ranges = append(s.ranges, header)
+
+	// MinIO reads these from every response
+	w.Header().Set("Last-Modified", "Sat, 03 Feb 2001 04:05:06 GMT")
+	w.Header().Set("ETag", `"0123456789abcdef0123456789abcdef"`)
+
+	size := int64(len(rangeTestObject))
+	if header == "" {
+		w.Write([]byte(rangeTestObject))
+		return
+	}
+	first, last, err := parseRange(header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if first >= size {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		w.Write([]byte("<Error><Code>InvalidRange</Code><Message>The requested range is not satisfiable</Message></Error>"))
+		return
+	}
+	if last < 0 || last >= size {
+		last = size - 1
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, size))
+	w.Header().Set("Content-Length", strconv.FormatInt(last-first+1, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write([]byte(rangeTestObject[first : last+1]))
+}
+
+// requests returns the Range headers recorded since the last call
+func (s *rangeServer) requests() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ranges := s.ranges
+	s.ranges = nil
+	return ranges
+}
+
+// parseRange parses a "bytes=first-last" header; last is -1 when it is omitted
+func parseRange(header string) (int64, int64, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return 0, 0, fmt.Errorf("unsupported range %q", header)
+	}
+	firstText, lastText, _ := strings.Cut(spec, "-")
+	first, err := strconv.ParseInt(firstText, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	last := int64(-1)
+	if lastText != "" {
+		if last, err = strconv.ParseInt(lastText, 10, 64); err != nil {
+			return 0, 0, err
+		}
+	}
+	return first, last, nil
+}
+
+func TestReadRange(t *testing.T) {
+	ctx := context.Background()
+	log := logger.New(false).Quiet()
+	server := newRangeServer(t)
+
+	s3Client, err := newS3Client(ctx, &S3Config{
+		Bucket:           "bucket",
+		Region:           "us-east-1",
+		Endpoint:         server.URL,
+		UsePathStyle:     true,
+		SignatureVersion: S3SignatureAnonymous,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	minioClient, err := minio.New(strings.TrimPrefix(server.URL, "http://"), &minio.Options{
+		Creds:  credentials.NewStaticV4("access", "secret", ""),
+		Region: "us-east-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "key"), []byte(rangeTestObject), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	providers := []struct {
+		name   string
+		reader RangeReader
+		// remote providers send the range to the server
+		remote bool
+	}{
+		{name: "s3", reader: &S3Provider{client: s3Client, config: &S3Config{Bucket: "bucket"}, logger: log}, remote: true},
+		{name: "minio", reader: &MinIOProvider{client: minioClient, config: &MinIOConfig{Bucket: "bucket"}, logger: log}, remote: true},
+		{name: "local", reader: &LocalProvider{config: &LocalConfig{Path: dir}, logger: log}},
+	}
+
+	tests := []struct {
+		name           string
+		offset, length int64
+		// wantRange is the Range header sent, or empty when no request is made
+		wantRange string
+		want      string
+	}{
+		{name: "range", offset: 2, length: 3, wantRange: "bytes=2-4", want: "234"},
+		{name: "negative length reads to the end", offset: 2, length: -1, wantRange: "bytes=2-", want: "23456789"},
+		{name: "range past the end", offset: 8, length: 5, wantRange: "bytes=8-12", want: "89"},
+		{name: "last byte", offset: 9, length: 1, wantRange: "bytes=9-9", want: "9"},
+		{name: "offset at the end", offset: 10, length: 3, wantRange: "bytes=10-12", want: ""},
+		{name: "offset past the end", offset: 12, length: 3, wantRange: "bytes=12-14", want: ""},
+		{name: "offset past the end to the end", offset: 12, length: -1, wantRange: "bytes=12-", want: ""},
+		{name: "zero length", offset: 2, length: 0, want: ""},
+	}
+
+	for _, provider := range providers {
+		for _, tt := range tests {
+			t.Run(provider.name+"/"+tt.name, func(t *testing.T) {
+				server.requests()
+				reader, err := provider.reader.ReadRange(ctx, "key", tt.offset, tt.length)
+				if err != nil {
+					t.Fatalf("ReadRange() error = %v", err)
+				}
+				got, err := io.ReadAll(reader)
+				reader.Close()
+				if err != nil {
+					t.Fatalf("reading range: %v", err)
+				}
+				if string(got) != tt.want {
+					t.Errorf("ReadRange() = %q, want %q", got, tt.want)
+				}
+
+				if !provider.remote {
+					return
+				}
+				var wantRequests []string
+				if tt.wantRange != "" {
+					wantRequests = []string{tt.wantRange}
+				}
+				if requests := server.requests(); strings.Join(requests, ",") != strings.Join(wantRequests, ",") || len(requests) != len(wantRequests) {
+					t.Errorf("Range headers sent = %q, want %q", requests, wantRequests)
+				}
+			})
+		}
+	}
+}
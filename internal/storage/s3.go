@@ -3,21 +3,29 @@ package storage
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"sync"
-	"time"
+	"net/http"
+	"net/url"
+	"os"
 
 	"github.com/seriousconsult/cloud_safe/internal/logger"
 	"github.com/seriousconsult/cloud_safe/internal/progress"
 	"github.com/seriousconsult/cloud_safe/internal/utils"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
+// cloudSafeTagging is the cloud_safe marker in the URL-encoded form the
+// Tagging field of S3 uploads takes
+var cloudSafeTagging = url.Values{CloudSafeTagKey: {CloudSafeTagValue}}.Encode()
+
 // S3Provider implements StorageProvider for AWS S3
 type S3Provider struct {
 	client     *s3.Client
@@ -26,7 +34,8 @@ type S3Provider struct {
 	bufferPool *utils.BufferPool
 }
 
-// NewS3Provider creates a new S3 storage provider
+// NewS3Provider creates a new S3 storage provider. With an endpoint set it
+// talks to an S3-compatible service instead of AWS.
 func NewS3Provider(cfg *S3Config, logger *logger.Logger) (*S3Provider, error) {
 	// Log AWS configuration being used
 	logger.Infof("AWS S3 Configuration:")
@@ -34,18 +43,17 @@ func NewS3Provider(cfg *S3Config, logger *logger.Logger) (*S3Provider, error) {
 	logger.Infof("  Profile: %s", cfg.Profile)
 	logger.Infof("  S3 Bucket: %s", cfg.Bucket)
 	logger.Infof("  S3 Key: %s", cfg.Key)
+	if cfg.Endpoint != "" {
+		logger.Infof("  Endpoint: %s", cfg.Endpoint)
+		logger.Infof("  Path Style: %t", cfg.UsePathStyle)
+	}
+	logger.Infof("  Tagging: %t", cfg.Tagging)
 
-	// Load AWS configuration
-	awsCfg, err := awsconfig.LoadDefaultConfig(context.Background(),
-		awsconfig.WithRegion(cfg.Region),
-		awsconfig.WithSharedConfigProfile(cfg.Profile),
-	)
+	client, err := newS3Client(context.Background(), cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+		return nil, err
 	}
 
-	client := s3.NewFromConfig(awsCfg)
-
 	// Test S3 connectivity
 	_, err = client.HeadBucket(context.Background(), &s3.HeadBucketInput{
 		Bucket: aws.String(cfg.Bucket),
@@ -64,6 +72,50 @@ func NewS3Provider(cfg *S3Config, logger *logger.Logger) (*S3Provider, error) {
 	}, nil
 }
 
+// newS3Client creates the S3 client for cfg, applying the endpoint, path
+// style, CA bundle and signature options
+func newS3Client(ctx context.Context, cfg *S3Config) (*s3.Client, error) {
+	var loadOptions []func(*awsconfig.LoadOptions) error
+	if cfg.CABundle != "" {
+		bundle, err := os.ReadFile(cfg.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		loadOptions = append(loadOptions, awsconfig.WithCustomCABundle(bytes.NewReader(bundle)))
+	}
+
+	// Load AWS configuration
+	awsCfg, err := LoadAWSConfig(ctx, cfg.Region, cfg.Profile, loadOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	var signature func(*s3.Options)
+	switch cfg.SignatureVersion {
+	case "", S3SignatureV4:
+	case S3SignatureV4UnsignedPayload:
+		signature = func(o *s3.Options) {
+			o.APIOptions = append(o.APIOptions, v4.SwapComputePayloadSHA256ForUnsignedPayloadMiddleware)
+		}
+	case S3SignatureAnonymous:
+		signature = func(o *s3.Options) {
+			o.Credentials = aws.AnonymousCredentials{}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported S3 signature version %q (use %s, %s or %s)", cfg.SignatureVersion, S3SignatureV4, S3SignatureV4UnsignedPayload, S3SignatureAnonymous)
+	}
+
+	return s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+		}
+		o.UsePathStyle = cfg.UsePathStyle
+		if signature != nil {
+			signature(o)
+		}
+	}), nil
+}
+
 // GetProviderType returns the provider type
 func (s *S3Provider) GetProviderType() Provider {
 	return ProviderS3
@@ -83,19 +135,58 @@ func (s *S3Provider) ValidateConfig() error {
 	return nil
 }
 
+// tagging returns the Tagging of uploaded objects, or nil when tagging is off
+func (s *S3Provider) tagging() *string {
+	if !s.config.Tagging {
+		return nil
+	}
+	return aws.String(cloudSafeTagging)
+}
+
 // UploadStream uploads data from a reader to S3
 func (s *S3Provider) UploadStream(ctx context.Context, reader io.Reader, estimatedSize int64, tracker progress.Tracker) error {
+	return s.upload(ctx, s.config.Key, reader, estimatedSize, s.config.Resume, tracker)
+}
+
+// PutObject uploads exactly size bytes from reader to key
+func (s *S3Provider) PutObject(ctx context.Context, key string, reader io.Reader, size int64, tracker progress.Tracker) error {
+	return s.upload(ctx, key, reader, size, false, tracker)
+}
+
+// WithKey returns a provider sharing the client of s that uploads streams to key
+func (s *S3Provider) WithKey(key string) StorageProvider {
+	cfg := *s.config
+	cfg.Key = key
+	provider := *s
+	provider.config = &cfg
+	return &provider
+}
+
+// DeleteObject deletes the object stored under key
+func (s *S3Provider) DeleteObject(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete %s from S3: %w", key, err)
+	}
+	return nil
+}
+
+// upload uploads reader to key, in parts when it is larger than a chunk
+func (s *S3Provider) upload(ctx context.Context, key string, reader io.Reader, size int64, resume bool, tracker progress.Tracker) error {
 	// Check if we should use multipart upload
-	if estimatedSize > s.config.ChunkSize {
-		return s.uploadMultipart(ctx, reader, estimatedSize, tracker)
+	if size > s.config.ChunkSize {
+		return s.uploadMultipart(ctx, key, reader, size, resume, tracker)
 	}
 
 	// Use single part upload for smaller files
-	return s.uploadSinglePart(ctx, reader, tracker)
+	return s.uploadSinglePart(ctx, key, reader, tracker)
 }
 
 // uploadSinglePart uploads a file in a single part
-func (s *S3Provider) uploadSinglePart(ctx context.Context, reader io.Reader, tracker progress.Tracker) error {
+func (s *S3Provider) uploadSinglePart(ctx context.Context, key string, reader io.Reader, tracker progress.Tracker) error {
 	s.logger.Info("Using single-part upload")
 
 	// For single part uploads, we need to buffer the entire content
@@ -108,9 +199,9 @@ func (s *S3Provider) uploadSinglePart(ctx context.Context, reader io.Reader, tra
 
 	input := &s3.PutObjectInput{
 		Bucket: aws.String(s.config.Bucket),
-		Key:    aws.String(s.config.Key),
+		Key:    aws.String(key),
 		Body:   bytes.NewReader(buffer.Bytes()),
-		Tagging: aws.String("Source=cloud_safe"),
+		Tagging: s.tagging(),
 	}
 
 	_, err = s.client.PutObject(ctx, input)
@@ -125,199 +216,154 @@ func (s *S3Provider) uploadSinglePart(ctx context.Context, reader io.Reader, tra
 	return nil
 }
 
-// uploadMultipart uploads a file using multipart upload
-func (s *S3Provider) uploadMultipart(ctx context.Context, reader io.Reader, estimatedSize int64, tracker progress.Tracker) error {
+// uploadMultipart uploads a file using multipart upload. Progress is recorded
+// for a later run when resume is set.
+func (s *S3Provider) uploadMultipart(ctx context.Context, key string, reader io.Reader, estimatedSize int64, resume bool, tracker progress.Tracker) error {
 	s.logger.Info("Using multipart upload")
 
+	partSize := s3PartSize(s.config.ChunkSize, estimatedSize)
+	if partSize != s.config.ChunkSize {
+		s.logger.Infof("Using %d byte parts to stay within S3's %d part limit", partSize, s3MaxParts)
+	}
+
+	statePath := ""
+	if resume {
+		statePath = s.statePath()
+	}
+
 	// Create multipart upload
-	multipart, err := NewS3MultipartUpload(s.client, s.config.Bucket, s.config.Key, s.logger, tracker)
+	multipart, err := NewS3MultipartUpload(s.client, s.config.Bucket, key, s.tagging(), partSize, s.config.Workers, statePath, s.logger, tracker)
 	if err != nil {
 		return fmt.Errorf("failed to create multipart upload: %w", err)
 	}
 
-	// Set up error handling and cleanup
-	defer func() {
-		if err != nil {
-			if abortErr := multipart.Abort(context.Background()); abortErr != nil {
-				s.logger.Errorf("Failed to abort multipart upload: %v", abortErr)
-			}
-		}
-	}()
-
-	// Create worker pool for concurrent uploads
-	partChan := make(chan partData, s.config.Workers)
-	errorChan := make(chan error, s.config.Workers)
-	var wg sync.WaitGroup
-
-	// Start worker goroutines
-	for i := 0; i < s.config.Workers; i++ {
-		wg.Add(1)
-		go s.uploadWorker(ctx, &wg, partChan, errorChan, multipart)
-	}
-
-	// Read and send parts
-	go func() {
-		defer close(partChan)
-		
-		buffer := make([]byte, s.config.ChunkSize)
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-			}
-
-			n, readErr := io.ReadFull(reader, buffer)
-			if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
-				if n > 0 {
-					partChan <- partData{
-						data: buffer[:n],
-						size: int64(n),
-					}
-				}
-				return
-			}
-			if readErr != nil {
-				errorChan <- fmt.Errorf("failed to read data: %w", readErr)
-				return
-			}
-
-			partChan <- partData{
-				data: buffer[:n],
-				size: int64(n),
-			}
-		}
-	}()
-
-	// Wait for all uploads to complete and check for errors
-	go func() {
-		wg.Wait()
-		close(errorChan)
-	}()
-
-	// Check for errors
-	for uploadErr := range errorChan {
-		if uploadErr != nil {
-			return uploadErr
+	if err := multipart.upload(ctx, reader); err != nil {
+		// Keep the parts for the next run when resume is enabled
+		if resume {
+			s.logger.Infof("Upload %s can be resumed by running the same command again", multipart.uploadID)
+		} else if abortErr := multipart.Abort(context.Background()); abortErr != nil {
+			s.logger.Errorf("Failed to abort multipart upload: %v", abortErr)
 		}
+		return err
 	}
 
 	// Complete the multipart upload
 	return multipart.Complete(ctx)
 }
 
-// partData represents a part to be uploaded
-type partData struct {
-	data []byte
-	size int64
-}
-
-// uploadWorker is a worker goroutine that uploads parts
-func (s *S3Provider) uploadWorker(ctx context.Context, wg *sync.WaitGroup, partChan <-chan partData, errorChan chan<- error, multipart *S3MultipartUpload) {
-	defer wg.Done()
+// Part sizing for uploads. s3PartSizeMargin leaves room below the 10,000 part
+// limit, since the size estimate is taken before compression.
+const (
+	s3MaxParts         = 10000
+	s3PartSizeMargin   = 9000
+	s3PartSizeRounding = 1024 * 1024
+)
 
-	for part := range partChan {
-		select {
-		case <-ctx.Done():
-			errorChan <- ctx.Err()
-			return
-		default:
-		}
+// s3PartSize returns the configured chunk size, raised to S3's minimum part
+// size and far enough that the estimated size fits in the part limit
+func s3PartSize(chunkSize, estimatedSize int64) int64 {
+	partSize := chunkSize
+	if partSize < s3MinPartSize {
+		partSize = s3MinPartSize
+	}
 
-		// Upload the part with retry logic
-		err := s.uploadPartWithRetry(ctx, multipart, part.data, part.size)
-		if err != nil {
-			errorChan <- err
-			return
-		}
+	if minimum := estimatedSize / s3PartSizeMargin; partSize < minimum {
+		partSize = (minimum/s3PartSizeRounding + 1) * s3PartSizeRounding
 	}
+	return partSize
 }
 
-// uploadPartWithRetry uploads a part with retry logic
-func (s *S3Provider) uploadPartWithRetry(ctx context.Context, multipart *S3MultipartUpload, data []byte, size int64) error {
-	const maxRetries = 3
-	const baseDelay = time.Second
-
-	for attempt := 0; attempt < maxRetries; attempt++ {
-		reader := bytes.NewReader(data)
-		err := multipart.UploadPart(ctx, reader, size)
-		if err == nil {
-			return nil
-		}
-
-		s.logger.Errorf("Upload attempt %d failed: %v", attempt+1, err)
-
-		if attempt < maxRetries-1 {
-			delay := baseDelay * time.Duration(1<<attempt) // Exponential backoff
-			s.logger.Debugf("Retrying in %v...", delay)
-			
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			case <-time.After(delay):
-			}
-		}
+// statePath returns the local file the multipart upload of the configured key is recorded in
+func (s *S3Provider) statePath() string {
+	target := "s3://" + s.config.Bucket + "/" + s.config.Key
+	if s.config.Endpoint != "" {
+		target = s.config.Endpoint + "/" + s.config.Bucket + "/" + s.config.Key
 	}
-
-	return fmt.Errorf("failed to upload part after %d attempts", maxRetries)
+	return StatePath(s.config.StateDir, "s3", target)
 }
 
-// CheckResumability checks if an upload can be resumed
+// CheckResumability returns the interrupted multipart upload recorded in the
+// local state file, after checking its parts against the server with ListParts
 func (s *S3Provider) CheckResumability(ctx context.Context) (ResumableUpload, error) {
 	if !s.config.Resume {
 		return nil, nil
 	}
 
-	// List ongoing multipart uploads
-	input := &s3.ListMultipartUploadsInput{
-		Bucket: aws.String(s.config.Bucket),
-		Prefix: aws.String(s.config.Key),
+	var state multipartState
+	found, err := LoadState(s.statePath(), &state)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		s.logUnresumableUploads(ctx)
+		return nil, nil
+	}
+	if state.Bucket != s.config.Bucket || state.Key != s.config.Key {
+		return nil, fmt.Errorf("upload state %s belongs to s3://%s/%s", s.statePath(), state.Bucket, state.Key)
 	}
 
-	output, err := s.client.ListMultipartUploads(ctx, input)
+	serverParts, err := s.getExistingParts(ctx, state.UploadID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list multipart uploads: %w", err)
+		var noSuchUpload *types.NoSuchUpload
+		if errors.As(err, &noSuchUpload) {
+			s.logger.Infof("Multipart upload %s no longer exists; starting a new upload", state.UploadID)
+			return nil, RemoveState(s.statePath())
+		}
+		return nil, err
 	}
 
-	// Look for an existing upload for our key
-	for _, upload := range output.Uploads {
-		if *upload.Key == s.config.Key {
-			s.logger.Infof("Found resumable upload: %s", *upload.UploadId)
-			
-			multipart := &S3MultipartUpload{
-				client:   s.client,
-				bucket:   s.config.Bucket,
-				key:      s.config.Key,
-				uploadID: *upload.UploadId,
-				logger:   s.logger,
-			}
+	multipart := &S3MultipartUpload{
+		client:   s.client,
+		bucket:   s.config.Bucket,
+		key:      s.config.Key,
+		uploadID: state.UploadID,
+		parts: &multipartParts{
+			partSize:  state.PartSize,
+			workers:   s.config.Workers,
+			statePath: s.statePath(),
+			logger:    s.logger,
+			state:     state,
+		},
+	}
 
-			// Get existing parts
-			parts, err := s.getExistingParts(ctx, *upload.UploadId)
-			if err != nil {
-				s.logger.Errorf("Failed to get existing parts: %v", err)
-				continue
-			}
+	// Only parts the server still has with the same size and ETag can be skipped
+	multipart.parts.confirm(func(part multipartPart) bool {
+		server, ok := serverParts[part.Number]
+		return ok && server.Size != nil && *server.Size == part.Size && server.ETag != nil && *server.ETag == part.ETag
+	})
 
-			multipart.parts = parts
-			multipart.partNumber = int32(len(parts) + 1)
+	s.logger.Infof("Found resumable upload: %s (%d parts, %d bytes)", state.UploadID, len(multipart.parts.state.Parts), multipart.GetUploadedSize())
+	return multipart, nil
+}
 
-			return multipart, nil
-		}
+// logUnresumableUploads reports multipart uploads for the configured key that
+// have no local state, since they cannot be resumed and keep costing storage
+func (s *S3Provider) logUnresumableUploads(ctx context.Context) {
+	output, err := s.client.ListMultipartUploads(ctx, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.config.Bucket),
+		Prefix: aws.String(s.config.Key),
+	})
+	if err != nil {
+		s.logger.Debugf("Failed to list multipart uploads: %v", err)
+		return
 	}
 
-	return nil, nil
+	for _, upload := range output.Uploads {
+		if aws.ToString(upload.Key) == s.config.Key {
+			s.logger.Infof("Multipart upload %s for %s has no local state and cannot be resumed", aws.ToString(upload.UploadId), s.config.Key)
+		}
+	}
 }
 
-// getExistingParts retrieves the list of already uploaded parts
-func (s *S3Provider) getExistingParts(ctx context.Context, uploadID string) ([]types.CompletedPart, error) {
+// getExistingParts retrieves the parts the server holds for an upload, by part number
+func (s *S3Provider) getExistingParts(ctx context.Context, uploadID string) (map[int32]types.Part, error) {
 	input := &s3.ListPartsInput{
 		Bucket:   aws.String(s.config.Bucket),
 		Key:      aws.String(s.config.Key),
 		UploadId: aws.String(uploadID),
 	}
 
-	var parts []types.CompletedPart
+	parts := make(map[int32]types.Part)
 	paginator := s3.NewListPartsPaginator(s.client, input)
 
 	for paginator.HasMorePages() {
@@ -327,12 +373,324 @@ func (s *S3Provider) getExistingParts(ctx context.Context, uploadID string) ([]t
 		}
 
 		for _, part := range output.Parts {
-			parts = append(parts, types.CompletedPart{
-				ETag:       part.ETag,
-				PartNumber: part.PartNumber,
+			if part.PartNumber != nil {
+				parts[*part.PartNumber] = part
+			}
+		}
+	}
+
+	return parts, nil
+}
+
+// DownloadStream downloads an object from S3 and writes it to writer
+func (s *S3Provider) DownloadStream(ctx context.Context, key string, writer io.Writer, tracker progress.Tracker) error {
+	s.logger.Infof("Starting S3 download of s3://%s/%s", s.config.Bucket, key)
+
+	output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get object %s: %w", key, err)
+	}
+	defer output.Body.Close()
+
+	// Create progress reader wrapper
+	var reader io.Reader = output.Body
+	if tracker != nil {
+		reader = &s3ProgressReader{
+			reader:  output.Body,
+			tracker: tracker,
+		}
+	}
+
+	if _, err := io.Copy(writer, reader); err != nil {
+		return fmt.Errorf("failed to download object %s: %w", key, err)
+	}
+
+	s.logger.Info("S3 download completed successfully")
+	return nil
+}
+
+// ReadRange returns a byte range of an object stored in S3
+func (s *S3Provider) ReadRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	s.logger.Debugf("Reading %s of s3://%s/%s", httpRange(offset, length), s.config.Bucket, key)
+
+	output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(httpRange(offset, length)),
+	})
+	var responseErr *awshttp.ResponseError
+	if errors.As(err, &responseErr) && responseErr.HTTPStatusCode() == http.StatusRequestedRangeNotSatisfiable {
+		// The range starts at or past the end of the object
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get range of object %s: %w", key, err)
+	}
+	return output.Body, nil
+}
+
+// httpRange returns the HTTP Range header value for length bytes from
+// offset, or all bytes from offset for a negative length
+func httpRange(offset, length int64) string {
+	if length < 0 {
+		return fmt.Sprintf("bytes=%d-", offset)
+	}
+	return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+}
+
+// Stat returns information about an object stored in S3
+func (s *S3Provider) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	output, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat object %s: %w", key, err)
+	}
+
+	return &ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(output.ContentLength),
+		LastModified: aws.ToTime(output.LastModified),
+		ETag:         aws.ToString(output.ETag),
+		Metadata:     output.Metadata,
+	}, nil
+}
+
+// List returns the objects in the bucket whose keys start with prefix. It does
+// not read their tags; see ReadMarkers.
+func (s *S3Provider) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.config.Bucket),
+		Prefix: aws.String(prefix),
+	}
+
+	var objects []ObjectInfo
+	paginator := s3.NewListObjectsV2Paginator(s.client, input)
+
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects: %w", err)
+		}
+
+		for _, object := range output.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.ToString(object.Key),
+				Size:         aws.ToInt64(object.Size),
+				LastModified: aws.ToTime(object.LastModified),
+				ETag:         aws.ToString(object.ETag),
 			})
 		}
 	}
 
+	return objects, nil
+}
+
+// ReadMarkers sets CloudSafe on objects that carry the Source=cloud_safe tag.
+// ListObjectsV2 does not return tags, so every object takes a request.
+func (s *S3Provider) ReadMarkers(ctx context.Context, objects []ObjectInfo) error {
+	for i := range objects {
+		tagged, err := s.hasCloudSafeTag(ctx, objects[i].Key)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			s.logger.Debugf("Failed to get tags for %s: %v", objects[i].Key, err)
+		}
+		objects[i].CloudSafe = tagged
+	}
+	return nil
+}
+
+// hasCloudSafeTag reports whether an object carries the tag set by uploadSinglePart and NewS3MultipartUpload
+func (s *S3Provider) hasCloudSafeTag(ctx context.Context, key string) (bool, error) {
+	output, err := s.client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	for _, tag := range output.TagSet {
+		if aws.ToString(tag.Key) == CloudSafeTagKey && aws.ToString(tag.Value) == CloudSafeTagValue {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// s3ProgressReader wraps an io.Reader to track progress
+type s3ProgressReader struct {
+	reader  io.Reader
+	tracker progress.Tracker
+}
+
+func (pr *s3ProgressReader) Read(p []byte) (n int, err error) {
+	n, err = pr.reader.Read(p)
+	if n > 0 && pr.tracker != nil {
+		pr.tracker.Update(int64(n))
+	}
+	return n, err
+}
+
+// Part sizes used by uploads and RewritePrefix. Every part but the last must
+// be at least 5 MiB, and an object may have at most 10,000 parts.
+const (
+	s3MinPartSize  = 5 * 1024 * 1024
+	s3CopyPartSize = 1024 * 1024 * 1024
+)
+
+// RewritePrefix replaces the first oldLength bytes of key with prefix. The new
+// prefix and the following 5 MiB are uploaded as the first part of a multipart
+// upload; the rest of the object is copied server-side with UploadPartCopy.
+func (s *S3Provider) RewritePrefix(ctx context.Context, key string, oldLength int64, prefix []byte) error {
+	head, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to stat object %s: %w", key, err)
+	}
+	size := aws.ToInt64(head.ContentLength)
+	if oldLength > size {
+		return fmt.Errorf("object %s is shorter than its %d byte header", key, oldLength)
+	}
+
+	// The first part carries the new prefix plus enough payload to reach the
+	// minimum part size; everything after it can be copied in place
+	firstEnd := oldLength + s3MinPartSize
+	if firstEnd > size {
+		firstEnd = size
+	}
+	first, err := s.readRange(ctx, key, aws.ToString(head.ETag), oldLength, firstEnd)
+	if err != nil {
+		return err
+	}
+	firstPart := append(append([]byte{}, prefix...), first...)
+
+	// Small objects are cheaper to rewrite in a single request
+	if firstEnd == size {
+		_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:   aws.String(s.config.Bucket),
+			Key:      aws.String(key),
+			Body:     bytes.NewReader(firstPart),
+			Metadata: head.Metadata,
+			Tagging:  s.tagging(),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to rewrite object %s: %w", key, err)
+		}
+		return nil
+	}
+
+	created, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(s.config.Bucket),
+		Key:      aws.String(key),
+		Metadata: head.Metadata,
+		Tagging:  s.tagging(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+	uploadID := aws.ToString(created.UploadId)
+
+	parts, err := s.copyParts(ctx, key, uploadID, aws.ToString(head.ETag), firstPart, firstEnd, size)
+	if err != nil {
+		// Do not leave billed, incomplete uploads behind
+		if _, abortErr := s.client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.config.Bucket),
+			Key:      aws.String(key),
+			UploadId: aws.String(uploadID),
+		}); abortErr != nil {
+			s.logger.Errorf("Failed to abort multipart upload %s: %v", uploadID, abortErr)
+		}
+		return err
+	}
+
+	_, err = s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.config.Bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+
+	s.logger.Infof("Rewrote header of s3://%s/%s with %d server-side copied part(s)", s.config.Bucket, key, len(parts)-1)
+	return nil
+}
+
+// copyParts uploads firstPart as part 1 and copies bytes [start, size) of the
+// original object into the following parts
+func (s *S3Provider) copyParts(ctx context.Context, key, uploadID, etag string, firstPart []byte, start, size int64) ([]types.CompletedPart, error) {
+	partNumber := int32(1)
+	uploaded, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:     aws.String(s.config.Bucket),
+		Key:        aws.String(key),
+		UploadId:   aws.String(uploadID),
+		PartNumber: aws.Int32(partNumber),
+		Body:       bytes.NewReader(firstPart),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload part %d: %w", partNumber, err)
+	}
+	parts := []types.CompletedPart{{ETag: uploaded.ETag, PartNumber: aws.Int32(partNumber)}}
+
+	copySource := s.config.Bucket + "/" + url.PathEscape(key)
+	for offset := start; offset < size; offset += s3CopyPartSize {
+		end := offset + s3CopyPartSize
+		if end > size {
+			end = size
+		}
+		partNumber++
+
+		copied, err := s.client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:            aws.String(s.config.Bucket),
+			Key:               aws.String(key),
+			UploadId:          aws.String(uploadID),
+			PartNumber:        aws.Int32(partNumber),
+			CopySource:        aws.String(copySource),
+			CopySourceRange:   aws.String(fmt.Sprintf("bytes=%d-%d", offset, end-1)),
+			CopySourceIfMatch: aws.String(etag),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to copy part %d: %w", partNumber, err)
+		}
+		parts = append(parts, types.CompletedPart{ETag: copied.CopyPartResult.ETag, PartNumber: aws.Int32(partNumber)})
+	}
+
 	return parts, nil
 }
+
+// readRange reads bytes [start, end) of key, failing if the object changed since etag
+func (s *S3Provider) readRange(ctx context.Context, key, etag string, start, end int64) ([]byte, error) {
+	if start == end {
+		return nil, nil
+	}
+
+	output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:  aws.String(s.config.Bucket),
+		Key:     aws.String(key),
+		Range:   aws.String(fmt.Sprintf("bytes=%d-%d", start, end-1)),
+		IfMatch: aws.String(etag),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object %s: %w", key, err)
+	}
+	defer output.Body.Close()
+
+	data, err := io.ReadAll(output.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object %s: %w", key, err)
+	}
+	return data, nil
+}
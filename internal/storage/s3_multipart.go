@@ -1,10 +1,11 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"sync"
 
 	"github.com/seriousconsult/cloud_safe/internal/logger"
 	"github.com/seriousconsult/cloud_safe/internal/progress"
@@ -16,23 +17,21 @@ import (
 
 // S3MultipartUpload handles S3 multipart uploads and implements ResumableUpload
 type S3MultipartUpload struct {
-	client     *s3.Client
-	bucket     string
-	key        string
-	uploadID   string
-	parts      []types.CompletedPart
-	partNumber int32
-	logger     *logger.Logger
-	tracker    progress.Tracker
-	mutex      sync.Mutex
+	client   *s3.Client
+	bucket   string
+	key      string
+	uploadID string
+	parts    *multipartParts
 }
 
-// NewS3MultipartUpload creates a new multipart upload
-func NewS3MultipartUpload(client *s3.Client, bucket, key string, logger *logger.Logger, tracker progress.Tracker) (*S3MultipartUpload, error) {
+// NewS3MultipartUpload creates a new multipart upload of an object with the
+// tags in tagging, which may be nil. Progress is recorded in statePath when
+// it is not empty.
+func NewS3MultipartUpload(client *s3.Client, bucket, key string, tagging *string, partSize int64, workers int, statePath string, logger *logger.Logger, tracker progress.Tracker) (*S3MultipartUpload, error) {
 	input := &s3.CreateMultipartUploadInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-		Tagging: aws.String("Source=cloud_safe"),
+		Bucket:  aws.String(bucket),
+		Key:     aws.String(key),
+		Tagging: tagging,
 	}
 
 	output, err := client.CreateMultipartUpload(context.Background(), input)
@@ -42,62 +41,54 @@ func NewS3MultipartUpload(client *s3.Client, bucket, key string, logger *logger.
 
 	logger.Infof("Created multipart upload: %s", *output.UploadId)
 
+	parts, err := newMultipartParts(bucket, key, *output.UploadId, partSize, workers, statePath, logger, tracker)
+	if err != nil {
+		return nil, err
+	}
+
 	return &S3MultipartUpload{
-		client:     client,
-		bucket:     bucket,
-		key:        key,
-		uploadID:   *output.UploadId,
-		parts:      make([]types.CompletedPart, 0),
-		partNumber: 1,
-		logger:     logger,
-		tracker:    tracker,
+		client:   client,
+		bucket:   bucket,
+		key:      key,
+		uploadID: *output.UploadId,
+		parts:    parts,
 	}, nil
 }
 
-// UploadPart uploads a single part
-func (m *S3MultipartUpload) UploadPart(ctx context.Context, reader io.Reader, size int64) error {
-	m.mutex.Lock()
-	partNum := m.partNumber
-	m.partNumber++
-	m.mutex.Unlock()
-
+// UploadPart uploads data as part partNumber and records it in the state file
+func (m *S3MultipartUpload) UploadPart(ctx context.Context, partNumber int32, data []byte) error {
 	input := &s3.UploadPartInput{
 		Bucket:     aws.String(m.bucket),
 		Key:        aws.String(m.key),
 		UploadId:   aws.String(m.uploadID),
-		PartNumber: &partNum,
-		Body:       reader,
+		PartNumber: aws.Int32(partNumber),
+		Body:       bytes.NewReader(data),
 	}
 
 	output, err := m.client.UploadPart(ctx, input)
 	if err != nil {
-		return fmt.Errorf("failed to upload part %d: %w", partNum, err)
-	}
-
-	m.logger.Debugf("Uploaded part %d, ETag: %s", partNum, *output.ETag)
-
-	// Store the completed part
-	m.mutex.Lock()
-	m.parts = append(m.parts, types.CompletedPart{
-		ETag:       output.ETag,
-		PartNumber: &partNum,
-	})
-	m.mutex.Unlock()
-
-	// Update progress tracker
-	if m.tracker != nil {
-		m.tracker.Update(size)
+		return fmt.Errorf("failed to upload part %d: %w", partNumber, err)
 	}
 
+	m.parts.logger.Debugf("Uploaded part %d, ETag: %s", partNumber, *output.ETag)
+	m.parts.record(partNumber, data, *output.ETag)
 	return nil
 }
 
-// Complete completes the multipart upload
+// upload uploads the stream as the parts of this upload
+func (m *S3MultipartUpload) upload(ctx context.Context, reader io.Reader) error {
+	return m.parts.upload(ctx, reader, m.UploadPart)
+}
+
+// Complete completes the multipart upload with the parts of the current stream
 func (m *S3MultipartUpload) Complete(ctx context.Context) error {
-	m.mutex.Lock()
-	parts := make([]types.CompletedPart, len(m.parts))
-	copy(parts, m.parts)
-	m.mutex.Unlock()
+	var parts []types.CompletedPart
+	for _, part := range m.parts.completedParts() {
+		parts = append(parts, types.CompletedPart{
+			ETag:       aws.String(part.ETag),
+			PartNumber: aws.Int32(part.Number),
+		})
+	}
 
 	input := &s3.CompleteMultipartUploadInput{
 		Bucket:   aws.String(m.bucket),
@@ -113,7 +104,8 @@ func (m *S3MultipartUpload) Complete(ctx context.Context) error {
 		return fmt.Errorf("failed to complete multipart upload: %w", err)
 	}
 
-	m.logger.Infof("Completed multipart upload: %s", m.uploadID)
+	m.parts.logger.Infof("Completed multipart upload: %s", m.uploadID)
+	m.parts.removeState()
 	return nil
 }
 
@@ -130,39 +122,32 @@ func (m *S3MultipartUpload) Abort(ctx context.Context) error {
 		return fmt.Errorf("failed to abort multipart upload: %w", err)
 	}
 
-	m.logger.Infof("Aborted multipart upload: %s", m.uploadID)
+	m.parts.logger.Infof("Aborted multipart upload: %s", m.uploadID)
+	m.parts.removeState()
 	return nil
 }
 
-// Resume continues an interrupted upload (implements ResumableUpload interface)
+// Resume continues an interrupted upload (implements ResumableUpload interface).
+// reader must supply the whole stream again; parts already uploaded with the
+// same content are skipped. A stream that differs from the parts sent earlier
+// aborts the upload with ErrStreamChanged.
 func (m *S3MultipartUpload) Resume(ctx context.Context, reader io.Reader, tracker progress.Tracker) error {
-	m.tracker = tracker
-	
-	// Calculate already uploaded size
-	var uploadedSize int64
-	for range m.parts {
-		// Estimate part size (this is approximate since we don't store actual sizes)
-		uploadedSize += 5 * 1024 * 1024 // Assume 5MB per part (minimum S3 part size)
-	}
-	
-	// Update tracker with already uploaded data
-	if tracker != nil {
-		tracker.Update(uploadedSize)
+	m.parts.tracker = tracker
+
+	m.parts.logger.Infof("Resuming upload %s (%d parts, %d bytes already uploaded)", m.uploadID, len(m.parts.state.Parts), m.GetUploadedSize())
+
+	if err := m.upload(ctx, reader); err != nil {
+		if errors.Is(err, ErrStreamChanged) {
+			if abortErr := m.Abort(ctx); abortErr != nil {
+				m.parts.logger.Errorf("Failed to abort multipart upload: %v", abortErr)
+			}
+		}
+		return err
 	}
-	
-	m.logger.Infof("Resuming upload from part %d", m.partNumber)
-	
-	// Continue uploading remaining parts
-	// This would be called by the main upload logic
-	return nil
+	return m.Complete(ctx)
 }
 
 // GetUploadedSize returns the amount of data already uploaded
 func (m *S3MultipartUpload) GetUploadedSize() int64 {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	
-	// Estimate uploaded size based on number of parts
-	// This is approximate since we don't store actual part sizes
-	return int64(len(m.parts)) * 5 * 1024 * 1024 // Assume 5MB per part
+	return m.parts.uploadedSize()
 }
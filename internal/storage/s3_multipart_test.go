@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+)
+
+// multipartServer serves the multipart uploads of one key of an
+// S3-compatible service and records the part numbers it receives
+type multipartServer struct {
+	testServer
+	uploads  map[string]map[int][]byte
+	uploaded []int
+	object   []byte
+}
+
+func newMultipartServer(t *testing.T) *multipartServer {
+	server := &multipartServer{uploads: make(map[string]map[int][]byte)}
+	server.start(t, server.serve)
+	return server
+}
+
+// partETag returns the quoted ETag the server gives a part
+func partETag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (s *multipartServer) serve(w http.ResponseWriter, r *http.Request, body []byte) {
+	query := r.URL.Query()
+	uploadID := query.Get("uploadId")
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		uploadID = fmt.Sprintf("upload-%d", len(s.uploads)+1)
+		s.uploads[uploadID] = make(map[int][]byte)
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>key</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, uploadID)
+	case r.Method == http.MethodPut && query.Has("partNumber"):
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		s.uploads[uploadID][partNumber] = body
+		s.uploaded = append(s.uploaded, partNumber)
+		w.Header().Set("ETag", partETag(body))
+	case r.Method == http.MethodGet && query.Has("uploads"):
+		fmt.Fprint(w, `<ListMultipartUploadsResult><Bucket>bucket</Bucket><IsTruncated>false</IsTruncated>`)
+		for id := range s.uploads {
+			fmt.Fprintf(w, `<Upload><Key>key</Key><UploadId>%s</UploadId></Upload>`, id)
+		}
+		fmt.Fprint(w, `</ListMultipartUploadsResult>`)
+	case r.Method == http.MethodGet && uploadID != "":
+		// ListParts returns the ETags with their quotes
+		fmt.Fprint(w, `<ListPartsResult><Bucket>bucket</Bucket><Key>key</Key><IsTruncated>false</IsTruncated>`)
+		for partNumber, data := range s.uploads[uploadID] {
+			fmt.Fprintf(w, `<Part><PartNumber>%d</PartNumber><ETag>%s</ETag><Size>%d</Size></Part>`, partNumber, partETag(data), len(data))
+		}
+		fmt.Fprint(w, `</ListPartsResult>`)
+	case r.Method == http.MethodPost && uploadID != "":
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		xml.Unmarshal(body, &complete)
+		s.object = nil
+		for _, part := range complete.Parts {
+			data := s.uploads[uploadID][part.PartNumber]
+			if strings.Trim(part.ETag, `"`) != strings.Trim(partETag(data), `"`) {
+				http.Error(w, "InvalidPart", http.StatusBadRequest)
+				return
+			}
+			s.object = append(s.object, data...)
+		}
+		delete(s.uploads, uploadID)
+		fmt.Fprint(w, `<CompleteMultipartUploadResult><Bucket>bucket</Bucket><Key>key</Key><ETag>"object"</ETag></CompleteMultipartUploadResult>`)
+	case r.Method == http.MethodDelete:
+		delete(s.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+// reset forgets the part numbers received so far and returns them in order
+func (s *multipartServer) reset() []int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	uploaded := s.uploaded
+	s.uploaded = nil
+	sort.Ints(uploaded)
+	return uploaded
+}
+
+// parts returns the parts of the only incomplete upload
+func (s *multipartServer) parts(t *testing.T) map[int][]byte {
+	t.Helper()
+	if len(s.uploads) != 1 {
+		t.Fatalf("server has %d incomplete uploads, want 1", len(s.uploads))
+	}
+	for _, parts := range s.uploads {
+		return parts
+	}
+	return nil
+}
+
+// interruptedReader returns an error once limit bytes have been read
+type interruptedReader struct {
+	reader io.Reader
+	limit  int
+}
+
+func (r *interruptedReader) Read(buf []byte) (int, error) {
+	if r.limit <= 0 {
+		return 0, errors.New("source interrupted")
+	}
+	if len(buf) > r.limit {
+		buf = buf[:r.limit]
+	}
+	n, err := r.reader.Read(buf)
+	r.limit -= n
+	return n, err
+}
+
+func TestS3Resume(t *testing.T) {
+	original := bytes.Repeat([]byte("0123456789abcdef"), 4*s3MinPartSize/16)
+
+	tests := []struct {
+		name   string
+		server func(parts map[int][]byte)
+		// want lists the parts the resumed upload sends again
+		want []int
+	}{
+		{name: "same stream", want: []int{3, 4}},
+		{name: "server lost a part", server: func(parts map[int][]byte) { delete(parts, 2) }, want: []int{2, 3, 4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			server := newMultipartServer(t)
+			provider := &S3Provider{
+				client: s3.New(s3.Options{
+					Region:       "us-east-1",
+					BaseEndpoint: aws.String(server.URL),
+					UsePathStyle: true,
+					Credentials:  aws.AnonymousCredentials{},
+				}),
+				logger: logger.New(false).Quiet(),
+				config: &S3Config{Bucket: "bucket", Key: "key", ChunkSize: s3MinPartSize, Workers: 2, Resume: true, StateDir: t.TempDir()},
+			}
+
+			// The first run stops partway into part 3
+			reader := &interruptedReader{reader: bytes.NewReader(original), limit: 2*s3MinPartSize + 100}
+			if err := provider.UploadStream(ctx, reader, int64(len(original)), nil); err == nil {
+				t.Fatal("UploadStream() of an interrupted stream succeeded")
+			}
+			if got := server.reset(); !reflect.DeepEqual(got, []int{1, 2}) {
+				t.Fatalf("interrupted upload sent parts %v, want 1 and 2", got)
+			}
+			if tt.server != nil {
+				tt.server(server.parts(t))
+			}
+
+			resumable, err := provider.CheckResumability(ctx)
+			if err != nil || resumable == nil {
+				t.Fatalf("CheckResumability() = %v, %v", resumable, err)
+			}
+			if err := resumable.Resume(ctx, bytes.NewReader(original), nil); err != nil {
+				t.Fatalf("Resume() error = %v", err)
+			}
+			if got := server.reset(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resumed upload sent parts %v, want %v", got, tt.want)
+			}
+			if !bytes.Equal(server.object, original) {
+				t.Error("completed object differs from the stream")
+			}
+			if again, err := provider.CheckResumability(ctx); again != nil || err != nil {
+				t.Errorf("CheckResumability() after completion = %v, %v", again, err)
+			}
+		})
+	}
+}
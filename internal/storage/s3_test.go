@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/seriousconsult/cloud_safe/internal/logger"
+	"github.com/seriousconsult/cloud_safe/internal/setup"
+)
+
+// taggingServer accepts single-part and multipart uploads to a bucket of an
+// S3-compatible service and records the tags each upload was created with
+type taggingServer struct {
+	testServer
+	tags []string
+}
+
+func newTaggingServer(t *testing.T) *taggingServer {
+	server := &taggingServer{}
+	server.start(t, server.serve)
+	return server
+}
+
+func (s *taggingServer) serve(w http.ResponseWriter, r *http.Request, body []byte) {
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == http.MethodHead:
+		// HeadBucket
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.record(r)
+		fmt.Fprint(w, `<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>key</Key><UploadId>upload</UploadId></InitiateMultipartUploadResult>`)
+	case r.Method == http.MethodPut && query.Has("partNumber"):
+		w.Header().Set("ETag", fmt.Sprintf(`"part-%s"`, query.Get("partNumber")))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		fmt.Fprint(w, `<CompleteMultipartUploadResult><Bucket>bucket</Bucket><Key>key</Key><ETag>"object"</ETag></CompleteMultipartUploadResult>`)
+	case r.Method == http.MethodPut:
+		s.record(r)
+		w.Header().Set("ETag", `"object"`)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+// record records the tags of the upload r creates
+func (s *taggingServer) record(r *http.Request) {
+	s.tags = append(s.tags, r.Header.Get("X-Amz-Tagging"))
+}
+
+// uploads returns the tags of the uploads created since the last call
+func (s *taggingServer) uploads() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	tags := s.tags
+	s.tags = nil
+	return tags
+}
+
+func TestS3Tagging(t *testing.T) {
+	ctx := context.Background()
+	server := newTaggingServer(t)
+	on, off := true, false
+
+	// Uploads to an endpoint are only tagged when asked to
+	tests := []struct {
+		name    string
+		tagging *bool
+		want    string
+	}{
+		{name: "default", want: ""},
+		{name: "tagging on", tagging: &on, want: "Source=cloud_safe"},
+		{name: "tagging off", tagging: &off, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &setup.Config{
+				StorageProvider:    string(ProviderS3),
+				S3Bucket:           "bucket",
+				S3Filename:         "key",
+				AWSRegion:          "us-east-1",
+				S3Endpoint:         server.URL,
+				S3UsePathStyle:     true,
+				S3SignatureVersion: S3SignatureAnonymous,
+				S3Tagging:          tt.tagging,
+				ChunkSize:          s3MinPartSize,
+				Workers:            1,
+				StateDir:           t.TempDir(),
+			}
+			provider, err := NewStorageProvider(cfg, logger.New(false).Quiet())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// One upload in a single part and one in two parts
+			for _, size := range []int64{1024, s3MinPartSize + 1024} {
+				if err := provider.PutObject(ctx, "key", bytes.NewReader(make([]byte, size)), size, nil); err != nil {
+					t.Fatalf("PutObject() of %d bytes error = %v", size, err)
+				}
+			}
+
+			uploads := server.uploads()
+			if len(uploads) != 2 {
+				t.Fatalf("server saw %d uploads, want 2", len(uploads))
+			}
+			for i, tags := range uploads {
+				if tags != tt.want {
+					t.Errorf("upload %d was tagged %q, want %q", i, tags, tt.want)
+				}
+			}
+		})
+	}
+}
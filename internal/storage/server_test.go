@@ -0,0 +1,28 @@
+package storage
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// testServer is the HTTP server of a fake service. Requests are handled one
+// at a time while holding mutex, which also guards the state of the fake.
+type testServer struct {
+	*httptest.Server
+	mutex sync.Mutex
+}
+
+// start serves requests with handle, which gets the request body already
+// read, until the test ends
+func (s *testServer) start(t *testing.T, handle func(w http.ResponseWriter, r *http.Request, body []byte)) {
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		handle(w, r, body)
+	}))
+	t.Cleanup(s.Close)
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// StatePath returns the file in dir that records resume state for an upload.
+// kind names the kind of state and target identifies the upload destination,
+// e.g. "s3://bucket/key".
+func StatePath(dir, kind, target string) string {
+	sum := sha256.Sum256([]byte(target))
+	return filepath.Join(dir, kind+"-"+hex.EncodeToString(sum[:8])+".json")
+}
+
+// SaveState writes v as JSON to path, readable only by the owner. The file is
+// replaced atomically so a crash never leaves a truncated state file.
+func SaveState(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode upload state: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(path), ".state-*")
+	if err != nil {
+		return fmt.Errorf("failed to save upload state: %w", err)
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to save upload state: %w", err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("failed to save upload state: %w", err)
+	}
+	if err := os.Rename(temp.Name(), path); err != nil {
+		return fmt.Errorf("failed to save upload state: %w", err)
+	}
+	return nil
+}
+
+// LoadState reads the JSON state file at path into v. It reports false
+// without an error when the file does not exist.
+func LoadState(path string, v interface{}) (bool, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read upload state: %w", err)
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("failed to parse upload state %s: %w", path, err)
+	}
+	return true, nil
+}
+
+// RemoveState deletes the state file at path if it exists
+func RemoveState(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove upload state: %w", err)
+	}
+	return nil
+}
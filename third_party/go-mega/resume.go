@@ -0,0 +1,88 @@
+package mega
+
+import (
+	"crypto/aes"
+	"errors"
+	"fmt"
+)
+
+// UploadState holds what is needed to finish an Upload in another process:
+// the URL the chunks are posted to, the key they are encrypted with, the MAC
+// of every uploaded chunk by id and the handle Mega returns once it has
+// received every chunk. The key must be kept as secret as the file.
+type UploadState struct {
+	URL              string
+	Key              []uint32
+	ChunkMACs        map[int][]byte
+	CompletionHandle []byte
+}
+
+// State returns the state of the upload. It may be called while chunks
+// are being uploaded.
+func (u *Upload) State() UploadState {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	macs := make(map[int][]byte)
+	for id, mac := range u.chunk_macs {
+		if mac != nil {
+			macs[id] = append([]byte{}, mac...)
+		}
+	}
+	return UploadState{
+		URL:              u.uploadUrl,
+		Key:              append([]uint32{}, u.ukey...),
+		ChunkMACs:        macs,
+		CompletionHandle: append([]byte{}, u.completion_handle...),
+	}
+}
+
+// ChunkMAC returns the MAC of the chunk of id, or nil if it has not been
+// uploaded
+func (u *Upload) ChunkMAC(id int) []byte {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if id < 0 || id >= len(u.chunk_macs) || u.chunk_macs[id] == nil {
+		return nil
+	}
+	return append([]byte{}, u.chunk_macs[id]...)
+}
+
+// CompletionHandle returns the handle Mega returned once it had received
+// every chunk, or an empty handle before that
+func (u *Upload) CompletionHandle() []byte {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return append([]byte{}, u.completion_handle...)
+}
+
+// ResumeUpload recreates the Upload of name into parent of fileSize whose
+// state was taken with State, possibly by another process.
+//
+// The chunks with a MAC in state are not uploaded again; upload the others
+// with UploadChunk, then call Finish as for a new Upload. A chunk that is
+// uploaded again must hold the same data, since it is encrypted with the
+// same key at the same position.
+func (m *Mega) ResumeUpload(parent *Node, name string, fileSize int64, state UploadState) (*Upload, error) {
+	if parent == nil {
+		return nil, EARGS
+	}
+	if state.URL == "" || len(state.Key) != 6 {
+		return nil, errors.New("upload state needs an upload URL and a 6 word key")
+	}
+
+	u, err := m.newUpload(parent.GetHash(), name, fileSize, state.URL, append([]uint32{}, state.Key...))
+	if err != nil {
+		return nil, err
+	}
+	for id, mac := range state.ChunkMACs {
+		if id < 0 || id >= len(u.chunks) || len(mac) != aes.BlockSize {
+			return nil, fmt.Errorf("upload state has a MAC for chunk %d, which a %d byte file does not have", id, fileSize)
+		}
+		u.chunk_macs[id] = append([]byte{}, mac...)
+	}
+	u.completion_handle = append([]byte{}, state.CompletionHandle...)
+	return u, nil
+}
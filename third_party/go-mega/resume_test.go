@@ -0,0 +1,157 @@
+package mega
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// uploadServer answers the requests that create uploads and stores the
+// encrypted chunks posted to the upload URLs it hands out
+type uploadServer struct {
+	*httptest.Server
+	mutex   sync.Mutex
+	uploads []map[int64][]byte
+	sizes   []int64
+}
+
+func newUploadServer(t *testing.T) *uploadServer {
+	s := &uploadServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *uploadServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	body, _ := io.ReadAll(r.Body)
+
+	if r.URL.Path == "/cs" {
+		var msg [1]UploadMsg
+		if err := json.Unmarshal(body, &msg); err != nil || msg[0].Cmd != "u" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		s.uploads = append(s.uploads, make(map[int64][]byte))
+		s.sizes = append(s.sizes, msg[0].S)
+		fmt.Fprintf(w, `[{"p":"%s/ul/%d"}]`, s.URL, len(s.uploads)-1)
+		return
+	}
+
+	var upload int
+	var offset int64
+	if _, err := fmt.Sscanf(r.URL.Path, "/ul/%d/%d", &upload, &offset); err != nil || upload >= len(s.uploads) {
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+	s.uploads[upload][offset] = body
+
+	var stored int64
+	for _, chunk := range s.uploads[upload] {
+		stored += int64(len(chunk))
+	}
+	if stored == s.sizes[upload] {
+		fmt.Fprintf(w, "handle%d", upload)
+	}
+}
+
+// uploadChunks uploads the chunks of u from first up to end, taken from data
+func uploadChunks(t *testing.T, u *Upload, data []byte, first, end int) {
+	t.Helper()
+	for id := first; id < end; id++ {
+		position, size, err := u.ChunkLocation(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunk := append([]byte{}, data[position:position+int64(size)]...)
+		if err := u.UploadChunk(id, chunk); err != nil {
+			t.Fatalf("UploadChunk(%d) failed: %v", id, err)
+		}
+	}
+}
+
+func TestResumeUpload(t *testing.T) {
+	server := newUploadServer(t)
+	m := New()
+	m.SetAPIUrl(server.URL)
+	m.SetRetries(0)
+	parent := &Node{fs: m.FS, hash: "parent"}
+
+	// Chunks of 128, 256, 384 and 512 KiB and a last one of 256 KiB
+	data := make([]byte, 1536*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	// The first process uploads two chunks
+	first, err := m.NewUpload(parent, "file", int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadChunks(t, first, data, 0, 2)
+	state := first.State()
+	if len(state.ChunkMACs) != 2 || first.ChunkMAC(2) != nil {
+		t.Fatalf("state of the interrupted upload has MACs for %d chunks", len(state.ChunkMACs))
+	}
+
+	// Another process uploads the rest
+	resumed, err := m.ResumeUpload(parent, "file", int64(len(data)), state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadChunks(t, resumed, data, 2, resumed.Chunks())
+	if got := string(resumed.CompletionHandle()); got != "handle0" {
+		t.Fatalf("CompletionHandle() = %q, want handle0", got)
+	}
+
+	// An upload of the whole file with the same key, to another URL
+	reference, err := m.NewUpload(parent, "file", int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	whole := UploadState{URL: reference.State().URL, Key: state.Key}
+	if reference, err = m.ResumeUpload(parent, "file", int64(len(data)), whole); err != nil {
+		t.Fatal(err)
+	}
+	uploadChunks(t, reference, data, 0, reference.Chunks())
+
+	if !reflect.DeepEqual(server.uploads[0], server.uploads[1]) {
+		t.Error("resumed upload stored other encrypted chunks than an upload of the whole file")
+	}
+	if !reflect.DeepEqual(resumed.State().ChunkMACs, reference.State().ChunkMACs) {
+		t.Error("resumed upload holds other chunk MACs than an upload of the whole file")
+	}
+	if !bytes.Equal(resumed.State().ChunkMACs[0], state.ChunkMACs[0]) {
+		t.Error("resumed upload lost the MAC of a chunk uploaded before")
+	}
+}
+
+func TestResumeUploadInvalidState(t *testing.T) {
+	m := New()
+	parent := &Node{fs: m.FS, hash: "parent"}
+	key := []uint32{1, 2, 3, 4, 5, 6}
+	mac := make([]byte, 16)
+
+	tests := []struct {
+		name  string
+		state UploadState
+	}{
+		{"no URL", UploadState{Key: key}},
+		{"short key", UploadState{URL: "http://upload", Key: key[:4]}},
+		{"chunk beyond the file", UploadState{URL: "http://upload", Key: key, ChunkMACs: map[int][]byte{1: mac}}},
+		{"short MAC", UploadState{URL: "http://upload", Key: key, ChunkMACs: map[int][]byte{0: mac[:8]}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := m.ResumeUpload(parent, "file", 1024, tt.state); err == nil {
+				t.Error("ResumeUpload() succeeded")
+			}
+		})
+	}
+}